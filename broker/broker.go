@@ -9,16 +9,15 @@ import (
 
 // Subscriber is a convenience return type for the Subscribe method
 type Subscriber interface {
+	// ID returns the unique id of the subscription. Several subscriptions of the same
+	// topic have different ids
+	ID() string
 	// Topic returns the subscribed topic
 	Topic() string
 	// Unsubscribe unsubscribes to the topic
 	Unsubscribe() error
 }
 
-type Message struct {
-	Data proto.Message
-}
-
 // Broker is an interface used for asynchronous messaging.
 type Broker interface {
 	// Init initializes the broker
@@ -31,14 +30,36 @@ type Broker interface {
 	Connect() error
 	// Disconnect disconnects from the broker
 	Disconnect() error
-	// Publish publishes a message to the topic
-	Publish(topic string, m proto.Message) error
+	// Drain stops the subscriptions from receiving new messages, waits for the handlers of the
+	// received messages, flushes the pending publishes and disconnects from the broker. When
+	// ctx is done first the remaining messages are dropped and the broker disconnects
+	Drain(ctx context.Context) error
+	// Publish publishes a message to the topic. Options which the broker does not support
+	// fail with ErrNotSupported
+	Publish(topic string, m proto.Message, opts ...PublishOption) error
 	// Publish publishes raw data to the topic
-	PublishRaw(topic string, m []byte) error
-	// Subscribe subscribes a handler to the topic
-	Subscribe(topic string, h interface{}) (Subscriber, error)
+	PublishRaw(topic string, m []byte, opts ...PublishOption) error
+	// PublishMessage publishes a message envelope to the topic
+	PublishMessage(topic string, m *Message, opts ...PublishOption) error
+	// Request publishes req to the topic and waits for a responder to answer with resp.
+	// The request fails when ctx is done before a response arrives
+	Request(ctx context.Context, topic string, req proto.Message, resp proto.Message) error
+	// Subscribe subscribes a handler to the topic. The handler is of the form
+	// func(context.Context, *pb.Message) error or func(context.Context, *pb.Message, *Message) error.
+	// Responders answering requests return a response, func(context.Context, *pb.Request) (*pb.Response, error).
+	// Options which the broker does not support fail with ErrNotSupported
+	Subscribe(topic string, h interface{}, opts ...SubscribeOption) (Subscriber, error)
 	// SubscribeRaw subscribes a raw handler to the topic
-	SubscribeRaw(topic string, h func(c context.Context, data []byte) error) (Subscriber, error)
+	SubscribeRaw(topic string, h func(c context.Context, data []byte) error, opts ...SubscribeOption) (Subscriber, error)
+	// Subscriptions returns the active subscriptions along with their stats in the order
+	// they were subscribed
+	Subscriptions() []SubscriptionInfo
+	// UnsubscribeAll unsubscribes every subscription. The broker stays connected
+	UnsubscribeAll() error
+	// Status returns the status of the connection to the broker
+	Status() Status
+	// NotifyStatus returns a channel which receives the changes of the status
+	NotifyStatus() <-chan Status
 	// Handle returns the raw connection handle to the broker
 	Handle() interface{}
 }
@@ -0,0 +1,163 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// Content types of the built in codecs
+const (
+	ContentTypeProtoJSON = "application/x-protobuf+json"
+	ContentTypeJSON      = "application/json"
+	ContentTypeMsgpack   = "application/msgpack"
+)
+
+// Codec encodes and decodes the payload of messages. The content type of the codec is
+// recorded in the headers of every message so that subscribers can pick the same codec
+type Codec interface {
+	// Marshal encodes v
+	Marshal(v interface{}) ([]byte, error)
+	// Unmarshal decodes data into v which is a pointer
+	Unmarshal(data []byte, v interface{}) error
+	// ContentType returns the content type of the encoded data
+	ContentType() string
+}
+
+var (
+	codecs = map[string]Codec{
+		ContentTypeProtobuf:  ProtobufCodec{},
+		ContentTypeProtoJSON: ProtoJSONCodec{},
+		ContentTypeJSON:      JSONCodec{},
+		ContentTypeMsgpack:   MsgpackCodec{},
+	}
+	codecsMu sync.RWMutex
+)
+
+// RegisterCodec makes the codec available for decoding the messages of its content type
+func RegisterCodec(c Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	codecs[mediaType(c.ContentType())] = c
+}
+
+// CodecFor returns the codec of the content type. Messages without a content type and raw
+// messages are decoded as protobuf
+func CodecFor(contentType string) (Codec, error) {
+	contentType = mediaType(contentType)
+	if contentType == "" || contentType == ContentTypeRaw {
+		return ProtobufCodec{}, nil
+	}
+
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+
+	c, ok := codecs[contentType]
+	if !ok {
+		return nil, fmt.Errorf("No codec registered for content type '%s'", contentType)
+	}
+	return c, nil
+}
+
+// mediaType strips the parameters like the charset from the content type
+func mediaType(contentType string) string {
+	if t, _, err := mime.ParseMediaType(contentType); err == nil {
+		return t
+	}
+	return strings.ToLower(strings.TrimSpace(contentType))
+}
+
+// ProtobufCodec encodes protobuf messages in the binary wire format
+type ProtobufCodec struct{}
+
+// Marshal encodes the protobuf message v
+func (ProtobufCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, errors.Errorf("%T does not implement proto.Message", v)
+	}
+	return proto.Marshal(m)
+}
+
+// Unmarshal decodes data into the protobuf message v
+func (ProtobufCodec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return errors.Errorf("%T does not implement proto.Message", v)
+	}
+	return proto.Unmarshal(data, m)
+}
+
+// ContentType returns the content type of protobuf messages
+func (ProtobufCodec) ContentType() string {
+	return ContentTypeProtobuf
+}
+
+// ProtoJSONCodec encodes protobuf messages in the canonical JSON format which is useful for debugging
+type ProtoJSONCodec struct{}
+
+// Marshal encodes the protobuf message v
+func (ProtoJSONCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, errors.Errorf("%T does not implement proto.Message", v)
+	}
+	return protojson.Marshal(m)
+}
+
+// Unmarshal decodes data into the protobuf message v
+func (ProtoJSONCodec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return errors.Errorf("%T does not implement proto.Message", v)
+	}
+	return protojson.Unmarshal(data, m)
+}
+
+// ContentType returns the content type of protobuf messages encoded as JSON
+func (ProtoJSONCodec) ContentType() string {
+	return ContentTypeProtoJSON
+}
+
+// JSONCodec encodes Go values with encoding/json to exchange messages with non Go services
+type JSONCodec struct{}
+
+// Marshal encodes v
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Unmarshal decodes data into v
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// ContentType returns the content type of JSON messages
+func (JSONCodec) ContentType() string {
+	return ContentTypeJSON
+}
+
+// MsgpackCodec encodes Go values with MessagePack
+type MsgpackCodec struct{}
+
+// Marshal encodes v
+func (MsgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+
+// Unmarshal decodes data into v
+func (MsgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	return msgpack.Unmarshal(data, v)
+}
+
+// ContentType returns the content type of MessagePack messages
+func (MsgpackCodec) ContentType() string {
+	return ContentTypeMsgpack
+}
@@ -0,0 +1,77 @@
+package broker
+
+import (
+	"testing"
+
+	proto "github.com/adityak368/ego/broker/proto/gen/broker"
+	"github.com/stretchr/testify/require"
+)
+
+// upperCodec is a codec registered by the tests
+type upperCodec struct {
+	JSONCodec
+}
+
+// ContentType returns the content type of the codec
+func (upperCodec) ContentType() string {
+	return "application/x-upper"
+}
+
+func TestCodecFor(t *testing.T) {
+
+	r := require.New(t)
+
+	for contentType, want := range map[string]Codec{
+		"":                                ProtobufCodec{},
+		ContentTypeRaw:                    ProtobufCodec{},
+		ContentTypeProtobuf:               ProtobufCodec{},
+		ContentTypeProtoJSON:              ProtoJSONCodec{},
+		"application/json; charset=utf-8": JSONCodec{},
+		" Application/MsgPack ":           MsgpackCodec{},
+	} {
+		codec, err := CodecFor(contentType)
+		r.Nil(err, contentType)
+		r.Equal(want, codec, contentType)
+	}
+
+	_, err := CodecFor("application/x-upper")
+	r.NotNil(err, "Unknown content types should be rejected")
+
+	RegisterCodec(upperCodec{})
+	codec, err := CodecFor("application/x-upper")
+	r.Nil(err)
+	r.Equal(upperCodec{}, codec)
+}
+
+func TestCodecs(t *testing.T) {
+
+	r := require.New(t)
+
+	for _, codec := range []Codec{ProtobufCodec{}, ProtoJSONCodec{}, JSONCodec{}, MsgpackCodec{}} {
+		data, err := codec.Marshal(&proto.TestMessage{Data: "Test"})
+		r.Nil(err, codec.ContentType())
+
+		msg := &proto.TestMessage{}
+		r.Nil(codec.Unmarshal(data, msg), codec.ContentType())
+		r.Equal("Test", msg.Data, codec.ContentType())
+	}
+
+	type order struct {
+		ID    string
+		Items []string
+	}
+	for _, codec := range []Codec{JSONCodec{}, MsgpackCodec{}} {
+		data, err := codec.Marshal(order{ID: "42", Items: []string{"book"}})
+		r.Nil(err, codec.ContentType())
+
+		var o order
+		r.Nil(codec.Unmarshal(data, &o), codec.ContentType())
+		r.Equal(order{ID: "42", Items: []string{"book"}}, o, codec.ContentType())
+	}
+
+	for _, codec := range []Codec{ProtobufCodec{}, ProtoJSONCodec{}} {
+		_, err := codec.Marshal(struct{}{})
+		r.NotNil(err, "Values which are not protobuf messages should be rejected")
+		r.NotNil(codec.Unmarshal([]byte{}, &struct{}{}))
+	}
+}
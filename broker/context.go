@@ -0,0 +1,56 @@
+package broker
+
+import "context"
+
+type messageKey struct{}
+
+// NewContext returns a copy of ctx carrying the message envelope
+func NewContext(ctx context.Context, m *Message) context.Context {
+	return context.WithValue(ctx, messageKey{}, m)
+}
+
+// FromContext returns the message envelope carried by ctx
+func FromContext(ctx context.Context) (*Message, bool) {
+	m, ok := ctx.Value(messageKey{}).(*Message)
+	return m, ok
+}
+
+// Deliver calls the handler with a delivery context derived from the subscriber context.
+// The delivery context carries the envelope and the processing deadline of the subscription
+// and is cancelled when the subscriber is unsubscribed or the broker disconnects.
+// Failed deliveries are retried according to the retry policy of the subscription and
+// dead letters are published using b. The handler is wrapped in the middleware of b and of
+// the subscription and panics of the handler are recovered. With a dedup store the messages
+// which were processed already are skipped
+func Deliver(ctx context.Context, b Broker, h HandlerFunc, m *Message, opts SubscribeOptions) error {
+	mw := []Middleware{Recover()}
+	mw = append(mw, b.Options().Middleware...)
+	mw = append(mw, opts.Middleware...)
+	h = Chain(mw...)(h)
+
+	if opts.Dedup != nil && m.ID != "" {
+		return deliverOnce(ctx, b, h, m, opts)
+	}
+	return deliverAttempts(ctx, b, h, m, opts)
+}
+
+// deliverAttempts delivers the message with the retry policy of the subscription, if any
+func deliverAttempts(ctx context.Context, b Broker, h HandlerFunc, m *Message, opts SubscribeOptions) error {
+	if opts.Retry.MaxAttempts > 1 || opts.Retry.DeadLetterTopic != "" {
+		return deliverWithRetry(ctx, b, h, m, opts)
+	}
+	return deliver(ctx, h, m, opts)
+}
+
+// deliver makes a single delivery attempt
+func deliver(ctx context.Context, h HandlerFunc, m *Message, opts SubscribeOptions) error {
+	ctx = NewContext(ctx, m)
+
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+
+	return h(ctx, m)
+}
@@ -0,0 +1,212 @@
+package broker
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/adityak368/swissknife/logger/v2"
+	"github.com/pkg/errors"
+)
+
+// ErrInProgress is returned for the deliveries of a message which another delivery is
+// processing, so that the broker redelivers it once the claim was recorded or released
+var ErrInProgress = errors.New("message is being processed by another delivery")
+
+// dedupLease is how long a delivery claims a message by default. The redeliveries of a
+// message whose delivery crashed are rejected until the lease expired
+const dedupLease = time.Minute
+
+// DedupStore records the processed messages of the idempotent consumers, see Dedup. A store
+// shared by the instances of a service deduplicates the deliveries of their queue group,
+// while every broadcast subscription deduplicates its deliveries on its own.
+// A delivery claims the key before calling the handler, so that concurrent deliveries of the
+// same message are handled once, and records or releases it afterwards
+type DedupStore interface {
+	// Claim atomically claims the key for the lease. It reports false when the key was
+	// recorded or claimed already
+	Claim(ctx context.Context, key string, lease time.Duration) (bool, error)
+	// Processed reports whether the key was recorded
+	Processed(ctx context.Context, key string) (bool, error)
+	// Record records the claimed key as processed
+	Record(ctx context.Context, key string) error
+	// Release removes the claim of the key unless it was recorded, so that a redelivery of
+	// the message can claim it again
+	Release(ctx context.Context, key string) error
+}
+
+// dedupKey returns the key of the message in the store. The deliveries are deduplicated
+// per queue group and topic, so that every service still handles the message once, and
+// per broadcast subscription, so that every broadcast subscriber handles it once
+func dedupKey(b Broker, m *Message, opts SubscribeOptions) string {
+	group := opts.QueueGroup(b.Options().Name)
+	if group == "" {
+		group = b.Options().Name + ".broadcast." + opts.subscription
+	}
+	return group + ":" + m.Topic + ":" + m.ID
+}
+
+// leaseOf returns how long a delivery claims the message. The lease covers every attempt
+// of the handler when the subscription has a timeout
+func leaseOf(opts SubscribeOptions) time.Duration {
+	attempts := opts.Retry.MaxAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	if lease := opts.Timeout * time.Duration(attempts); lease > dedupLease {
+		return lease
+	}
+	return dedupLease
+}
+
+// deliverOnce claims the message in the store before calling the handler and records it
+// once the handler succeeded. Messages which were processed already are skipped and the
+// deliveries of a message another delivery is processing fail with ErrInProgress. A message
+// whose handler failed is released, so that its redelivery is handled again
+func deliverOnce(ctx context.Context, b Broker, h HandlerFunc, m *Message, opts SubscribeOptions) error {
+
+	key := dedupKey(b, m, opts)
+	claimed, err := opts.Dedup.Claim(ctx, key, leaseOf(opts))
+	if err != nil {
+		return errors.Wrapf(err, "Could not claim message %s of '%s'", m.ID, m.Topic)
+	}
+	if !claimed {
+		// a claim released in the meantime is reported as in progress, so the broker redelivers
+		processed, err := opts.Dedup.Processed(ctx, key)
+		if err != nil {
+			return errors.Wrapf(err, "Could not check whether message %s of '%s' was processed", m.ID, m.Topic)
+		}
+		if processed {
+			logger.Debug().Msgf("Skipping message %s of '%s'. It was processed already", m.ID, m.Topic)
+			return nil
+		}
+		return errors.Wrapf(ErrInProgress, "Message %s of '%s'", m.ID, m.Topic)
+	}
+
+	if err := deliverAttempts(ctx, b, h, m, opts); err != nil {
+		// the delivery context may be cancelled already
+		if err := opts.Dedup.Release(context.Background(), key); err != nil {
+			logger.Warn().Err(err).Msgf("Could not release message %s of '%s'", m.ID, m.Topic)
+		}
+		return err
+	}
+
+	// the message was handled, failing now would only have it handled again
+	if err := opts.Dedup.Record(context.Background(), key); err != nil {
+		logger.Warn().Err(err).Msgf("Could not record message %s of '%s' as processed", m.ID, m.Topic)
+	}
+	return nil
+}
+
+// memoryDedupStore keeps the most recently processed keys in memory
+type memoryDedupStore struct {
+	size    int
+	ttl     time.Duration
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	// lru orders the entries from the most to the least recently used
+	lru *list.List
+}
+
+// dedupEntry is an entry of the in-memory store
+type dedupEntry struct {
+	key string
+	// processed is false while the key is claimed by a delivery
+	processed bool
+	expires   time.Time
+}
+
+// NewMemoryDedupStore returns a DedupStore which keeps up to size keys in memory for ttl.
+// The least recently used key is evicted once the store is full. A ttl of zero keeps the
+// keys until they are evicted. The keys are lost when the process exits
+func NewMemoryDedupStore(size int, ttl time.Duration) DedupStore {
+	return &memoryDedupStore{
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// Claim claims the key for the lease unless it was recorded or claimed and has not expired
+func (s *memoryDedupStore) Claim(_ context.Context, key string, lease time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.get(key) != nil {
+		return false, nil
+	}
+
+	s.add(&dedupEntry{key: key, expires: time.Now().Add(lease)})
+	return true, nil
+}
+
+// Processed reports whether the key was recorded and has not expired
+func (s *memoryDedupStore) Processed(_ context.Context, key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e := s.get(key)
+	return e != nil && e.Value.(*dedupEntry).processed, nil
+}
+
+// Record records the key as processed for the ttl of the store
+func (s *memoryDedupStore) Record(_ context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry := &dedupEntry{key: key, processed: true}
+	if s.ttl > 0 {
+		entry.expires = time.Now().Add(s.ttl)
+	}
+	if e := s.get(key); e != nil {
+		e.Value = entry
+		return nil
+	}
+	s.add(entry)
+	return nil
+}
+
+// Release removes the claim of the key unless it was recorded
+func (s *memoryDedupStore) Release(_ context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e := s.get(key); e != nil && !e.Value.(*dedupEntry).processed {
+		s.remove(e)
+	}
+	return nil
+}
+
+// add adds the entry as the most recently used one and evicts the least recently used
+// entries once the store is full
+func (s *memoryDedupStore) add(entry *dedupEntry) {
+	s.entries[entry.key] = s.lru.PushFront(entry)
+
+	for s.size > 0 && s.lru.Len() > s.size {
+		s.remove(s.lru.Back())
+	}
+}
+
+// get returns the element of the key and marks it as recently used. Expired keys are removed
+func (s *memoryDedupStore) get(key string) *list.Element {
+	e, ok := s.entries[key]
+	if !ok {
+		return nil
+	}
+
+	if expires := e.Value.(*dedupEntry).expires; !expires.IsZero() && time.Now().After(expires) {
+		s.remove(e)
+		return nil
+	}
+
+	s.lru.MoveToFront(e)
+	return e
+}
+
+// remove removes the element from the store
+func (s *memoryDedupStore) remove(e *list.Element) {
+	s.lru.Remove(e)
+	delete(s.entries, e.Value.(*dedupEntry).key)
+}
@@ -0,0 +1,85 @@
+package broker
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryDedupStore(t *testing.T) {
+
+	r := require.New(t)
+	ctx := context.Background()
+
+	store := NewMemoryDedupStore(2, time.Hour)
+	for _, key := range []string{"a", "b"} {
+		claimed, err := store.Claim(ctx, key, time.Minute)
+		r.Nil(err)
+		r.True(claimed)
+	}
+	claimed, err := store.Claim(ctx, "a", time.Minute)
+	r.Nil(err)
+	r.False(claimed, "Claimed keys should not be claimed again")
+
+	r.Nil(store.Record(ctx, "a"))
+	r.Nil(store.Release(ctx, "a"))
+	r.Nil(store.Release(ctx, "b"))
+	for key, processed := range map[string]bool{"a": true, "b": false} {
+		ok, err := store.Processed(ctx, key)
+		r.Nil(err)
+		r.Equal(processed, ok, key)
+	}
+	claimed, err = store.Claim(ctx, "b", time.Minute)
+	r.Nil(err)
+	r.True(claimed, "Released keys should be claimed again")
+
+	// 'a' is the least recently used key
+	r.Nil(store.Record(ctx, "c"))
+	for key, processed := range map[string]bool{"a": false, "c": true} {
+		ok, err := store.Processed(ctx, key)
+		r.Nil(err)
+		r.Equal(processed, ok, key)
+	}
+
+	store = NewMemoryDedupStore(2, 10*time.Millisecond)
+	r.Nil(store.Record(ctx, "a"))
+	_, err = store.Claim(ctx, "b", 10*time.Millisecond)
+	r.Nil(err)
+	time.Sleep(20 * time.Millisecond)
+	processed, err := store.Processed(ctx, "a")
+	r.Nil(err)
+	r.False(processed, "Expired keys should not be processed")
+	claimed, err = store.Claim(ctx, "b", time.Minute)
+	r.Nil(err)
+	r.True(claimed, "Expired claims should be claimed again")
+}
+
+func TestMemoryDedupStoreConcurrentClaims(t *testing.T) {
+
+	r := require.New(t)
+	ctx := context.Background()
+
+	store := NewMemoryDedupStore(100, time.Hour)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	claims := 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			claimed, err := store.Claim(ctx, "a", time.Minute)
+			r.Nil(err)
+			if claimed {
+				mu.Lock()
+				claims++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	r.Equal(1, claims, "Concurrent deliveries should claim the key once")
+}
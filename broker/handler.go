@@ -0,0 +1,118 @@
+package broker
+
+import (
+	"context"
+	"reflect"
+
+	"github.com/pkg/errors"
+)
+
+// HandlerFunc is the form every subscribe handler is converted to by the broker implementations
+type HandlerFunc func(ctx context.Context, m *Message) error
+
+var (
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+	messageType = reflect.TypeOf((*Message)(nil))
+)
+
+// NewHandlerFunc validates a subscribe handler and converts it to a HandlerFunc.
+// The handler should be of the form
+//
+//	func(ctx context.Context, msg *pb.Message) error
+//	func(ctx context.Context, msg *pb.Message, m *broker.Message) error
+//
+// where pb.Message is the type of the message and m is the received envelope. The message
+// is decoded with the codec of the content type of the envelope, see CodecFor.
+// Responders which answer requests return the response as well
+//
+//	func(ctx context.Context, req *pb.Request) (*pb.Response, error)
+//	func(ctx context.Context, req *pb.Request, m *broker.Message) (*pb.Response, error)
+//
+// The response is set as the Response of the envelope and is published to its ReplyTo topic
+func NewHandlerFunc(h interface{}) (HandlerFunc, error) {
+
+	typ := reflect.TypeOf(h)
+	if typ == nil || typ.Kind() != reflect.Func {
+		return nil, errors.New("Need a function as a callback")
+	}
+
+	if typ.NumIn() != 2 && typ.NumIn() != 3 {
+		return nil, errors.New("Function takes two inputs. 1. context.Context and 2. a pointer to the message. An optional third input *broker.Message receives the envelope")
+	}
+
+	ctxType := typ.In(0)
+	if ctxType.Kind() != reflect.Interface || !ctxType.Implements(contextType) {
+		return nil, errors.New("First Parameter should be of type context.Context")
+	}
+
+	msgType := typ.In(1)
+	if msgType.Kind() != reflect.Ptr {
+		return nil, errors.New("Message should be a pointer")
+	}
+
+	withEnvelope := typ.NumIn() == 3
+	if withEnvelope && typ.In(2) != messageType {
+		return nil, errors.New("Third Parameter should be of type *broker.Message")
+	}
+
+	if typ.NumOut() != 1 && typ.NumOut() != 2 {
+		return nil, errors.New("Function should return error, or a response and error")
+	}
+
+	responder := typ.NumOut() == 2
+	if responder {
+		respType := typ.Out(0)
+		if respType.Kind() != reflect.Ptr {
+			return nil, errors.New("Response should be a pointer")
+		}
+	}
+
+	errType := typ.Out(typ.NumOut() - 1)
+	if errType.Kind() != reflect.Interface || !errType.Implements(errorType) {
+		return nil, errors.New("Function should return error or nil")
+	}
+
+	cb := reflect.ValueOf(h)
+
+	return func(ctx context.Context, m *Message) error {
+		codec, err := CodecFor(m.ContentType)
+		if err != nil {
+			return err
+		}
+
+		msg := reflect.New(msgType.Elem())
+		if err := codec.Unmarshal(m.Body, msg.Interface()); err != nil {
+			return errors.Wrap(err, "Could not decode message")
+		}
+		m.Data = msg.Interface()
+
+		args := []reflect.Value{reflect.ValueOf(ctx), msg}
+		if withEnvelope {
+			args = append(args, reflect.ValueOf(m))
+		}
+
+		res := cb.Call(args)
+
+		if v := res[len(res)-1].Interface(); v != nil {
+			err = v.(error)
+		}
+
+		if responder {
+			var resp interface{}
+			if !res[0].IsNil() {
+				resp = res[0].Interface()
+			}
+			m.Response = NewResponse(m, resp, err)
+		}
+
+		return err
+	}, nil
+}
+
+// NewRawHandlerFunc converts a raw handler to a HandlerFunc
+func NewRawHandlerFunc(h func(ctx context.Context, data []byte) error) HandlerFunc {
+	return func(ctx context.Context, m *Message) error {
+		return h(ctx, m.Body)
+	}
+}
@@ -0,0 +1,28 @@
+package jetstream
+
+import (
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// Config is the config for the JetStream broker
+type Config struct {
+	// Stream stores all the topics. If empty a stream is provisioned for every topic
+	// prefix, e.g. the stream 'ORDERS' with the subjects 'orders' and 'orders.>' for 'orders.created'
+	Stream string
+	// Subjects are the subjects of Stream
+	Subjects []string
+	// Storage is the storage backend of the provisioned streams
+	Storage jetstream.StorageType
+	// MaxAge is the maximum age of the messages in the provisioned streams. Zero means unlimited
+	MaxAge time.Duration
+	// Replicas is the number of replicas of the provisioned streams
+	Replicas int
+	// MaxDeliver is the maximum number of delivery attempts of a message. Zero means unlimited
+	MaxDeliver int
+	// AckWait is how long the server waits for an ack before redelivering a message
+	AckWait time.Duration
+	// NakDelay delays the redelivery of the messages whose handler returned an error
+	NakDelay time.Duration
+}
@@ -0,0 +1,656 @@
+// Package jetstream is the NATS JetStream implementation of the broker. Messages are
+// persisted in streams and consumed by durable consumers which ack or nak every
+// message depending on the error returned by the handler.
+package jetstream
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/adityak368/ego/broker"
+	natsbroker "github.com/adityak368/ego/broker/nats"
+	"github.com/adityak368/swissknife/logger/v2"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// jetstreamBroker is the NATS JetStream implementation of the broker
+type jetstreamBroker struct {
+	options         broker.Options
+	config          Config
+	connection      *nats.Conn
+	js              jetstream.JetStream
+	subscriptionMap map[string]*jetstreamSubscriber
+	streams         map[string]string
+	mu              sync.Mutex
+	ctx             context.Context
+	cancel          context.CancelFunc
+	// closed is closed once the connection is closed
+	closed chan struct{}
+	status broker.StatusNotifier
+	// scheduler consumes the scheduled messages of the service
+	scheduler jetstream.ConsumeContext
+}
+
+// Address Returns the broker bind interface
+func (n *jetstreamBroker) Address() string {
+	return n.options.Address
+}
+
+// Init initialises the broker
+func (n *jetstreamBroker) Init(opts broker.Options) error {
+	n.options = opts
+	return nil
+}
+
+// Options returns the broker options
+func (n *jetstreamBroker) Options() broker.Options {
+	return n.options
+}
+
+// String returns the description of the broker
+func (n *jetstreamBroker) String() string {
+	return fmt.Sprintf("[JETSTREAM]: Connected to NATS JetStream on %s", n.Address())
+}
+
+// Connect connects to the broker and provisions the configured stream
+func (n *jetstreamBroker) Connect() error {
+	closed := make(chan struct{})
+	opts, err := natsbroker.ConnectOptions("[JETSTREAM]", n.options, &n.status, closed)
+	if err != nil {
+		return err
+	}
+
+	conn, err := nats.Connect(n.Address(), opts...)
+	if err != nil {
+		return err
+	}
+
+	js, err := jetstream.New(conn)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	n.connection = conn
+	n.closed = closed
+	n.js = js
+	n.status.Set(broker.StatusConnected, n.options.OnStatus)
+	n.ctx, n.cancel = context.WithCancel(context.Background())
+
+	if n.config.Stream != "" {
+		if len(n.config.Subjects) == 0 {
+			n.Disconnect()
+			return errors.New("[JETSTREAM]: Config.Subjects is required when Config.Stream is set")
+		}
+		if err := n.ensureStream(n.streamConfig(n.config.Stream, n.config.Subjects)); err != nil {
+			n.Disconnect()
+			return err
+		}
+	}
+
+	// the messages scheduled before are published once they are due
+	if _, err := n.js.Stream(n.ctx, scheduleStream); err == nil {
+		if err := n.startScheduler(); err != nil {
+			n.Disconnect()
+			return err
+		}
+	}
+
+	logger.Info().Msgf("[JETSTREAM]: Connected to %s", n.Address())
+	return nil
+}
+
+// Disconnect disconnects from the broker
+func (n *jetstreamBroker) Disconnect() error {
+
+	if n.connection == nil {
+		return errors.New("[JETSTREAM]: Cannot Disconnect. Not connected to broker")
+	}
+
+	n.stopScheduler()
+	n.cancel()
+	n.connection.Close()
+	// the closed handler runs asynchronously, the status is closed once Disconnect returns
+	n.status.Set(broker.StatusClosed, n.options.OnStatus)
+
+	for _, s := range n.takeSubscribers() {
+		s.workers.Stop()
+	}
+
+	logger.Info().Msgf("[JETSTREAM]: Disconnected from %s", n.Address())
+	return nil
+}
+
+// Drain drains the consumers first, so that their handlers can still publish and ack,
+// and then the connection, which flushes the pending publishes before it is closed
+func (n *jetstreamBroker) Drain(ctx context.Context) error {
+
+	if n.connection == nil {
+		return errors.New("[JETSTREAM]: Cannot Drain. Not connected to broker")
+	}
+
+	n.stopScheduler()
+	subscribers := n.takeSubscribers()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(subscribers))
+	for _, s := range subscribers {
+		wg.Add(1)
+		go func(s *jetstreamSubscriber) {
+			defer wg.Done()
+			if err := s.drain(ctx); err != nil {
+				errs <- err
+			}
+		}(s)
+	}
+	wg.Wait()
+	close(errs)
+
+	err := <-errs
+	if drainErr := n.connection.Drain(); drainErr != nil && err == nil {
+		err = drainErr
+	}
+
+	select {
+	case <-n.closed:
+	case <-ctx.Done():
+		n.connection.Close()
+		if err == nil {
+			err = ctx.Err()
+		}
+	}
+
+	n.cancel()
+	logger.Info().Msgf("[JETSTREAM]: Drained and disconnected from %s", n.Address())
+	return err
+}
+
+// Subscriptions returns the active subscriptions along with their stats in the order they were subscribed
+func (n *jetstreamBroker) Subscriptions() []broker.SubscriptionInfo {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	infos := make([]broker.SubscriptionInfo, 0, len(n.subscriptionMap))
+	for _, s := range n.subscriptionMap {
+		infos = append(infos, s.info())
+	}
+	broker.SortSubscriptions(infos)
+	return infos
+}
+
+// UnsubscribeAll unsubscribes every subscription. Durable consumers are kept on the server
+func (n *jetstreamBroker) UnsubscribeAll() error {
+	var err error
+	for _, s := range n.takeSubscribers() {
+		if unsubscribeErr := s.Unsubscribe(); unsubscribeErr != nil && err == nil {
+			err = unsubscribeErr
+		}
+	}
+	return err
+}
+
+// takeSubscribers removes every subscriber from the broker and returns them
+func (n *jetstreamBroker) takeSubscribers() []*jetstreamSubscriber {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	subscribers := make([]*jetstreamSubscriber, 0, len(n.subscriptionMap))
+	for _, s := range n.subscriptionMap {
+		subscribers = append(subscribers, s)
+	}
+	n.subscriptionMap = make(map[string]*jetstreamSubscriber)
+	return subscribers
+}
+
+// remove removes the subscriber from the broker
+func (n *jetstreamBroker) remove(s *jetstreamSubscriber) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.subscriptionMap, s.id)
+}
+
+// Status returns the status of the connection to the broker
+func (n *jetstreamBroker) Status() broker.Status {
+	return n.status.Status()
+}
+
+// NotifyStatus returns a channel which receives the changes of the status
+func (n *jetstreamBroker) NotifyStatus() <-chan broker.Status {
+	return n.status.Notify()
+}
+
+// Handle returns the raw connection handle to the broker
+func (n *jetstreamBroker) Handle() interface{} {
+	return n.connection
+}
+
+// Publish publishes a message to the topic
+func (n *jetstreamBroker) Publish(topic string, m proto.Message, opts ...broker.PublishOption) error {
+
+	if n.connection == nil {
+		return errors.New("[JETSTREAM]: Cannot Publish. Not connected to broker")
+	}
+
+	return n.publishWith(topic, &broker.Message{Data: m}, opts)
+}
+
+// PublishRaw publishes raw data to the topic
+func (n *jetstreamBroker) PublishRaw(topic string, m []byte, opts ...broker.PublishOption) error {
+
+	if n.connection == nil {
+		return errors.New("[JETSTREAM]: Cannot PublishRaw. Not connected to broker")
+	}
+
+	return n.publishWith(topic, &broker.Message{Body: m}, opts)
+}
+
+// PublishMessage publishes a message envelope to the topic
+func (n *jetstreamBroker) PublishMessage(topic string, m *broker.Message, opts ...broker.PublishOption) error {
+
+	if n.connection == nil {
+		return errors.New("[JETSTREAM]: Cannot PublishMessage. Not connected to broker")
+	}
+
+	return n.publishWith(topic, m, opts)
+}
+
+// Request stores the request in the stream of the topic and waits for the response on a
+// NATS inbox. Responses are not persisted since nobody but the requester is interested in them
+func (n *jetstreamBroker) Request(ctx context.Context, topic string, req proto.Message, resp proto.Message) error {
+
+	if n.connection == nil {
+		return errors.New("[JETSTREAM]: Cannot Request. Not connected to broker")
+	}
+
+	inbox := nats.NewInbox()
+	subscription, err := n.connection.SubscribeSync(inbox)
+	if err != nil {
+		return err
+	}
+	defer subscription.Unsubscribe()
+
+	err = n.publish(topic, &broker.Message{
+		CorrelationID: broker.NewID(),
+		ReplyTo:       inbox,
+		Data:          req,
+	})
+	if err != nil {
+		return err
+	}
+
+	reply, err := subscription.NextMsgWithContext(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "[JETSTREAM]: No response to request on '%s'", topic)
+	}
+
+	return broker.DecodeResponse(toMessage(reply.Subject, reply.Header, reply.Data), resp)
+}
+
+// publishWith applies the publish options to the envelope and publishes or schedules it.
+// The expiry of the messages is configured on the stream, see Config.MaxAge
+func (n *jetstreamBroker) publishWith(topic string, m *broker.Message, opts []broker.PublishOption) error {
+
+	o := broker.NewPublishOptions(opts...)
+	switch {
+	case o.TTL > 0:
+		return broker.NotSupported("JETSTREAM", "TTL")
+	case o.Priority > 0:
+		return broker.NotSupported("JETSTREAM", "Priority")
+	}
+	if err := o.CheckNative("JETSTREAM"); err != nil {
+		return err
+	}
+
+	msg, err := o.Apply(m)
+	if err != nil {
+		return err
+	}
+	if !o.At.IsZero() {
+		return n.schedule(topic, msg, o.At)
+	}
+	return n.publish(topic, msg)
+}
+
+// publish stores the envelope in the stream of the topic and waits for the ack of the server.
+// The message id is used by the server to drop duplicate publishes
+func (n *jetstreamBroker) publish(topic string, m *broker.Message) error {
+
+	if _, err := n.stream(topic); err != nil {
+		return err
+	}
+
+	natsMsg, err := toNatsMsg(topic, m, n.options.Codec)
+	if err != nil {
+		return err
+	}
+	natsMsg.Header.Set(jetstream.MsgIDHeader, natsMsg.Header.Get(broker.HeaderID))
+
+	_, err = n.js.PublishMsg(n.ctx, natsMsg)
+	return err
+}
+
+// reply publishes the response of a responder to the inbox of the requester
+func (n *jetstreamBroker) reply(m *broker.Message) error {
+
+	natsMsg, err := toNatsMsg(m.ReplyTo, m.Response, n.options.Codec)
+	if err != nil {
+		return err
+	}
+
+	return n.connection.PublishMsg(natsMsg)
+}
+
+// Subscribe subscribes a handler to the topic
+func (n *jetstreamBroker) Subscribe(topic string, h interface{}, opts ...broker.SubscribeOption) (broker.Subscriber, error) {
+
+	if n.connection == nil {
+		return nil, errors.New("[JETSTREAM]: Cannot Subscribe. Not connected to broker")
+	}
+
+	handler, err := broker.NewHandlerFunc(h)
+	if err != nil {
+		return nil, errors.Wrap(err, "[JETSTREAM]")
+	}
+
+	return n.subscribe(topic, handler, broker.HandlerType(h), broker.NewSubscribeOptions(opts...))
+}
+
+// SubscribeRaw subscribes a raw handler to the topic
+func (n *jetstreamBroker) SubscribeRaw(topic string, h func(c context.Context, data []byte) error, opts ...broker.SubscribeOption) (broker.Subscriber, error) {
+
+	if n.connection == nil {
+		return nil, errors.New("[JETSTREAM]: Cannot Subscribe. Not connected to broker")
+	}
+
+	return n.subscribe(topic, broker.NewRawHandlerFunc(h), broker.HandlerType(h), broker.NewSubscribeOptions(opts...))
+}
+
+// subscribe consumes the topic from its stream. Subscribers in the same queue group share
+// a durable consumer which starts with the first message of the stream, broadcast
+// subscribers get an ephemeral consumer of their own which starts with the new messages.
+// StartAtSequence and StartAtTime set where a new consumer starts
+func (n *jetstreamBroker) subscribe(topic string, h broker.HandlerFunc, handlerType string, opts broker.SubscribeOptions) (broker.Subscriber, error) {
+
+	if err := opts.CheckNative("JETSTREAM"); err != nil {
+		return nil, err
+	}
+
+	stream, err := n.stream(topic)
+	if err != nil {
+		return nil, err
+	}
+
+	config := jetstream.ConsumerConfig{
+		FilterSubject: topic,
+		AckPolicy:     jetstream.AckExplicitPolicy,
+		AckWait:       n.config.AckWait,
+		MaxDeliver:    n.config.MaxDeliver,
+		DeliverPolicy: jetstream.DeliverNewPolicy,
+	}
+
+	switch {
+	case opts.StartSequence > 0:
+		config.DeliverPolicy = jetstream.DeliverByStartSequencePolicy
+		config.OptStartSeq = opts.StartSequence
+	case !opts.StartTime.IsZero():
+		config.DeliverPolicy = jetstream.DeliverByStartTimePolicy
+		startTime := opts.StartTime
+		config.OptStartTime = &startTime
+	}
+
+	queue := opts.QueueGroup(n.options.Name)
+	if queue != "" {
+		config.Durable = sanitize(queue + "_" + topic)
+		if config.DeliverPolicy == jetstream.DeliverNewPolicy {
+			config.DeliverPolicy = jetstream.DeliverAllPolicy
+		}
+		if err := n.keepStart(stream, &config, opts); err != nil {
+			return nil, err
+		}
+	}
+
+	var consumeOpts []jetstream.PullConsumeOpt
+	if opts.AutoAck {
+		config.AckPolicy = jetstream.AckNonePolicy
+	}
+
+	if opts.Prefetch > 0 {
+		config.MaxAckPending = opts.Prefetch
+		consumeOpts = append(consumeOpts, jetstream.PullMaxMessages(opts.Prefetch))
+	}
+
+	consumer, err := n.js.CreateOrUpdateConsumer(n.ctx, stream, config)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(n.ctx)
+	subscriber := &jetstreamSubscriber{
+		id:          broker.NewID(),
+		topic:       topic,
+		queue:       queue,
+		handlerType: opts.ReportedHandlerType(handlerType),
+		subscribed:  time.Now(),
+		stream:      stream,
+		consumer:    consumer.CachedInfo().Name,
+		durable:     queue != "",
+		workers:     broker.NewWorkers(opts.Concurrency, opts.BufferSize),
+		broker:      n,
+		js:          n.js,
+		cancel:      cancel,
+	}
+
+	consume, err := consumer.Consume(func(msg jetstream.Msg) {
+		subscriber.stats.Receive()
+		subscriber.workers.Go(func() { n.handle(ctx, subscriber, h, msg, opts) })
+	}, consumeOpts...)
+
+	if err != nil {
+		subscriber.workers.Stop()
+		cancel()
+		return nil, err
+	}
+
+	subscriber.consume = consume
+	n.mu.Lock()
+	n.subscriptionMap[subscriber.id] = subscriber
+	n.mu.Unlock()
+
+	if queue != "" {
+		logger.Info().Msgf("[JETSTREAM]: Subscribed to topic '%s' with durable consumer '%s'", topic, subscriber.consumer)
+		return subscriber, nil
+	}
+	logger.Info().Msgf("[JETSTREAM]: Subscribed to topic '%s'", topic)
+	return subscriber, nil
+}
+
+// keepStart keeps the start of an existing durable consumer, which JetStream cannot update.
+// Subscribing without a start option resumes the consumer where it left off, while a start
+// option other than the one the consumer was created with fails
+func (n *jetstreamBroker) keepStart(stream string, config *jetstream.ConsumerConfig, opts broker.SubscribeOptions) error {
+	consumer, err := n.js.Consumer(n.ctx, stream, config.Durable)
+	if errors.Is(err, jetstream.ErrConsumerNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	existing := consumer.CachedInfo().Config
+	if opts.StartSequence == 0 && opts.StartTime.IsZero() {
+		config.DeliverPolicy = existing.DeliverPolicy
+		config.OptStartSeq = existing.OptStartSeq
+		config.OptStartTime = existing.OptStartTime
+		return nil
+	}
+
+	sameTime := existing.OptStartTime == nil && config.OptStartTime == nil ||
+		existing.OptStartTime != nil && config.OptStartTime != nil && existing.OptStartTime.Equal(*config.OptStartTime)
+	if existing.DeliverPolicy != config.DeliverPolicy || existing.OptStartSeq != config.OptStartSeq || !sameTime {
+		return errors.Errorf("[JETSTREAM]: Durable consumer '%s' already exists with another start. Subscribe without a start option to resume it or delete it to start over", config.Durable)
+	}
+	return nil
+}
+
+// handle delivers the message to the handler and acks it once the handler succeeded.
+// Messages of subscriptions with AutoAck are not acked by the client
+func (n *jetstreamBroker) handle(ctx context.Context, s *jetstreamSubscriber, h broker.HandlerFunc, msg jetstream.Msg, opts broker.SubscribeOptions) {
+	m := toMessage(msg.Subject(), msg.Headers(), msg.Data())
+	err := broker.Deliver(ctx, n, h, m, opts)
+	s.stats.Done(err)
+	if m.ReplyTo != "" && m.Response != nil {
+		if err := n.reply(m); err != nil {
+			logger.Error().Err(err).Msg("")
+		}
+	}
+	if opts.AutoAck {
+		if err != nil {
+			logger.Error().Err(err).Msg("")
+		}
+		return
+	}
+	if err == nil {
+		if err := msg.Ack(); err != nil {
+			logger.Warn().Err(err).Msg("[JETSTREAM]: Could not ack message")
+		}
+		return
+	}
+
+	logger.Error().Err(err).Msg("")
+	n.nak(s.topic, msg)
+}
+
+// nak requests the redelivery of a message whose handler failed, or terminates it once
+// the redelivery limit is reached
+func (n *jetstreamBroker) nak(topic string, msg jetstream.Msg) {
+
+	metadata, err := msg.Metadata()
+	if err == nil && n.config.MaxDeliver > 0 && metadata.NumDelivered >= uint64(n.config.MaxDeliver) {
+		logger.Warn().Msgf("[JETSTREAM]: Giving up on message %d of '%s' after %d attempts", metadata.Sequence.Stream, topic, metadata.NumDelivered)
+		err = msg.Term()
+	} else if n.config.NakDelay > 0 {
+		err = msg.NakWithDelay(n.config.NakDelay)
+	} else {
+		err = msg.Nak()
+	}
+
+	if err != nil {
+		logger.Warn().Err(err).Msg("[JETSTREAM]: Could not nak message")
+	}
+}
+
+// stream returns the stream which stores the topic, provisioning it if needed
+func (n *jetstreamBroker) stream(topic string) (string, error) {
+
+	if n.config.Stream != "" {
+		return n.config.Stream, nil
+	}
+
+	prefix := strings.SplitN(topic, ".", 2)[0]
+	if prefix == "" || prefix == "*" || prefix == ">" {
+		return "", fmt.Errorf("[JETSTREAM]: Cannot provision a stream for topic '%s'. Set Config.Stream", topic)
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if stream, ok := n.streams[prefix]; ok {
+		return stream, nil
+	}
+
+	stream := strings.ToUpper(sanitize(prefix))
+	if err := n.ensureStream(n.streamConfig(stream, []string{prefix, prefix + ".>"})); err != nil {
+		return "", err
+	}
+
+	n.streams[prefix] = stream
+	return stream, nil
+}
+
+// streamConfig returns the config of a provisioned stream
+func (n *jetstreamBroker) streamConfig(name string, subjects []string) jetstream.StreamConfig {
+	return jetstream.StreamConfig{
+		Name:     name,
+		Subjects: subjects,
+		Storage:  n.config.Storage,
+		MaxAge:   n.config.MaxAge,
+		Replicas: n.config.Replicas,
+	}
+}
+
+// ensureStream creates the stream unless it already exists. Existing streams are left
+// untouched so that their configuration can be managed outside of the service
+func (n *jetstreamBroker) ensureStream(config jetstream.StreamConfig) error {
+
+	_, err := n.js.Stream(n.ctx, config.Name)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, jetstream.ErrStreamNotFound) {
+		return err
+	}
+
+	_, err = n.js.CreateStream(n.ctx, config)
+	if err != nil && !errors.Is(err, jetstream.ErrStreamNameAlreadyInUse) {
+		return err
+	}
+
+	logger.Info().Msgf("[JETSTREAM]: Provisioned stream '%s' for subjects %v", config.Name, config.Subjects)
+	return nil
+}
+
+// toNatsMsg encodes the envelope into a NATS message. c encodes the messages without content type
+func toNatsMsg(topic string, m *broker.Message, c broker.Codec) (*nats.Msg, error) {
+
+	msg, err := m.Encode(c)
+	if err != nil {
+		return nil, err
+	}
+
+	natsMsg := nats.NewMsg(topic)
+	natsMsg.Data = msg.Body
+	for k, v := range msg.Headers() {
+		natsMsg.Header.Set(k, v)
+	}
+
+	return natsMsg, nil
+}
+
+// toMessage extracts the envelope from the subject, headers and data of a JetStream or NATS message
+func toMessage(subject string, header nats.Header, data []byte) *broker.Message {
+	headers := make(map[string]string, len(header))
+	for k := range header {
+		if k == jetstream.MsgIDHeader {
+			continue
+		}
+		headers[k] = header.Get(k)
+	}
+	return broker.MessageFromHeaders(subject, headers, data)
+}
+
+// sanitize replaces the characters which are not allowed in stream and consumer names
+func sanitize(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', '*', '>', ' ', '/', '\\':
+			return '_'
+		}
+		return r
+	}, name)
+}
+
+// New returns a new JetStream broker
+func New(config Config) broker.Broker {
+	return &jetstreamBroker{
+		config:          config,
+		subscriptionMap: make(map[string]*jetstreamSubscriber),
+		streams:         make(map[string]string),
+	}
+}
@@ -0,0 +1,487 @@
+package jetstream
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/adityak368/ego/broker"
+	proto "github.com/adityak368/ego/broker/proto/gen/broker"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+const timeout = 5 * time.Second
+
+// runServer starts an embedded nats-server with JetStream enabled
+func runServer(t *testing.T) *server.Server {
+	ns, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		NoLog:     true,
+		NoSigs:    true,
+	})
+	require.Nil(t, err)
+
+	go ns.Start()
+	if !ns.ReadyForConnections(timeout) {
+		t.Fatal("nats-server did not start")
+	}
+	t.Cleanup(ns.Shutdown)
+	return ns
+}
+
+func newBroker(t *testing.T, ns *server.Server, config Config) broker.Broker {
+	bkr := New(config)
+	bkr.Init(broker.Options{
+		Name:    "JetStream",
+		Address: ns.ClientURL(),
+	})
+	require.Nil(t, bkr.Connect())
+	t.Cleanup(func() { bkr.Disconnect() })
+	return bkr
+}
+
+func TestJetStream(t *testing.T) {
+
+	r := require.New(t)
+
+	ns := runServer(t)
+	bkr := newBroker(t, ns, Config{})
+
+	c := make(chan *broker.Message, 1)
+
+	// TestMessage is a protobuf message
+	OnTestMessageProto := func(ctx context.Context, msg *proto.TestMessage, m *broker.Message) error {
+		r.Equal(msg.Data, "Test", "Wrong data received")
+		c <- m
+		return nil
+	}
+
+	// messages published before the subscriber exists are stored in the stream
+	err := bkr.PublishMessage("test.testMessageProto", &broker.Message{
+		CorrelationID: "correlation",
+		Data:          &proto.TestMessage{Data: "Test"},
+	})
+	r.Nil(err)
+
+	subscriptionProto, err := bkr.Subscribe("test.testMessageProto", OnTestMessageProto)
+	r.Nil(err)
+	r.Equal(subscriptionProto.Topic(), "test.testMessageProto", "test.testMessageProto subscription error")
+
+	select {
+	case m := <-c:
+		r.Equal("correlation", m.CorrelationID)
+		r.Equal(broker.ContentTypeProtobuf, m.ContentType)
+		r.NotContains(m.Header, "Nats-Msg-Id")
+	case <-time.After(timeout):
+		t.Fatal("Timed out waiting for message from broker")
+	}
+
+	// the durable consumer keeps its position while nobody is subscribed
+	r.Nil(subscriptionProto.Unsubscribe())
+	r.Nil(bkr.Publish("test.testMessageProto", &proto.TestMessage{Data: "Test"}))
+
+	_, err = bkr.Subscribe("test.testMessageProto", OnTestMessageProto)
+	r.Nil(err)
+
+	select {
+	case <-c:
+	case <-time.After(timeout):
+		t.Fatal("Timed out waiting for message published while unsubscribed")
+	}
+
+	select {
+	case <-c:
+		t.Fatal("Acked message should not be redelivered")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestJetStreamRedelivery(t *testing.T) {
+
+	r := require.New(t)
+
+	ns := runServer(t)
+	bkr := newBroker(t, ns, Config{
+		MaxDeliver: 3,
+		AckWait:    time.Second,
+	})
+
+	var mu sync.Mutex
+	attempts := 0
+	done := make(chan bool, 1)
+
+	// TestMessage is a protobuf message
+	OnTestMessageRawWithError := func(ctx context.Context, msg []byte) error {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		if attempts == 3 {
+			done <- true
+		}
+		return errors.New("Something went wrong")
+	}
+
+	_, err := bkr.SubscribeRaw("test.testMessageRawWithError", OnTestMessageRawWithError)
+	r.Nil(err)
+
+	r.Nil(bkr.PublishRaw("test.testMessageRawWithError", []byte("Test")))
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		t.Fatal("Timed out waiting for redeliveries")
+	}
+
+	time.Sleep(2 * time.Second)
+
+	mu.Lock()
+	defer mu.Unlock()
+	r.Equal(3, attempts, "Message should not be delivered more than MaxDeliver times")
+}
+
+func TestJetStreamReplay(t *testing.T) {
+
+	r := require.New(t)
+
+	ns := runServer(t)
+	bkr := newBroker(t, ns, Config{
+		Stream:   "REPLAY",
+		Subjects: []string{"replay.>"},
+	})
+
+	for _, data := range []string{"1", "2", "3"} {
+		r.Nil(bkr.PublishRaw("replay.test", []byte(data)))
+	}
+
+	c := make(chan string, 3)
+	OnTestMessageRaw := func(ctx context.Context, msg []byte) error {
+		c <- string(msg)
+		return nil
+	}
+
+	_, err := bkr.SubscribeRaw("replay.test", OnTestMessageRaw, broker.Broadcast(), broker.StartAtSequence(2))
+	r.Nil(err)
+
+	for _, expected := range []string{"2", "3"} {
+		select {
+		case data := <-c:
+			r.Equal(expected, data)
+		case <-time.After(timeout):
+			t.Fatal("Timed out waiting for replayed message")
+		}
+	}
+
+	_, err = bkr.SubscribeRaw("replay.test", OnTestMessageRaw, broker.Broadcast(), broker.StartAtTime(time.Now().Add(time.Hour)))
+	r.Nil(err)
+
+	// without a start option a broadcast subscriber receives the new messages only
+	_, err = bkr.SubscribeRaw("replay.test", OnTestMessageRaw, broker.Broadcast())
+	r.Nil(err)
+
+	select {
+	case data := <-c:
+		t.Fatalf("Unexpected message %s", data)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// a durable consumer keeps its start
+	s, err := bkr.SubscribeRaw("replay.test", OnTestMessageRaw, broker.Queue("replay"), broker.StartAtSequence(3))
+	r.Nil(err)
+	select {
+	case data := <-c:
+		r.Equal("3", data)
+	case <-time.After(timeout):
+		t.Fatal("Timed out waiting for replayed message")
+	}
+	r.Nil(s.Unsubscribe())
+
+	_, err = bkr.SubscribeRaw("replay.test", OnTestMessageRaw, broker.Queue("replay"), broker.StartAtSequence(1))
+	r.NotNil(err, "The start of an existing durable consumer should not change")
+	r.Contains(err.Error(), "already exists")
+	s, err = bkr.SubscribeRaw("replay.test", OnTestMessageRaw, broker.Queue("replay"), broker.StartAtSequence(3))
+	r.Nil(err)
+	r.Nil(s.Unsubscribe())
+	_, err = bkr.SubscribeRaw("replay.test", OnTestMessageRaw, broker.Queue("replay"))
+	r.Nil(err, "Durable consumers should be resumed without a start option")
+
+	select {
+	case data := <-c:
+		t.Fatalf("Unexpected message %s", data)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestJetStreamQueueGroups(t *testing.T) {
+
+	r := require.New(t)
+
+	ns := runServer(t)
+	bkr := newBroker(t, ns, Config{})
+
+	var mu sync.Mutex
+	received := map[string]int{}
+	done := make(chan bool, 1)
+	handler := func(name string) func(ctx context.Context, msg []byte) error {
+		return func(ctx context.Context, msg []byte) error {
+			mu.Lock()
+			defer mu.Unlock()
+			received[name]++
+			if received["worker1"]+received["worker2"] == 10 {
+				done <- true
+			}
+			return nil
+		}
+	}
+
+	_, err := bkr.SubscribeRaw("test.testMessageQueue", handler("worker1"), broker.Queue("workers"))
+	r.Nil(err)
+	_, err = bkr.SubscribeRaw("test.testMessageQueue", handler("worker2"), broker.Queue("workers"))
+	r.Nil(err)
+
+	for i := 0; i < 10; i++ {
+		r.Nil(bkr.PublishRaw("test.testMessageQueue", []byte("Test")))
+	}
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		t.Fatal("Timed out waiting for messages from broker")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	r.Equal(10, received["worker1"]+received["worker2"], "Each message should be handled once per queue group")
+}
+
+func TestJetStreamRequest(t *testing.T) {
+
+	r := require.New(t)
+
+	ns := runServer(t)
+	bkr := newBroker(t, ns, Config{MaxDeliver: 1})
+
+	OnEcho := func(ctx context.Context, req *proto.TestMessage) (*proto.TestMessage, error) {
+		if req.Data == "fail" {
+			return nil, errors.New("Something went wrong")
+		}
+		return &proto.TestMessage{Data: "Echo " + req.Data}, nil
+	}
+
+	_, err := bkr.Subscribe("test.echo", OnEcho)
+	r.Nil(err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	resp := &proto.TestMessage{}
+	r.Nil(bkr.Request(ctx, "test.echo", &proto.TestMessage{Data: "Test"}, resp))
+	r.Equal("Echo Test", resp.Data)
+
+	err = bkr.Request(ctx, "test.echo", &proto.TestMessage{Data: "fail"}, resp)
+	r.EqualError(err, "Something went wrong", "Responder errors should be returned to the requester")
+
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	err = bkr.Request(ctx, "test.nobody", &proto.TestMessage{Data: "Test"}, resp)
+	r.True(errors.Is(err, context.DeadlineExceeded), "Request should time out without a responder")
+}
+
+func TestJetStreamSchedule(t *testing.T) {
+
+	r := require.New(t)
+
+	ns := runServer(t)
+	bkr := New(Config{})
+	bkr.Init(broker.Options{Name: "JetStream", Address: ns.ClientURL()})
+	r.Nil(bkr.Connect())
+
+	start := time.Now()
+	r.Nil(bkr.PublishRaw("orders.reminder", []byte("cancelled"), broker.WithMessageID("cancelled"), broker.PublishAfter(200*time.Millisecond)))
+	r.Nil(bkr.PublishRaw("orders.reminder", []byte("delayed"), broker.WithHeader("Tenant", "ego"), broker.PublishAfter(300*time.Millisecond)))
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	r.Nil(broker.Cancel(ctx, bkr, "cancelled"))
+	r.True(errors.Is(broker.Cancel(ctx, bkr, "cancelled"), broker.ErrNotScheduled))
+
+	// the scheduled messages survive a restart of the service
+	r.Nil(bkr.Disconnect())
+	bkr = newBroker(t, ns, Config{})
+
+	c := make(chan *broker.Message, 2)
+	_, err := bkr.SubscribeRaw("orders.reminder", func(ctx context.Context, msg []byte) error {
+		m, _ := broker.FromContext(ctx)
+		c <- m
+		return nil
+	})
+	r.Nil(err)
+
+	select {
+	case m := <-c:
+		r.Equal("delayed", string(m.Body), "Cancelled messages should not be delivered")
+		r.Equal("ego", m.Header["Tenant"])
+		r.NotContains(m.Header, headerScheduleTopic)
+		r.True(time.Since(start) >= 300*time.Millisecond, "Scheduled messages should be delivered when due")
+	case <-time.After(timeout):
+		t.Fatal("Timed out waiting for the scheduled message")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	r.Len(c, 0)
+}
+
+func TestJetStreamOptions(t *testing.T) {
+
+	r := require.New(t)
+
+	ns := runServer(t)
+	bkr := newBroker(t, ns, Config{})
+
+	var mu sync.Mutex
+	received := 0
+	c := make(chan bool, 2)
+	_, err := bkr.SubscribeRaw("options.created", func(ctx context.Context, msg []byte) error {
+		mu.Lock()
+		defer mu.Unlock()
+		received++
+		c <- true
+		return nil
+	}, broker.AutoAck(), broker.Prefetch(10), broker.Concurrency(2))
+	r.Nil(err)
+
+	// messages with the same id are stored once
+	for i := 0; i < 2; i++ {
+		r.Nil(bkr.PublishRaw("options.created", []byte("Test"), broker.WithMessageID("order")))
+	}
+
+	select {
+	case <-c:
+	case <-time.After(timeout):
+		t.Fatal("Timed out waiting for message from broker")
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	mu.Lock()
+	r.Equal(1, received, "Duplicate messages should be dropped")
+	mu.Unlock()
+
+	err = bkr.PublishRaw("options.created", []byte("Test"), broker.Priority(1))
+	r.True(errors.Is(err, broker.ErrNotSupported), "Priority should be rejected")
+}
+
+func TestJetStreamReconnect(t *testing.T) {
+
+	r := require.New(t)
+
+	ns := runServer(t)
+	statuses := make(chan broker.Status, 16)
+
+	bkr := New(Config{})
+	bkr.Init(broker.Options{
+		Name:      "JetStream",
+		Address:   ns.ClientURL(),
+		Reconnect: broker.ReconnectPolicy{Backoff: 50 * time.Millisecond},
+		OnStatus: func(status broker.Status) {
+			statuses <- status
+		},
+	})
+	r.Nil(bkr.Connect())
+	defer bkr.Disconnect()
+
+	r.Equal(broker.StatusConnected, <-statuses)
+	r.Equal(broker.StatusConnected, bkr.Status())
+	notify := bkr.NotifyStatus()
+
+	received := make(chan bool, 1)
+	_, err := bkr.SubscribeRaw("test.testMessageReconnect", func(ctx context.Context, msg []byte) error {
+		received <- true
+		return nil
+	})
+	r.Nil(err)
+
+	port := ns.Addr().(*net.TCPAddr).Port
+	storeDir := ns.JetStreamConfig().StoreDir
+	ns.Shutdown()
+
+	waitStatus(t, statuses, broker.StatusReconnecting)
+
+	restarted, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      port,
+		JetStream: true,
+		StoreDir:  storeDir,
+		NoLog:     true,
+		NoSigs:    true,
+	})
+	r.Nil(err)
+	go restarted.Start()
+	t.Cleanup(restarted.Shutdown)
+
+	waitStatus(t, statuses, broker.StatusConnected)
+	waitStatus(t, notify, broker.StatusConnected)
+
+	r.Nil(bkr.PublishRaw("test.testMessageReconnect", []byte("Test")))
+	select {
+	case <-received:
+	case <-time.After(timeout):
+		t.Fatal("Consumer should resume after the reconnect")
+	}
+
+	r.Nil(bkr.Disconnect())
+	waitStatus(t, statuses, broker.StatusClosed)
+	r.Equal(broker.StatusClosed, bkr.Status())
+}
+
+// waitStatus waits until the status is received
+func waitStatus(t *testing.T, statuses <-chan broker.Status, status broker.Status) {
+	for {
+		select {
+		case s := <-statuses:
+			if s == status {
+				return
+			}
+		case <-time.After(timeout):
+			t.Fatalf("Timed out waiting for status %s", status)
+		}
+	}
+}
+
+func TestJetStreamAuth(t *testing.T) {
+
+	r := require.New(t)
+
+	ns, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		Username:  "ego",
+		Password:  "secret",
+		NoLog:     true,
+		NoSigs:    true,
+	})
+	r.Nil(err)
+	go ns.Start()
+	if !ns.ReadyForConnections(timeout) {
+		t.Fatal("nats-server did not start")
+	}
+	defer ns.Shutdown()
+
+	bkr := New(Config{})
+	bkr.Init(broker.Options{Name: "JetStream", Address: ns.ClientURL()})
+	r.NotNil(bkr.Connect(), "Connecting without credentials should fail")
+
+	bkr.Init(broker.Options{Name: "JetStream", Address: ns.ClientURL(), Username: "ego", Password: "secret"})
+	r.Nil(bkr.Connect())
+	r.Nil(bkr.Disconnect())
+}
@@ -0,0 +1,176 @@
+package jetstream
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/adityak368/ego/broker"
+	"github.com/adityak368/swissknife/logger/v2"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const (
+	// scheduleStream stores the scheduled messages of every service until they are due.
+	// Every message is stored on a subject of its own, so that it can be purged by id
+	scheduleStream  = "EGO_SCHEDULE"
+	scheduleSubject = "_EGO.schedule"
+	// headers of the scheduled messages, which are removed before the message is published
+	headerScheduleTopic = "Ego-Schedule-Topic"
+	headerScheduleAt    = "Ego-Schedule-At"
+	// retryDelay delays the next attempt to publish a due message whose publish failed
+	retryDelay = time.Second
+)
+
+// subject returns the subject of the scheduled message with the id in the schedule of the service
+func (n *jetstreamBroker) scheduleSubject(id string) string {
+	return scheduleSubject + "." + sanitize(n.options.Name) + "." + id
+}
+
+// schedule stores the message in the schedule stream until it is due. The server keeps a
+// single message per subject, so a message scheduled with the id of a scheduled message
+// replaces it
+func (n *jetstreamBroker) schedule(topic string, m *broker.Message, at time.Time) error {
+
+	if _, err := n.stream(topic); err != nil {
+		return err
+	}
+	if err := n.startScheduler(); err != nil {
+		return err
+	}
+
+	msg, err := m.Encode(n.options.Codec)
+	if err != nil {
+		return err
+	}
+	if strings.ContainsAny(msg.ID, ".*> \t\r\n") {
+		return fmt.Errorf("[JETSTREAM]: Cannot schedule message '%s'. Its id is no valid subject token", msg.ID)
+	}
+
+	natsMsg, err := toNatsMsg(n.scheduleSubject(msg.ID), msg, n.options.Codec)
+	if err != nil {
+		return err
+	}
+	natsMsg.Header.Set(headerScheduleTopic, topic)
+	natsMsg.Header.Set(headerScheduleAt, at.UTC().Format(time.RFC3339Nano))
+
+	_, err = n.js.PublishMsg(n.ctx, natsMsg)
+	return err
+}
+
+// startScheduler provisions the schedule stream and consumes the schedule of the service
+// unless it is consumed already. The instances of a service share a durable consumer, so
+// that every message is published once
+func (n *jetstreamBroker) startScheduler() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.scheduler != nil {
+		return nil
+	}
+
+	err := n.ensureStream(jetstream.StreamConfig{
+		Name:              scheduleStream,
+		Subjects:          []string{scheduleSubject + ".>"},
+		Retention:         jetstream.WorkQueuePolicy,
+		MaxMsgsPerSubject: 1,
+		Storage:           n.config.Storage,
+		Replicas:          n.config.Replicas,
+	})
+	if err != nil {
+		return err
+	}
+
+	consumer, err := n.js.CreateOrUpdateConsumer(n.ctx, scheduleStream, jetstream.ConsumerConfig{
+		Durable:       sanitize(n.options.Name + "_schedule"),
+		FilterSubject: n.scheduleSubject(">"),
+		AckPolicy:     jetstream.AckExplicitPolicy,
+		// every scheduled message is pending until it is due
+		MaxAckPending: -1,
+	})
+	if err != nil {
+		return err
+	}
+
+	scheduler, err := consumer.Consume(n.release)
+	if err != nil {
+		return err
+	}
+	n.scheduler = scheduler
+	return nil
+}
+
+// stopScheduler stops consuming the schedule
+func (n *jetstreamBroker) stopScheduler() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.scheduler != nil {
+		n.scheduler.Stop()
+		n.scheduler = nil
+	}
+}
+
+// release publishes the scheduled message once it is due. The server redelivers the messages
+// which are not due yet after the remaining delay
+func (n *jetstreamBroker) release(msg jetstream.Msg) {
+
+	header := msg.Headers()
+	at, err := time.Parse(time.RFC3339Nano, header.Get(headerScheduleAt))
+	if err != nil {
+		logger.Error().Err(err).Msgf("[JETSTREAM]: Dropping scheduled message '%s' without a valid time", msg.Subject())
+		msg.Term()
+		return
+	}
+
+	if wait := time.Until(at); wait > 0 {
+		if err := msg.NakWithDelay(wait); err != nil {
+			logger.Warn().Err(err).Msgf("[JETSTREAM]: Could not delay scheduled message '%s'", msg.Subject())
+		}
+		return
+	}
+
+	topic := header.Get(headerScheduleTopic)
+	m := toMessage(topic, header, msg.Data())
+	delete(m.Header, headerScheduleTopic)
+	delete(m.Header, headerScheduleAt)
+
+	if err := n.publish(topic, m); err != nil {
+		logger.Warn().Err(err).Msgf("[JETSTREAM]: Could not publish scheduled message %s to '%s'. Retrying in %s", m.ID, topic, retryDelay)
+		msg.NakWithDelay(retryDelay)
+		return
+	}
+
+	if err := msg.Ack(); err != nil {
+		logger.Warn().Err(err).Msg("[JETSTREAM]: Could not ack scheduled message")
+	}
+}
+
+// Cancel purges the scheduled message with the id from the schedule stream
+func (n *jetstreamBroker) Cancel(ctx context.Context, id string) error {
+
+	if n.connection == nil {
+		return errors.New("[JETSTREAM]: Cannot Cancel. Not connected to broker")
+	}
+
+	stream, err := n.js.Stream(ctx, scheduleStream)
+	if errors.Is(err, jetstream.ErrStreamNotFound) {
+		return errors.Wrapf(broker.ErrNotScheduled, "[JETSTREAM]: Cannot cancel message %s", id)
+	}
+	if err != nil {
+		return err
+	}
+
+	subject := n.scheduleSubject(id)
+	if _, err := stream.GetLastMsgForSubject(ctx, subject); err != nil {
+		if errors.Is(err, jetstream.ErrMsgNotFound) {
+			return errors.Wrapf(broker.ErrNotScheduled, "[JETSTREAM]: Cannot cancel message %s", id)
+		}
+		return err
+	}
+
+	return stream.Purge(ctx, jetstream.WithPurgeSubject(subject))
+}
@@ -0,0 +1,92 @@
+package jetstream
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/adityak368/ego/broker"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/pkg/errors"
+)
+
+type jetstreamSubscriber struct {
+	id          string
+	topic       string
+	queue       string
+	handlerType string
+	subscribed  time.Time
+	stream      string
+	consumer    string
+	durable     bool
+	consume     jetstream.ConsumeContext
+	workers     *broker.Workers
+	stats       broker.StatsCounter
+	broker      *jetstreamBroker
+	js          jetstream.JetStream
+	cancel      context.CancelFunc
+}
+
+// ID returns the unique id of the subscription
+func (s *jetstreamSubscriber) ID() string {
+	return s.id
+}
+
+// Topic returns the subscribed topic
+func (s *jetstreamSubscriber) Topic() string {
+	return s.topic
+}
+
+// info describes the subscription
+func (s *jetstreamSubscriber) info() broker.SubscriptionInfo {
+	return broker.SubscriptionInfo{
+		ID:         s.id,
+		Topic:      s.topic,
+		Handler:    s.handlerType,
+		Subscribed: s.subscribed,
+		Queue:      s.queue,
+		Stats:      s.stats.Stats(),
+	}
+}
+
+// Unsubscribe unsubscribes to the topic. Durable consumers are kept on the server
+// so that the messages published in the meantime are delivered on the next subscribe
+func (s *jetstreamSubscriber) Unsubscribe() error {
+	if s.consume == nil {
+		return fmt.Errorf("[JETSTREAM]: Cannot unsubscribe from %s", s.topic)
+	}
+	s.broker.remove(s)
+
+	s.consume.Stop()
+	s.cancel()
+	// unacked messages in the buffer are redelivered after the ack wait
+	s.workers.Stop()
+
+	if s.durable {
+		return nil
+	}
+
+	err := s.js.DeleteConsumer(context.Background(), s.stream, s.consumer)
+	if err != nil && !errors.Is(err, jetstream.ErrConsumerNotFound) {
+		return err
+	}
+	return nil
+}
+
+// drain stops the consumer from fetching messages, lets it hand the fetched messages to
+// the workers and waits for the workers to handle them
+func (s *jetstreamSubscriber) drain(ctx context.Context) error {
+	defer s.cancel()
+
+	s.consume.Drain()
+
+	select {
+	case <-s.consume.Closed():
+	case <-ctx.Done():
+		// the workers are stopped without waiting for the handlers in flight
+		s.consume.Stop()
+		return s.workers.Drain(ctx)
+	}
+
+	return s.workers.Drain(ctx)
+}
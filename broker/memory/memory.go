@@ -0,0 +1,487 @@
+// Package memory is an in-process implementation of the broker. It is useful
+// for tests and for single process deployments where no external broker is
+// available.
+package memory
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/adityak368/ego/broker"
+	"github.com/adityak368/swissknife/logger/v2"
+)
+
+// Broker is the in-memory implementation of the broker
+type Broker interface {
+	broker.Broker
+	broker.Scheduler
+	// Flush blocks until every published message has been handled by its subscribers
+	Flush(ctx context.Context) error
+}
+
+// memoryBroker is the in-memory implementation of the broker
+type memoryBroker struct {
+	options     broker.Options
+	connected   bool
+	draining    bool
+	ctx         context.Context
+	cancel      context.CancelFunc
+	subscribers map[*memorySubscriber]struct{}
+	sequence    uint64
+	mu          sync.RWMutex
+
+	// roundRobin is the index of the next subscriber of each queue group
+	roundRobin    map[string]int
+	roundRobinMux sync.Mutex
+
+	status broker.StatusNotifier
+
+	// pending is the number of deliveries which are queued or being handled
+	pending    int
+	idle       chan struct{}
+	pendingMux sync.Mutex
+
+	// scheduled holds the timers of the scheduled messages by message id
+	scheduled    map[string]*time.Timer
+	scheduledMux sync.Mutex
+}
+
+// Address Returns the broker bind interface
+func (n *memoryBroker) Address() string {
+	return n.options.Address
+}
+
+// Init initialises the broker
+func (n *memoryBroker) Init(opts broker.Options) error {
+	n.options = opts
+	return nil
+}
+
+// Options returns the broker options
+func (n *memoryBroker) Options() broker.Options {
+	return n.options
+}
+
+// String returns the description of the broker
+func (n *memoryBroker) String() string {
+	return "[MEMORY]: In-memory broker"
+}
+
+// Connect connects to the broker
+func (n *memoryBroker) Connect() error {
+	n.mu.Lock()
+	if !n.connected {
+		n.ctx, n.cancel = context.WithCancel(context.Background())
+		n.connected = true
+		n.draining = false
+	}
+	n.mu.Unlock()
+	n.status.Set(broker.StatusConnected, n.options.OnStatus)
+	logger.Info().Msg("[MEMORY]: Connected")
+	return nil
+}
+
+// Disconnect disconnects from the broker
+func (n *memoryBroker) Disconnect() error {
+	n.mu.Lock()
+	if !n.connected {
+		n.mu.Unlock()
+		return errors.New("[MEMORY]: Cannot Disconnect. Not connected to broker")
+	}
+	n.connected = false
+	n.cancel()
+	subscribers := n.subscribers
+	n.subscribers = make(map[*memorySubscriber]struct{})
+	n.mu.Unlock()
+
+	for s := range subscribers {
+		s.close()
+	}
+
+	n.scheduledMux.Lock()
+	for id, timer := range n.scheduled {
+		timer.Stop()
+		delete(n.scheduled, id)
+	}
+	n.scheduledMux.Unlock()
+
+	n.status.Set(broker.StatusClosed, n.options.OnStatus)
+	logger.Info().Msg("[MEMORY]: Disconnected")
+	return nil
+}
+
+// Drain waits until the published messages are handled by their subscribers and disconnects.
+// Like NATS, the broker rejects new publishes once it is draining, while the handlers can
+// still reply to requests
+func (n *memoryBroker) Drain(ctx context.Context) error {
+	n.mu.Lock()
+	n.draining = n.connected
+	n.mu.Unlock()
+
+	err := n.Flush(ctx)
+	if disconnectErr := n.Disconnect(); disconnectErr != nil {
+		return disconnectErr
+	}
+	return err
+}
+
+// Status returns the status of the broker. It never loses its connection
+func (n *memoryBroker) Status() broker.Status {
+	return n.status.Status()
+}
+
+// NotifyStatus returns a channel which receives the changes of the status
+func (n *memoryBroker) NotifyStatus() <-chan broker.Status {
+	return n.status.Notify()
+}
+
+// Handle returns the raw connection handle to the broker
+func (n *memoryBroker) Handle() interface{} {
+	return nil
+}
+
+// Flush blocks until every published message has been handled by its subscribers
+func (n *memoryBroker) Flush(ctx context.Context) error {
+	n.pendingMux.Lock()
+	if n.pending == 0 {
+		n.pendingMux.Unlock()
+		return nil
+	}
+	idle := n.idle
+	n.pendingMux.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Publish publishes a message to the topic
+func (n *memoryBroker) Publish(topic string, m proto.Message, opts ...broker.PublishOption) error {
+	return n.publish(topic, &broker.Message{Data: m}, "Publish", opts...)
+}
+
+// PublishRaw publishes raw data to the topic
+func (n *memoryBroker) PublishRaw(topic string, m []byte, opts ...broker.PublishOption) error {
+	data := make([]byte, len(m))
+	copy(data, m)
+	return n.publish(topic, &broker.Message{Body: data}, "PublishRaw", opts...)
+}
+
+// PublishMessage publishes a message envelope to the topic
+func (n *memoryBroker) PublishMessage(topic string, m *broker.Message, opts ...broker.PublishOption) error {
+	return n.publish(topic, m, "PublishMessage", opts...)
+}
+
+// Request publishes the request to the topic and waits for the response on a private inbox topic
+func (n *memoryBroker) Request(ctx context.Context, topic string, req proto.Message, resp proto.Message) error {
+
+	id := broker.NewID()
+	reply := make(chan *broker.Message, 1)
+	receive := func(ctx context.Context, m *broker.Message) error {
+		select {
+		case reply <- m:
+		default:
+		}
+		return nil
+	}
+	inbox, err := n.subscribe("_INBOX."+id, receive, broker.HandlerType(receive), broker.NewSubscribeOptions(broker.Broadcast()))
+	if err != nil {
+		return err
+	}
+	defer inbox.Unsubscribe()
+
+	err = n.publish(topic, &broker.Message{
+		CorrelationID: id,
+		ReplyTo:       "_INBOX." + id,
+		Data:          req,
+	}, "Request")
+	if err != nil {
+		return err
+	}
+
+	select {
+	case m := <-reply:
+		return broker.DecodeResponse(m, resp)
+	case <-ctx.Done():
+		return errors.Wrapf(ctx.Err(), "[MEMORY]: No response to request on '%s'", topic)
+	}
+}
+
+// publish delivers the message to every subscriber whose topic matches
+func (n *memoryBroker) publish(topic string, m *broker.Message, op string, opts ...broker.PublishOption) error {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	if !n.connected {
+		return fmt.Errorf("[MEMORY]: Cannot %s. Not connected to broker", op)
+	}
+	if n.draining && op != "Reply" {
+		return fmt.Errorf("[MEMORY]: Cannot %s. The broker is draining", op)
+	}
+
+	o := broker.NewPublishOptions(opts...)
+	switch {
+	case o.TTL > 0:
+		return broker.NotSupported("MEMORY", "TTL")
+	case o.Priority > 0:
+		return broker.NotSupported("MEMORY", "Priority")
+	}
+	if err := o.CheckNative("MEMORY"); err != nil {
+		return err
+	}
+
+	m, err := o.Apply(m)
+	if err != nil {
+		return err
+	}
+
+	msg, err := m.Encode(n.options.Codec)
+	if err != nil {
+		return err
+	}
+	msg.Topic = topic
+
+	if !o.At.IsZero() {
+		n.schedule(topic, msg, o.At)
+		return nil
+	}
+
+	n.route(topic, msg)
+	return nil
+}
+
+// route enqueues the message to every subscriber whose topic matches. The caller holds mu
+func (n *memoryBroker) route(topic string, msg *broker.Message) {
+	groups := make(map[string][]*memorySubscriber)
+	for s := range n.subscribers {
+		if !broker.MatchTopic(s.topic, topic) {
+			continue
+		}
+		if s.group == "" {
+			s.enqueue(msg)
+			continue
+		}
+		// like NATS, a queue group is scoped to the subscribed topic
+		group := s.topic + " " + s.group
+		groups[group] = append(groups[group], s)
+	}
+
+	for group, members := range groups {
+		sort.Slice(members, func(i, j int) bool { return members[i].id < members[j].id })
+		members[n.nextMember(group, len(members))].enqueue(msg)
+	}
+}
+
+// schedule routes the message once it is due. A message scheduled with the id of a
+// scheduled message replaces it. Scheduled messages are lost on Disconnect
+func (n *memoryBroker) schedule(topic string, msg *broker.Message, at time.Time) {
+	n.scheduledMux.Lock()
+	defer n.scheduledMux.Unlock()
+
+	if timer, ok := n.scheduled[msg.ID]; ok {
+		timer.Stop()
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(time.Until(at), func() {
+		n.scheduledMux.Lock()
+		if n.scheduled[msg.ID] != timer {
+			n.scheduledMux.Unlock()
+			return
+		}
+		delete(n.scheduled, msg.ID)
+		n.scheduledMux.Unlock()
+
+		n.mu.RLock()
+		defer n.mu.RUnlock()
+		if n.connected {
+			n.route(topic, msg)
+		}
+	})
+	n.scheduled[msg.ID] = timer
+}
+
+// Cancel cancels the scheduled message with the id
+func (n *memoryBroker) Cancel(_ context.Context, id string) error {
+	n.scheduledMux.Lock()
+	defer n.scheduledMux.Unlock()
+
+	timer, ok := n.scheduled[id]
+	if !ok || !timer.Stop() {
+		return errors.Wrapf(broker.ErrNotScheduled, "[MEMORY]: Cannot cancel message %s", id)
+	}
+	delete(n.scheduled, id)
+	return nil
+}
+
+// nextMember returns the index of the member of the queue group which receives the next message
+func (n *memoryBroker) nextMember(group string, count int) int {
+	n.roundRobinMux.Lock()
+	defer n.roundRobinMux.Unlock()
+
+	next := n.roundRobin[group] % count
+	n.roundRobin[group] = next + 1
+	return next
+}
+
+// Subscribe subscribes a handler to the topic
+func (n *memoryBroker) Subscribe(topic string, h interface{}, opts ...broker.SubscribeOption) (broker.Subscriber, error) {
+
+	handler, err := broker.NewHandlerFunc(h)
+	if err != nil {
+		return nil, errors.Wrap(err, "[MEMORY]")
+	}
+
+	return n.subscribe(topic, handler, broker.HandlerType(h), broker.NewSubscribeOptions(opts...))
+}
+
+// SubscribeRaw subscribes a raw handler to the topic
+func (n *memoryBroker) SubscribeRaw(topic string, h func(c context.Context, data []byte) error, opts ...broker.SubscribeOption) (broker.Subscriber, error) {
+	return n.subscribe(topic, broker.NewRawHandlerFunc(h), broker.HandlerType(h), broker.NewSubscribeOptions(opts...))
+}
+
+// subscribe registers the handler and starts its delivery loop
+func (n *memoryBroker) subscribe(topic string, h broker.HandlerFunc, handlerType string, opts broker.SubscribeOptions) (broker.Subscriber, error) {
+
+	if !broker.ValidTopic(topic) {
+		return nil, fmt.Errorf("[MEMORY]: Invalid topic '%s'", topic)
+	}
+
+	if err := checkSubscribeOptions(opts); err != nil {
+		return nil, err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if !n.connected {
+		return nil, errors.New("[MEMORY]: Cannot Subscribe. Not connected to broker")
+	}
+
+	n.sequence++
+	ctx, cancel := context.WithCancel(n.ctx)
+	subscriber := &memorySubscriber{
+		id:          n.sequence,
+		topic:       topic,
+		group:       opts.QueueGroup(n.options.Name),
+		handler:     h,
+		handlerType: opts.ReportedHandlerType(handlerType),
+		subscribed:  time.Now(),
+		options:     opts,
+		broker:      n,
+		ctx:         ctx,
+		cancel:      cancel,
+		workers:     broker.NewWorkers(opts.Concurrency, 0),
+		signal:      make(chan struct{}, 1),
+		done:        make(chan struct{}),
+	}
+	n.subscribers[subscriber] = struct{}{}
+	go subscriber.run()
+
+	if subscriber.group != "" {
+		logger.Info().Msgf("[MEMORY]: Subscribed to topic '%s' in queue group '%s'", topic, subscriber.group)
+		return subscriber, nil
+	}
+	logger.Info().Msgf("[MEMORY]: Subscribed to topic '%s'", topic)
+	return subscriber, nil
+}
+
+// Subscriptions returns the active subscriptions in the order they were subscribed
+func (n *memoryBroker) Subscriptions() []broker.SubscriptionInfo {
+	n.mu.RLock()
+	subscribers := make([]*memorySubscriber, 0, len(n.subscribers))
+	for s := range n.subscribers {
+		subscribers = append(subscribers, s)
+	}
+	n.mu.RUnlock()
+
+	sort.Slice(subscribers, func(i, j int) bool { return subscribers[i].id < subscribers[j].id })
+
+	infos := make([]broker.SubscriptionInfo, 0, len(subscribers))
+	for _, s := range subscribers {
+		infos = append(infos, s.info())
+	}
+	return infos
+}
+
+// UnsubscribeAll unsubscribes every subscription. Undelivered messages are discarded
+func (n *memoryBroker) UnsubscribeAll() error {
+	n.mu.Lock()
+	subscribers := n.subscribers
+	n.subscribers = make(map[*memorySubscriber]struct{})
+	n.mu.Unlock()
+
+	for s := range subscribers {
+		s.close()
+	}
+	return nil
+}
+
+// unsubscribe removes the subscriber from the broker
+func (n *memoryBroker) unsubscribe(s *memorySubscriber) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if _, ok := n.subscribers[s]; !ok {
+		return false
+	}
+	delete(n.subscribers, s)
+	return true
+}
+
+// addPending marks a delivery as queued
+func (n *memoryBroker) addPending() {
+	n.pendingMux.Lock()
+	if n.pending == 0 {
+		n.idle = make(chan struct{})
+	}
+	n.pending++
+	n.pendingMux.Unlock()
+}
+
+// donePending marks count deliveries as handled
+func (n *memoryBroker) donePending(count int) {
+	if count == 0 {
+		return
+	}
+	n.pendingMux.Lock()
+	n.pending -= count
+	if n.pending == 0 {
+		close(n.idle)
+	}
+	n.pendingMux.Unlock()
+}
+
+// checkSubscribeOptions rejects the options the in-memory broker has no equivalent for.
+// Messages are not persisted and every subscriber has an unbounded queue
+func checkSubscribeOptions(opts broker.SubscribeOptions) error {
+	switch {
+	case opts.StartSequence > 0:
+		return broker.NotSupported("MEMORY", "StartAtSequence")
+	case !opts.StartTime.IsZero():
+		return broker.NotSupported("MEMORY", "StartAtTime")
+	case opts.Prefetch > 0:
+		return broker.NotSupported("MEMORY", "Prefetch")
+	case opts.BufferSize > 0:
+		return broker.NotSupported("MEMORY", "BufferSize")
+	}
+	return opts.CheckNative("MEMORY")
+}
+
+// New returns a new in-memory broker
+func New() Broker {
+	return &memoryBroker{
+		subscribers: make(map[*memorySubscriber]struct{}),
+		roundRobin:  make(map[string]int),
+		scheduled:   make(map[string]*time.Timer),
+	}
+}
@@ -0,0 +1,931 @@
+package memory
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/adityak368/ego/broker"
+	proto "github.com/adityak368/ego/broker/proto/gen/broker"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+const timeout = 5 * time.Second
+
+func TestMemory(t *testing.T) {
+
+	r := require.New(t)
+
+	var mu sync.Mutex
+	received := map[string][]string{}
+	record := func(key, value string) {
+		mu.Lock()
+		defer mu.Unlock()
+		received[key] = append(received[key], value)
+	}
+
+	// msg is a raw message
+	OnTestMessageRaw := func(ctx context.Context, msg []byte) error {
+		record("raw", string(msg))
+		return nil
+	}
+
+	// TestMessage is a protobuf message
+	OnTestMessageProto := func(ctx context.Context, msg *proto.TestMessage) error {
+		record("proto", msg.Data)
+		return nil
+	}
+
+	// TestMessage is a protobuf message
+	OnTestMessageProtoWithError := func(ctx context.Context, msg *proto.TestMessage) error {
+		record("error", msg.Data)
+		return errors.New("Something went wrong")
+	}
+
+	OnWildcard := func(ctx context.Context, msg *proto.TestMessage) error {
+		record("wildcard", msg.Data)
+		return nil
+	}
+
+	OnFullWildcard := func(ctx context.Context, msg []byte) error {
+		record("fullwildcard", string(msg))
+		return nil
+	}
+
+	bkr := New()
+	bkr.Init(broker.Options{
+		Name: "Memory",
+	})
+
+	err := bkr.Publish("test.testMessageProto", &proto.TestMessage{Data: "Test"})
+	r.NotNil(err, "Publish should fail when not connected")
+
+	err = bkr.Connect()
+	r.Nil(err)
+
+	subscriptionRaw, err := bkr.SubscribeRaw("test.testMessageRaw", OnTestMessageRaw)
+	r.Nil(err)
+	r.NotNil(subscriptionRaw)
+	subscriptionProto, err := bkr.Subscribe("test.testMessageProto", OnTestMessageProto)
+	r.Nil(err)
+	r.NotNil(subscriptionProto)
+	subscriptionProtoWithError, err := bkr.Subscribe("test.testMessageProtoWithError", OnTestMessageProtoWithError)
+	r.Nil(err)
+	r.NotNil(subscriptionProtoWithError)
+	subscriptionWildcard, err := bkr.Subscribe("test.*", OnWildcard)
+	r.Nil(err)
+	r.NotNil(subscriptionWildcard)
+	subscriptionFullWildcard, err := bkr.SubscribeRaw("test.>", OnFullWildcard)
+	r.Nil(err)
+	r.NotNil(subscriptionFullWildcard)
+
+	r.Equal(subscriptionRaw.Topic(), "test.testMessageRaw", "test.testMessageRaw subscription error")
+	r.Equal(subscriptionProto.Topic(), "test.testMessageProto", "test.testMessageProto subscription error")
+	r.Equal(subscriptionProtoWithError.Topic(), "test.testMessageProtoWithError", "test.testMessageProtoWithError subscription error")
+
+	_, err = bkr.Subscribe("test.invalid", func(msg *proto.TestMessage) error { return nil })
+	r.NotNil(err, "Handler without context should be rejected")
+	_, err = bkr.Subscribe("test.invalid", func(ctx context.Context, msg string) error { return nil })
+	r.NotNil(err, "Non pointer message should be rejected")
+	_, err = bkr.SubscribeRaw("test.>.invalid", OnTestMessageRaw)
+	r.NotNil(err, "Invalid wildcard should be rejected")
+
+	err = bkr.PublishRaw("test.testMessageRaw", []byte("Test"))
+	r.Nil(err)
+	for _, data := range []string{"1", "2", "3"} {
+		err = bkr.Publish("test.testMessageProto", &proto.TestMessage{Data: data})
+		r.Nil(err)
+	}
+	err = bkr.Publish("test.testMessageProtoWithError", &proto.TestMessage{Data: "Test"})
+	r.Nil(err)
+	err = bkr.PublishRaw("test.nested.topic", []byte("Nested"))
+	r.Nil(err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	r.Nil(bkr.Flush(ctx))
+
+	mu.Lock()
+	r.Equal([]string{"Test"}, received["raw"])
+	r.Equal([]string{"1", "2", "3"}, received["proto"], "Messages should be delivered in order")
+	r.Equal([]string{"Test"}, received["error"])
+	r.Len(received["wildcard"], 4)
+	r.Len(received["fullwildcard"], 6)
+	r.Contains(received["fullwildcard"], "Nested")
+	mu.Unlock()
+
+	r.Nil(subscriptionProto.Unsubscribe())
+	r.NotNil(subscriptionProto.Unsubscribe(), "Unsubscribing twice should fail")
+
+	err = bkr.Publish("test.testMessageProto", &proto.TestMessage{Data: "4"})
+	r.Nil(err)
+	r.Nil(bkr.Flush(ctx))
+
+	mu.Lock()
+	r.Equal([]string{"1", "2", "3"}, received["proto"], "Unsubscribed handler should not receive messages")
+	mu.Unlock()
+
+	r.Nil(bkr.Disconnect())
+	r.NotNil(bkr.PublishRaw("test.testMessageRaw", []byte("Test")))
+}
+
+func TestMemoryFlushWaitsForNestedPublishes(t *testing.T) {
+
+	r := require.New(t)
+
+	bkr := New()
+	bkr.Init(broker.Options{Name: "Memory"})
+	r.Nil(bkr.Connect())
+	defer bkr.Disconnect()
+
+	done := make(chan bool, 1)
+
+	_, err := bkr.SubscribeRaw("test.first", func(ctx context.Context, msg []byte) error {
+		time.Sleep(10 * time.Millisecond)
+		return bkr.PublishRaw("test.second", msg)
+	})
+	r.Nil(err)
+
+	_, err = bkr.SubscribeRaw("test.second", func(ctx context.Context, msg []byte) error {
+		time.Sleep(10 * time.Millisecond)
+		done <- true
+		return nil
+	})
+	r.Nil(err)
+
+	r.Nil(bkr.PublishRaw("test.first", []byte("Test")))
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	r.Nil(bkr.Flush(ctx))
+
+	select {
+	case <-done:
+	default:
+		t.Error("Flush returned before the nested message was handled")
+	}
+}
+
+func TestMemoryMessage(t *testing.T) {
+
+	r := require.New(t)
+
+	bkr := New()
+	bkr.Init(broker.Options{Name: "Memory"})
+	r.Nil(bkr.Connect())
+	defer bkr.Disconnect()
+
+	var received *broker.Message
+	var data *proto.TestMessage
+
+	_, err := bkr.Subscribe("test.envelope", func(ctx context.Context, msg *proto.TestMessage, m *broker.Message) error {
+		data = msg
+		received = m
+		return nil
+	})
+	r.Nil(err)
+
+	_, err = bkr.Subscribe("test.envelope", func(ctx context.Context, msg *proto.TestMessage, m string) error { return nil })
+	r.NotNil(err, "Third parameter should be the envelope")
+
+	err = bkr.PublishMessage("test.envelope", &broker.Message{
+		CorrelationID: "correlation",
+		Header:        map[string]string{"Tenant": "ego"},
+		Data:          &proto.TestMessage{Data: "Test"},
+	})
+	r.Nil(err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	r.Nil(bkr.Flush(ctx))
+
+	r.NotNil(received)
+	r.Equal("Test", data.Data)
+	r.NotEmpty(received.ID)
+	r.False(received.Timestamp.IsZero())
+	r.Equal(broker.ContentTypeProtobuf, received.ContentType)
+	r.Equal("correlation", received.CorrelationID)
+	r.Equal("ego", received.Header["Tenant"])
+	r.Equal("test.envelope", received.Topic)
+	r.Equal(data, received.Data)
+}
+
+func TestMemoryContext(t *testing.T) {
+
+	r := require.New(t)
+
+	bkr := New()
+	bkr.Init(broker.Options{Name: "Memory"})
+	r.Nil(bkr.Connect())
+
+	started := make(chan context.Context, 1)
+	release := make(chan bool)
+
+	subscription, err := bkr.SubscribeRaw("test.context", func(ctx context.Context, msg []byte) error {
+		started <- ctx
+		<-release
+		return nil
+	}, broker.HandlerTimeout(time.Minute))
+	r.Nil(err)
+
+	r.Nil(bkr.PublishMessage("test.context", &broker.Message{CorrelationID: "correlation", Body: []byte("Test")}))
+
+	var ctx context.Context
+	select {
+	case ctx = <-started:
+	case <-time.After(timeout):
+		t.Fatal("Timed out waiting for message from broker")
+	}
+
+	m, ok := broker.FromContext(ctx)
+	r.True(ok, "Context should carry the envelope")
+	r.Equal("correlation", m.CorrelationID)
+
+	_, ok = ctx.Deadline()
+	r.True(ok, "Context should carry the processing deadline")
+	r.Nil(ctx.Err())
+
+	r.Nil(subscription.Unsubscribe())
+	r.Equal(context.Canceled, ctx.Err(), "Context should be cancelled on Unsubscribe")
+	close(release)
+
+	_, err = bkr.SubscribeRaw("test.context", func(ctx context.Context, msg []byte) error {
+		started <- ctx
+		return nil
+	})
+	r.Nil(err)
+
+	r.Nil(bkr.PublishRaw("test.context", []byte("Test")))
+	select {
+	case ctx = <-started:
+	case <-time.After(timeout):
+		t.Fatal("Timed out waiting for message from broker")
+	}
+
+	_, ok = ctx.Deadline()
+	r.False(ok, "Context should not have a deadline by default")
+
+	r.Nil(bkr.Disconnect())
+	r.Equal(context.Canceled, ctx.Err(), "Context should be cancelled on Disconnect")
+}
+
+func TestMemoryQueueGroups(t *testing.T) {
+
+	r := require.New(t)
+
+	bkr := New()
+	bkr.Init(broker.Options{Name: "Memory"})
+	r.Nil(bkr.Connect())
+	defer bkr.Disconnect()
+
+	var mu sync.Mutex
+	received := map[string]int{}
+	handler := func(name string) func(ctx context.Context, msg []byte) error {
+		return func(ctx context.Context, msg []byte) error {
+			mu.Lock()
+			defer mu.Unlock()
+			received[name]++
+			return nil
+		}
+	}
+
+	// replicas of the same service join the queue group named after the service
+	_, err := bkr.SubscribeRaw("test.queue", handler("replica1"))
+	r.Nil(err)
+	_, err = bkr.SubscribeRaw("test.queue", handler("replica2"))
+	r.Nil(err)
+	_, err = bkr.SubscribeRaw("test.queue", handler("worker1"), broker.Queue("workers"))
+	r.Nil(err)
+	_, err = bkr.SubscribeRaw("test.queue", handler("worker2"), broker.Queue("workers"))
+	r.Nil(err)
+	_, err = bkr.SubscribeRaw("test.queue", handler("broadcast"), broker.Broadcast())
+	r.Nil(err)
+
+	for i := 0; i < 10; i++ {
+		r.Nil(bkr.PublishRaw("test.queue", []byte("Test")))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	r.Nil(bkr.Flush(ctx))
+
+	mu.Lock()
+	defer mu.Unlock()
+	r.Equal(10, received["replica1"]+received["replica2"], "Each message should be handled once per queue group")
+	r.Equal(10, received["worker1"]+received["worker2"], "Each message should be handled once per queue group")
+	r.Equal(5, received["worker1"], "Messages should be distributed across the queue group")
+	r.Equal(10, received["broadcast"], "Broadcast subscriber should receive every message")
+}
+
+func TestMemoryRequest(t *testing.T) {
+
+	r := require.New(t)
+
+	bkr := New()
+	bkr.Init(broker.Options{Name: "Memory"})
+	r.Nil(bkr.Connect())
+	defer bkr.Disconnect()
+
+	OnEcho := func(ctx context.Context, req *proto.TestMessage) (*proto.TestMessage, error) {
+		if req.Data == "fail" {
+			return nil, errors.New("Something went wrong")
+		}
+		return &proto.TestMessage{Data: "Echo " + req.Data}, nil
+	}
+
+	_, err := bkr.Subscribe("test.echo", OnEcho)
+	r.Nil(err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	resp := &proto.TestMessage{}
+	r.Nil(bkr.Request(ctx, "test.echo", &proto.TestMessage{Data: "Test"}, resp))
+	r.Equal("Echo Test", resp.Data)
+
+	err = bkr.Request(ctx, "test.echo", &proto.TestMessage{Data: "fail"}, resp)
+	r.EqualError(err, "Something went wrong", "Responder errors should be returned to the requester")
+
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	err = bkr.Request(ctx, "test.nobody", &proto.TestMessage{Data: "Test"}, resp)
+	r.True(errors.Is(err, context.DeadlineExceeded), "Request should time out without a responder")
+
+	_, err = bkr.Subscribe("test.invalid", func(ctx context.Context, req *proto.TestMessage) (string, error) {
+		return "", nil
+	})
+	r.NotNil(err)
+}
+
+func TestMemoryRetry(t *testing.T) {
+
+	r := require.New(t)
+
+	bkr := New()
+	bkr.Init(broker.Options{Name: "Memory"})
+	r.Nil(bkr.Connect())
+	defer bkr.Disconnect()
+
+	var mu sync.Mutex
+	attempts := map[string]int{}
+
+	// fails until the third attempt for 'flaky' and always for 'broken'
+	OnTestMessageRaw := func(ctx context.Context, msg []byte) error {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts[string(msg)]++
+		if string(msg) == "flaky" && attempts["flaky"] == 3 {
+			return nil
+		}
+		return errors.New("Something went wrong")
+	}
+
+	dead := make(chan *broker.Message, 2)
+	_, err := bkr.SubscribeRaw("test.dead", func(ctx context.Context, msg []byte) error {
+		m, _ := broker.FromContext(ctx)
+		dead <- m
+		return nil
+	})
+	r.Nil(err)
+
+	_, err = bkr.SubscribeRaw("test.retry", OnTestMessageRaw, broker.Retry(broker.RetryPolicy{
+		MaxAttempts:     3,
+		Backoff:         10 * time.Millisecond,
+		MaxBackoff:      20 * time.Millisecond,
+		Jitter:          0.2,
+		DeadLetterTopic: "test.dead",
+	}))
+	r.Nil(err)
+
+	r.Nil(bkr.PublishRaw("test.retry", []byte("flaky")))
+	r.Nil(bkr.PublishMessage("test.retry", &broker.Message{
+		ID:            "broken",
+		CorrelationID: "correlation",
+		Header:        map[string]string{"Tenant": "ego"},
+		Body:          []byte("broken"),
+	}))
+
+	select {
+	case m := <-dead:
+		r.Equal([]byte("broken"), m.Body, "Dead letter should carry the original payload")
+		r.Equal("correlation", m.CorrelationID)
+		r.Equal("ego", m.Header["Tenant"])
+		r.Equal("Something went wrong", m.Header[broker.HeaderError])
+		r.Equal("3", m.Header[broker.HeaderAttempts])
+		r.Equal("broken", m.Header[broker.HeaderOriginalID])
+		r.Equal("test.retry", m.Header[broker.HeaderOriginalTopic])
+	case <-time.After(timeout):
+		t.Fatal("Timed out waiting for dead letter")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	r.Nil(bkr.Flush(ctx))
+
+	mu.Lock()
+	defer mu.Unlock()
+	r.Equal(3, attempts["flaky"], "Successful attempt should not be retried")
+	r.Equal(3, attempts["broken"], "Message should not be handled more than MaxAttempts times")
+	r.Len(dead, 0, "Only exhausted messages should be dead lettered")
+}
+
+func TestMemoryDedup(t *testing.T) {
+
+	r := require.New(t)
+
+	bkr := New()
+	bkr.Init(broker.Options{Name: "Memory"})
+	r.Nil(bkr.Connect())
+	defer bkr.Disconnect()
+
+	var mu sync.Mutex
+	handled := map[string]int{}
+	handler := func(name string) func(ctx context.Context, msg []byte) error {
+		return func(ctx context.Context, msg []byte) error {
+			mu.Lock()
+			defer mu.Unlock()
+			handled[name+" "+string(msg)]++
+			// the first delivery of 'flaky' fails
+			if string(msg) == "flaky" && handled[name+" flaky"] == 1 {
+				return errors.New("Something went wrong")
+			}
+			return nil
+		}
+	}
+
+	store := broker.NewMemoryDedupStore(100, time.Hour)
+	_, err := bkr.SubscribeRaw("test.dedup", handler("orders"), broker.Dedup(store))
+	r.Nil(err)
+	_, err = bkr.SubscribeRaw("test.dedup", handler("billing"), broker.Dedup(store), broker.Queue("billing"))
+	r.Nil(err)
+	for _, name := range []string{"audit", "metrics"} {
+		_, err = bkr.SubscribeRaw("test.dedup", handler(name), broker.Dedup(store), broker.Broadcast())
+		r.Nil(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// the redeliveries of a message carry its id
+	for _, body := range []string{"once", "once", "flaky", "flaky", "flaky"} {
+		r.Nil(bkr.PublishMessage("test.dedup", &broker.Message{ID: body, Body: []byte(body)}))
+		r.Nil(bkr.Flush(ctx))
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	r.Equal(1, handled["orders once"], "Processed messages should be skipped")
+	r.Equal(1, handled["billing once"], "Every queue group should handle the message")
+	r.Equal(2, handled["orders flaky"], "Failed messages should not be recorded")
+	r.Equal(2, handled["billing flaky"])
+	r.Equal(1, handled["audit once"], "Every broadcast subscriber should handle the message")
+	r.Equal(1, handled["metrics once"], "Every broadcast subscriber should handle the message")
+}
+
+func TestMemoryDedupConcurrent(t *testing.T) {
+
+	r := require.New(t)
+
+	bkr := New()
+	bkr.Init(broker.Options{Name: "Memory"})
+	r.Nil(bkr.Connect())
+	defer bkr.Disconnect()
+
+	var mu sync.Mutex
+	handled := 0
+	release := make(chan struct{})
+	_, err := bkr.SubscribeRaw("test.dedupConcurrent", func(ctx context.Context, msg []byte) error {
+		mu.Lock()
+		handled++
+		mu.Unlock()
+		<-release
+		return nil
+	}, broker.Dedup(broker.NewMemoryDedupStore(100, time.Hour)), broker.Concurrency(2))
+	r.Nil(err)
+
+	// the duplicate arrives while the first delivery is processed
+	r.Nil(bkr.PublishMessage("test.dedupConcurrent", &broker.Message{ID: "once", Body: []byte("once")}))
+	r.Eventually(func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return handled == 1
+	}, timeout, time.Millisecond)
+	r.Nil(bkr.PublishMessage("test.dedupConcurrent", &broker.Message{ID: "once", Body: []byte("once")}))
+	r.Eventually(func() bool {
+		return bkr.Subscriptions()[0].Stats.Failed == 1
+	}, timeout, time.Millisecond, "The duplicate should fail while the message is processed")
+	close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	r.Nil(bkr.PublishMessage("test.dedupConcurrent", &broker.Message{ID: "once", Body: []byte("once")}))
+	r.Nil(bkr.Flush(ctx))
+
+	mu.Lock()
+	defer mu.Unlock()
+	r.Equal(1, handled, "Concurrent duplicates should be handled once")
+}
+
+func TestMemorySchedule(t *testing.T) {
+
+	r := require.New(t)
+
+	bkr := New()
+	bkr.Init(broker.Options{Name: "Memory"})
+	r.Nil(bkr.Connect())
+	defer bkr.Disconnect()
+
+	c := make(chan string, 2)
+	_, err := bkr.SubscribeRaw("test.schedule", func(ctx context.Context, msg []byte) error {
+		c <- string(msg)
+		return nil
+	})
+	r.Nil(err)
+
+	start := time.Now()
+	r.Nil(bkr.PublishRaw("test.schedule", []byte("cancelled"), broker.WithMessageID("reminder"), broker.PublishAfter(50*time.Millisecond)))
+	r.Nil(bkr.PublishRaw("test.schedule", []byte("delayed"), broker.PublishAt(start.Add(100*time.Millisecond))))
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	r.Nil(broker.Cancel(ctx, bkr, "reminder"))
+	r.True(errors.Is(broker.Cancel(ctx, bkr, "reminder"), broker.ErrNotScheduled))
+
+	select {
+	case msg := <-c:
+		r.Equal("delayed", msg, "Cancelled messages should not be delivered")
+		r.True(time.Since(start) >= 100*time.Millisecond, "Scheduled messages should be delivered when due")
+	case <-time.After(timeout):
+		t.Fatal("Timed out waiting for the scheduled message")
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	r.Len(c, 0)
+}
+
+func TestMemoryMiddleware(t *testing.T) {
+
+	r := require.New(t)
+
+	var mu sync.Mutex
+	calls := []string{}
+	record := func(name string) broker.Middleware {
+		return func(h broker.HandlerFunc) broker.HandlerFunc {
+			return func(ctx context.Context, m *broker.Message) error {
+				mu.Lock()
+				calls = append(calls, name+" "+m.Topic)
+				mu.Unlock()
+				return h(ctx, m)
+			}
+		}
+	}
+
+	bkr := New()
+	bkr.Init(broker.Options{
+		Name:       "Memory",
+		Middleware: []broker.Middleware{record("global")},
+	})
+	r.Nil(bkr.Connect())
+	defer bkr.Disconnect()
+
+	_, err := bkr.Subscribe("test.proto", func(ctx context.Context, msg *proto.TestMessage) error {
+		mu.Lock()
+		calls = append(calls, "handler "+msg.Data)
+		mu.Unlock()
+		return nil
+	}, broker.WrapHandler(record("subscription")))
+	r.Nil(err)
+
+	_, err = bkr.SubscribeRaw("test.raw", func(ctx context.Context, msg []byte) error {
+		panic("Something went wrong")
+	}, broker.WrapHandler(record("subscription")))
+	r.Nil(err)
+
+	r.Nil(bkr.Publish("test.proto", &proto.TestMessage{Data: "Test"}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	r.Nil(bkr.Flush(ctx))
+
+	// the panic is recovered and the subscriber keeps receiving messages
+	r.Nil(bkr.PublishRaw("test.raw", []byte("Test")))
+	r.Nil(bkr.PublishRaw("test.raw", []byte("Test")))
+	r.Nil(bkr.Flush(ctx))
+
+	mu.Lock()
+	defer mu.Unlock()
+	r.Equal([]string{
+		"global test.proto",
+		"subscription test.proto",
+		"handler Test",
+		"global test.raw",
+		"subscription test.raw",
+		"global test.raw",
+		"subscription test.raw",
+	}, calls)
+}
+
+func TestMemoryCodecs(t *testing.T) {
+
+	r := require.New(t)
+
+	// Order is a plain Go struct which is exchanged as JSON or MessagePack
+	type Order struct {
+		ID    string `json:"id" msgpack:"id"`
+		Total int    `json:"total" msgpack:"total"`
+	}
+
+	bkr := New()
+	bkr.Init(broker.Options{
+		Name:  "Memory",
+		Codec: broker.ProtoJSONCodec{},
+	})
+	r.Nil(bkr.Connect())
+	defer bkr.Disconnect()
+
+	orders := make(chan *broker.Message, 2)
+	_, err := bkr.Subscribe("test.orders", func(ctx context.Context, order *Order, m *broker.Message) error {
+		r.Equal(Order{ID: "order", Total: 42}, *order)
+		orders <- m
+		return nil
+	})
+	r.Nil(err)
+
+	protos := make(chan *broker.Message, 1)
+	_, err = bkr.Subscribe("test.proto", func(ctx context.Context, msg *proto.TestMessage, m *broker.Message) error {
+		r.Equal("Test", msg.Data)
+		protos <- m
+		return nil
+	})
+	r.Nil(err)
+
+	// the codec of the broker is used unless the content type is set on publish
+	r.Nil(bkr.Publish("test.proto", &proto.TestMessage{Data: "Test"}))
+	r.Nil(bkr.PublishMessage("test.orders", &broker.Message{
+		ContentType: broker.ContentTypeJSON,
+		Data:        &Order{ID: "order", Total: 42},
+	}))
+	r.Nil(bkr.PublishMessage("test.orders", &broker.Message{
+		ContentType: broker.ContentTypeMsgpack,
+		Data:        &Order{ID: "order", Total: 42},
+	}))
+
+	for _, contentType := range []string{broker.ContentTypeJSON, broker.ContentTypeMsgpack} {
+		select {
+		case m := <-orders:
+			r.Equal(contentType, m.ContentType)
+		case <-time.After(timeout):
+			t.Fatal("Timed out waiting for message from broker")
+		}
+	}
+
+	select {
+	case m := <-protos:
+		r.Equal(broker.ContentTypeProtoJSON, m.ContentType)
+		r.JSONEq(`{"Data": "Test"}`, string(m.Body))
+	case <-time.After(timeout):
+		t.Fatal("Timed out waiting for message from broker")
+	}
+
+	// messages from non Go services carry parameters in the content type
+	r.Nil(bkr.PublishMessage("test.orders", &broker.Message{
+		ContentType: "application/json; charset=utf-8",
+		Body:        []byte(`{"id": "order", "total": 42}`),
+	}))
+	select {
+	case <-orders:
+	case <-time.After(timeout):
+		t.Fatal("Timed out waiting for message from broker")
+	}
+
+	err = bkr.PublishMessage("test.orders", &broker.Message{
+		ContentType: "application/xml",
+		Data:        &Order{ID: "order", Total: 42},
+	})
+	r.NotNil(err, "Publishing with an unknown content type should fail")
+}
+
+func TestMemoryTyped(t *testing.T) {
+
+	r := require.New(t)
+
+	bkr := New()
+	bkr.Init(broker.Options{Name: "Memory"})
+	r.Nil(bkr.Connect())
+	defer bkr.Disconnect()
+
+	c := make(chan *broker.Message, 1)
+	_, err := broker.SubscribeTyped(bkr, "test.typed", func(ctx context.Context, msg *proto.TestMessage) error {
+		r.Equal("Test", msg.Data)
+		m, _ := broker.FromContext(ctx)
+		c <- m
+		return nil
+	})
+	r.Nil(err)
+
+	r.Nil(broker.PublishTyped(bkr, "test.typed", &proto.TestMessage{Data: "Test"}))
+
+	select {
+	case m := <-c:
+		msg, ok := m.Data.(*proto.TestMessage)
+		r.True(ok, "Envelope should carry the decoded message")
+		r.Equal("Test", msg.Data)
+	case <-time.After(timeout):
+		t.Fatal("Timed out waiting for message from broker")
+	}
+
+	_, err = broker.RespondTyped(bkr, "test.typed.echo", func(ctx context.Context, req *proto.TestMessage) (*proto.TestMessage, error) {
+		if req.Data == "fail" {
+			return nil, errors.New("Something went wrong")
+		}
+		return &proto.TestMessage{Data: "Echo " + req.Data}, nil
+	})
+	r.Nil(err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	resp := &proto.TestMessage{}
+	r.Nil(bkr.Request(ctx, "test.typed.echo", &proto.TestMessage{Data: "Test"}, resp))
+	r.Equal("Echo Test", resp.Data)
+
+	err = bkr.Request(ctx, "test.typed.echo", &proto.TestMessage{Data: "fail"}, resp)
+	r.EqualError(err, "Something went wrong")
+
+	subscriptions := bkr.Subscriptions()
+	r.Len(subscriptions, 2)
+	r.Equal("func(context.Context, *broker.TestMessage) error", subscriptions[0].Handler, "Typed handlers should report their own type")
+	r.Equal("func(context.Context, *broker.TestMessage) (*broker.TestMessage, error)", subscriptions[1].Handler)
+}
+
+func TestMemoryOptions(t *testing.T) {
+
+	r := require.New(t)
+
+	bkr := New()
+	bkr.Init(broker.Options{Name: "Memory"})
+	r.Nil(bkr.Connect())
+	defer bkr.Disconnect()
+
+	c := make(chan *broker.Message, 1)
+	_, err := bkr.SubscribeRaw("test.options", func(ctx context.Context, msg []byte) error {
+		m, _ := broker.FromContext(ctx)
+		c <- m
+		return nil
+	}, broker.Concurrency(2), broker.AutoAck())
+	r.Nil(err)
+
+	err = bkr.Publish("test.options", &proto.TestMessage{Data: "Test"},
+		broker.WithHeader("Tenant", "ego"),
+		broker.WithCorrelationID("correlation"),
+		broker.WithMessageID("id"),
+		broker.WithCodec(broker.JSONCodec{}),
+	)
+	r.Nil(err)
+
+	select {
+	case m := <-c:
+		r.Equal("ego", m.Header["Tenant"])
+		r.Equal("correlation", m.CorrelationID)
+		r.Equal("id", m.ID)
+		r.Equal(broker.ContentTypeJSON, m.ContentType)
+	case <-time.After(timeout):
+		t.Fatal("Timed out waiting for message from broker")
+	}
+
+	// options without an in-memory equivalent are rejected
+	err = bkr.PublishRaw("test.options", []byte("Test"), broker.TTL(time.Minute))
+	r.True(errors.Is(err, broker.ErrNotSupported), "TTL should be rejected")
+
+	_, err = bkr.SubscribeRaw("test.options", func(ctx context.Context, msg []byte) error {
+		return nil
+	}, broker.StartAtSequence(1))
+	r.True(errors.Is(err, broker.ErrNotSupported), "Start positions should be rejected")
+
+	_, err = bkr.SubscribeRaw("test.options", func(ctx context.Context, msg []byte) error {
+		return nil
+	}, broker.NativeOption("rabbitmq.exclusive", true))
+	r.True(errors.Is(err, broker.ErrNotSupported), "Options of other brokers should be rejected")
+
+	err = bkr.PublishRaw("test.options", []byte("Test"), broker.NativePublishOption("mqtt.retained", true))
+	r.True(errors.Is(err, broker.ErrNotSupported), "Publish options of other brokers should be rejected")
+}
+
+func TestMemoryDrain(t *testing.T) {
+
+	r := require.New(t)
+
+	bkr := New()
+	bkr.Init(broker.Options{Name: "Memory"})
+	r.Nil(bkr.Connect())
+
+	release := make(chan bool)
+	_, err := bkr.SubscribeRaw("test.drain", func(ctx context.Context, msg []byte) error {
+		<-release
+		return nil
+	})
+	r.Nil(err)
+	r.Nil(bkr.PublishRaw("test.drain", []byte("Test")))
+
+	// the handler is blocked, so the drain times out and the broker disconnects anyway
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	drained := make(chan error, 1)
+	go func() { drained <- bkr.Drain(ctx) }()
+	r.Eventually(func() bool {
+		err := bkr.PublishRaw("test.drain", []byte("Test"))
+		return err != nil && strings.Contains(err.Error(), "draining")
+	}, timeout, time.Millisecond, "Publishes should be rejected while draining")
+	r.True(errors.Is(<-drained, context.DeadlineExceeded))
+	close(release)
+	r.NotNil(bkr.PublishRaw("test.drain", []byte("Test")), "Broker should be disconnected")
+
+	r.Nil(bkr.Connect())
+	var mu sync.Mutex
+	handled := 0
+	_, err = bkr.SubscribeRaw("test.drain", func(ctx context.Context, msg []byte) error {
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		defer mu.Unlock()
+		handled++
+		return nil
+	})
+	r.Nil(err)
+
+	for i := 0; i < 5; i++ {
+		r.Nil(bkr.PublishRaw("test.drain", []byte("Test")))
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	r.Nil(bkr.Drain(ctx))
+
+	mu.Lock()
+	defer mu.Unlock()
+	r.Equal(5, handled, "Drain should wait for the published messages")
+}
+
+func TestMemoryStatus(t *testing.T) {
+
+	r := require.New(t)
+
+	bkr := New()
+	bkr.Init(broker.Options{Name: "Memory"})
+	notify := bkr.NotifyStatus()
+	r.Equal(broker.StatusDisconnected, bkr.Status())
+
+	r.Nil(bkr.Connect())
+	r.Equal(broker.StatusConnected, bkr.Status())
+	r.Nil(bkr.Disconnect())
+	r.Equal(broker.StatusClosed, bkr.Status())
+
+	r.Equal(broker.StatusConnected, <-notify)
+	r.Equal(broker.StatusClosed, <-notify)
+}
+
+func TestMemorySubscriptions(t *testing.T) {
+
+	r := require.New(t)
+
+	bkr := New()
+	bkr.Init(broker.Options{Name: "Memory"})
+	r.Nil(bkr.Connect())
+	defer bkr.Disconnect()
+
+	first, err := bkr.SubscribeRaw("test.subscriptions", func(ctx context.Context, msg []byte) error {
+		return nil
+	}, broker.Broadcast())
+	r.Nil(err)
+	second, err := bkr.Subscribe("test.subscriptions", func(ctx context.Context, msg *proto.TestMessage) error {
+		return errors.New("Something went wrong")
+	}, broker.Broadcast())
+	r.Nil(err)
+	r.NotEqual(first.ID(), second.ID(), "Subscriptions of the same topic should have unique ids")
+
+	r.Nil(bkr.Publish("test.subscriptions", &proto.TestMessage{Data: "Test"}))
+	r.Nil(bkr.Flush(context.Background()))
+
+	subscriptions := bkr.Subscriptions()
+	r.Len(subscriptions, 2, "The second subscription should not replace the first")
+	r.Equal(first.ID(), subscriptions[0].ID)
+	r.Equal("test.subscriptions", subscriptions[0].Topic)
+	r.Equal("func(context.Context, []uint8) error", subscriptions[0].Handler)
+	r.Equal(broker.SubscriptionStats{Received: 1, Handled: 1, LastReceived: subscriptions[0].Stats.LastReceived}, subscriptions[0].Stats)
+	r.False(subscriptions[0].Stats.LastReceived.IsZero())
+	r.Equal("func(context.Context, *broker.TestMessage) error", subscriptions[1].Handler)
+	r.Equal(uint64(1), subscriptions[1].Stats.Failed)
+
+	r.Nil(first.Unsubscribe())
+	subscriptions = bkr.Subscriptions()
+	r.Len(subscriptions, 1)
+	r.Equal(second.ID(), subscriptions[0].ID)
+
+	r.Nil(bkr.UnsubscribeAll())
+	r.Empty(bkr.Subscriptions())
+	r.NotNil(second.Unsubscribe(), "UnsubscribeAll should unsubscribe every subscription")
+	r.Nil(bkr.PublishRaw("test.subscriptions", []byte("Test")), "Broker should stay connected")
+}
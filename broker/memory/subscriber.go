@@ -0,0 +1,165 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/adityak368/ego/broker"
+	"github.com/adityak368/swissknife/logger/v2"
+)
+
+type memorySubscriber struct {
+	id      uint64
+	topic   string
+	group   string
+	handler broker.HandlerFunc
+	// handlerType is the type of the subscribed handler
+	handlerType string
+	subscribed  time.Time
+	options     broker.SubscribeOptions
+	broker      *memoryBroker
+	ctx         context.Context
+	cancel      context.CancelFunc
+	workers     *broker.Workers
+	stats       broker.StatsCounter
+
+	queue  []*broker.Message
+	closed bool
+	mu     sync.Mutex
+	signal chan struct{}
+	done   chan struct{}
+}
+
+// ID returns the unique id of the subscription
+func (s *memorySubscriber) ID() string {
+	return strconv.FormatUint(s.id, 10)
+}
+
+// Topic returns the subscribed topic
+func (s *memorySubscriber) Topic() string {
+	return s.topic
+}
+
+// info describes the subscription
+func (s *memorySubscriber) info() broker.SubscriptionInfo {
+	return broker.SubscriptionInfo{
+		ID:         s.ID(),
+		Topic:      s.topic,
+		Handler:    s.handlerType,
+		Subscribed: s.subscribed,
+		Queue:      s.group,
+		Stats:      s.stats.Stats(),
+	}
+}
+
+// Unsubscribe unsubscribes to the topic
+func (s *memorySubscriber) Unsubscribe() error {
+	if !s.broker.unsubscribe(s) {
+		return fmt.Errorf("[MEMORY]: Cannot unsubscribe from %s", s.topic)
+	}
+	s.close()
+	return nil
+}
+
+// enqueue queues the message for delivery to the handler
+func (s *memorySubscriber) enqueue(m *broker.Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+
+	s.broker.addPending()
+	s.stats.Receive()
+	s.queue = append(s.queue, m)
+
+	select {
+	case s.signal <- struct{}{}:
+	default:
+	}
+}
+
+// close stops the delivery loop and discards undelivered messages
+func (s *memorySubscriber) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+	s.closed = true
+	s.cancel()
+	close(s.done)
+}
+
+// next pops the next queued message
+func (s *memorySubscriber) next() (*broker.Message, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed || len(s.queue) == 0 {
+		return nil, false
+	}
+
+	m := s.queue[0]
+	s.queue[0] = nil
+	s.queue = s.queue[1:]
+
+	// every subscriber receives its own copy of the envelope
+	return broker.MessageFromHeaders(m.Topic, m.Headers(), m.Body), true
+}
+
+// run hands the queued messages to the workers in publish order
+func (s *memorySubscriber) run() {
+	defer s.discard()
+	defer s.workers.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-s.signal:
+		}
+
+		for {
+			m, ok := s.next()
+			if !ok {
+				break
+			}
+
+			if !s.workers.Go(func() { s.deliver(m) }) {
+				s.broker.donePending(1)
+			}
+		}
+	}
+}
+
+// deliver delivers the message to the handler and publishes its response
+func (s *memorySubscriber) deliver(m *broker.Message) {
+	defer s.broker.donePending(1)
+
+	err := broker.Deliver(s.ctx, s.broker, s.handler, m, s.options)
+	s.stats.Done(err)
+	if err != nil {
+		logger.Error().Err(err).Msg("")
+	}
+	if m.ReplyTo != "" && m.Response != nil {
+		if err := s.broker.publish(m.ReplyTo, m.Response, "Reply"); err != nil {
+			logger.Error().Err(err).Msg("")
+		}
+	}
+}
+
+// discard drops the messages which were not delivered before the subscriber was closed
+func (s *memorySubscriber) discard() {
+	s.mu.Lock()
+	count := len(s.queue)
+	s.queue = nil
+	s.mu.Unlock()
+
+	s.broker.donePending(count)
+}
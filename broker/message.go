@@ -0,0 +1,195 @@
+package broker
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Header keys used to carry the message envelope over the wire
+const (
+	HeaderID            = "Ego-Id"
+	HeaderTimestamp     = "Ego-Timestamp"
+	HeaderContentType   = "Content-Type"
+	HeaderCorrelationID = "Ego-Correlation-Id"
+	HeaderReplyTo       = "Ego-Reply-To"
+	HeaderError         = "Ego-Error"
+)
+
+// Content types of the message body
+const (
+	ContentTypeProtobuf = "application/x-protobuf"
+	ContentTypeRaw      = "application/octet-stream"
+)
+
+// Message is the envelope for the data sent over the broker
+type Message struct {
+	// ID uniquely identifies the message. It is generated on publish if empty
+	ID string
+	// Timestamp is the time of publishing. It is set on publish if zero
+	Timestamp time.Time
+	// ContentType describes the encoding of the body
+	ContentType string
+	// CorrelationID relates the message to a request or a workflow
+	CorrelationID string
+	// ReplyTo is the topic the response to a request is published to
+	ReplyTo string
+	// Header holds arbitrary metadata
+	Header map[string]string
+	// Topic is the topic on which the message was received
+	Topic string
+	// Body is the encoded payload
+	Body []byte
+	// Data is the payload which is encoded into Body on publish if Body is empty. It is
+	// encoded with the codec of ContentType, or with the codec of the broker if ContentType is empty
+	Data interface{}
+	// Response is set by responder handlers and is published to ReplyTo
+	Response *Message
+}
+
+// Encode returns a copy of the message with the defaults filled in and Data encoded into Body.
+// c is the codec used when the message has no content type. It defaults to protobuf
+func (m *Message) Encode(c Codec) (*Message, error) {
+	msg := *m
+
+	if msg.ID == "" {
+		msg.ID = NewID()
+	}
+
+	if msg.Timestamp.IsZero() {
+		msg.Timestamp = time.Now()
+	}
+
+	if msg.Body == nil && msg.Data != nil {
+		if msg.ContentType != "" {
+			codec, err := CodecFor(msg.ContentType)
+			if err != nil {
+				return nil, err
+			}
+			c = codec
+		} else if c == nil {
+			c = ProtobufCodec{}
+		}
+
+		data, err := c.Marshal(msg.Data)
+		if err != nil {
+			return nil, err
+		}
+		msg.Body = data
+		msg.ContentType = c.ContentType()
+	}
+
+	if msg.ContentType == "" {
+		msg.ContentType = ContentTypeRaw
+	}
+
+	return &msg, nil
+}
+
+// Headers flattens the envelope into a single set of headers
+func (m *Message) Headers() map[string]string {
+	headers := make(map[string]string, len(m.Header)+4)
+	for k, v := range m.Header {
+		headers[k] = v
+	}
+
+	if m.ID != "" {
+		headers[HeaderID] = m.ID
+	}
+	if !m.Timestamp.IsZero() {
+		headers[HeaderTimestamp] = m.Timestamp.UTC().Format(time.RFC3339Nano)
+	}
+	if m.ContentType != "" {
+		headers[HeaderContentType] = m.ContentType
+	}
+	if m.CorrelationID != "" {
+		headers[HeaderCorrelationID] = m.CorrelationID
+	}
+	if m.ReplyTo != "" {
+		headers[HeaderReplyTo] = m.ReplyTo
+	}
+
+	return headers
+}
+
+// MessageFromHeaders builds a received message from the flattened headers and the body
+func MessageFromHeaders(topic string, headers map[string]string, body []byte) *Message {
+	m := &Message{
+		Topic:  topic,
+		Body:   body,
+		Header: make(map[string]string),
+	}
+
+	for k, v := range headers {
+		switch {
+		case strings.EqualFold(k, HeaderID):
+			m.ID = v
+		case strings.EqualFold(k, HeaderTimestamp):
+			m.Timestamp, _ = time.Parse(time.RFC3339Nano, v)
+		case strings.EqualFold(k, HeaderContentType):
+			m.ContentType = v
+		case strings.EqualFold(k, HeaderCorrelationID):
+			m.CorrelationID = v
+		case strings.EqualFold(k, HeaderReplyTo):
+			m.ReplyTo = v
+		default:
+			m.Header[k] = v
+		}
+	}
+
+	return m
+}
+
+// NewResponse returns the response to the request m. The response is encoded like the request.
+// A non nil err is sent in the HeaderError header so that the requester fails instead of waiting for a timeout
+func NewResponse(m *Message, data interface{}, err error) *Message {
+	resp := &Message{
+		CorrelationID: m.CorrelationID,
+		Data:          data,
+	}
+
+	if m.ContentType != ContentTypeRaw {
+		resp.ContentType = m.ContentType
+	}
+
+	if err != nil {
+		resp.Header = map[string]string{HeaderError: err.Error()}
+	}
+
+	if resp.Data == nil {
+		resp.Body = []byte{}
+	}
+
+	return resp
+}
+
+// DecodeResponse decodes the response to a request into resp using the codec of its content type
+func DecodeResponse(m *Message, resp interface{}) error {
+	if e, ok := m.Header[HeaderError]; ok {
+		return errors.New(e)
+	}
+
+	// responders which return no response send an empty body
+	if len(m.Body) == 0 {
+		return nil
+	}
+
+	codec, err := CodecFor(m.ContentType)
+	if err != nil {
+		return err
+	}
+
+	return codec.Unmarshal(m.Body, resp)
+}
+
+// NewID returns a new random message id
+func NewID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return time.Now().Format("20060102150405.000000000")
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,39 @@
+package broker
+
+import (
+	"context"
+	"runtime/debug"
+
+	"github.com/adityak368/swissknife/logger/v2"
+	"github.com/pkg/errors"
+)
+
+// Middleware wraps a handler to add behaviour like logging, metrics or tracing around it.
+// Typed and raw handlers are both converted to HandlerFunc so that middleware applies to both
+type Middleware func(h HandlerFunc) HandlerFunc
+
+// Chain composes the middleware into one. The first middleware is the outermost
+func Chain(mw ...Middleware) Middleware {
+	return func(h HandlerFunc) HandlerFunc {
+		for i := len(mw) - 1; i >= 0; i-- {
+			h = mw[i](h)
+		}
+		return h
+	}
+}
+
+// Recover converts a panic in the handler into an error so that it is handled like any
+// other failed delivery instead of crashing the consumer. The brokers always apply it
+func Recover() Middleware {
+	return func(h HandlerFunc) HandlerFunc {
+		return func(ctx context.Context, m *Message) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					logger.Error().Msgf("Recovered from panic in handler of '%s': %v\n%s", m.Topic, r, debug.Stack())
+					err = errors.Errorf("Handler panicked: %v", r)
+				}
+			}()
+			return h(ctx, m)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package mqtt
+
+import "time"
+
+const (
+	defaultTimeout = 10 * time.Second
+	// quiesce is how long Disconnect waits for the pending work of the client in milliseconds
+	quiesce = 250
+	// maxBacklog is the number of messages of a persistent session which are kept until
+	// their topic is subscribed again
+	maxBacklog = 1024
+)
+
+// Will is the last will the server publishes when the client disconnects unexpectedly
+type Will struct {
+	// Topic is the topic of the will in the topic syntax of the framework
+	Topic   string
+	Payload []byte
+	QoS     byte
+	// Retained keeps the will as the retained message of the topic
+	Retained bool
+}
+
+// Config is the config for the MQTT broker
+type Config struct {
+	// ClientID identifies the client and its session with the server. Defaults to the
+	// broker name followed by a random suffix. Persistent sessions need a fixed ClientID
+	ClientID string
+	// PersistentSession keeps the subscriptions and the QoS 1 and 2 messages of the client
+	// on the server while it is disconnected instead of starting a clean session
+	PersistentSession bool
+	// QoS is the quality of service of the publishes and subscriptions without a QoS option.
+	// Defaults to 0, at most once. Messages are acked when they are received, before their
+	// handler runs, so a message whose handler fails or which is lost while stopping is not
+	// delivered again whatever the QoS
+	QoS byte
+	// SharedSubscriptions tells that the server supports shared subscriptions. Subscriptions
+	// then share the subscription of their queue group ($share/<group>/<filter>), which
+	// defaults to the broker name as on the other brokers, and broadcast subscriptions use
+	// the plain filter. Without it every subscription uses the plain filter and receives
+	// every message, and broker.Queue fails with ErrNotSupported
+	SharedSubscriptions bool
+	// Will is published by the server when the client disconnects unexpectedly
+	Will *Will
+	// KeepAlive is the interval of the pings to the server. Defaults to 30 seconds
+	KeepAlive time.Duration
+	// Timeout is how long connecting, publishing and subscribing wait for the server.
+	// Defaults to 10 seconds
+	Timeout time.Duration
+	// Envelope wraps the messages into a JSON envelope carrying the headers of the message,
+	// which MQTT 3.1.1 has no place for, and is needed for requests. Without the envelope
+	// only the body is published, which is what devices expect
+	Envelope bool
+}
+
+// timeout returns the configured Timeout or its default
+func (c Config) timeout() time.Duration {
+	if c.Timeout > 0 {
+		return c.Timeout
+	}
+	return defaultTimeout
+}
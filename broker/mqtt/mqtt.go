@@ -0,0 +1,797 @@
+// Package mqtt is the MQTT 3.1.1 implementation of the broker. The tokens of the topics
+// are MQTT topic levels and the wildcards '*' and '>' are translated to '+' and '#'. Every
+// subscription receives every message of its topic, unless the server supports shared
+// subscriptions (Config.SharedSubscriptions). Queue groups are then shared subscriptions
+// ($share/<group>/<filter>), which receive no retained messages. A client receives a message once for all of its
+// filters, so a message matching both a shared and a plain filter of the client is handed
+// to the subscribers of both.
+package mqtt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/adityak368/ego/broker"
+	"github.com/adityak368/swissknife/logger/v2"
+	paho "github.com/eclipse/paho.mqtt.golang"
+)
+
+// HeaderRetained is set on the received messages which are the retained message of their topic
+const HeaderRetained = "Mqtt-Retained"
+
+// envelope is the payload of the published messages with Config.Envelope
+type envelope struct {
+	Headers map[string]string `json:"headers"`
+	Body    []byte            `json:"body"`
+}
+
+// route fans the messages of a topic filter out to its subscribers, since the client and
+// the server know every filter once. The subscribers of a shared filter take turns
+type route struct {
+	qos         byte
+	shared      bool
+	subscribers []*mqttSubscriber
+	next        int
+}
+
+// mqttBroker is the MQTT implementation of the broker
+type mqttBroker struct {
+	options         broker.Options
+	config          Config
+	client          paho.Client
+	routes          map[string]*route
+	subscriptionMap map[string]*mqttSubscriber
+	mu              sync.Mutex
+	// subscribeMu serialises the subscribes and unsubscribes of the filters
+	subscribeMu sync.Mutex
+	ctx         context.Context
+	cancel      context.CancelFunc
+	status      broker.StatusNotifier
+	// attempts is the number of reconnect attempts since the connection was lost
+	attempts int32
+	// stopping is set while disconnecting
+	stopping bool
+	// backlog holds the messages of a persistent session which arrive before their topic
+	// is subscribed again, e.g. the messages the server queued while the client was away
+	backlog []paho.Message
+}
+
+// Address Returns the broker bind interface
+func (n *mqttBroker) Address() string {
+	return n.options.Address
+}
+
+// Init initialises the broker
+func (n *mqttBroker) Init(opts broker.Options) error {
+	n.options = opts
+	return nil
+}
+
+// Options returns the broker options
+func (n *mqttBroker) Options() broker.Options {
+	return n.options
+}
+
+// String returns the description of the broker
+func (n *mqttBroker) String() string {
+	return fmt.Sprintf("[MQTT]: Connected to MQTT on %s", n.Address())
+}
+
+// Connect connects to the MQTT server
+func (n *mqttBroker) Connect() error {
+	opts, err := n.clientOptions()
+	if err != nil {
+		return err
+	}
+
+	client := paho.NewClient(opts)
+	if err := n.wait(client.Connect()); err != nil {
+		return errors.Wrapf(err, "[MQTT]: Could not connect to %s", n.Address())
+	}
+
+	n.mu.Lock()
+	n.client = client
+	n.stopping = false
+	n.mu.Unlock()
+	n.ctx, n.cancel = context.WithCancel(context.Background())
+	n.status.Set(broker.StatusConnected, n.options.OnStatus)
+	logger.Info().Msgf("[MQTT]: Connected to %s", n.Address())
+	return nil
+}
+
+// clientOptions maps the broker options and the config onto the client. The messages are
+// acked on receipt, so a message whose handler did not finish is not redelivered
+func (n *mqttBroker) clientOptions() (*paho.ClientOptions, error) {
+	switch {
+	case n.options.Token != "":
+		return nil, broker.NotSupported("MQTT", "Token")
+	case n.options.CredentialsFile != "":
+		return nil, broker.NotSupported("MQTT", "CredentialsFile")
+	case n.options.NKeySeedFile != "":
+		return nil, broker.NotSupported("MQTT", "NKeySeedFile")
+	}
+
+	clientID := n.config.ClientID
+	if clientID == "" {
+		if n.config.PersistentSession {
+			return nil, errors.New("[MQTT]: Persistent sessions need a ClientID")
+		}
+		clientID = n.options.Name + "-" + broker.NewID()[:8]
+	}
+
+	// the delay of a late attempt is the MaxBackoff of the policy or its default
+	policy := n.options.Reconnect
+	opts := paho.NewClientOptions().
+		AddBroker(n.Address()).
+		SetClientID(clientID).
+		SetCleanSession(!n.config.PersistentSession).
+		SetAutoAckDisabled(true).
+		SetConnectTimeout(n.config.timeout()).
+		SetAutoReconnect(policy.Enabled()).
+		SetMaxReconnectInterval(policy.Delay(math.MaxInt32)).
+		SetOnConnectHandler(n.onConnect).
+		SetConnectionLostHandler(n.onConnectionLost).
+		SetReconnectingHandler(n.onReconnecting)
+
+	opts.SetDefaultPublishHandler(n.dispatch)
+	if n.config.KeepAlive > 0 {
+		opts.SetKeepAlive(n.config.KeepAlive)
+	}
+	if will := n.config.Will; will != nil {
+		topic, err := toMQTTTopic(will.Topic)
+		if err != nil {
+			return nil, err
+		}
+		opts.SetBinaryWill(topic, will.Payload, will.QoS, will.Retained)
+	}
+	if n.options.TLSConfig != nil {
+		opts.SetTLSConfig(n.options.TLSConfig)
+	}
+	if n.options.Username != "" {
+		opts.SetUsername(n.options.Username)
+		opts.SetPassword(n.options.Password)
+	}
+
+	return opts, nil
+}
+
+// onConnect subscribes the filters again after a reconnect, since a clean session loses them
+func (n *mqttBroker) onConnect(client paho.Client) {
+	if atomic.SwapInt32(&n.attempts, 0) > 0 {
+		logger.Info().Msgf("[MQTT]: Reconnected to %s", n.Address())
+	}
+
+	n.mu.Lock()
+	routes := make(map[string]byte, len(n.routes))
+	for filter, r := range n.routes {
+		routes[filter] = r.qos
+	}
+	n.mu.Unlock()
+
+	for filter, qos := range routes {
+		if err := n.wait(client.Subscribe(filter, qos, nil)); err != nil {
+			logger.Error().Err(err).Msgf("[MQTT]: Could not subscribe to '%s' again", filter)
+		}
+	}
+
+	n.status.Set(broker.StatusConnected, n.options.OnStatus)
+}
+
+// onConnectionLost reports the lost connection
+func (n *mqttBroker) onConnectionLost(_ paho.Client, err error) {
+	logger.Error().Err(err).Msgf("[MQTT]: Connection to %s lost", n.Address())
+	n.status.Set(broker.StatusDisconnected, n.options.OnStatus)
+	if n.options.Reconnect.Enabled() {
+		n.status.Set(broker.StatusReconnecting, n.options.OnStatus)
+	}
+}
+
+// onReconnecting gives up reconnecting once the attempts of the reconnect policy are used up.
+// The client backs off on its own, doubling the delay up to the MaxBackoff of the policy
+func (n *mqttBroker) onReconnecting(client paho.Client, _ *paho.ClientOptions) {
+	attempt := int(atomic.AddInt32(&n.attempts, 1))
+	if !n.options.Reconnect.Exhausted(attempt) {
+		return
+	}
+
+	logger.Error().Msgf("[MQTT]: Giving up reconnecting to %s after %d attempts", n.Address(), attempt-1)
+	go func() {
+		client.Disconnect(0)
+		n.status.Set(broker.StatusClosed, n.options.OnStatus)
+	}()
+}
+
+// wait waits for the token of the client
+func (n *mqttBroker) wait(token paho.Token) error {
+	if !token.WaitTimeout(n.config.timeout()) {
+		return errors.New("[MQTT]: Timed out waiting for the server")
+	}
+	return token.Error()
+}
+
+// Disconnect stops the subscribers, waits for the handlers in flight and disconnects. Queued
+// messages which were not handled yet are dropped. The filters stay subscribed on the server,
+// so that a persistent session keeps receiving their messages until the next connect
+func (n *mqttBroker) Disconnect() error {
+
+	if n.client == nil {
+		return errors.New("[MQTT]: Cannot Disconnect. Not connected to broker")
+	}
+
+	n.stop()
+	for _, s := range n.takeSubscribers() {
+		s.close(false)
+	}
+
+	n.close()
+	return nil
+}
+
+// Drain stops the subscribers from receiving, waits until the queued messages are handled
+// and disconnects. The messages of a persistent session which arrive meanwhile are not acked,
+// so the server delivers them again on the next connect
+func (n *mqttBroker) Drain(ctx context.Context) error {
+
+	if n.client == nil {
+		return errors.New("[MQTT]: Cannot Drain. Not connected to broker")
+	}
+
+	n.stop()
+	subscribers := n.takeSubscribers()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(subscribers))
+	for _, s := range subscribers {
+		wg.Add(1)
+		go func(s *mqttSubscriber) {
+			defer wg.Done()
+			if err := s.drain(ctx); err != nil {
+				errs <- err
+			}
+		}(s)
+	}
+	wg.Wait()
+	close(errs)
+
+	n.close()
+	return <-errs
+}
+
+// stop marks the broker as stopping
+func (n *mqttBroker) stop() {
+	n.mu.Lock()
+	n.stopping = true
+	n.mu.Unlock()
+}
+
+// close disconnects the client
+func (n *mqttBroker) close() {
+	n.cancel()
+	n.client.Disconnect(quiesce)
+	n.status.Set(broker.StatusClosed, n.options.OnStatus)
+	logger.Info().Msgf("[MQTT]: Disconnected from %s", n.Address())
+}
+
+// Subscriptions returns the active subscriptions along with their stats in the order they were subscribed
+func (n *mqttBroker) Subscriptions() []broker.SubscriptionInfo {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	infos := make([]broker.SubscriptionInfo, 0, len(n.subscriptionMap))
+	for _, s := range n.subscriptionMap {
+		infos = append(infos, s.info())
+	}
+	broker.SortSubscriptions(infos)
+	return infos
+}
+
+// UnsubscribeAll unsubscribes every subscription and waits for the handlers in flight
+func (n *mqttBroker) UnsubscribeAll() error {
+	var err error
+	for _, s := range n.takeSubscribers() {
+		if closeErr := s.close(true); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// takeSubscribers removes every subscriber from the broker and returns them. Their
+// routes stay until the subscribers are closed or drained
+func (n *mqttBroker) takeSubscribers() []*mqttSubscriber {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	subscribers := make([]*mqttSubscriber, 0, len(n.subscriptionMap))
+	for _, s := range n.subscriptionMap {
+		subscribers = append(subscribers, s)
+	}
+	n.subscriptionMap = make(map[string]*mqttSubscriber)
+	return subscribers
+}
+
+// unsubscribe removes the subscriber from the broker
+func (n *mqttBroker) unsubscribe(s *mqttSubscriber) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if _, ok := n.subscriptionMap[s.id]; !ok {
+		return false
+	}
+	delete(n.subscriptionMap, s.id)
+	return true
+}
+
+// addRoute adds the subscriber to the route of its filter and hands it the messages of the
+// backlog matching the filter. The filter is subscribed when it is new or when the subscriber
+// needs a higher QoS. The route is added first so that the retained messages sent right after
+// subscribing are delivered
+func (n *mqttBroker) addRoute(s *mqttSubscriber) error {
+	n.subscribeMu.Lock()
+	defer n.subscribeMu.Unlock()
+
+	n.mu.Lock()
+	r, ok := n.routes[s.filter]
+	if !ok {
+		r = &route{qos: s.qos, shared: s.queue != ""}
+		n.routes[s.filter] = r
+	}
+	subscribe := !ok || s.qos > r.qos
+	if s.qos > r.qos {
+		r.qos = s.qos
+	}
+	r.subscribers = append(r.subscribers, s)
+	qos := r.qos
+
+	var backlog []paho.Message
+	remaining := n.backlog[:0]
+	for _, m := range n.backlog {
+		if matchFilter(s.filter, m.Topic()) {
+			backlog = append(backlog, m)
+		} else {
+			remaining = append(remaining, m)
+		}
+	}
+	n.backlog = remaining
+	n.mu.Unlock()
+
+	for _, m := range backlog {
+		s.enqueue(m)
+	}
+
+	if !subscribe {
+		return nil
+	}
+
+	if err := n.wait(n.client.Subscribe(s.filter, qos, nil)); err != nil {
+		n.removeRoute(s, true)
+		return errors.Wrapf(err, "[MQTT]: Could not subscribe to '%s'", s.topic)
+	}
+	return nil
+}
+
+// removeRoute removes the subscriber from the route of its filter. With unsubscribe the
+// filter is unsubscribed on the server once it has no subscribers left
+func (n *mqttBroker) removeRoute(s *mqttSubscriber, unsubscribe bool) error {
+	n.subscribeMu.Lock()
+	defer n.subscribeMu.Unlock()
+
+	n.mu.Lock()
+	r, ok := n.routes[s.filter]
+	if !ok {
+		n.mu.Unlock()
+		return nil
+	}
+	for i, subscriber := range r.subscribers {
+		if subscriber == s {
+			r.subscribers = append(r.subscribers[:i], r.subscribers[i+1:]...)
+			break
+		}
+	}
+	last := len(r.subscribers) == 0
+	if last {
+		delete(n.routes, s.filter)
+	}
+	n.mu.Unlock()
+
+	if !last || !unsubscribe {
+		return nil
+	}
+	return n.wait(n.client.Unsubscribe(s.filter))
+}
+
+// dispatch hands the messages of the client to the subscribers of the matching filters. The
+// client cannot route them itself, since it does not tell a shared filter from the plain one.
+// dispatch must not block, since the client processes the acks of the publishes on the same
+// goroutine, and it acks the message, since the client cannot ack once the handler returned.
+// A message is thus acked before it is handled, see Config.QoS.
+// The messages of a persistent session which match no filter are kept in the backlog, while
+// stopping they are not acked, so that the server delivers them again on the next connect
+func (n *mqttBroker) dispatch(_ paho.Client, m paho.Message) {
+	n.mu.Lock()
+	var subscribers []*mqttSubscriber
+	for filter, r := range n.routes {
+		if len(r.subscribers) == 0 || !matchFilter(filter, m.Topic()) {
+			continue
+		}
+		if r.shared {
+			subscribers = append(subscribers, r.subscribers[r.next%len(r.subscribers)])
+			r.next++
+		} else {
+			subscribers = append(subscribers, r.subscribers...)
+		}
+	}
+
+	switch {
+	case len(subscribers) > 0 || !n.config.PersistentSession:
+	case n.stopping:
+		n.mu.Unlock()
+		return
+	default:
+		if len(n.backlog) == maxBacklog {
+			logger.Warn().Msgf("[MQTT]: Dropping message of '%s'. The backlog is full", n.backlog[0].Topic())
+			n.backlog = n.backlog[1:]
+		}
+		n.backlog = append(n.backlog, m)
+	}
+	n.mu.Unlock()
+
+	for _, s := range subscribers {
+		s.enqueue(m)
+	}
+	m.Ack()
+}
+
+// Status returns the status of the connection to the broker
+func (n *mqttBroker) Status() broker.Status {
+	return n.status.Status()
+}
+
+// NotifyStatus returns a channel which receives the changes of the status
+func (n *mqttBroker) NotifyStatus() <-chan broker.Status {
+	return n.status.Notify()
+}
+
+// Handle returns the raw connection handle to the broker
+func (n *mqttBroker) Handle() interface{} {
+	return n.client
+}
+
+// Publish publishes a message to the topic
+func (n *mqttBroker) Publish(topic string, m proto.Message, opts ...broker.PublishOption) error {
+
+	if n.client == nil {
+		return errors.New("[MQTT]: Cannot Publish. Not connected to broker")
+	}
+
+	return n.publishWith(topic, &broker.Message{Data: m}, opts)
+}
+
+// PublishRaw publishes raw data to the topic
+func (n *mqttBroker) PublishRaw(topic string, m []byte, opts ...broker.PublishOption) error {
+
+	if n.client == nil {
+		return errors.New("[MQTT]: Cannot PublishRaw. Not connected to broker")
+	}
+
+	return n.publishWith(topic, &broker.Message{Body: m}, opts)
+}
+
+// PublishMessage publishes a message envelope to the topic. Without Config.Envelope only
+// the body of the envelope is published
+func (n *mqttBroker) PublishMessage(topic string, m *broker.Message, opts ...broker.PublishOption) error {
+
+	if n.client == nil {
+		return errors.New("[MQTT]: Cannot PublishMessage. Not connected to broker")
+	}
+
+	return n.publishWith(topic, m, opts)
+}
+
+// Request publishes the request to the topic and waits for the response on an inbox
+// topic of its own. Requests need Config.Envelope to carry the reply topic
+func (n *mqttBroker) Request(ctx context.Context, topic string, req proto.Message, resp proto.Message) error {
+
+	if n.client == nil {
+		return errors.New("[MQTT]: Cannot Request. Not connected to broker")
+	}
+	if !n.config.Envelope {
+		return errors.New("[MQTT]: Cannot Request. Requests need Config.Envelope")
+	}
+
+	inbox := "_INBOX." + broker.NewID()
+	filter, _ := toMQTTTopic(inbox)
+	replies := make(chan paho.Message, 1)
+	err := n.wait(n.client.Subscribe(filter, 1, func(_ paho.Client, m paho.Message) {
+		m.Ack()
+		select {
+		case replies <- m:
+		default:
+		}
+	}))
+	if err != nil {
+		return errors.Wrapf(err, "[MQTT]: Could not subscribe to the inbox of the request on '%s'", topic)
+	}
+	defer n.client.Unsubscribe(filter)
+
+	if err := n.publish(topic, &broker.Message{Data: req, ReplyTo: inbox}, 1, false); err != nil {
+		return err
+	}
+
+	select {
+	case reply := <-replies:
+		return broker.DecodeResponse(n.toMessage(reply), resp)
+	case <-ctx.Done():
+		return errors.Wrapf(ctx.Err(), "[MQTT]: No response to request on '%s'", topic)
+	}
+}
+
+// publishWith applies the publish options to the envelope and publishes it. MQTT neither
+// expires nor prioritises messages, and without Config.Envelope it carries no headers
+func (n *mqttBroker) publishWith(topic string, m *broker.Message, opts []broker.PublishOption) error {
+
+	o := broker.NewPublishOptions(opts...)
+	switch {
+	case o.TTL > 0:
+		return broker.NotSupported("MQTT", "TTL")
+	case o.Priority > 0:
+		return broker.NotSupported("MQTT", "Priority")
+	case !o.At.IsZero():
+		return broker.NotSupported("MQTT", "PublishAt")
+	case !n.config.Envelope && len(o.Header) > 0:
+		return broker.NotSupported("MQTT", "WithHeader")
+	case !n.config.Envelope && o.CorrelationID != "":
+		return broker.NotSupported("MQTT", "WithCorrelationID")
+	case !n.config.Envelope && o.MessageID != "":
+		return broker.NotSupported("MQTT", "WithMessageID")
+	}
+	if err := o.CheckNative("MQTT"); err != nil {
+		return err
+	}
+
+	qos, err := qosOf(n.config, o.Native)
+	if err != nil {
+		return err
+	}
+	retained, _ := o.Native[optionRetained].(bool)
+
+	msg, err := o.Apply(m)
+	if err != nil {
+		return err
+	}
+	return n.publish(topic, msg, qos, retained)
+}
+
+// publish publishes the envelope to the topic and waits until the server received it
+// with the QoS
+func (n *mqttBroker) publish(topic string, m *broker.Message, qos byte, retained bool) error {
+
+	mqttTopic, err := toMQTTTopic(topic)
+	if err != nil {
+		return err
+	}
+	if strings.ContainsAny(mqttTopic, "+#") {
+		return fmt.Errorf("[MQTT]: Cannot publish to '%s'. Topics of publishes have no wildcards", topic)
+	}
+
+	payload, err := n.toPayload(m)
+	if err != nil {
+		return err
+	}
+
+	if err := n.wait(n.client.Publish(mqttTopic, qos, retained, payload)); err != nil {
+		return errors.Wrapf(err, "[MQTT]: Could not publish to '%s'", topic)
+	}
+	return nil
+}
+
+// Subscribe subscribes a handler to the topic
+func (n *mqttBroker) Subscribe(topic string, h interface{}, opts ...broker.SubscribeOption) (broker.Subscriber, error) {
+
+	if n.client == nil {
+		return nil, errors.New("[MQTT]: Cannot Subscribe. Not connected to broker")
+	}
+
+	handler, err := broker.NewHandlerFunc(h)
+	if err != nil {
+		return nil, errors.Wrap(err, "[MQTT]")
+	}
+
+	return n.subscribe(topic, handler, broker.HandlerType(h), broker.NewSubscribeOptions(opts...))
+}
+
+// SubscribeRaw subscribes a raw handler to the topic
+func (n *mqttBroker) SubscribeRaw(topic string, h func(c context.Context, data []byte) error, opts ...broker.SubscribeOption) (broker.Subscriber, error) {
+
+	if n.client == nil {
+		return nil, errors.New("[MQTT]: Cannot Subscribe. Not connected to broker")
+	}
+
+	return n.subscribe(topic, broker.NewRawHandlerFunc(h), broker.HandlerType(h), broker.NewSubscribeOptions(opts...))
+}
+
+// subscribe subscribes the handler to the topic filter of the topic. With shared subscriptions
+// the subscribers in a queue group share the subscription of the group. Plain MQTT servers
+// do not support them, so without Config.SharedSubscriptions there are no queue groups
+func (n *mqttBroker) subscribe(topic string, h broker.HandlerFunc, handlerType string, opts broker.SubscribeOptions) (broker.Subscriber, error) {
+
+	filter, err := toMQTTTopic(topic)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkSubscribeOptions(n.config, opts); err != nil {
+		return nil, err
+	}
+
+	qos, err := qosOf(n.config, opts.Native)
+	if err != nil {
+		return nil, err
+	}
+
+	queue := ""
+	if n.config.SharedSubscriptions {
+		queue = opts.QueueGroup(n.options.Name)
+	}
+	if queue != "" {
+		if strings.ContainsAny(queue, "/+#") {
+			return nil, fmt.Errorf("[MQTT]: Invalid queue group '%s'", queue)
+		}
+		filter = "$share/" + queue + "/" + filter
+	}
+
+	ctx, cancel := context.WithCancel(n.ctx)
+	subscriber := &mqttSubscriber{
+		id:          broker.NewID(),
+		topic:       topic,
+		queue:       queue,
+		filter:      filter,
+		qos:         qos,
+		handler:     h,
+		handlerType: opts.ReportedHandlerType(handlerType),
+		subscribed:  time.Now(),
+		options:     opts,
+		workers:     broker.NewWorkers(opts.Concurrency, opts.BufferSize),
+		broker:      n,
+		ctx:         ctx,
+		cancel:      cancel,
+		signal:      make(chan struct{}, 1),
+		done:        make(chan struct{}),
+		stopped:     make(chan struct{}),
+	}
+	go subscriber.run()
+
+	if err := n.addRoute(subscriber); err != nil {
+		subscriber.stop()
+		return nil, err
+	}
+
+	n.mu.Lock()
+	n.subscriptionMap[subscriber.id] = subscriber
+	n.mu.Unlock()
+
+	if queue != "" {
+		logger.Info().Msgf("[MQTT]: Subscribed to topic '%s' in queue group '%s'", topic, queue)
+		return subscriber, nil
+	}
+	logger.Info().Msgf("[MQTT]: Subscribed to topic '%s'", topic)
+	return subscriber, nil
+}
+
+// checkSubscribeOptions rejects the options MQTT has no equivalent for. Messages are acked
+// on receipt, so every subscription acks automatically
+func checkSubscribeOptions(config Config, opts broker.SubscribeOptions) error {
+	switch {
+	case opts.Queue != "" && !config.SharedSubscriptions:
+		return broker.NotSupported("MQTT", "Queue without shared subscriptions")
+	case opts.StartSequence > 0:
+		return broker.NotSupported("MQTT", "StartAtSequence")
+	case !opts.StartTime.IsZero():
+		return broker.NotSupported("MQTT", "StartAtTime")
+	case opts.Prefetch > 0:
+		return broker.NotSupported("MQTT", "Prefetch")
+	}
+	return opts.CheckNative("MQTT")
+}
+
+// toMQTTTopic translates the topic into an MQTT topic or topic filter. The tokens become
+// the topic levels and the wildcards '*' and '>' become '+' and '#'
+func toMQTTTopic(topic string) (string, error) {
+	tokens := strings.Split(topic, ".")
+	for i, token := range tokens {
+		switch {
+		case token == "*":
+			tokens[i] = "+"
+		case token == ">" && i == len(tokens)-1:
+			tokens[i] = "#"
+		case token == "" || strings.ContainsAny(token, "*>/+#"):
+			return "", fmt.Errorf("[MQTT]: Invalid topic '%s'", topic)
+		}
+	}
+	return strings.Join(tokens, "/"), nil
+}
+
+// matchFilter matches an MQTT topic against a topic filter. The share name of shared
+// subscriptions is skipped
+func matchFilter(filter, topic string) bool {
+	if strings.HasPrefix(filter, "$share/") {
+		if parts := strings.SplitN(filter, "/", 3); len(parts) == 3 {
+			filter = parts[2]
+		}
+	}
+
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
+
+// fromMQTTTopic translates an MQTT topic into the topic syntax of the framework
+func fromMQTTTopic(topic string) string {
+	return strings.ReplaceAll(topic, "/", ".")
+}
+
+// toPayload encodes the envelope into the payload of an MQTT message
+func (n *mqttBroker) toPayload(m *broker.Message) ([]byte, error) {
+
+	msg, err := m.Encode(n.options.Codec)
+	if err != nil {
+		return nil, err
+	}
+	if !n.config.Envelope {
+		return msg.Body, nil
+	}
+
+	payload, err := json.Marshal(envelope{Headers: msg.Headers(), Body: msg.Body})
+	if err != nil {
+		return nil, errors.Wrap(err, "[MQTT]: Could not encode message")
+	}
+	return payload, nil
+}
+
+// toMessage extracts the envelope from the MQTT message. Payloads which are no envelope,
+// e.g. the messages of devices, are delivered as the body
+func (n *mqttBroker) toMessage(m paho.Message) *broker.Message {
+	topic := fromMQTTTopic(m.Topic())
+
+	var msg *broker.Message
+	var e envelope
+	if n.config.Envelope && json.Unmarshal(m.Payload(), &e) == nil && e.Headers != nil {
+		msg = broker.MessageFromHeaders(topic, e.Headers, e.Body)
+	} else {
+		msg = broker.MessageFromHeaders(topic, nil, m.Payload())
+	}
+
+	if m.Retained() {
+		msg.Header[HeaderRetained] = "true"
+	}
+	return msg
+}
+
+// New returns a new MQTT broker
+func New(config Config) broker.Broker {
+	return &mqttBroker{
+		config:          config,
+		routes:          make(map[string]*route),
+		subscriptionMap: make(map[string]*mqttSubscriber),
+	}
+}
@@ -0,0 +1,467 @@
+package mqtt
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/adityak368/ego/broker"
+	proto "github.com/adityak368/ego/broker/proto/gen/broker"
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+const timeout = 5 * time.Second
+
+// newServer starts an embedded MQTT server and returns its address
+func newServer(t *testing.T) (*mochi.Server, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	address := l.Addr().String()
+	l.Close()
+
+	server := mochi.New(&mochi.Options{InlineClient: true})
+	require.Nil(t, server.AddHook(new(auth.AllowHook), nil))
+	require.Nil(t, server.AddListener(listeners.NewTCP(listeners.Config{ID: "tcp", Address: address})))
+	require.Nil(t, server.Serve())
+	t.Cleanup(func() { server.Close() })
+	return server, address
+}
+
+func newBroker(t *testing.T, address, name string, config Config) broker.Broker {
+	bkr := New(config)
+	bkr.Init(broker.Options{
+		Name:    name,
+		Address: address,
+	})
+	require.Nil(t, bkr.Connect())
+	t.Cleanup(func() { bkr.Disconnect() })
+	return bkr
+}
+
+func TestMQTT(t *testing.T) {
+
+	r := require.New(t)
+
+	_, address := newServer(t)
+	bkr := newBroker(t, address, "MQTT", Config{})
+
+	var mu sync.Mutex
+	received := map[string][]string{}
+	record := func(name, data string) {
+		mu.Lock()
+		defer mu.Unlock()
+		received[name] = append(received[name], data)
+	}
+
+	_, err := bkr.Subscribe("test.testMessageProto", func(ctx context.Context, msg *proto.TestMessage) error {
+		record("proto", msg.Data)
+		return nil
+	})
+	r.Nil(err)
+	_, err = bkr.SubscribeRaw("test.testMessageRaw", func(ctx context.Context, msg []byte) error {
+		record("raw", string(msg))
+		return nil
+	})
+	r.Nil(err)
+	_, err = bkr.SubscribeRaw("test.*", func(ctx context.Context, msg []byte) error {
+		record("wildcard", "")
+		return nil
+	}, broker.Broadcast())
+	r.Nil(err)
+	_, err = bkr.SubscribeRaw("test.>", func(ctx context.Context, msg []byte) error {
+		record("fullwildcard", "")
+		return nil
+	}, broker.Broadcast())
+	r.Nil(err)
+
+	r.Nil(bkr.Publish("test.testMessageProto", &proto.TestMessage{Data: "Test"}))
+	r.Nil(bkr.PublishRaw("test.testMessageRaw", []byte("Raw")))
+	r.Nil(bkr.PublishRaw("test.testMessageRaw.nested", []byte("Nested")))
+
+	r.Eventually(func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(received["proto"]) == 1 && len(received["raw"]) == 1 &&
+			len(received["wildcard"]) == 2 && len(received["fullwildcard"]) == 3
+	}, timeout, 10*time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	r.Equal([]string{"Test"}, received["proto"])
+	r.Equal([]string{"Raw"}, received["raw"])
+
+	_, err = bkr.SubscribeRaw("test.*a", func(ctx context.Context, msg []byte) error { return nil })
+	r.NotNil(err, "Wildcards inside tokens should be rejected")
+	r.NotNil(bkr.PublishRaw("test.*", []byte("Test")), "Wildcards should be rejected when publishing")
+}
+
+func TestTopics(t *testing.T) {
+
+	r := require.New(t)
+
+	for topic, filter := range map[string]string{
+		"test":              "test",
+		"test.created":      "test/created",
+		"test.*.created":    "test/+/created",
+		"test.>":            "test/#",
+		"devices.*.sensors": "devices/+/sensors",
+	} {
+		mqttTopic, err := toMQTTTopic(topic)
+		r.Nil(err)
+		r.Equal(filter, mqttTopic)
+	}
+
+	for _, topic := range []string{"", "test..created", "test.>.created", "test/created", "test.+", "test.#", "test.*a"} {
+		_, err := toMQTTTopic(topic)
+		r.NotNil(err, topic)
+	}
+
+	r.Equal("test.created", fromMQTTTopic("test/created"))
+
+	r.True(matchFilter("test/+", "test/created"))
+	r.False(matchFilter("test/+", "test/created/nested"))
+	r.True(matchFilter("test/#", "test/created/nested"))
+	r.True(matchFilter("$share/orders/test/+", "test/created"))
+	r.False(matchFilter("test/created", "test/deleted"))
+}
+
+func TestMQTTQoS(t *testing.T) {
+
+	r := require.New(t)
+
+	_, address := newServer(t)
+	bkr := newBroker(t, address, "MQTT", Config{QoS: 1})
+
+	c := make(chan string, 3)
+	for _, qos := range []byte{0, 1, 2} {
+		_, err := bkr.SubscribeRaw("test.testMessageQoS", func(ctx context.Context, msg []byte) error {
+			c <- string(msg)
+			return nil
+		}, SubscribeQoS(qos), broker.Broadcast())
+		r.Nil(err)
+	}
+
+	r.Nil(bkr.PublishRaw("test.testMessageQoS", []byte("Test"), PublishQoS(2)))
+	for i := 0; i < 3; i++ {
+		select {
+		case msg := <-c:
+			r.Equal("Test", msg)
+		case <-time.After(timeout):
+			t.Fatal("Timed out waiting for message from broker")
+		}
+	}
+
+	r.NotNil(bkr.PublishRaw("test.testMessageQoS", []byte("Test"), PublishQoS(3)), "Invalid QoS should be rejected")
+	_, err := bkr.SubscribeRaw("test.testMessageQoS", func(ctx context.Context, msg []byte) error { return nil }, SubscribeQoS(3))
+	r.NotNil(err, "Invalid QoS should be rejected")
+	_, err = bkr.SubscribeRaw("test.testMessageQoS", func(ctx context.Context, msg []byte) error { return nil }, broker.NativeOption(optionQoS, 1))
+	r.NotNil(err, "QoS values which are not a byte should be rejected")
+}
+
+func TestMQTTRetained(t *testing.T) {
+
+	r := require.New(t)
+
+	_, address := newServer(t)
+	bkr := newBroker(t, address, "MQTT", Config{})
+
+	r.Nil(bkr.PublishRaw("devices.thermostat.setpoint", []byte("21"), Retained(), PublishQoS(1)))
+
+	// the retained message is delivered to the subscribers which subscribe later, except to
+	// shared subscriptions
+	c := make(chan *broker.Message, 1)
+	_, err := bkr.SubscribeRaw("devices.*.setpoint", func(ctx context.Context, _ []byte) error {
+		msg, _ := broker.FromContext(ctx)
+		c <- msg
+		return nil
+	}, broker.Broadcast())
+	r.Nil(err)
+
+	select {
+	case msg := <-c:
+		r.Equal("21", string(msg.Body))
+		r.Equal("devices.thermostat.setpoint", msg.Topic)
+		r.Equal("true", msg.Header[HeaderRetained])
+	case <-time.After(timeout):
+		t.Fatal("Timed out waiting for the retained message")
+	}
+}
+
+func TestMQTTWill(t *testing.T) {
+
+	r := require.New(t)
+
+	server, address := newServer(t)
+	bkr := newBroker(t, address, "MQTT", Config{})
+
+	c := make(chan string, 1)
+	_, err := bkr.SubscribeRaw("devices.sensor.status", func(ctx context.Context, msg []byte) error {
+		c <- string(msg)
+		return nil
+	})
+	r.Nil(err)
+
+	newBroker(t, address, "Sensor", Config{
+		ClientID: "sensor",
+		Will:     &Will{Topic: "devices.sensor.status", Payload: []byte("offline"), QoS: 1},
+	})
+
+	// the connection of the sensor breaks without a disconnect
+	client, ok := server.Clients.Get("sensor")
+	r.True(ok)
+	client.Stop(errors.New("connection lost"))
+
+	select {
+	case msg := <-c:
+		r.Equal("offline", msg)
+	case <-time.After(timeout):
+		t.Fatal("Timed out waiting for the will")
+	}
+}
+
+func TestMQTTPersistentSession(t *testing.T) {
+
+	r := require.New(t)
+
+	_, address := newServer(t)
+	publisher := newBroker(t, address, "Publisher", Config{QoS: 1})
+	config := Config{ClientID: "persistent", PersistentSession: true, QoS: 1}
+
+	received := make(chan string, 2)
+	handler := func(ctx context.Context, msg []byte) error {
+		received <- string(msg)
+		return nil
+	}
+
+	bkr := New(config)
+	bkr.Init(broker.Options{Name: "MQTT", Address: address})
+	r.Nil(bkr.Connect())
+	_, err := bkr.SubscribeRaw("test.testMessagePersistent", handler)
+	r.Nil(err)
+	r.Nil(bkr.Disconnect())
+
+	// the server queues the messages of the session while the client is away
+	r.Nil(publisher.PublishRaw("test.testMessagePersistent", []byte("Offline")))
+
+	bkr = newBroker(t, address, "MQTT", config)
+	_, err = bkr.SubscribeRaw("test.testMessagePersistent", handler)
+	r.Nil(err)
+
+	select {
+	case msg := <-received:
+		r.Equal("Offline", msg)
+	case <-time.After(timeout):
+		t.Fatal("Timed out waiting for the queued message")
+	}
+}
+
+func TestMQTTQueueGroups(t *testing.T) {
+
+	r := require.New(t)
+
+	_, address := newServer(t)
+
+	var mu sync.Mutex
+	received := map[string]int{}
+	handler := func(name string) func(ctx context.Context, msg []byte) error {
+		return func(ctx context.Context, msg []byte) error {
+			mu.Lock()
+			defer mu.Unlock()
+			received[name]++
+			return nil
+		}
+	}
+
+	// with shared subscriptions the instances of a service share the messages by default,
+	// without them every subscription receives every message
+	orders := newBroker(t, address, "orders", Config{})
+	for i := 0; i < 2; i++ {
+		instance := newBroker(t, address, "orders", Config{SharedSubscriptions: true})
+		_, err := instance.SubscribeRaw("test.testMessageGroups", handler("orders"))
+		r.Nil(err)
+		r.Equal("orders", instance.Subscriptions()[0].Queue)
+	}
+	shared := newBroker(t, address, "shared", Config{SharedSubscriptions: true})
+	_, err := shared.SubscribeRaw("test.testMessageGroups", handler("shared"), broker.Broadcast())
+	r.Nil(err)
+	billing := newBroker(t, address, "billing", Config{})
+	_, err = billing.SubscribeRaw("test.testMessageGroups", handler("billing"))
+	r.Nil(err)
+	_, err = billing.SubscribeRaw("test.testMessageGroups", handler("broadcast"))
+	r.Nil(err)
+	r.Empty(billing.Subscriptions()[0].Queue, "Subscriptions should not be shared without shared subscriptions")
+
+	_, err = billing.SubscribeRaw("test.testMessageGroups", handler("billing"), broker.Queue("billing"))
+	r.True(errors.Is(err, broker.ErrNotSupported), "Queue groups should be rejected without shared subscriptions")
+
+	for i := 0; i < 10; i++ {
+		r.Nil(orders.PublishRaw("test.testMessageGroups", []byte("Test")))
+	}
+
+	r.Eventually(func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return received["orders"] == 10 && received["shared"] == 10 && received["billing"] == 10 && received["broadcast"] == 10
+	}, timeout, 10*time.Millisecond)
+
+	time.Sleep(50 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	r.Equal(10, received["orders"], "A message should be handled once per queue group")
+}
+
+func TestMQTTRequest(t *testing.T) {
+
+	r := require.New(t)
+
+	_, address := newServer(t)
+	bkr := newBroker(t, address, "MQTT", Config{Envelope: true})
+
+	_, err := bkr.Subscribe("test.testMessageRequest", func(ctx context.Context, req *proto.TestMessage) (*proto.TestMessage, error) {
+		return &proto.TestMessage{Data: req.Data + " Response"}, nil
+	})
+	r.Nil(err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	resp := &proto.TestMessage{}
+	r.Nil(bkr.Request(ctx, "test.testMessageRequest", &proto.TestMessage{Data: "Test"}, resp))
+	r.Equal("Test Response", resp.Data)
+
+	// the envelope carries the headers
+	c := make(chan *broker.Message, 1)
+	_, err = bkr.SubscribeRaw("test.testMessageHeaders", func(ctx context.Context, _ []byte) error {
+		msg, _ := broker.FromContext(ctx)
+		c <- msg
+		return nil
+	})
+	r.Nil(err)
+	r.Nil(bkr.PublishRaw("test.testMessageHeaders", []byte("Test"), broker.WithHeader("Tenant", "acme")))
+	select {
+	case msg := <-c:
+		r.Equal("Test", string(msg.Body))
+		r.Equal("acme", msg.Header["Tenant"])
+	case <-time.After(timeout):
+		t.Fatal("Timed out waiting for message from broker")
+	}
+
+	plain := newBroker(t, address, "MQTT", Config{})
+	r.NotNil(plain.Request(ctx, "test.testMessageRequest", &proto.TestMessage{Data: "Test"}, resp), "Requests need the envelope")
+	r.NotNil(plain.PublishRaw("test.testMessageHeaders", []byte("Test"), broker.WithHeader("Tenant", "acme")), "Headers need the envelope")
+}
+
+func TestMQTTSubscriptions(t *testing.T) {
+
+	r := require.New(t)
+
+	server, address := newServer(t)
+	bkr := newBroker(t, address, "MQTT", Config{})
+
+	c := make(chan string, 2)
+	subscription, err := bkr.SubscribeRaw("test.testMessageSubscriptions", func(ctx context.Context, msg []byte) error {
+		c <- "first"
+		return nil
+	})
+	r.Nil(err)
+	_, err = bkr.SubscribeRaw("test.testMessageSubscriptions", func(ctx context.Context, msg []byte) error {
+		c <- "second"
+		return nil
+	}, broker.Broadcast())
+	r.Nil(err)
+	subscriptions := bkr.Subscriptions()
+	r.Len(subscriptions, 2)
+	r.NotEqual(subscriptions[0].ID, subscriptions[1].ID)
+
+	r.Nil(subscription.Unsubscribe())
+	r.NotNil(subscription.Unsubscribe())
+	r.Len(bkr.Subscriptions(), 1)
+
+	r.Nil(bkr.PublishRaw("test.testMessageSubscriptions", []byte("Test")))
+	select {
+	case msg := <-c:
+		r.Equal("second", msg)
+	case <-time.After(timeout):
+		t.Fatal("Timed out waiting for message from broker")
+	}
+	r.Eventually(func() bool {
+		return bkr.Subscriptions()[0].Stats.Handled == 1
+	}, timeout, 10*time.Millisecond)
+
+	r.Nil(bkr.UnsubscribeAll())
+	r.Empty(bkr.Subscriptions())
+	r.Eventually(func() bool {
+		return len(server.Topics.Subscribers("test/testMessageSubscriptions").Subscriptions) == 0
+	}, timeout, 10*time.Millisecond, "Filters should be unsubscribed")
+}
+
+func TestMQTTDrain(t *testing.T) {
+
+	r := require.New(t)
+
+	_, address := newServer(t)
+	bkr := New(Config{})
+	bkr.Init(broker.Options{Name: "MQTT", Address: address})
+	r.Nil(bkr.Connect())
+
+	const count = 5
+	var mu sync.Mutex
+	handled := 0
+	_, err := bkr.SubscribeRaw("test.testMessageDrain", func(ctx context.Context, msg []byte) error {
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		defer mu.Unlock()
+		handled++
+		return nil
+	}, broker.Broadcast(), broker.BufferSize(count))
+	r.Nil(err)
+
+	for i := 0; i < count; i++ {
+		r.Nil(bkr.PublishRaw("test.testMessageDrain", []byte("Test"), PublishQoS(1)))
+	}
+	r.Eventually(func() bool {
+		return bkr.Subscriptions()[0].Stats.Received == count
+	}, timeout, time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	r.Nil(bkr.Drain(ctx))
+	r.Equal(broker.StatusClosed, bkr.Status())
+
+	mu.Lock()
+	defer mu.Unlock()
+	r.Equal(count, handled, "Drain should wait for the received messages")
+}
+
+func TestMQTTOptions(t *testing.T) {
+
+	r := require.New(t)
+
+	_, address := newServer(t)
+	bkr := newBroker(t, address, "MQTT", Config{})
+
+	err := bkr.PublishRaw("test.testMessageOptions", []byte("Test"), broker.TTL(time.Second))
+	r.True(errors.Is(err, broker.ErrNotSupported), "TTL should be rejected")
+
+	for _, opt := range []broker.SubscribeOption{broker.StartAtSequence(1), broker.StartAtTime(time.Now()), broker.Prefetch(10)} {
+		_, err = bkr.SubscribeRaw("test.testMessageOptions", func(ctx context.Context, msg []byte) error {
+			return nil
+		}, opt)
+		r.True(errors.Is(err, broker.ErrNotSupported))
+	}
+
+	_, err = bkr.Subscribe("test.testMessageOptions", func(msg *proto.TestMessage) error { return nil })
+	r.NotNil(err, "Invalid handlers should be rejected")
+
+	shared := newBroker(t, address, "MQTT", Config{SharedSubscriptions: true})
+	_, err = shared.SubscribeRaw("test.testMessageOptions", func(ctx context.Context, msg []byte) error {
+		return nil
+	}, broker.Queue("orders/eu"))
+	r.NotNil(err, "Queue groups with topic separators should be rejected")
+}
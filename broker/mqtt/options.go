@@ -0,0 +1,47 @@
+package mqtt
+
+import (
+	"fmt"
+
+	"github.com/adityak368/ego/broker"
+)
+
+// names of the MQTT specific subscribe and publish options
+const (
+	optionQoS      = "mqtt.qos"
+	optionRetained = "mqtt.retained"
+)
+
+// SubscribeQoS sets the quality of service of the subscription. It is the QoS between the
+// server and the client only: the client acks a message when it receives it, before the
+// handler runs, so a failed handler does not make the server deliver it again
+func SubscribeQoS(qos byte) broker.SubscribeOption {
+	return broker.NativeOption(optionQoS, qos)
+}
+
+// PublishQoS sets the quality of service of the publish
+func PublishQoS(qos byte) broker.PublishOption {
+	return broker.NativePublishOption(optionQoS, qos)
+}
+
+// Retained publishes the message as the retained message of the topic, which the server
+// delivers to every new subscriber of the topic
+func Retained() broker.PublishOption {
+	return broker.NativePublishOption(optionRetained, true)
+}
+
+// qosOf returns the QoS of the native options or the QoS of the config
+func qosOf(config Config, native map[string]interface{}) (byte, error) {
+	qos := config.QoS
+	if v, ok := native[optionQoS]; ok {
+		b, ok := v.(byte)
+		if !ok {
+			return 0, fmt.Errorf("[MQTT]: Invalid QoS %v", v)
+		}
+		qos = b
+	}
+	if qos > 2 {
+		return 0, fmt.Errorf("[MQTT]: Invalid QoS %d", qos)
+	}
+	return qos, nil
+}
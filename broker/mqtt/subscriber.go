@@ -0,0 +1,189 @@
+package mqtt
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/adityak368/ego/broker"
+	"github.com/adityak368/swissknife/logger/v2"
+	paho "github.com/eclipse/paho.mqtt.golang"
+)
+
+type mqttSubscriber struct {
+	id          string
+	topic       string
+	queue       string
+	filter      string
+	qos         byte
+	handler     broker.HandlerFunc
+	handlerType string
+	subscribed  time.Time
+	options     broker.SubscribeOptions
+	workers     *broker.Workers
+	stats       broker.StatsCounter
+	broker      *mqttBroker
+	ctx         context.Context
+	cancel      context.CancelFunc
+
+	// pending queues the messages of the client for the workers, since the handler of
+	// the client must not block
+	mu       sync.Mutex
+	pending  []paho.Message
+	closed   bool
+	draining bool
+	// signal wakes the run loop, done stops it and stopped is closed once it returned
+	signal  chan struct{}
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// ID returns the unique id of the subscription
+func (s *mqttSubscriber) ID() string {
+	return s.id
+}
+
+// Topic returns the subscribed topic
+func (s *mqttSubscriber) Topic() string {
+	return s.topic
+}
+
+// info describes the subscription
+func (s *mqttSubscriber) info() broker.SubscriptionInfo {
+	return broker.SubscriptionInfo{
+		ID:         s.id,
+		Topic:      s.topic,
+		Handler:    s.handlerType,
+		Subscribed: s.subscribed,
+		Queue:      s.queue,
+		Stats:      s.stats.Stats(),
+	}
+}
+
+// Unsubscribe unsubscribes to the topic and waits for the handlers in flight.
+// Queued messages which were not handled yet are dropped
+func (s *mqttSubscriber) Unsubscribe() error {
+	if !s.broker.unsubscribe(s) {
+		return fmt.Errorf("[MQTT]: Cannot unsubscribe from %s", s.topic)
+	}
+	return s.close(true)
+}
+
+// enqueue queues the message for the workers without blocking
+func (s *mqttSubscriber) enqueue(m paho.Message) {
+	s.mu.Lock()
+	if s.closed || s.draining {
+		s.mu.Unlock()
+		return
+	}
+	s.pending = append(s.pending, m)
+	s.mu.Unlock()
+
+	s.stats.Receive()
+	select {
+	case s.signal <- struct{}{}:
+	default:
+	}
+}
+
+// next takes the next queued message. It returns false once the queue of a draining
+// subscriber is empty
+func (s *mqttSubscriber) next() (paho.Message, bool, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.pending) == 0 {
+		return nil, false, !s.draining
+	}
+	m := s.pending[0]
+	s.pending = s.pending[1:]
+	return m, true, true
+}
+
+// run hands the queued messages to the workers until the subscriber is stopped or drained
+func (s *mqttSubscriber) run() {
+	defer close(s.stopped)
+
+	for {
+		m, ok, more := s.next()
+		if !more {
+			return
+		}
+		if !ok {
+			select {
+			case <-s.signal:
+			case <-s.done:
+				return
+			}
+			continue
+		}
+		if !s.workers.Go(func() { s.handle(m) }) {
+			return
+		}
+	}
+}
+
+// handle delivers the message to the handler and publishes the response of requests
+func (s *mqttSubscriber) handle(m paho.Message) {
+	msg := s.broker.toMessage(m)
+	err := broker.Deliver(s.ctx, s.broker, s.handler, msg, s.options)
+	s.stats.Done(err)
+	if err != nil {
+		logger.Error().Err(err).Msg("")
+	}
+
+	if msg.ReplyTo != "" && msg.Response != nil {
+		if err := s.broker.publish(msg.ReplyTo, msg.Response, 1, false); err != nil {
+			logger.Error().Err(err).Msg("")
+		}
+	}
+}
+
+// stop stops the run loop, cancels the handlers and waits for the handlers in flight
+func (s *mqttSubscriber) stop() {
+	s.mu.Lock()
+	s.closed = true
+	s.pending = nil
+	s.mu.Unlock()
+
+	close(s.done)
+	s.cancel()
+	// the run loop may wait for a worker
+	s.workers.Stop()
+	<-s.stopped
+}
+
+// close removes the subscriber from its route and stops it. With unsubscribe the filter is
+// unsubscribed on the server once no other subscriber uses it
+func (s *mqttSubscriber) close(unsubscribe bool) error {
+	err := s.broker.removeRoute(s, unsubscribe)
+	s.stop()
+	return err
+}
+
+// drain removes the subscriber from its route and waits until the queued messages are handled
+func (s *mqttSubscriber) drain(ctx context.Context) error {
+	defer s.cancel()
+
+	s.broker.removeRoute(s, false)
+	s.mu.Lock()
+	s.draining = true
+	s.mu.Unlock()
+	select {
+	case s.signal <- struct{}{}:
+	default:
+	}
+
+	select {
+	case <-s.stopped:
+	case <-ctx.Done():
+		// the run loop may wait for a worker
+		s.workers.Stop()
+		close(s.done)
+		<-s.stopped
+		return ctx.Err()
+	}
+
+	return s.workers.Drain(ctx)
+}
@@ -3,7 +3,8 @@ package nats
 import (
 	"context"
 	"fmt"
-	"reflect"
+	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 	"google.golang.org/protobuf/proto"
@@ -18,6 +19,12 @@ type natsBroker struct {
 	options         broker.Options
 	connection      *nats.Conn
 	subscriptionMap map[string]*natsSubscriber
+	mu              sync.Mutex
+	ctx             context.Context
+	cancel          context.CancelFunc
+	// closed is closed once the connection is closed
+	closed chan struct{}
+	status broker.StatusNotifier
 }
 
 // Address Returns the broker bind interface
@@ -43,12 +50,21 @@ func (n *natsBroker) String() string {
 
 // Connect connects to the broker
 func (n *natsBroker) Connect() error {
-	conn, err := nats.Connect(n.Address())
+	closed := make(chan struct{})
+	opts, err := ConnectOptions("[NATS]", n.options, &n.status, closed)
+	if err != nil {
+		return err
+	}
+
+	conn, err := nats.Connect(n.Address(), opts...)
 	if err != nil {
 		return err
 	}
 	logger.Info().Msgf("[NATS]: Connected to %s", n.Address())
 	n.connection = conn
+	n.closed = closed
+	n.status.Set(broker.StatusConnected, n.options.OnStatus)
+	n.ctx, n.cancel = context.WithCancel(context.Background())
 	return nil
 }
 
@@ -59,151 +75,407 @@ func (n *natsBroker) Disconnect() error {
 		return errors.New("[NATS]: Cannot Disconnect. Not connected to broker")
 	}
 
+	n.cancel()
 	n.connection.Close()
+	// the closed handler runs asynchronously, the status is closed once Disconnect returns
+	n.status.Set(broker.StatusClosed, n.options.OnStatus)
+	for _, s := range n.takeSubscribers() {
+		s.workers.Stop()
+	}
 	logger.Info().Msgf("[NATS]: Disconnected from %s", n.Address())
 	return nil
 }
 
+// ConnectOptions maps the reconnect policy, the TLS config and the credentials of the broker
+// options onto the client, which re-establishes the subscriptions after a reconnect, and
+// reports the changes of the connection status to status. closed is closed once the
+// connection is closed. The JetStream broker connects with them as well, prefix is the
+// prefix of the log messages and errors, e.g. "[NATS]"
+func ConnectOptions(prefix string, o broker.Options, status *broker.StatusNotifier, closed chan struct{}) ([]nats.Option, error) {
+	policy := o.Reconnect
+
+	opts := []nats.Option{
+		nats.CustomReconnectDelay(policy.Delay),
+		nats.DisconnectErrHandler(func(c *nats.Conn, err error) {
+			// the handler runs asynchronously, after the status is set by Disconnect
+			if c.IsClosed() {
+				return
+			}
+			if err != nil {
+				logger.Error().Err(err).Msgf("%s: Connection to %s lost", prefix, o.Address)
+			}
+			status.Set(broker.StatusDisconnected, o.OnStatus)
+			if policy.Enabled() {
+				status.Set(broker.StatusReconnecting, o.OnStatus)
+			}
+		}),
+		nats.ReconnectHandler(func(*nats.Conn) {
+			logger.Info().Msgf("%s: Reconnected to %s", prefix, o.Address)
+			status.Set(broker.StatusConnected, o.OnStatus)
+		}),
+		nats.ClosedHandler(func(*nats.Conn) {
+			status.Set(broker.StatusClosed, o.OnStatus)
+			close(closed)
+		}),
+	}
+
+	switch {
+	case !policy.Enabled():
+		opts = append(opts, nats.NoReconnect())
+	case policy.MaxAttempts == 0:
+		opts = append(opts, nats.MaxReconnects(-1))
+	default:
+		opts = append(opts, nats.MaxReconnects(policy.MaxAttempts))
+	}
+
+	if o.TLSConfig != nil {
+		opts = append(opts, nats.Secure(o.TLSConfig))
+	}
+	if o.Username != "" {
+		opts = append(opts, nats.UserInfo(o.Username, o.Password))
+	}
+	if o.Token != "" {
+		opts = append(opts, nats.Token(o.Token))
+	}
+	if o.CredentialsFile != "" {
+		opts = append(opts, nats.UserCredentials(o.CredentialsFile))
+	}
+	if o.NKeySeedFile != "" {
+		nkey, err := nats.NkeyOptionFromSeed(o.NKeySeedFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s: Could not read the NKEY seed", prefix)
+		}
+		opts = append(opts, nkey)
+	}
+
+	return opts, nil
+}
+
+// Drain drains the subscriptions first, so that their handlers can still publish, and
+// then the connection, which flushes the pending publishes before it is closed
+func (n *natsBroker) Drain(ctx context.Context) error {
+
+	if n.connection == nil {
+		return errors.New("[NATS]: Cannot Drain. Not connected to broker")
+	}
+
+	subscribers := n.takeSubscribers()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(subscribers))
+	for _, s := range subscribers {
+		wg.Add(1)
+		go func(s *natsSubscriber) {
+			defer wg.Done()
+			if err := s.drain(ctx); err != nil {
+				errs <- err
+			}
+		}(s)
+	}
+	wg.Wait()
+	close(errs)
+
+	err := <-errs
+	if drainErr := n.connection.Drain(); drainErr != nil && err == nil {
+		err = drainErr
+	}
+
+	select {
+	case <-n.closed:
+	case <-ctx.Done():
+		n.connection.Close()
+		if err == nil {
+			err = ctx.Err()
+		}
+	}
+
+	n.cancel()
+	logger.Info().Msgf("[NATS]: Drained and disconnected from %s", n.Address())
+	return err
+}
+
+// Subscriptions returns the active subscriptions along with their stats in the order they were subscribed
+func (n *natsBroker) Subscriptions() []broker.SubscriptionInfo {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	infos := make([]broker.SubscriptionInfo, 0, len(n.subscriptionMap))
+	for _, s := range n.subscriptionMap {
+		infos = append(infos, s.info())
+	}
+	broker.SortSubscriptions(infos)
+	return infos
+}
+
+// UnsubscribeAll unsubscribes every subscription and waits for the handlers in flight
+func (n *natsBroker) UnsubscribeAll() error {
+	var err error
+	for _, s := range n.takeSubscribers() {
+		if unsubscribeErr := s.Unsubscribe(); unsubscribeErr != nil && err == nil {
+			err = unsubscribeErr
+		}
+	}
+	return err
+}
+
+// takeSubscribers removes every subscriber from the broker and returns them
+func (n *natsBroker) takeSubscribers() []*natsSubscriber {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	subscribers := make([]*natsSubscriber, 0, len(n.subscriptionMap))
+	for _, s := range n.subscriptionMap {
+		subscribers = append(subscribers, s)
+	}
+	n.subscriptionMap = make(map[string]*natsSubscriber)
+	return subscribers
+}
+
+// remove removes the subscriber from the broker
+func (n *natsBroker) remove(s *natsSubscriber) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.subscriptionMap, s.id)
+}
+
+// Status returns the status of the connection to the broker
+func (n *natsBroker) Status() broker.Status {
+	return n.status.Status()
+}
+
+// NotifyStatus returns a channel which receives the changes of the status
+func (n *natsBroker) NotifyStatus() <-chan broker.Status {
+	return n.status.Notify()
+}
+
 // Handle returns the raw connection handle to the db
 func (n *natsBroker) Handle() interface{} {
 	return n.connection
 }
 
 // Publish publishes a message to the topic
-func (n *natsBroker) Publish(topic string, m proto.Message) error {
+func (n *natsBroker) Publish(topic string, m proto.Message, opts ...broker.PublishOption) error {
 
 	if n.connection == nil {
 		return errors.New("[NATS]: Cannot Publish. Not connected to broker")
 	}
 
-	data, err := proto.Marshal(m)
-	if err != nil {
-		return err
-	}
-	n.connection.Publish(topic, data)
-	return nil
+	return n.publishWith(topic, &broker.Message{Data: m}, opts)
 }
 
 // PublishRaw publishes raw data to the topic
-func (n *natsBroker) PublishRaw(topic string, m []byte) error {
+func (n *natsBroker) PublishRaw(topic string, m []byte, opts ...broker.PublishOption) error {
 
 	if n.connection == nil {
 		return errors.New("[NATS]: Cannot PublishRaw. Not connected to broker")
 	}
 
-	n.connection.Publish(topic, m)
-	return nil
+	return n.publishWith(topic, &broker.Message{Body: m}, opts)
 }
 
-// Subscribe subscribes a handler to the topic
-func (n *natsBroker) Subscribe(topic string, h interface{}) (broker.Subscriber, error) {
+// PublishMessage publishes a message envelope to the topic
+func (n *natsBroker) PublishMessage(topic string, m *broker.Message, opts ...broker.PublishOption) error {
 
 	if n.connection == nil {
-		return nil, errors.New("[NATS]: Cannot Subscribe. Not connected to broker")
+		return errors.New("[NATS]: Cannot PublishMessage. Not connected to broker")
 	}
 
-	typ := reflect.TypeOf(h)
-	if typ.Kind() != reflect.Func {
-		return nil, errors.New("[NATS]: Need a function as a callback")
+	return n.publishWith(topic, m, opts)
+}
+
+// Request publishes the request to the topic and waits for the response on a NATS inbox
+func (n *natsBroker) Request(ctx context.Context, topic string, req proto.Message, resp proto.Message) error {
+
+	if n.connection == nil {
+		return errors.New("[NATS]: Cannot Request. Not connected to broker")
 	}
 
-	if typ.NumIn() != 2 {
-		return nil, errors.New("[NATS]: Function takes two inputs. 1. context.Context and 2. proto.Message which is the message")
+	natsMsg, err := toNatsMsg(topic, &broker.Message{Data: req}, n.options.Codec)
+	if err != nil {
+		return err
 	}
 
-	ctxType := typ.In(0)
-	if ctxType.Kind() != reflect.Interface || !ctxType.Implements(reflect.TypeOf((*context.Context)(nil)).Elem()) {
-		return nil, errors.New("[NATS]: First Parameter should be of type context.Context")
+	reply, err := n.connection.RequestMsgWithContext(ctx, natsMsg)
+	if err != nil {
+		return errors.Wrapf(err, "[NATS]: No response to request on '%s'", topic)
 	}
 
-	msgType := typ.In(1)
-	if msgType.Kind() != reflect.Ptr {
-		return nil, errors.New("[NATS]: Message should be a pointer")
+	return broker.DecodeResponse(toMessage(reply), resp)
+}
+
+// publishWith applies the publish options to the envelope and publishes it. Core NATS
+// neither expires nor prioritises messages
+func (n *natsBroker) publishWith(topic string, m *broker.Message, opts []broker.PublishOption) error {
+
+	o := broker.NewPublishOptions(opts...)
+	switch {
+	case o.TTL > 0:
+		return broker.NotSupported("NATS", "TTL")
+	case o.Priority > 0:
+		return broker.NotSupported("NATS", "Priority")
+	case !o.At.IsZero():
+		return broker.NotSupported("NATS", "PublishAt")
+	}
+	if err := o.CheckNative("NATS"); err != nil {
+		return err
 	}
 
-	if typ.NumOut() != 1 {
-		return nil, errors.New("[NATS]: Function should have a single return value")
+	msg, err := o.Apply(m)
+	if err != nil {
+		return err
 	}
+	return n.publish(topic, msg)
+}
+
+// publish maps the envelope onto the NATS headers and publishes it
+func (n *natsBroker) publish(topic string, m *broker.Message) error {
 
-	errType := typ.Out(0)
-	if errType.Kind() != reflect.Interface || !errType.Implements(reflect.TypeOf((*error)(nil)).Elem()) {
-		return nil, errors.New("[NATS]: Function should return error or nil")
+	natsMsg, err := toNatsMsg(topic, m, n.options.Codec)
+	if err != nil {
+		return err
 	}
 
-	cb := reflect.ValueOf(h)
+	return n.connection.PublishMsg(natsMsg)
+}
+
+// Subscribe subscribes a handler to the topic
+func (n *natsBroker) Subscribe(topic string, h interface{}, opts ...broker.SubscribeOption) (broker.Subscriber, error) {
 
-	subscription, err := n.connection.Subscribe(topic, func(m *nats.Msg) {
-		msg := reflect.New(msgType.Elem())
+	if n.connection == nil {
+		return nil, errors.New("[NATS]: Cannot Subscribe. Not connected to broker")
+	}
 
-		protoMsg, ok := msg.Interface().(proto.Message)
-		if !ok {
-			logger.Warn().Msg("[NATS]: Message does not implement protobuf message")
-			return
-		}
+	handler, err := broker.NewHandlerFunc(h)
+	if err != nil {
+		return nil, errors.Wrap(err, "[NATS]")
+	}
 
-		err := proto.Unmarshal(m.Data, protoMsg)
-		if err != nil {
-			logger.Warn().Msg("[NATS]: Could not decode message")
-			return
-		}
+	return n.subscribe(topic, handler, broker.HandlerType(h), broker.NewSubscribeOptions(opts...))
+}
 
-		res := cb.Call([]reflect.Value{reflect.ValueOf(context.Background()), msg})
+// SubscribeRaw subscribes a raw handler to the topic
+func (n *natsBroker) SubscribeRaw(topic string, h func(c context.Context, data []byte) error, opts ...broker.SubscribeOption) (broker.Subscriber, error) {
 
-		if len(res) != 1 {
-			logger.Warn().Msg("[NATS]: Invalid return value")
-			return
-		}
+	if n.connection == nil {
+		return nil, errors.New("[NATS]: Cannot Subscribe. Not connected to broker")
+	}
+
+	return n.subscribe(topic, broker.NewRawHandlerFunc(h), broker.HandlerType(h), broker.NewSubscribeOptions(opts...))
+}
+
+// subscribe subscribes the handler to the topic
+func (n *natsBroker) subscribe(topic string, h broker.HandlerFunc, handlerType string, opts broker.SubscribeOptions) (broker.Subscriber, error) {
+
+	if err := checkSubscribeOptions(opts); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(n.ctx)
+	subscriber := &natsSubscriber{
+		id:          broker.NewID(),
+		topic:       topic,
+		queue:       opts.QueueGroup(n.options.Name),
+		handlerType: opts.ReportedHandlerType(handlerType),
+		subscribed:  time.Now(),
+		workers:     broker.NewWorkers(opts.Concurrency, opts.BufferSize),
+		broker:      n,
+		cancel:      cancel,
+	}
 
-		if v := res[0].Interface(); v != nil {
-			err, ok = v.(error)
-			if !ok {
-				logger.Warn().Msg("[NATS]: Could not parse error")
-			} else {
+	// the client calls cb for one message at a time, the workers process them concurrently
+	cb := func(m *nats.Msg) {
+		subscriber.stats.Receive()
+		subscriber.workers.Go(func() {
+			msg := toMessage(m)
+			err := broker.Deliver(ctx, n, h, msg, opts)
+			subscriber.stats.Done(err)
+			if err != nil {
 				logger.Error().Err(err).Msg("")
 			}
-		}
-	})
+			if msg.ReplyTo != "" && msg.Response != nil {
+				if err := n.publish(msg.ReplyTo, msg.Response); err != nil {
+					logger.Error().Err(err).Msg("")
+				}
+			}
+		})
+	}
+
+	var subscription *nats.Subscription
+	var err error
+
+	queue := subscriber.queue
+	if queue != "" {
+		subscription, err = n.connection.QueueSubscribe(topic, queue, cb)
+	} else {
+		subscription, err = n.connection.Subscribe(topic, cb)
+	}
 
 	if err != nil {
+		if subscription != nil {
+			subscription.Unsubscribe()
+		}
+		subscriber.workers.Stop()
+		cancel()
 		return nil, err
 	}
 
-	subscriber := &natsSubscriber{
-		topic:        topic,
-		subscription: subscription,
-	}
+	subscriber.subscription = subscription
+	n.mu.Lock()
+	n.subscriptionMap[subscriber.id] = subscriber
+	n.mu.Unlock()
 
-	n.subscriptionMap[topic] = subscriber
+	if queue != "" {
+		logger.Info().Msgf("[NATS]: Subscribed to topic '%s' in queue group '%s'", topic, queue)
+		return subscriber, nil
+	}
 	logger.Info().Msgf("[NATS]: Subscribed to topic '%s'", topic)
 	return subscriber, nil
 }
 
-// SubscribeRaw subscribes a raw handler to the topic
-func (n *natsBroker) SubscribeRaw(topic string, h func(c context.Context, data []byte) error) (broker.Subscriber, error) {
-
-	if n.connection == nil {
-		return nil, errors.New("[NATS]: Cannot Subscribe. Not connected to broker")
+// checkSubscribeOptions rejects the options core NATS has no equivalent for. Messages are
+// not persisted and are never redelivered, so every subscription acks automatically. Nor
+// is there a prefetch, the client drops the messages beyond its pending limits instead
+func checkSubscribeOptions(opts broker.SubscribeOptions) error {
+	switch {
+	case opts.Prefetch > 0:
+		return broker.NotSupported("NATS", "Prefetch")
+	case opts.StartSequence > 0:
+		return broker.NotSupported("NATS", "StartAtSequence")
+	case !opts.StartTime.IsZero():
+		return broker.NotSupported("NATS", "StartAtTime")
 	}
+	return opts.CheckNative("NATS")
+}
 
-	subscription, err := n.connection.Subscribe(topic, func(m *nats.Msg) {
-		err := h(context.Background(), m.Data)
-		if err != nil {
-			logger.Error().Err(err).Msg("")
-		}
-	})
+// toNatsMsg encodes the envelope into a NATS message. c encodes the messages without content type
+func toNatsMsg(topic string, m *broker.Message, c broker.Codec) (*nats.Msg, error) {
 
+	msg, err := m.Encode(c)
 	if err != nil {
 		return nil, err
 	}
 
-	subscriber := &natsSubscriber{
-		topic:        topic,
-		subscription: subscription,
+	natsMsg := nats.NewMsg(topic)
+	natsMsg.Data = msg.Body
+	for k, v := range msg.Headers() {
+		natsMsg.Header.Set(k, v)
 	}
 
-	n.subscriptionMap[topic] = subscriber
-	logger.Info().Msgf("[NATS]: Subscribed to topic '%s'", topic)
-	return subscriber, nil
+	return natsMsg, nil
+}
+
+// toMessage extracts the envelope from the NATS message. The reply subject of
+// requests sent with the NATS request API is used as the reply topic
+func toMessage(m *nats.Msg) *broker.Message {
+	headers := make(map[string]string, len(m.Header))
+	for k := range m.Header {
+		headers[k] = m.Header.Get(k)
+	}
+	msg := broker.MessageFromHeaders(m.Subject, headers, m.Data)
+	if msg.ReplyTo == "" {
+		msg.ReplyTo = m.Reply
+	}
+	return msg
 }
 
 // New returns a new natsBroker broker
@@ -2,11 +2,26 @@ package nats
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/adityak368/ego/broker"
 	proto "github.com/adityak368/ego/broker/proto/gen/broker"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
 )
@@ -52,6 +67,7 @@ func TestNats(t *testing.T) {
 
 	err := bkr.Connect()
 	r.Nil(err)
+	defer bkr.Disconnect()
 
 	subscriptionRaw, err := bkr.SubscribeRaw("test.testMessageRaw", OnTestMessageRaw)
 	r.Nil(err)
@@ -82,3 +98,693 @@ func TestNats(t *testing.T) {
 	}
 
 }
+
+func TestNatsMessage(t *testing.T) {
+
+	r := require.New(t)
+
+	c := make(chan *broker.Message, 1)
+
+	// TestMessage is a protobuf message received along with its envelope
+	OnTestMessageWithEnvelope := func(ctx context.Context, msg *proto.TestMessage, m *broker.Message) error {
+		r.Equal(msg.Data, "Test", "Wrong data received")
+		c <- m
+		return nil
+	}
+
+	bkr := New()
+	bkr.Init(broker.Options{
+		Name:    "Nats",
+		Address: "localhost:4222",
+	})
+
+	err := bkr.Connect()
+	r.Nil(err)
+	defer bkr.Disconnect()
+
+	subscription, err := bkr.Subscribe("test.testMessageEnvelope", OnTestMessageWithEnvelope)
+	r.Nil(err)
+	defer subscription.Unsubscribe()
+
+	err = bkr.PublishMessage("test.testMessageEnvelope", &broker.Message{
+		CorrelationID: "correlation",
+		Header:        map[string]string{"Tenant": "ego"},
+		Data:          &proto.TestMessage{Data: "Test"},
+	})
+	r.Nil(err)
+
+	select {
+	case m := <-c:
+		r.NotEmpty(m.ID)
+		r.False(m.Timestamp.IsZero())
+		r.Equal(broker.ContentTypeProtobuf, m.ContentType)
+		r.Equal("correlation", m.CorrelationID)
+		r.Equal("ego", m.Header["Tenant"])
+		r.Equal("test.testMessageEnvelope", m.Topic)
+	case <-time.After(timeout):
+		t.Error("Timed out waiting for message from broker")
+	}
+}
+
+func TestNatsContext(t *testing.T) {
+
+	r := require.New(t)
+
+	c := make(chan context.Context, 1)
+
+	// msg is a raw message
+	OnTestMessageRaw := func(ctx context.Context, msg []byte) error {
+		c <- ctx
+		return nil
+	}
+
+	bkr := New()
+	bkr.Init(broker.Options{
+		Name:    "Nats",
+		Address: "localhost:4222",
+	})
+
+	err := bkr.Connect()
+	r.Nil(err)
+
+	subscription, err := bkr.SubscribeRaw("test.testMessageContext", OnTestMessageRaw, broker.HandlerTimeout(time.Minute))
+	r.Nil(err)
+
+	err = bkr.PublishMessage("test.testMessageContext", &broker.Message{CorrelationID: "correlation", Body: []byte("Test")})
+	r.Nil(err)
+
+	var ctx context.Context
+	select {
+	case ctx = <-c:
+	case <-time.After(timeout):
+		t.Fatal("Timed out waiting for message from broker")
+	}
+
+	m, ok := broker.FromContext(ctx)
+	r.True(ok, "Context should carry the envelope")
+	r.Equal("correlation", m.CorrelationID)
+
+	_, ok = ctx.Deadline()
+	r.True(ok, "Context should carry the processing deadline")
+
+	r.Nil(subscription.Unsubscribe())
+	r.Nil(bkr.Disconnect())
+}
+
+func TestNatsQueueGroups(t *testing.T) {
+
+	r := require.New(t)
+
+	var mu sync.Mutex
+	received := map[string]int{}
+	done := make(chan bool, 1)
+	handler := func(name string) func(ctx context.Context, msg []byte) error {
+		return func(ctx context.Context, msg []byte) error {
+			mu.Lock()
+			defer mu.Unlock()
+			received[name]++
+			if name == "broadcast" && received[name] == 10 {
+				done <- true
+			}
+			return nil
+		}
+	}
+
+	bkr := New()
+	bkr.Init(broker.Options{
+		Name:    "Nats",
+		Address: "localhost:4222",
+	})
+
+	err := bkr.Connect()
+	r.Nil(err)
+	defer bkr.Disconnect()
+
+	_, err = bkr.SubscribeRaw("test.testMessageQueue", handler("worker1"), broker.Queue("workers"))
+	r.Nil(err)
+	_, err = bkr.SubscribeRaw("test.testMessageQueue", handler("worker2"), broker.Queue("workers"))
+	r.Nil(err)
+	_, err = bkr.SubscribeRaw("test.testMessageQueue", handler("broadcast"), broker.Broadcast())
+	r.Nil(err)
+
+	for i := 0; i < 10; i++ {
+		r.Nil(bkr.PublishRaw("test.testMessageQueue", []byte("Test")))
+	}
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		t.Fatal("Timed out waiting for message from broker")
+	}
+
+	r.Nil(bkr.Handle().(*nats.Conn).Flush())
+	time.Sleep(100 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	r.Equal(10, received["worker1"]+received["worker2"], "Each message should be handled once per queue group")
+}
+
+func TestNatsRequest(t *testing.T) {
+
+	r := require.New(t)
+
+	bkr := New()
+	bkr.Init(broker.Options{
+		Name:    "Nats",
+		Address: "localhost:4222",
+	})
+
+	err := bkr.Connect()
+	r.Nil(err)
+	defer bkr.Disconnect()
+
+	OnEcho := func(ctx context.Context, req *proto.TestMessage) (*proto.TestMessage, error) {
+		if req.Data == "fail" {
+			return nil, errors.New("Something went wrong")
+		}
+		return &proto.TestMessage{Data: "Echo " + req.Data}, nil
+	}
+
+	_, err = bkr.Subscribe("test.echo", OnEcho)
+	r.Nil(err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	resp := &proto.TestMessage{}
+	r.Nil(bkr.Request(ctx, "test.echo", &proto.TestMessage{Data: "Test"}, resp))
+	r.Equal("Echo Test", resp.Data)
+
+	err = bkr.Request(ctx, "test.echo", &proto.TestMessage{Data: "fail"}, resp)
+	r.EqualError(err, "Something went wrong", "Responder errors should be returned to the requester")
+
+	err = bkr.Request(ctx, "test.nobody", &proto.TestMessage{Data: "Test"}, resp)
+	r.NotNil(err, "Request should fail without a responder")
+}
+
+func TestNatsRetry(t *testing.T) {
+
+	r := require.New(t)
+
+	bkr := New()
+	bkr.Init(broker.Options{
+		Name:    "Nats",
+		Address: "localhost:4222",
+	})
+
+	err := bkr.Connect()
+	r.Nil(err)
+	defer bkr.Disconnect()
+
+	var mu sync.Mutex
+	attempts := 0
+
+	OnTestMessageRawWithError := func(ctx context.Context, msg []byte) error {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		return errors.New("Something went wrong")
+	}
+
+	dead := make(chan *broker.Message, 1)
+	_, err = bkr.SubscribeRaw("test.testMessageDead", func(ctx context.Context, msg []byte) error {
+		m, _ := broker.FromContext(ctx)
+		dead <- m
+		return nil
+	})
+	r.Nil(err)
+
+	_, err = bkr.SubscribeRaw("test.testMessageRetry", OnTestMessageRawWithError, broker.Retry(broker.RetryPolicy{
+		MaxAttempts:     3,
+		Backoff:         10 * time.Millisecond,
+		DeadLetterTopic: "test.testMessageDead",
+	}))
+	r.Nil(err)
+
+	r.Nil(bkr.PublishRaw("test.testMessageRetry", []byte("Test")))
+
+	select {
+	case m := <-dead:
+		r.Equal([]byte("Test"), m.Body)
+		r.Equal("3", m.Header[broker.HeaderAttempts])
+		r.Equal("test.testMessageRetry", m.Header[broker.HeaderOriginalTopic])
+	case <-time.After(timeout):
+		t.Fatal("Timed out waiting for dead letter")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	r.Equal(3, attempts)
+}
+
+func TestNatsRecover(t *testing.T) {
+
+	r := require.New(t)
+
+	bkr := New()
+	bkr.Init(broker.Options{
+		Name:    "Nats",
+		Address: "localhost:4222",
+	})
+
+	err := bkr.Connect()
+	r.Nil(err)
+	defer bkr.Disconnect()
+
+	c := make(chan bool, 2)
+	OnTestMessageRawWithPanic := func(ctx context.Context, msg []byte) error {
+		c <- true
+		panic("Something went wrong")
+	}
+
+	_, err = bkr.SubscribeRaw("test.testMessagePanic", OnTestMessageRawWithPanic)
+	r.Nil(err)
+
+	for i := 0; i < 2; i++ {
+		r.Nil(bkr.PublishRaw("test.testMessagePanic", []byte("Test")))
+		select {
+		case <-c:
+		case <-time.After(timeout):
+			t.Fatal("Timed out waiting for message after panic")
+		}
+	}
+}
+
+func TestNatsCodecs(t *testing.T) {
+
+	r := require.New(t)
+
+	// Order is a plain Go struct which is exchanged as JSON
+	type Order struct {
+		ID    string `json:"id"`
+		Total int    `json:"total"`
+	}
+
+	bkr := New()
+	bkr.Init(broker.Options{
+		Name:    "Nats",
+		Address: "localhost:4222",
+		Codec:   broker.JSONCodec{},
+	})
+
+	err := bkr.Connect()
+	r.Nil(err)
+	defer bkr.Disconnect()
+
+	c := make(chan *broker.Message, 1)
+	OnOrder := func(ctx context.Context, order *Order, m *broker.Message) error {
+		r.Equal(Order{ID: "order", Total: 42}, *order)
+		c <- m
+		return nil
+	}
+
+	_, err = bkr.Subscribe("test.testMessageJSON", OnOrder)
+	r.Nil(err)
+
+	r.Nil(bkr.PublishMessage("test.testMessageJSON", &broker.Message{Data: &Order{ID: "order", Total: 42}}))
+
+	select {
+	case m := <-c:
+		r.Equal(broker.ContentTypeJSON, m.ContentType)
+		r.JSONEq(`{"id": "order", "total": 42}`, string(m.Body))
+	case <-time.After(timeout):
+		t.Fatal("Timed out waiting for message from broker")
+	}
+}
+
+func TestNatsConcurrency(t *testing.T) {
+
+	r := require.New(t)
+
+	bkr := New()
+	bkr.Init(broker.Options{
+		Name:    "Nats",
+		Address: "localhost:4222",
+	})
+
+	err := bkr.Connect()
+	r.Nil(err)
+	defer bkr.Disconnect()
+
+	// every handler waits until all the workers are busy
+	const workers = 4
+	var inFlight sync.WaitGroup
+	inFlight.Add(workers)
+	busy := make(chan bool)
+	go func() {
+		inFlight.Wait()
+		close(busy)
+	}()
+
+	_, err = bkr.SubscribeRaw("test.testMessageConcurrent", func(ctx context.Context, msg []byte) error {
+		inFlight.Done()
+		<-busy
+		return nil
+	}, broker.Concurrency(workers), broker.BufferSize(workers))
+	r.Nil(err)
+
+	for i := 0; i < workers; i++ {
+		r.Nil(bkr.PublishRaw("test.testMessageConcurrent", []byte("Test")))
+	}
+
+	select {
+	case <-busy:
+	case <-time.After(timeout):
+		t.Fatal("Messages should be handled concurrently")
+	}
+
+	// with a single worker the messages are handled in publish order
+	const count = 100
+	received := make(chan string, count)
+	_, err = bkr.SubscribeRaw("test.testMessageOrdered", func(ctx context.Context, msg []byte) error {
+		received <- string(msg)
+		return nil
+	}, broker.Concurrency(1), broker.BufferSize(10))
+	r.Nil(err)
+
+	for i := 0; i < count; i++ {
+		r.Nil(bkr.PublishRaw("test.testMessageOrdered", []byte(fmt.Sprint(i))))
+	}
+
+	for i := 0; i < count; i++ {
+		select {
+		case msg := <-received:
+			r.Equal(fmt.Sprint(i), msg)
+		case <-time.After(timeout):
+			t.Fatal("Timed out waiting for message from broker")
+		}
+	}
+}
+
+func TestNatsOptions(t *testing.T) {
+
+	r := require.New(t)
+
+	bkr := New()
+	bkr.Init(broker.Options{
+		Name:    "Nats",
+		Address: "localhost:4222",
+	})
+
+	err := bkr.Connect()
+	r.Nil(err)
+	defer bkr.Disconnect()
+
+	c := make(chan *broker.Message, 1)
+	_, err = bkr.SubscribeRaw("test.testMessageOptions", func(ctx context.Context, msg []byte) error {
+		m, _ := broker.FromContext(ctx)
+		c <- m
+		return nil
+	}, broker.AutoAck())
+	r.Nil(err)
+
+	err = bkr.PublishRaw("test.testMessageOptions", []byte("Test"),
+		broker.WithHeader("Tenant", "ego"),
+		broker.WithCorrelationID("correlation"),
+	)
+	r.Nil(err)
+
+	select {
+	case m := <-c:
+		r.Equal("ego", m.Header["Tenant"])
+		r.Equal("correlation", m.CorrelationID)
+	case <-time.After(timeout):
+		t.Fatal("Timed out waiting for message from broker")
+	}
+
+	// core NATS neither expires nor replays messages
+	err = bkr.PublishRaw("test.testMessageOptions", []byte("Test"), broker.TTL(time.Minute))
+	r.True(errors.Is(err, broker.ErrNotSupported), "TTL should be rejected")
+
+	_, err = bkr.SubscribeRaw("test.testMessageOptions", func(ctx context.Context, msg []byte) error {
+		return nil
+	}, broker.StartAtTime(time.Now()))
+	r.True(errors.Is(err, broker.ErrNotSupported), "Start positions should be rejected")
+
+	// the client would drop the messages beyond a pending limit
+	_, err = bkr.SubscribeRaw("test.testMessageOptions", func(ctx context.Context, msg []byte) error {
+		return nil
+	}, broker.Prefetch(10))
+	r.True(errors.Is(err, broker.ErrNotSupported), "Prefetch should be rejected")
+}
+
+func TestNatsDrain(t *testing.T) {
+
+	r := require.New(t)
+
+	bkr := New()
+	bkr.Init(broker.Options{
+		Name:    "Nats",
+		Address: "localhost:4222",
+	})
+
+	err := bkr.Connect()
+	r.Nil(err)
+
+	const count = 5
+	var mu sync.Mutex
+	handled := 0
+	_, err = bkr.SubscribeRaw("test.testMessageDrain", func(ctx context.Context, msg []byte) error {
+		time.Sleep(50 * time.Millisecond)
+		mu.Lock()
+		defer mu.Unlock()
+		handled++
+		return nil
+	}, broker.BufferSize(count))
+	r.Nil(err)
+
+	for i := 0; i < count; i++ {
+		r.Nil(bkr.PublishRaw("test.testMessageDrain", []byte("Test")))
+	}
+	r.Nil(bkr.Handle().(*nats.Conn).Flush())
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	r.Nil(bkr.Drain(ctx))
+
+	mu.Lock()
+	defer mu.Unlock()
+	r.Equal(count, handled, "Drain should wait for the received messages")
+	r.True(bkr.Handle().(*nats.Conn).IsClosed())
+}
+
+func TestNatsStatus(t *testing.T) {
+
+	r := require.New(t)
+
+	var mu sync.Mutex
+	var statuses []broker.Status
+
+	bkr := New()
+	r.Equal(broker.StatusDisconnected, bkr.Status())
+	bkr.Init(broker.Options{
+		Name:      "Nats",
+		Address:   "localhost:4222",
+		Reconnect: broker.ReconnectPolicy{MaxAttempts: -1},
+		OnStatus: func(status broker.Status) {
+			mu.Lock()
+			defer mu.Unlock()
+			statuses = append(statuses, status)
+		},
+	})
+	notify := bkr.NotifyStatus()
+
+	r.Nil(bkr.Connect())
+	r.Equal(broker.StatusConnected, bkr.Status())
+	r.False(bkr.Handle().(*nats.Conn).Opts.AllowReconnect, "A negative MaxAttempts should disable reconnecting")
+
+	r.Nil(bkr.Disconnect())
+	for _, want := range []broker.Status{broker.StatusConnected, broker.StatusClosed} {
+		select {
+		case status := <-notify:
+			r.Equal(want, status)
+		case <-time.After(timeout):
+			t.Fatalf("Timed out waiting for status %s", want)
+		}
+	}
+	r.Equal(broker.StatusClosed, bkr.Status())
+
+	mu.Lock()
+	defer mu.Unlock()
+	r.Equal([]broker.Status{broker.StatusConnected, broker.StatusClosed}, statuses)
+}
+
+func TestNatsSubscriptions(t *testing.T) {
+
+	r := require.New(t)
+
+	bkr := New()
+	bkr.Init(broker.Options{
+		Name:    "Nats",
+		Address: "localhost:4222",
+	})
+	r.Nil(bkr.Connect())
+	defer bkr.Disconnect()
+
+	c := make(chan bool, 2)
+	handler := func(ctx context.Context, msg []byte) error {
+		c <- true
+		return nil
+	}
+
+	first, err := bkr.SubscribeRaw("test.testMessageSubscriptions", handler, broker.Broadcast())
+	r.Nil(err)
+	second, err := bkr.SubscribeRaw("test.testMessageSubscriptions", handler, broker.Broadcast())
+	r.Nil(err)
+	r.NotEqual(first.ID(), second.ID(), "Subscriptions of the same topic should have unique ids")
+
+	r.Nil(bkr.PublishRaw("test.testMessageSubscriptions", []byte("Test")))
+	for i := 0; i < 2; i++ {
+		select {
+		case <-c:
+		case <-time.After(timeout):
+			t.Fatal("Both subscriptions should receive the message")
+		}
+	}
+
+	subscriptions := bkr.Subscriptions()
+	r.Len(subscriptions, 2, "The second subscription should not replace the first")
+	for _, s := range subscriptions {
+		r.Equal("test.testMessageSubscriptions", s.Topic)
+		r.Equal("func(context.Context, []uint8) error", s.Handler)
+		r.Equal(uint64(1), s.Stats.Received)
+	}
+
+	r.Nil(first.Unsubscribe())
+	subscriptions = bkr.Subscriptions()
+	r.Len(subscriptions, 1)
+	r.Equal(second.ID(), subscriptions[0].ID)
+
+	_, err = bkr.SubscribeRaw("test.testMessageSubscriptions", handler)
+	r.Nil(err)
+	r.Nil(bkr.UnsubscribeAll())
+	r.Empty(bkr.Subscriptions())
+	r.Equal(broker.StatusConnected, bkr.Status(), "Broker should stay connected")
+}
+
+// selfSignedCert returns the TLS config of a server with a self-signed certificate for
+// localhost and the TLS config of a client trusting it
+func selfSignedCert(t *testing.T) (*tls.Config, *tls.Config) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.Nil(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.Nil(t, err)
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+
+	serverConfig := &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		MinVersion:   tls.VersionTLS12,
+	}
+	return serverConfig, &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12}
+}
+
+// runServer starts an embedded nats-server with the options
+func runServer(t *testing.T, opts *server.Options) *server.Server {
+	opts.Host = "127.0.0.1"
+	opts.Port = -1
+	opts.NoLog = true
+	opts.NoSigs = true
+
+	ns, err := server.NewServer(opts)
+	require.Nil(t, err)
+
+	go ns.Start()
+	if !ns.ReadyForConnections(timeout) {
+		t.Fatal("nats-server did not start")
+	}
+	t.Cleanup(ns.Shutdown)
+	return ns
+}
+
+// connect connects a broker with the options to the embedded server
+func connect(ns *server.Server, opts broker.Options) (broker.Broker, error) {
+	opts.Name = "Nats"
+	opts.Address = fmt.Sprintf("nats://localhost:%d", ns.Addr().(*net.TCPAddr).Port)
+
+	bkr := New()
+	bkr.Init(opts)
+	return bkr, bkr.Connect()
+}
+
+func TestNatsAuth(t *testing.T) {
+
+	r := require.New(t)
+
+	serverTLS, clientTLS := selfSignedCert(t)
+	ns := runServer(t, &server.Options{
+		TLSConfig: serverTLS,
+		TLS:       true,
+		Username:  "ego",
+		Password:  "secret",
+	})
+
+	_, err := connect(ns, broker.Options{Username: "ego", Password: "secret"})
+	r.NotNil(err, "Connecting without TLS should fail")
+	_, err = connect(ns, broker.Options{TLSConfig: clientTLS, Username: "ego", Password: "wrong"})
+	r.NotNil(err, "Connecting with a wrong password should fail")
+
+	bkr, err := connect(ns, broker.Options{TLSConfig: clientTLS, Username: "ego", Password: "secret"})
+	r.Nil(err)
+	defer bkr.Disconnect()
+	r.True(bkr.Handle().(*nats.Conn).TLSRequired())
+
+	c := make(chan bool, 1)
+	_, err = bkr.SubscribeRaw("test.testMessageAuth", func(ctx context.Context, msg []byte) error {
+		c <- true
+		return nil
+	})
+	r.Nil(err)
+	r.Nil(bkr.PublishRaw("test.testMessageAuth", []byte("Test")))
+	select {
+	case <-c:
+	case <-time.After(timeout):
+		t.Fatal("Timed out waiting for message from broker")
+	}
+
+	tokenServer := runServer(t, &server.Options{Authorization: "s3cr3t"})
+	_, err = connect(tokenServer, broker.Options{Token: "wrong"})
+	r.NotNil(err, "Connecting with a wrong token should fail")
+	bkr, err = connect(tokenServer, broker.Options{Token: "s3cr3t"})
+	r.Nil(err)
+	r.Nil(bkr.Disconnect())
+
+	user, err := nkeys.CreateUser()
+	r.Nil(err)
+	publicKey, err := user.PublicKey()
+	r.Nil(err)
+	seed, err := user.Seed()
+	r.Nil(err)
+	seedFile := filepath.Join(t.TempDir(), "user.nk")
+	r.Nil(os.WriteFile(seedFile, seed, 0600))
+
+	nkeyServer := runServer(t, &server.Options{Nkeys: []*server.NkeyUser{{Nkey: publicKey}}})
+	_, err = connect(nkeyServer, broker.Options{})
+	r.NotNil(err, "Connecting without the NKEY should fail")
+	bkr, err = connect(nkeyServer, broker.Options{NKeySeedFile: seedFile})
+	r.Nil(err)
+	r.Nil(bkr.Disconnect())
+
+	_, err = connect(nkeyServer, broker.Options{NKeySeedFile: filepath.Join(t.TempDir(), "missing.nk")})
+	r.NotNil(err, "A missing seed file should fail")
+	_, err = connect(nkeyServer, broker.Options{CredentialsFile: filepath.Join(t.TempDir(), "missing.creds")})
+	r.NotNil(err, "A missing credentials file should fail")
+}
@@ -1,14 +1,30 @@
 package nats
 
 import (
+	"context"
 	"fmt"
+	"time"
 
+	"github.com/adityak368/ego/broker"
 	"github.com/nats-io/nats.go"
 )
 
 type natsSubscriber struct {
+	id           string
 	topic        string
+	queue        string
+	handlerType  string
+	subscribed   time.Time
 	subscription *nats.Subscription
+	workers      *broker.Workers
+	stats        broker.StatsCounter
+	broker       *natsBroker
+	cancel       context.CancelFunc
+}
+
+// ID returns the unique id of the subscription
+func (s *natsSubscriber) ID() string {
+	return s.id
 }
 
 // Topic returns the subscribed topic
@@ -16,10 +32,49 @@ func (s *natsSubscriber) Topic() string {
 	return s.topic
 }
 
-// Unsubscribe unsibscribes to the topic
+// info describes the subscription
+func (s *natsSubscriber) info() broker.SubscriptionInfo {
+	return broker.SubscriptionInfo{
+		ID:         s.id,
+		Topic:      s.topic,
+		Handler:    s.handlerType,
+		Subscribed: s.subscribed,
+		Queue:      s.queue,
+		Stats:      s.stats.Stats(),
+	}
+}
+
+// Unsubscribe unsubscribes to the topic and waits for the handlers in flight.
+// Buffered messages which were not handled yet are dropped
 func (s *natsSubscriber) Unsubscribe() error {
 	if s.subscription == nil {
 		return fmt.Errorf("[NATS]: Cannot unsubscribe from %s", s.topic)
 	}
-	return s.subscription.Unsubscribe()
+	s.broker.remove(s)
+	err := s.subscription.Unsubscribe()
+	s.cancel()
+	s.workers.Stop()
+	return err
+}
+
+// drain stops the subscription from receiving messages, lets the client hand the received
+// messages to the workers and waits for the workers to handle them
+func (s *natsSubscriber) drain(ctx context.Context) error {
+	defer s.cancel()
+
+	closed := s.subscription.StatusChanged(nats.SubscriptionClosed)
+	if err := s.subscription.Drain(); err != nil {
+		s.workers.Stop()
+		return err
+	}
+
+	select {
+	case <-closed:
+	case <-ctx.Done():
+		// the workers are stopped without waiting for the handlers in flight
+		s.subscription.Unsubscribe()
+		return s.workers.Drain(ctx)
+	}
+
+	return s.workers.Drain(ctx)
 }
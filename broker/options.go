@@ -1,7 +1,398 @@
 package broker
 
+import (
+	"crypto/tls"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrNotSupported is returned by the brokers for the options they cannot map to a native feature
+var ErrNotSupported = errors.New("option is not supported by the broker")
+
+// NotSupported returns the error for an option which is not supported by the implementation
+func NotSupported(implementation, option string) error {
+	return errors.Wrapf(ErrNotSupported, "[%s]: %s", implementation, option)
+}
+
 // Options is the config for the broker
 type Options struct {
 	Name    string
 	Address string
+	// Middleware wraps the handlers of every subscription of the broker
+	Middleware []Middleware
+	// Codec encodes the published messages which have no content type. Defaults to protobuf
+	Codec Codec
+	// Reconnect is the policy for re-establishing a lost connection. By default the broker
+	// reconnects without limit
+	Reconnect ReconnectPolicy
+	// OnStatus is called whenever the status of the connection changes
+	OnStatus func(Status)
+
+	// TLSConfig secures the connection to the broker. RabbitMQ requires an amqps:// address
+	TLSConfig *tls.Config
+	// Username and Password authenticate with the broker. RabbitMQ authenticates with its
+	// client certificate (SASL EXTERNAL) when TLSConfig has one and Username is empty
+	Username string
+	Password string
+	// Token authenticates with an auth token. NATS only
+	Token string
+	// CredentialsFile is a NATS credentials file holding the user JWT and NKEY seed. NATS only
+	CredentialsFile string
+	// NKeySeedFile is a file holding the NKEY seed the user authenticates with. NATS only
+	NKeySeedFile string
+}
+
+// SubscribeOptions is the config for a subscription
+type SubscribeOptions struct {
+	// Timeout is the processing deadline of a single delivery attempt. Zero means no deadline
+	Timeout time.Duration
+	// Retry is the retry policy of the failed deliveries. By default a failed delivery
+	// is left to the broker
+	Retry RetryPolicy
+	// Middleware wraps the handler of the subscription inside the middleware of the broker
+	Middleware []Middleware
+	// Queue is the queue group of the subscription. Subscribers of a topic in the same
+	// queue group compete for its messages. Defaults to the broker name, so several
+	// subscriptions of a service to the same topic share its messages unless they are
+	// given groups of their own or Broadcast
+	Queue string
+	// Broadcast delivers every message of the topic to the subscriber instead of joining a queue group
+	Broadcast bool
+	// StartSequence replays the stored messages of the topic starting from the sequence
+	StartSequence uint64
+	// StartTime replays the stored messages of the topic published since the time
+	StartTime time.Time
+	// Concurrency is the number of deliveries processed at the same time. Defaults to 1,
+	// which processes the deliveries in order
+	Concurrency int
+	// Prefetch is the number of unacknowledged deliveries the broker sends ahead of the
+	// handlers. Zero leaves it to the broker
+	Prefetch int
+	// BufferSize is the number of received deliveries waiting for a free handler
+	BufferSize int
+	// AutoAck acknowledges the deliveries when they are received instead of after the
+	// handler succeeded, so failed deliveries are not redelivered by the broker
+	AutoAck bool
+	// Dedup skips the messages which were processed already, see Dedup
+	Dedup DedupStore
+	// HandlerType is reported by Subscriptions instead of the type of the subscribed
+	// handler, see WithHandlerType
+	HandlerType string
+	// Native holds the options specific to a broker implementation by name, see NativeOption
+	Native map[string]interface{}
+
+	// subscription identifies a broadcast subscription, so that it deduplicates the messages
+	// on its own
+	subscription string
+}
+
+// SubscribeOption sets a value in the SubscribeOptions
+type SubscribeOption func(*SubscribeOptions)
+
+// NewSubscribeOptions returns the SubscribeOptions with the options applied
+func NewSubscribeOptions(opts ...SubscribeOption) SubscribeOptions {
+	options := SubscribeOptions{}
+	for _, o := range opts {
+		o(&options)
+	}
+	return options
+}
+
+// CheckNative returns an error for the first native option which does not belong to the
+// implementation. Native option names are prefixed with the lower case implementation name
+func (o SubscribeOptions) CheckNative(implementation string) error {
+	return checkNative(implementation, o.Native)
+}
+
+// ReportedHandlerType returns the handler type set with WithHandlerType, or handlerType
+func (o SubscribeOptions) ReportedHandlerType(handlerType string) string {
+	if o.HandlerType != "" {
+		return o.HandlerType
+	}
+	return handlerType
+}
+
+// checkNative returns an error for the first native option which does not belong to the implementation
+func checkNative(implementation string, native map[string]interface{}) error {
+	prefix := strings.ToLower(implementation) + "."
+	for name := range native {
+		if !strings.HasPrefix(name, prefix) {
+			return NotSupported(implementation, name)
+		}
+	}
+	return nil
+}
+
+// QueueGroup returns the queue group the subscription joins, or an empty string when
+// every message should be delivered to the subscriber. name is the broker name
+func (o SubscribeOptions) QueueGroup(name string) string {
+	if o.Broadcast {
+		return ""
+	}
+	if o.Queue != "" {
+		return o.Queue
+	}
+	return name
+}
+
+// HandlerTimeout sets the processing deadline of every delivery to the subscription
+func HandlerTimeout(d time.Duration) SubscribeOption {
+	return func(o *SubscribeOptions) {
+		o.Timeout = d
+	}
+}
+
+// Retry retries failed deliveries with exponential backoff and forwards the messages
+// to the dead-letter topic of the policy once every attempt failed
+func Retry(policy RetryPolicy) SubscribeOption {
+	return func(o *SubscribeOptions) {
+		o.Retry = policy
+	}
+}
+
+// WrapHandler adds middleware around the handler of the subscription. It runs inside
+// the middleware of the broker, once for every delivery attempt
+func WrapHandler(mw ...Middleware) SubscribeOption {
+	return func(o *SubscribeOptions) {
+		o.Middleware = append(o.Middleware, mw...)
+	}
+}
+
+// Queue sets the queue group of the subscription so that the subscribers in the group
+// share the messages of the topic
+func Queue(name string) SubscribeOption {
+	return func(o *SubscribeOptions) {
+		o.Queue = name
+		o.Broadcast = false
+		o.subscription = ""
+	}
+}
+
+// Broadcast makes the subscriber receive every message of the topic
+func Broadcast() SubscribeOption {
+	return func(o *SubscribeOptions) {
+		o.Queue = ""
+		o.Broadcast = true
+		o.subscription = NewID()
+	}
+}
+
+// StartAtSequence replays the stored messages of the topic starting from the sequence.
+// Only supported by brokers which persist messages
+func StartAtSequence(seq uint64) SubscribeOption {
+	return func(o *SubscribeOptions) {
+		o.StartSequence = seq
+	}
+}
+
+// StartAtTime replays the stored messages of the topic published since t.
+// Only supported by brokers which persist messages
+func StartAtTime(t time.Time) SubscribeOption {
+	return func(o *SubscribeOptions) {
+		o.StartTime = t
+	}
+}
+
+// Concurrency processes up to n deliveries of the subscription at the same time.
+// Deliveries are only processed in order with a concurrency of 1
+func Concurrency(n int) SubscribeOption {
+	return func(o *SubscribeOptions) {
+		o.Concurrency = n
+	}
+}
+
+// Prefetch limits the number of unacknowledged deliveries the broker sends ahead of the handlers
+func Prefetch(n int) SubscribeOption {
+	return func(o *SubscribeOptions) {
+		o.Prefetch = n
+	}
+}
+
+// BufferSize sets the number of received deliveries waiting for a free handler. Receiving
+// blocks once the buffer is full
+func BufferSize(n int) SubscribeOption {
+	return func(o *SubscribeOptions) {
+		o.BufferSize = n
+	}
+}
+
+// AutoAck acknowledges the deliveries of the subscription when they are received. Failed
+// deliveries are not redelivered by the broker
+func AutoAck() SubscribeOption {
+	return func(o *SubscribeOptions) {
+		o.AutoAck = true
+	}
+}
+
+// Dedup makes the subscriber an idempotent consumer. The messages whose id the store recorded
+// as processed are skipped and a message is recorded once its handler succeeded, so that
+// redeliveries and retries by the broker are handled once. While a delivery processes the
+// message, its concurrent deliveries fail with ErrInProgress. Messages without id are not
+// deduplicated
+func Dedup(store DedupStore) SubscribeOption {
+	return func(o *SubscribeOptions) {
+		o.Dedup = store
+	}
+}
+
+// WithHandlerType reports t as the type of the handler in Subscriptions. Handlers wrapping
+// another handler, like the ones of SubscribeTyped, report the type of the wrapped handler
+func WithHandlerType(t string) SubscribeOption {
+	return func(o *SubscribeOptions) {
+		o.HandlerType = t
+	}
+}
+
+// NativeOption sets an option specific to a broker implementation. The name is prefixed with
+// the lower case name of the implementation, e.g. "rabbitmq.exclusive", so that the other
+// implementations reject it instead of ignoring it
+func NativeOption(name string, value interface{}) SubscribeOption {
+	return func(o *SubscribeOptions) {
+		if o.Native == nil {
+			o.Native = make(map[string]interface{})
+		}
+		o.Native[name] = value
+	}
+}
+
+// PublishOptions is the config for a publish
+type PublishOptions struct {
+	// Header is added to the header of the message
+	Header map[string]string
+	// CorrelationID sets the correlation id of the message
+	CorrelationID string
+	// MessageID sets the id of the message. Brokers which deduplicate messages use it
+	// as the deduplication key
+	MessageID string
+	// Codec encodes the message instead of the codec of the broker
+	Codec Codec
+	// TTL is how long the message may wait for a consumer before it is discarded
+	TTL time.Duration
+	// Priority is the priority of the message. Higher priorities are delivered first
+	Priority uint8
+	// At delays the delivery of the message until the time, see PublishAt
+	At time.Time
+	// Native holds the options specific to a broker implementation by name, see NativePublishOption
+	Native map[string]interface{}
+}
+
+// PublishOption sets a value in the PublishOptions
+type PublishOption func(*PublishOptions)
+
+// NewPublishOptions returns the PublishOptions with the options applied
+func NewPublishOptions(opts ...PublishOption) PublishOptions {
+	options := PublishOptions{}
+	for _, o := range opts {
+		o(&options)
+	}
+	return options
+}
+
+// CheckNative returns an error for the first native option which does not belong to the
+// implementation. Native option names are prefixed with the lower case implementation name
+func (o PublishOptions) CheckNative(implementation string) error {
+	return checkNative(implementation, o.Native)
+}
+
+// Apply returns a copy of the message with the options applied. Data is encoded with the
+// codec of the options
+func (o PublishOptions) Apply(m *Message) (*Message, error) {
+	msg := *m
+
+	if len(o.Header) > 0 {
+		msg.Header = make(map[string]string, len(m.Header)+len(o.Header))
+		for k, v := range m.Header {
+			msg.Header[k] = v
+		}
+		for k, v := range o.Header {
+			msg.Header[k] = v
+		}
+	}
+	if o.CorrelationID != "" {
+		msg.CorrelationID = o.CorrelationID
+	}
+	if o.MessageID != "" {
+		msg.ID = o.MessageID
+	}
+	if o.Codec != nil {
+		return msg.Encode(o.Codec)
+	}
+	return &msg, nil
+}
+
+// WithHeader adds the header to the published message
+func WithHeader(key, value string) PublishOption {
+	return func(o *PublishOptions) {
+		if o.Header == nil {
+			o.Header = make(map[string]string)
+		}
+		o.Header[key] = value
+	}
+}
+
+// WithCorrelationID sets the correlation id of the published message
+func WithCorrelationID(id string) PublishOption {
+	return func(o *PublishOptions) {
+		o.CorrelationID = id
+	}
+}
+
+// WithMessageID sets the id of the published message. JetStream deduplicates the messages by id
+func WithMessageID(id string) PublishOption {
+	return func(o *PublishOptions) {
+		o.MessageID = id
+	}
+}
+
+// WithCodec encodes the published message with the codec instead of the codec of the broker
+func WithCodec(c Codec) PublishOption {
+	return func(o *PublishOptions) {
+		o.Codec = c
+	}
+}
+
+// TTL discards the published message when it is not consumed within d.
+// Only supported by RabbitMQ
+func TTL(d time.Duration) PublishOption {
+	return func(o *PublishOptions) {
+		o.TTL = d
+	}
+}
+
+// Priority sets the priority of the published message. Only supported by RabbitMQ
+// on queues declared with a maximum priority
+func Priority(p uint8) PublishOption {
+	return func(o *PublishOptions) {
+		o.Priority = p
+	}
+}
+
+// NativePublishOption sets a publish option specific to a broker implementation. Like with
+// NativeOption the name is prefixed with the lower case name of the implementation, e.g.
+// "mqtt.qos", so that the other implementations reject it instead of ignoring it
+func NativePublishOption(name string, value interface{}) PublishOption {
+	return func(o *PublishOptions) {
+		if o.Native == nil {
+			o.Native = make(map[string]interface{})
+		}
+		o.Native[name] = value
+	}
+}
+
+// PublishAt delays the delivery of the published message until t. The message can be
+// cancelled by its id until then, see Cancel. Brokers which cannot schedule messages fail
+// with ErrNotSupported, they are wrapped by the scheduler package instead
+func PublishAt(t time.Time) PublishOption {
+	return func(o *PublishOptions) {
+		o.At = t
+	}
+}
+
+// PublishAfter delays the delivery of the published message by d, see PublishAt
+func PublishAfter(d time.Duration) PublishOption {
+	return func(o *PublishOptions) {
+		o.At = time.Now().Add(d)
+	}
 }
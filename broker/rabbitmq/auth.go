@@ -0,0 +1,64 @@
+package rabbitmq
+
+import (
+	"strings"
+	"time"
+
+	"github.com/adityak368/ego/broker"
+	"github.com/pkg/errors"
+	"github.com/streadway/amqp"
+)
+
+// heartbeat and locale are the defaults of amqp.Dial
+const (
+	heartbeat = 10 * time.Second
+	locale    = "en_US"
+)
+
+// externalAuth authenticates with the client certificate of the TLS connection
+type externalAuth struct{}
+
+// Mechanism returns the name of the SASL mechanism
+func (externalAuth) Mechanism() string {
+	return "EXTERNAL"
+}
+
+// Response returns an empty response since the identity is taken from the certificate
+func (externalAuth) Response() string {
+	return ""
+}
+
+// amqpConfig maps the TLS config and the credentials of the broker options onto the dialer.
+// Without credentials in the options the credentials of the address are used
+func amqpConfig(o broker.Options) (amqp.Config, error) {
+	switch {
+	case o.Token != "":
+		return amqp.Config{}, broker.NotSupported("RABBITMQ", "Token")
+	case o.CredentialsFile != "":
+		return amqp.Config{}, broker.NotSupported("RABBITMQ", "CredentialsFile")
+	case o.NKeySeedFile != "":
+		return amqp.Config{}, broker.NotSupported("RABBITMQ", "NKeySeedFile")
+	}
+
+	config := amqp.Config{
+		Heartbeat: heartbeat,
+		Locale:    locale,
+	}
+
+	if o.TLSConfig != nil {
+		// the client only speaks TLS with amqps addresses
+		if !strings.HasPrefix(o.Address, "amqps://") {
+			return amqp.Config{}, errors.New("[RABBITMQ]: TLSConfig requires an amqps:// address")
+		}
+		config.TLSClientConfig = o.TLSConfig
+	}
+
+	switch {
+	case o.Username != "":
+		config.SASL = []amqp.Authentication{&amqp.PlainAuth{Username: o.Username, Password: o.Password}}
+	case o.TLSConfig != nil && (len(o.TLSConfig.Certificates) > 0 || o.TLSConfig.GetClientCertificate != nil):
+		config.SASL = []amqp.Authentication{externalAuth{}}
+	}
+
+	return config, nil
+}
@@ -1,13 +1,59 @@
 package rabbitmq
 
-import "github.com/streadway/amqp"
+import (
+	"time"
 
+	"github.com/streadway/amqp"
+)
+
+// defaultConfirmTimeout is how long Publish waits for the confirm of the broker in confirm mode
+const defaultConfirmTimeout = 5 * time.Second
+
+// Config is the config for the RabbitMQ broker. The queues of the subscriptions are
+// configured per subscription, see AutoDelete, Exclusive, NoWait, QueueArguments,
+// ConsumerArguments and broker.AutoAck
 type Config struct {
-	Durable          bool
+	// Durable declares the exchange and the queues of the subscriptions as durable
+	Durable bool
+	// DeleteWhenUnused is the default of AutoDelete for every subscription.
+	//
+	// Deprecated: use AutoDelete per subscription
 	DeleteWhenUnused bool
-	Exclusive        bool
-	NoWait           bool
-	AutoAck          bool
-	Exchange         string
-	Arguments        amqp.Table
+	// Exclusive is the default of Exclusive for every subscription.
+	//
+	// Deprecated: use Exclusive per subscription
+	Exclusive bool
+	// NoWait is the default of NoWait for every subscription.
+	//
+	// Deprecated: use NoWait per subscription
+	NoWait bool
+	// AutoAck acknowledges the deliveries of every subscription when they are received.
+	//
+	// Deprecated: use broker.AutoAck per subscription
+	AutoAck bool
+	// Arguments are the default consumer arguments of every subscription.
+	//
+	// Deprecated: use ConsumerArguments per subscription
+	Arguments amqp.Table
+	// Exchange is the exchange the messages are published to with the topic as routing key.
+	// Every queue group gets a queue bound to the exchange so that every service receives a
+	// copy of each message. If empty the predeclared exchange of ExchangeType is used, e.g.
+	// "amq.topic"
+	Exchange string
+	// ExchangeType is the type of Exchange, "topic" (the default), "fanout" or "direct". A
+	// fanout exchange ignores the topics, so its subscriptions have to subscribe to ">"
+	ExchangeType string
+	// DefaultExchange publishes to the default exchange instead of Exchange, where every topic
+	// is a queue. All the subscribers of a topic then compete for its messages, so queue
+	// groups, broadcast and wildcard topics are not supported
+	DefaultExchange bool
+	// ChannelPoolSize is the number of idle channels kept open for publishing. Defaults to 8
+	ChannelPoolSize int
+	// Confirm puts the publishing channels in confirm mode. Messages are published as
+	// mandatory and Publish waits until the broker acks them, failing with ErrNacked when
+	// the broker rejects a message and with ErrUnroutable when no queue is bound for it.
+	// The broker implements Confirmer for publishing with a context or asynchronously
+	Confirm bool
+	// ConfirmTimeout bounds how long Publish waits for the confirm. Defaults to 5 seconds
+	ConfirmTimeout time.Duration
 }
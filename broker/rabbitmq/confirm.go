@@ -0,0 +1,191 @@
+package rabbitmq
+
+import (
+	"context"
+	"sync"
+
+	"github.com/adityak368/ego/broker"
+	"github.com/pkg/errors"
+	"github.com/streadway/amqp"
+)
+
+var (
+	// ErrNacked is returned when the broker rejects a published message
+	ErrNacked = errors.New("[RABBITMQ]: Message was rejected by the broker")
+	// ErrUnroutable is returned when a published message is not routed to any queue
+	ErrUnroutable = errors.New("[RABBITMQ]: Message could not be routed to a queue")
+
+	errConfirmsDisabled = errors.New("[RABBITMQ]: Publisher confirms are not enabled. Set Config.Confirm")
+	errConfirmLost      = errors.New("[RABBITMQ]: Channel closed before the message was confirmed")
+)
+
+// confirmTagHeader carries the delivery tag of a message published in confirm mode, so that
+// a returned message is matched with its confirm. Its value is not a string, so it is not
+// part of the headers of the received messages
+const confirmTagHeader = "x-ego-confirm-tag"
+
+// Confirmer publishes messages with publisher confirms. The broker returned by New
+// implements it when Config.Confirm is set, e.g.
+//
+//	err := bkr.(rabbitmq.Confirmer).PublishConfirm(ctx, "orders.created", m)
+type Confirmer interface {
+	// PublishConfirm publishes the envelope to the topic and waits until the broker
+	// confirms it or ctx is done
+	PublishConfirm(ctx context.Context, topic string, m *broker.Message, opts ...broker.PublishOption) error
+	// PublishAsync publishes the envelope to the topic without waiting for the confirm.
+	// The returned channel receives nil once the broker acks the message, or the error
+	PublishAsync(topic string, m *broker.Message, opts ...broker.PublishOption) (<-chan error, error)
+}
+
+// confirms tracks the messages published on a channel in confirm mode until the broker
+// acks them. Messages are published as mandatory, so unroutable messages are returned
+// by the broker before they are acked. Returns carry no delivery tag, so every message
+// carries its tag in the confirmTagHeader
+type confirms struct {
+	// next is the delivery tag of the next publish
+	next     uint64
+	pending  map[uint64]*pendingConfirm
+	returned map[uint64]bool
+	mu       sync.Mutex
+	// unconfirmed counts the messages waiting for their confirm
+	unconfirmed sync.WaitGroup
+}
+
+// pendingConfirm is a published message waiting for its confirm
+type pendingConfirm struct {
+	done chan error
+}
+
+// newConfirms puts the channel in confirm mode and starts listening for the confirms
+func newConfirms(ch *amqp.Channel) (*confirms, error) {
+	if err := ch.Confirm(false); err != nil {
+		return nil, err
+	}
+
+	c := &confirms{
+		next:     1,
+		pending:  make(map[uint64]*pendingConfirm),
+		returned: make(map[uint64]bool),
+	}
+
+	// the notifications are unbuffered so that a return is always received before the
+	// confirm of the message which follows it
+	returns := ch.NotifyReturn(make(chan amqp.Return))
+	acks := ch.NotifyPublish(make(chan amqp.Confirmation))
+	go c.listen(returns, acks)
+
+	return c, nil
+}
+
+// publish publishes the message as mandatory and returns the channel receiving its confirm
+func (c *confirms) publish(ch *amqp.Channel, exchange, routingKey string, msg amqp.Publishing) (<-chan error, error) {
+	done := make(chan error, 1)
+
+	c.mu.Lock()
+	tag := c.next
+	c.next++
+	c.pending[tag] = &pendingConfirm{done: done}
+	c.unconfirmed.Add(1)
+	c.mu.Unlock()
+
+	if msg.Headers == nil {
+		msg.Headers = amqp.Table{}
+	}
+	msg.Headers[confirmTagHeader] = int64(tag)
+
+	if err := ch.Publish(exchange, routingKey, true, false, msg); err != nil {
+		// the channel is discarded after a failed publish, so the tag is not reused
+		c.mu.Lock()
+		delete(c.pending, tag)
+		c.unconfirmed.Done()
+		c.mu.Unlock()
+		return nil, err
+	}
+
+	return done, nil
+}
+
+// listen resolves the pending messages until the channel is closed. Messages which are
+// still pending then fail
+func (c *confirms) listen(returns <-chan amqp.Return, acks <-chan amqp.Confirmation) {
+	for returns != nil || acks != nil {
+		select {
+		case r, ok := <-returns:
+			if !ok {
+				returns = nil
+				continue
+			}
+			if tag, ok := r.Headers[confirmTagHeader].(int64); ok {
+				c.mu.Lock()
+				c.returned[uint64(tag)] = true
+				c.mu.Unlock()
+			}
+		case a, ok := <-acks:
+			if !ok {
+				acks = nil
+				continue
+			}
+			c.confirm(a)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for tag, p := range c.pending {
+		p.done <- errConfirmLost
+		delete(c.pending, tag)
+		c.unconfirmed.Done()
+	}
+}
+
+// wait waits until every published message is confirmed
+func (c *confirms) wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		c.unconfirmed.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "[RABBITMQ]: Messages are waiting for their confirm")
+	}
+}
+
+// confirm resolves the message with the delivery tag of the confirmation
+func (c *confirms) confirm(a amqp.Confirmation) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	p, ok := c.pending[a.DeliveryTag]
+	if !ok {
+		return
+	}
+	delete(c.pending, a.DeliveryTag)
+	defer c.unconfirmed.Done()
+
+	returned := c.returned[a.DeliveryTag]
+	delete(c.returned, a.DeliveryTag)
+
+	switch {
+	case !a.Ack:
+		p.done <- ErrNacked
+	case returned:
+		p.done <- ErrUnroutable
+	default:
+		p.done <- nil
+	}
+}
+
+// waitConfirm waits for the confirm of a published message
+func waitConfirm(ctx context.Context, confirm <-chan error) error {
+	select {
+	case err := <-confirm:
+		return err
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "[RABBITMQ]: No confirm from the broker")
+	}
+}
@@ -0,0 +1,395 @@
+package rabbitmq
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/adityak368/ego/broker"
+	"github.com/adityak368/swissknife/logger/v2"
+	"github.com/pkg/errors"
+	"github.com/streadway/amqp"
+)
+
+const (
+	// defaultChannelPoolSize is the number of idle publishing channels kept open
+	defaultChannelPoolSize = 8
+)
+
+// errConnectionLost is returned while the connection is being re-established
+var errConnectionLost = errors.New("[RABBITMQ]: Connection lost. Reconnecting")
+
+// connection is the single connection of the broker to RabbitMQ. Publishers borrow channels
+// from a pool and every consumer opens a channel of its own. When the connection is lost it
+// is re-established in the background, the declared exchanges are re-declared and the
+// consumers waiting in wait are released so that they re-declare their queues. Once the
+// attempts of the reconnect policy are used up the connection is closed
+type connection struct {
+	url     string
+	config  amqp.Config
+	conn    *amqp.Connection
+	pool    chan *channel
+	confirm bool
+	policy  broker.ReconnectPolicy
+	// setStatus reports the changes of the connection status
+	setStatus func(broker.Status)
+
+	// exchanges holds the declared exchanges by name along with their declaration
+	exchanges map[string]func(ch *amqp.Channel) error
+	// delays holds when the delay queues were declared by name
+	delays map[string]time.Time
+
+	// ready is closed once the connection is established
+	ready  chan struct{}
+	closed bool
+	mu     sync.RWMutex
+}
+
+// channel is a publishing channel of the pool. In confirm mode confirms tracks the
+// messages published on the channel until the broker acks them
+type channel struct {
+	*amqp.Channel
+	confirms *confirms
+}
+
+// publish publishes the message on the channel. In confirm mode it returns the channel
+// receiving the confirm of the broker
+func (ch *channel) publish(exchange, routingKey string, msg amqp.Publishing) (<-chan error, error) {
+	if ch.confirms == nil {
+		return nil, ch.Publish(exchange, routingKey, false, false, msg)
+	}
+	return ch.confirms.publish(ch.Channel, exchange, routingKey, msg)
+}
+
+// dial connects to RabbitMQ with the config and starts watching the connection. With
+// confirm the publishing channels are put in confirm mode
+func dial(url string, config amqp.Config, poolSize int, confirm bool, policy broker.ReconnectPolicy, setStatus func(broker.Status)) (*connection, error) {
+	conn, err := amqp.DialConfig(url, config)
+	if err != nil {
+		return nil, err
+	}
+
+	if poolSize <= 0 {
+		poolSize = defaultChannelPoolSize
+	}
+
+	c := &connection{
+		url:       url,
+		config:    config,
+		conn:      conn,
+		pool:      make(chan *channel, poolSize),
+		confirm:   confirm,
+		policy:    policy,
+		setStatus: setStatus,
+		exchanges: make(map[string]func(ch *amqp.Channel) error),
+		delays:    make(map[string]time.Time),
+		ready:     make(chan struct{}),
+	}
+	close(c.ready)
+	setStatus(broker.StatusConnected)
+
+	go c.watch(conn.NotifyClose(make(chan *amqp.Error, 1)))
+	return c, nil
+}
+
+// Connection returns the current connection or nil while reconnecting
+func (c *connection) Connection() *amqp.Connection {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.closed || c.conn.IsClosed() {
+		return nil
+	}
+	return c.conn
+}
+
+// wait blocks until the connection is established
+func (c *connection) wait(ctx context.Context) (*amqp.Connection, error) {
+	for {
+		c.mu.RLock()
+		conn, ready, closed := c.conn, c.ready, c.closed
+		c.mu.RUnlock()
+
+		if closed {
+			return nil, amqp.ErrClosed
+		}
+
+		select {
+		case <-ready:
+			if !conn.IsClosed() {
+				return conn, nil
+			}
+			// the connection was lost but watch did not replace it yet
+			select {
+			case <-time.After(10 * time.Millisecond):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Channel opens a new channel of the connection
+func (c *connection) Channel() (*amqp.Channel, error) {
+	conn := c.Connection()
+	if conn == nil {
+		return nil, errConnectionLost
+	}
+	return conn.Channel()
+}
+
+// publishingChannel opens a new publishing channel of the connection
+func (c *connection) publishingChannel() (*channel, error) {
+	ch, err := c.Channel()
+	if err != nil {
+		return nil, err
+	}
+
+	if !c.confirm {
+		return &channel{Channel: ch}, nil
+	}
+
+	confirms, err := newConfirms(ch)
+	if err != nil {
+		ch.Close()
+		return nil, err
+	}
+	return &channel{Channel: ch, confirms: confirms}, nil
+}
+
+// WithChannel calls fn with a channel of the pool. Channels which fail are discarded since
+// RabbitMQ closes a channel on every channel level error. If a pooled channel turns out to
+// be closed fn is called again with a new channel
+func (c *connection) WithChannel(fn func(ch *channel) error) error {
+	var ch *channel
+	pooled := true
+	select {
+	case ch = <-c.pool:
+	default:
+		pooled = false
+		var err error
+		if ch, err = c.publishingChannel(); err != nil {
+			return err
+		}
+	}
+
+	if err := fn(ch); err != nil {
+		ch.Close()
+		if pooled && err == amqp.ErrClosed {
+			return c.WithChannel(fn)
+		}
+		return err
+	}
+
+	select {
+	case c.pool <- ch:
+	default:
+		ch.Close()
+	}
+	return nil
+}
+
+// DeclareExchange declares the exchange unless it was declared before. The exchange is
+// re-declared after every reconnect
+func (c *connection) DeclareExchange(name, kind string, durable bool) error {
+	c.mu.RLock()
+	_, ok := c.exchanges[name]
+	c.mu.RUnlock()
+	if ok {
+		return nil
+	}
+
+	declare := func(ch *amqp.Channel) error {
+		return ch.ExchangeDeclare(name, kind, durable, false, false, false, nil)
+	}
+	if err := c.WithChannel(func(ch *channel) error { return declare(ch.Channel) }); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.exchanges[name] = declare
+	c.mu.Unlock()
+	return nil
+}
+
+// watch re-establishes the connection when it is lost. A connection closed with Close
+// reports no error and ends the watch
+func (c *connection) watch(notify chan *amqp.Error) {
+	for {
+		err, ok := <-notify
+		if !ok || err == nil {
+			return
+		}
+
+		logger.Error().Err(err).Msgf("[RABBITMQ]: Connection to %s lost", c.url)
+
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			return
+		}
+		c.ready = make(chan struct{})
+		// the delay queues may be gone along with the server
+		c.delays = make(map[string]time.Time)
+		c.mu.Unlock()
+
+		c.drainPool()
+		c.setStatus(broker.StatusDisconnected)
+
+		if notify = c.reconnect(); notify == nil {
+			return
+		}
+	}
+}
+
+// reconnect dials until the connection is established, the connection is closed or the
+// attempts of the policy are used up. It returns the close notifications of the new connection
+func (c *connection) reconnect() chan *amqp.Error {
+	for attempt := 1; ; attempt++ {
+		if c.policy.Exhausted(attempt) {
+			logger.Error().Msgf("[RABBITMQ]: Giving up reconnecting to %s", c.url)
+			c.giveUp()
+			return nil
+		}
+
+		c.setStatus(broker.StatusReconnecting)
+		time.Sleep(c.policy.Delay(attempt))
+
+		c.mu.RLock()
+		closed := c.closed
+		c.mu.RUnlock()
+		if closed {
+			return nil
+		}
+
+		conn, err := amqp.DialConfig(c.url, c.config)
+		if err == nil {
+			err = c.redeclare(conn)
+			if err != nil {
+				conn.Close()
+			}
+		}
+
+		if err != nil {
+			logger.Warn().Err(err).Msgf("[RABBITMQ]: Could not reconnect to %s", c.url)
+			continue
+		}
+
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			conn.Close()
+			return nil
+		}
+		notify := conn.NotifyClose(make(chan *amqp.Error, 1))
+		c.conn = conn
+		close(c.ready)
+		c.mu.Unlock()
+
+		logger.Info().Msgf("[RABBITMQ]: Reconnected to %s", c.url)
+		c.setStatus(broker.StatusConnected)
+		return notify
+	}
+}
+
+// giveUp closes the connection after the reconnect attempts failed and releases the
+// consumers waiting for it
+func (c *connection) giveUp() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return
+	}
+	c.closed = true
+	close(c.ready)
+	c.setStatus(broker.StatusClosed)
+}
+
+// redeclare declares the exchanges on the new connection
+func (c *connection) redeclare(conn *amqp.Connection) error {
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	for _, declare := range c.exchanges {
+		if err := declare(ch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WaitConfirms waits until the messages published on the idle channels of the pool are
+// confirmed. Channels which are in use wait for their confirms themselves
+func (c *connection) WaitConfirms(ctx context.Context) error {
+	var idle []*channel
+	defer func() {
+		for _, ch := range idle {
+			select {
+			case c.pool <- ch:
+			default:
+				ch.Close()
+			}
+		}
+	}()
+
+collect:
+	for {
+		select {
+		case ch := <-c.pool:
+			idle = append(idle, ch)
+		default:
+			break collect
+		}
+	}
+
+	for _, ch := range idle {
+		if ch.confirms == nil {
+			continue
+		}
+		if err := ch.confirms.wait(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// drainPool closes the idle channels of the lost connection
+func (c *connection) drainPool() {
+	for {
+		select {
+		case ch := <-c.pool:
+			ch.Close()
+		default:
+			return
+		}
+	}
+}
+
+// Close closes the connection and stops reconnecting
+func (c *connection) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return amqp.ErrClosed
+	}
+	c.closed = true
+	conn := c.conn
+	c.mu.Unlock()
+
+	c.drainPool()
+	c.setStatus(broker.StatusClosed)
+
+	if err := conn.Close(); err != nil && err != amqp.ErrClosed {
+		return err
+	}
+	return nil
+}
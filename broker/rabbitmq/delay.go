@@ -0,0 +1,67 @@
+package rabbitmq
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// delayExpiry is how long a delay queue outlives its last declaration
+const delayExpiry = time.Minute
+
+// delayName returns the name of the delay exchange and queue of the messages to the exchange
+// which are delayed by d. The delay is rounded up to whole seconds, so that the messages with
+// similar delays share a queue
+func delayName(exchange string, d time.Duration) (string, time.Duration) {
+	delay := d.Truncate(time.Second)
+	if delay < d {
+		delay += time.Second
+	}
+
+	if exchange == "" {
+		exchange = "default"
+	}
+	return "ego.delay." + exchange + "." + strconv.FormatInt(int64(delay/time.Second), 10) + "s", delay
+}
+
+// DeclareDelay declares the delay exchange and its queue. The messages of the queue expire
+// after the delay and are dead-lettered to the exchange with their routing key. The queue
+// expires once it is unused for delayExpiry after the delay, so a declaration is cached for
+// half of delayExpiry only, which leaves the messages published meanwhile time to expire
+// into the exchange. The cache is cleared when the connection is lost
+func (c *connection) DeclareDelay(name, exchange string, delay time.Duration, durable bool) error {
+	c.mu.RLock()
+	declared, ok := c.delays[name]
+	c.mu.RUnlock()
+	if ok && time.Since(declared) < delayExpiry/2 {
+		return nil
+	}
+
+	now := time.Now()
+	err := c.WithChannel(func(ch *channel) error {
+		// the exchange is deleted along with the queue
+		if err := ch.ExchangeDeclare(name, amqp.ExchangeFanout, durable, true, false, false, nil); err != nil {
+			return err
+		}
+
+		_, err := ch.QueueDeclare(name, durable, false, false, false, amqp.Table{
+			"x-message-ttl":          delay.Milliseconds(),
+			"x-dead-letter-exchange": exchange,
+			"x-expires":              (delay + delayExpiry).Milliseconds(),
+		})
+		if err != nil {
+			return err
+		}
+
+		return ch.QueueBind(name, "", name, false, nil)
+	})
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.delays[name] = now
+	c.mu.Unlock()
+	return nil
+}
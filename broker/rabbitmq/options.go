@@ -0,0 +1,94 @@
+package rabbitmq
+
+import (
+	"github.com/adityak368/ego/broker"
+	"github.com/streadway/amqp"
+)
+
+// names of the RabbitMQ specific subscribe options
+const (
+	optionAutoDelete        = "rabbitmq.autoDelete"
+	optionExclusive         = "rabbitmq.exclusive"
+	optionNoWait            = "rabbitmq.noWait"
+	optionQueueArguments    = "rabbitmq.queueArguments"
+	optionConsumerArguments = "rabbitmq.consumerArguments"
+)
+
+// queueOptions are the settings of the queue and the consumer of a subscription
+type queueOptions struct {
+	durable           bool
+	autoDelete        bool
+	exclusive         bool
+	noWait            bool
+	autoAck           bool
+	prefetch          int
+	queueArguments    amqp.Table
+	consumerArguments amqp.Table
+}
+
+// AutoDelete deletes the queue of the subscription once its last consumer is gone
+func AutoDelete() broker.SubscribeOption {
+	return broker.NativeOption(optionAutoDelete, true)
+}
+
+// Exclusive declares the queue of the subscription as exclusive to the connection
+func Exclusive() broker.SubscribeOption {
+	return broker.NativeOption(optionExclusive, true)
+}
+
+// NoWait declares, binds and consumes the queue of the subscription without waiting for the broker
+func NoWait() broker.SubscribeOption {
+	return broker.NativeOption(optionNoWait, true)
+}
+
+// QueueArguments sets the arguments of the queue declaration, e.g. x-max-priority for
+// messages published with broker.Priority
+func QueueArguments(args amqp.Table) broker.SubscribeOption {
+	return broker.NativeOption(optionQueueArguments, args)
+}
+
+// ConsumerArguments sets the arguments of the consumer, e.g. x-priority
+func ConsumerArguments(args amqp.Table) broker.SubscribeOption {
+	return broker.NativeOption(optionConsumerArguments, args)
+}
+
+// newQueueOptions maps the subscribe options onto the queue and consumer settings. The
+// deprecated settings of the config are the defaults which the native options override.
+// Classic queues cannot replay consumed messages, so start positions are rejected
+func newQueueOptions(config Config, opts broker.SubscribeOptions) (queueOptions, error) {
+	switch {
+	case opts.StartSequence > 0:
+		return queueOptions{}, broker.NotSupported("RABBITMQ", "StartAtSequence")
+	case !opts.StartTime.IsZero():
+		return queueOptions{}, broker.NotSupported("RABBITMQ", "StartAtTime")
+	}
+
+	if err := opts.CheckNative("RABBITMQ"); err != nil {
+		return queueOptions{}, err
+	}
+
+	q := queueOptions{
+		durable:           config.Durable,
+		autoDelete:        config.DeleteWhenUnused,
+		exclusive:         config.Exclusive,
+		noWait:            config.NoWait,
+		autoAck:           opts.AutoAck || config.AutoAck,
+		prefetch:          opts.Prefetch,
+		consumerArguments: config.Arguments,
+	}
+	if v, ok := opts.Native[optionAutoDelete].(bool); ok {
+		q.autoDelete = v
+	}
+	if v, ok := opts.Native[optionExclusive].(bool); ok {
+		q.exclusive = v
+	}
+	if v, ok := opts.Native[optionNoWait].(bool); ok {
+		q.noWait = v
+	}
+	if v, ok := opts.Native[optionConsumerArguments].(amqp.Table); ok {
+		q.consumerArguments = v
+	}
+	q.queueArguments, _ = opts.Native[optionQueueArguments].(amqp.Table)
+
+	return q, nil
+}
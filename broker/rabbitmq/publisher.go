@@ -0,0 +1,46 @@
+package rabbitmq
+
+import (
+	"github.com/adityak368/ego/broker"
+	"github.com/streadway/amqp"
+)
+
+// toPublishing maps the envelope onto the AMQP message properties and headers
+func toPublishing(m *broker.Message) amqp.Publishing {
+	headers := make(amqp.Table, len(m.Header))
+	for k, v := range m.Header {
+		headers[k] = v
+	}
+
+	return amqp.Publishing{
+		Headers:       headers,
+		ContentType:   m.ContentType,
+		DeliveryMode:  amqp.Persistent,
+		CorrelationId: m.CorrelationID,
+		ReplyTo:       m.ReplyTo,
+		MessageId:     m.ID,
+		Timestamp:     m.Timestamp,
+		Body:          m.Body,
+	}
+}
+
+// toMessage extracts the envelope from the AMQP delivery
+func toMessage(topic string, d amqp.Delivery) *broker.Message {
+	header := make(map[string]string, len(d.Headers))
+	for k, v := range d.Headers {
+		if s, ok := v.(string); ok {
+			header[k] = s
+		}
+	}
+
+	return &broker.Message{
+		ID:            d.MessageId,
+		Timestamp:     d.Timestamp,
+		ContentType:   d.ContentType,
+		CorrelationID: d.CorrelationId,
+		ReplyTo:       d.ReplyTo,
+		Header:        header,
+		Topic:         topic,
+		Body:          d.Body,
+	}
+}
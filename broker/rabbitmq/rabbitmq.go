@@ -3,22 +3,30 @@ package rabbitmq
 import (
 	"context"
 	"fmt"
-	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 	"google.golang.org/protobuf/proto"
 
 	"github.com/adityak368/ego/broker"
 	"github.com/adityak368/swissknife/logger/v2"
-	"github.com/wagslane/go-rabbitmq"
+	"github.com/streadway/amqp"
 )
 
 // RabbitMq is the RABBITMQ implementation of the broker
 type rabbitmqBroker struct {
 	options         broker.Options
-	subscriptionMap map[string]rabbitmq.Consumer
-	publisherMap    map[string]rabbitmq.Publisher
+	connection      *connection
+	subscriptionMap map[string]*rabbitmqSubscriber
+	replies         *replyConsumer
 	config          Config
+	mu              sync.Mutex
+	ctx             context.Context
+	cancel          context.CancelFunc
+	status          broker.StatusNotifier
 }
 
 // Address Returns the broker bind interface
@@ -42,263 +50,555 @@ func (n *rabbitmqBroker) String() string {
 	return fmt.Sprintf("[RABBITMQ]: Connected to RabbitMQ on %s", n.Address())
 }
 
-// Connect connects to the broker
+// Connect connects to the broker. Publishers and consumers use channels of the connection
+// which is re-established automatically when it is lost
 func (n *rabbitmqBroker) Connect() error {
+	config, err := amqpConfig(n.options)
+	if err != nil {
+		return err
+	}
+
+	setStatus := func(status broker.Status) {
+		n.status.Set(status, n.options.OnStatus)
+	}
+	connection, err := dial(n.Address(), config, n.config.ChannelPoolSize, n.config.Confirm, n.options.Reconnect, setStatus)
+	if err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	n.connection = connection
+	n.ctx, n.cancel = context.WithCancel(context.Background())
+	n.mu.Unlock()
+
 	logger.Info().Msgf("[RABBITMQ]: Connected to %s", n.Address())
 	return nil
 }
 
-// Disconnect disconnects from the broker
+// Disconnect stops the consumers, waits for the handlers which are in flight, closes the
+// publishing channels and disconnects from the broker
 func (n *rabbitmqBroker) Disconnect() error {
+	return n.shutdown(context.Background(), false)
+}
+
+// Drain cancels the consumers, waits until the deliveries they received are handled and
+// the pending confirms arrived, and disconnects from the broker. Deliveries which are not
+// handled when ctx is done are requeued by the broker
+func (n *rabbitmqBroker) Drain(ctx context.Context) error {
+	return n.shutdown(ctx, true)
+}
+
+// shutdown stops or drains the consumers and closes the connection
+func (n *rabbitmqBroker) shutdown(ctx context.Context, drain bool) error {
+
+	n.mu.Lock()
+	if n.connection == nil {
+		n.mu.Unlock()
+		return errors.New("[RABBITMQ]: Cannot Disconnect. Not connected to broker")
+	}
+	subscribers := n.subscriptionMap
+	n.subscriptionMap = make(map[string]*rabbitmqSubscriber)
+	n.mu.Unlock()
+
+	// handlers may still publish responses, so the connection is closed afterwards
+	var wg sync.WaitGroup
+	errs := make(chan error, len(subscribers))
+	for _, s := range subscribers {
+		wg.Add(1)
+		go func(s *rabbitmqSubscriber) {
+			defer wg.Done()
+
+			var err error
+			if drain {
+				err = s.drain(ctx)
+			} else {
+				err = s.close()
+			}
+			if err != nil {
+				logger.Warn().Err(err).Msgf("[RABBITMQ]: Could not stop consumer of topic '%s'", s.topic)
+				errs <- err
+			}
+		}(s)
+	}
+	wg.Wait()
+	close(errs)
+
+	n.mu.Lock()
+	// the reply consumer stops with the context instead of declaring a new queue
+	n.cancel()
+	if n.replies != nil {
+		n.replies.Close()
+		n.replies = nil
+	}
+	connection := n.connection
+	n.connection = nil
+	n.mu.Unlock()
+
+	var err error
+	if drain {
+		err = <-errs
+		if confirmErr := connection.WaitConfirms(ctx); confirmErr != nil && err == nil {
+			err = confirmErr
+		}
+	}
+
+	// the connection is already closed when the broker gave up reconnecting
+	if closeErr := connection.Close(); closeErr != nil && closeErr != amqp.ErrClosed {
+		return closeErr
+	}
+
 	logger.Info().Msgf("[RABBITMQ]: Disconnected from %s", n.Address())
-	return nil
+	return err
+}
+
+// Status returns the status of the connection to the broker
+func (n *rabbitmqBroker) Status() broker.Status {
+	return n.status.Status()
+}
+
+// NotifyStatus returns a channel which receives the changes of the status
+func (n *rabbitmqBroker) NotifyStatus() <-chan broker.Status {
+	return n.status.Notify()
 }
 
-// Handle returns the raw connection handle to the db
+// Handle returns the raw connection handle to the broker. It is nil while reconnecting
 func (n *rabbitmqBroker) Handle() interface{} {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.connection == nil {
+		return nil
+	}
+	if conn := n.connection.Connection(); conn != nil {
+		return conn
+	}
 	return nil
 }
 
 // Publish publishes a message to the topic
-func (n *rabbitmqBroker) Publish(topic string, m proto.Message) error {
-
-	var p rabbitmq.Publisher
-	p, ok := n.publisherMap[topic]
-	if !ok {
-		publisher, _, err := rabbitmq.NewPublisher(
-			n.Address(),
-			// can pass nothing for no logging
-			rabbitmq.WithPublisherOptionsLogging,
-		)
+func (n *rabbitmqBroker) Publish(topic string, m proto.Message, opts ...broker.PublishOption) error {
+	return n.publish(topic, &broker.Message{Data: m}, opts...)
+}
+
+// PublishRaw publishes raw data to the topic
+func (n *rabbitmqBroker) PublishRaw(topic string, m []byte, opts ...broker.PublishOption) error {
+	return n.publish(topic, &broker.Message{Body: m}, opts...)
+}
+
+// PublishMessage publishes a message envelope to the topic
+func (n *rabbitmqBroker) PublishMessage(topic string, m *broker.Message, opts ...broker.PublishOption) error {
+	return n.publish(topic, m, opts...)
+}
+
+// Request publishes the request with a reply-to queue and a correlation id and waits for
+// the response which the responder publishes to the reply-to queue
+func (n *rabbitmqBroker) Request(ctx context.Context, topic string, req proto.Message, resp proto.Message) error {
+
+	n.mu.Lock()
+	if n.connection == nil {
+		n.mu.Unlock()
+		return errors.New("[RABBITMQ]: Cannot Request. Not connected to broker")
+	}
+	if n.replies == nil {
+		replies, err := newReplyConsumer(n.connection, n.ctx)
 		if err != nil {
+			n.mu.Unlock()
 			return err
 		}
-		n.publisherMap[topic] = publisher
-		p = publisher
+		n.replies = replies
 	}
-
-	data, err := proto.Marshal(m)
+	replies := n.replies
+	n.mu.Unlock()
+
+	correlationID := broker.NewID()
+	reply := replies.register(correlationID)
+	defer replies.remove(correlationID)
+
+	err := n.publish(topic, &broker.Message{
+		CorrelationID: correlationID,
+		ReplyTo:       replies.Queue(),
+		Data:          req,
+	})
 	if err != nil {
 		return err
 	}
 
-	err = p.Publish(
-		data,
-		[]string{topic},
-		rabbitmq.WithPublishOptionsContentType("application/octet-stream"),
-		rabbitmq.WithPublishOptionsPersistentDelivery,
-		func(options *rabbitmq.PublishOptions) {
-			options.Exchange = ""
-			options.Mandatory = false
-		},
-	)
+	select {
+	case m := <-reply:
+		return broker.DecodeResponse(m, resp)
+	case <-ctx.Done():
+		return errors.Wrapf(ctx.Err(), "[RABBITMQ]: No response to request on '%s'", topic)
+	}
+}
+
+// publish publishes the envelope to the exchange of the broker with the topic as routing key
+func (n *rabbitmqBroker) publish(topic string, m *broker.Message, opts ...broker.PublishOption) error {
+	return n.publishTo(n.exchangeName(), topic, m, opts...)
+}
+
+// PublishConfirm publishes the envelope to the topic and waits until the broker confirms it
+func (n *rabbitmqBroker) PublishConfirm(ctx context.Context, topic string, m *broker.Message, opts ...broker.PublishOption) error {
+	confirm, err := n.PublishAsync(topic, m, opts...)
 	if err != nil {
 		return err
 	}
+	return waitConfirm(ctx, confirm)
+}
 
-	return nil
+// PublishAsync publishes the envelope to the topic and returns the channel receiving the confirm
+func (n *rabbitmqBroker) PublishAsync(topic string, m *broker.Message, opts ...broker.PublishOption) (<-chan error, error) {
+	if !n.config.Confirm {
+		return nil, errConfirmsDisabled
+	}
+	return n.publishAsync(n.exchangeName(), topic, m, opts...)
 }
 
-// PublishRaw publishes raw data to the topic
-func (n *rabbitmqBroker) PublishRaw(topic string, m []byte) error {
-
-	var p rabbitmq.Publisher
-	p, ok := n.publisherMap[topic]
-	if !ok {
-		publisher, _, err := rabbitmq.NewPublisher(
-			n.Address(),
-			// can pass nothing for no logging
-			rabbitmq.WithPublisherOptionsLogging,
-		)
-		if err != nil {
-			return err
-		}
-		n.publisherMap[topic] = publisher
-		p = publisher
-	}
-
-	err := p.Publish(
-		m,
-		[]string{topic},
-		rabbitmq.WithPublishOptionsContentType("application/octet-stream"),
-		rabbitmq.WithPublishOptionsPersistentDelivery,
-		func(options *rabbitmq.PublishOptions) {
-			options.Exchange = ""
-			options.Mandatory = false
-		},
-	)
-	if err != nil {
+// publishTo publishes the envelope to the exchange. In confirm mode it waits for the
+// confirm of the broker for at most Config.ConfirmTimeout
+func (n *rabbitmqBroker) publishTo(exchange, routingKey string, m *broker.Message, opts ...broker.PublishOption) error {
+	confirm, err := n.publishAsync(exchange, routingKey, m, opts...)
+	if err != nil || confirm == nil {
 		return err
 	}
 
-	return nil
+	ctx, cancel := context.WithTimeout(context.Background(), n.confirmTimeout())
+	defer cancel()
+	return waitConfirm(ctx, confirm)
 }
 
-// Subscribe subscribes a handler to the topic
-func (n *rabbitmqBroker) Subscribe(topic string, h interface{}) (broker.Subscriber, error) {
+// publishAsync publishes the envelope to the exchange on a channel of the pool. The exchange
+// is declared before the first publish. Delayed messages are published to a delay queue
+// which dead-letters them to the exchange once they are due. In confirm mode it returns the
+// channel receiving the confirm
+func (n *rabbitmqBroker) publishAsync(exchange, routingKey string, m *broker.Message, opts ...broker.PublishOption) (<-chan error, error) {
 
-	typ := reflect.TypeOf(h)
-	if typ.Kind() != reflect.Func {
-		return nil, errors.New("[RABBITMQ]: Need a function as a callback")
+	connection, err := n.exchange(exchange)
+	if err != nil {
+		return nil, err
 	}
 
-	if typ.NumIn() != 2 {
-		return nil, errors.New("[RABBITMQ]: Function takes two inputs. 1. context.Context and 2. proto.Message which is the message")
+	o := broker.NewPublishOptions(opts...)
+	if err := o.CheckNative("RABBITMQ"); err != nil {
+		return nil, err
+	}
+	m, err = o.Apply(m)
+	if err != nil {
+		return nil, err
 	}
 
-	ctxType := typ.In(0)
-	if ctxType.Kind() != reflect.Interface || !ctxType.Implements(reflect.TypeOf((*context.Context)(nil)).Elem()) {
-		return nil, errors.New("[RABBITMQ]: First Parameter should be of type context.Context")
+	msg, err := m.Encode(n.options.Codec)
+	if err != nil {
+		return nil, err
 	}
 
-	msgType := typ.In(1)
-	if msgType.Kind() != reflect.Ptr {
-		return nil, errors.New("[RABBITMQ]: Message should be a pointer")
+	publishing := toPublishing(msg)
+	publishing.Priority = o.Priority
+	if o.TTL > 0 {
+		// the expiration is given in milliseconds
+		publishing.Expiration = strconv.FormatInt(o.TTL.Milliseconds(), 10)
 	}
 
-	if typ.NumOut() != 1 {
-		return nil, errors.New("[RABBITMQ]: Function should have a single return value")
+	if wait := time.Until(o.At); !o.At.IsZero() && wait > 0 {
+		if o.TTL > 0 {
+			// the message would expire in the delay queue
+			return nil, broker.NotSupported("RABBITMQ", "TTL with PublishAt")
+		}
+		name, delay := delayName(exchange, wait)
+		if err := connection.DeclareDelay(name, exchange, delay, n.config.Durable); err != nil {
+			return nil, err
+		}
+		exchange = name
 	}
 
-	errType := typ.Out(0)
-	if errType.Kind() != reflect.Interface || !errType.Implements(reflect.TypeOf((*error)(nil)).Elem()) {
-		return nil, errors.New("[RABBITMQ]: Function should return error or nil")
+	var confirm <-chan error
+	err = connection.WithChannel(func(ch *channel) error {
+		var err error
+		confirm, err = ch.publish(exchange, routingKey, publishing)
+		return err
+	})
+	return confirm, err
+}
+
+// confirmTimeout returns how long a publish waits for the confirm of the broker
+func (n *rabbitmqBroker) confirmTimeout() time.Duration {
+	if n.config.ConfirmTimeout > 0 {
+		return n.config.ConfirmTimeout
 	}
+	return defaultConfirmTimeout
+}
 
-	cb := reflect.ValueOf(h)
+// exchange declares the exchange unless it is the default or a predeclared exchange and
+// returns the connection
+func (n *rabbitmqBroker) exchange(exchange string) (*connection, error) {
 
-	var c rabbitmq.Consumer
-	c, ok := n.subscriptionMap[topic]
-	if !ok {
-		consumer, err := rabbitmq.NewConsumer(
-			n.Address(),
-			rabbitmq.WithConsumerOptionsLogging,
-		)
-		if err != nil {
-			logger.Error().Err(err).Msg("")
-		}
-		n.subscriptionMap[topic] = consumer
-		c = consumer
+	n.mu.Lock()
+	connection := n.connection
+	n.mu.Unlock()
+
+	if connection == nil {
+		return nil, errors.New("[RABBITMQ]: Cannot Publish. Not connected to broker")
 	}
 
-	err := c.StartConsuming(
-		func(d rabbitmq.Delivery) bool {
-			msg := reflect.New(msgType.Elem())
+	if exchange == "" || predeclared(exchange) {
+		return connection, nil
+	}
 
-			protoMsg, ok := msg.Interface().(proto.Message)
-			if !ok {
-				logger.Warn().Msg("[RABBITMQ]: Message does not implement protobuf message")
-				return false
-			}
+	return connection, connection.DeclareExchange(exchange, n.exchangeType(), n.config.Durable)
+}
 
-			err := proto.Unmarshal(d.Body, protoMsg)
-			if err != nil {
-				logger.Warn().Msg("[RABBITMQ]: Could not decode message")
-				return false
-			}
+// exchangeName returns the exchange the messages are published to. Without a configured
+// exchange it is the predeclared exchange of the exchange type
+func (n *rabbitmqBroker) exchangeName() string {
+	switch {
+	case n.config.DefaultExchange:
+		return ""
+	case n.config.Exchange != "":
+		return n.config.Exchange
+	}
+	return "amq." + n.exchangeType()
+}
 
-			res := cb.Call([]reflect.Value{reflect.ValueOf(context.Background()), msg})
+// predeclared reports whether the exchange is one of the exchanges every RabbitMQ server
+// declares. They cannot be declared by clients
+func predeclared(exchange string) bool {
+	return strings.HasPrefix(exchange, "amq.")
+}
 
-			if len(res) != 1 {
-				logger.Warn().Msg("[RABBITMQ]: Invalid return value")
-				return false
-			}
+// exchangeType returns the type of the configured exchange
+func (n *rabbitmqBroker) exchangeType() string {
+	if n.config.ExchangeType == "" {
+		return amqp.ExchangeTopic
+	}
+	return n.config.ExchangeType
+}
 
-			if v := res[0].Interface(); v != nil {
-				err, ok := v.(error)
-				if !ok {
-					logger.Warn().Msg("[RABBITMQ]: Could not parse error")
-				} else {
-					logger.Error().Err(err).Msg("")
-				}
-				return false
-			}
+// Subscribe subscribes a handler to the topic
+func (n *rabbitmqBroker) Subscribe(topic string, h interface{}, opts ...broker.SubscribeOption) (broker.Subscriber, error) {
 
-			return true
-		},
-		topic,
-		nil,
-		rabbitmq.WithConsumeOptionsConcurrency(1),
-		func(options *rabbitmq.ConsumeOptions) {
-			options.ConsumerAutoAck = n.config.AutoAck
-			options.ConsumerArgs = rabbitmq.Table(n.config.Arguments)
-			options.ConsumerNoWait = n.config.NoWait
-			options.QueueAutoDelete = n.config.DeleteWhenUnused
-			options.QueueExclusive = n.config.Exclusive
-			options.QueueDurable = n.config.Durable
-		},
-	)
+	handler, err := broker.NewHandlerFunc(h)
+	if err != nil {
+		return nil, errors.Wrap(err, "[RABBITMQ]")
+	}
+
+	return n.subscribe(topic, handler, broker.HandlerType(h), broker.NewSubscribeOptions(opts...))
+}
+
+// SubscribeRaw subscribes a raw handler to the topic
+func (n *rabbitmqBroker) SubscribeRaw(topic string, h func(c context.Context, data []byte) error, opts ...broker.SubscribeOption) (broker.Subscriber, error) {
+	return n.subscribe(topic, broker.NewRawHandlerFunc(h), broker.HandlerType(h), broker.NewSubscribeOptions(opts...))
+}
+
+// subscribe declares the queue of the subscription and starts consuming it on a channel
+// of its own. The consumer is identified by its consumer tag so that it can be cancelled
+func (n *rabbitmqBroker) subscribe(topic string, h broker.HandlerFunc, handlerType string, opts broker.SubscribeOptions) (broker.Subscriber, error) {
+
+	n.mu.Lock()
+	connection := n.connection
+	n.mu.Unlock()
 
+	if connection == nil {
+		return nil, errors.New("[RABBITMQ]: Cannot Subscribe. Not connected to broker")
+	}
+
+	options, err := newQueueOptions(n.config, opts)
 	if err != nil {
 		return nil, err
 	}
 
-	subscriber := &rabbitmqSubscriber{
-		topic: topic,
+	queue, bindings, private, err := n.queue(topic, opts)
+	if err != nil {
+		return nil, err
 	}
 
-	logger.Info().Msgf("[RABBITMQ]: Subscribed to topic '%s'", topic)
-	return subscriber, nil
-}
+	ctx, cancel := context.WithCancel(n.ctx)
+	quit, stop := context.WithCancel(context.Background())
 
-// SubscribeRaw subscribes a raw handler to the topic
-func (n *rabbitmqBroker) SubscribeRaw(topic string, h func(c context.Context, data []byte) error) (broker.Subscriber, error) {
-
-	var c rabbitmq.Consumer
-	c, ok := n.subscriptionMap[topic]
-	if !ok {
-		consumer, err := rabbitmq.NewConsumer(
-			n.Address(),
-			rabbitmq.WithConsumerOptionsLogging,
-		)
-		if err != nil {
-			logger.Error().Err(err).Msg("")
-		}
-		n.subscriptionMap[topic] = consumer
-		c = consumer
+	subscriber := &rabbitmqSubscriber{
+		topic:      topic,
+		queue:      queue,
+		bindings:   bindings,
+		private:    private,
+		tag:        "ego-" + broker.NewID(),
+		exchange:   n.exchangeName(),
+		options:    options,
+		workers:    broker.NewWorkers(opts.Concurrency, opts.BufferSize),
+		broker:     n,
+		cancel:     cancel,
+		quit:       quit,
+		connection: connection,
+		stop:       stop,
+		done:       make(chan struct{}),
+
+		handlerType: opts.ReportedHandlerType(handlerType),
+		subscribed:  time.Now(),
 	}
 
-	err := c.StartConsuming(
-		func(d rabbitmq.Delivery) bool {
+	subscriber.handler = func(d amqp.Delivery) bool {
 
-			err := h(context.Background(), d.Body)
-			if err != nil {
+		msg := toMessage(d.RoutingKey, d)
+		err := broker.Deliver(ctx, n, h, msg, opts)
+		subscriber.stats.Done(err)
+		if msg.ReplyTo != "" && msg.Response != nil {
+			// responses go to the reply-to queue of the requester through the default exchange
+			if err := n.publishTo("", msg.ReplyTo, msg.Response); err != nil {
 				logger.Error().Err(err).Msg("")
-				return false
 			}
+		}
+		if err != nil {
+			logger.Error().Err(err).Msg("")
+			return false
+		}
 
-			return true
-		},
-		topic,
-		nil,
-		rabbitmq.WithConsumeOptionsConcurrency(1),
-		func(options *rabbitmq.ConsumeOptions) {
-			options.ConsumerAutoAck = n.config.AutoAck
-			options.ConsumerArgs = rabbitmq.Table(n.config.Arguments)
-			options.ConsumerNoWait = n.config.NoWait
-			options.QueueAutoDelete = n.config.DeleteWhenUnused
-			options.QueueExclusive = n.config.Exclusive
-			options.QueueDurable = n.config.Durable
-		},
-	)
+		return true
+	}
 
+	conn := connection.Connection()
+	if conn == nil {
+		subscriber.workers.Stop()
+		cancel()
+		stop()
+		return nil, errConnectionLost
+	}
+
+	deliveries, err := subscriber.consume(conn)
 	if err != nil {
+		subscriber.workers.Stop()
+		cancel()
+		stop()
 		return nil, err
 	}
 
-	subscriber := &rabbitmqSubscriber{
-		topic: topic,
-	}
+	n.mu.Lock()
+	n.subscriptionMap[subscriber.tag] = subscriber
+	n.mu.Unlock()
 
-	logger.Info().Msgf("[RABBITMQ]: Subscribed to topic '%s'", topic)
+	go subscriber.run(deliveries)
+
+	logger.Info().Msgf("[RABBITMQ]: Subscribed to topic '%s' with queue '%s'", topic, queue)
 	return subscriber, nil
 }
 
+// Subscriptions returns the active subscriptions along with their stats in the order they were subscribed
+func (n *rabbitmqBroker) Subscriptions() []broker.SubscriptionInfo {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	infos := make([]broker.SubscriptionInfo, 0, len(n.subscriptionMap))
+	for _, s := range n.subscriptionMap {
+		infos = append(infos, s.info())
+	}
+	broker.SortSubscriptions(infos)
+	return infos
+}
+
+// UnsubscribeAll cancels every consumer and waits for the handlers in flight. Unacked
+// messages are requeued by the broker
+func (n *rabbitmqBroker) UnsubscribeAll() error {
+	n.mu.Lock()
+	subscribers := n.subscriptionMap
+	n.subscriptionMap = make(map[string]*rabbitmqSubscriber)
+	n.mu.Unlock()
+
+	var err error
+	for _, s := range subscribers {
+		if closeErr := s.close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// unsubscribe removes the subscriber from the broker
+func (n *rabbitmqBroker) unsubscribe(s *rabbitmqSubscriber) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if _, ok := n.subscriptionMap[s.tag]; !ok {
+		return false
+	}
+	delete(n.subscriptionMap, s.tag)
+	return true
+}
+
+// queue returns the name of the queue consumed by the subscription, the routing keys
+// which bind it to the exchange and whether the queue is private to the subscriber.
+//
+// On the default exchange the queue is named after the topic and every consumer of the
+// queue competes for its messages, so all the consumers form a single queue group.
+// Otherwise every queue group has its own queue named '<queue group>.<topic>', which makes
+// every service receive a copy of each message, and broadcast subscribers get a private queue.
+// Topics may use the NATS wildcard '>', see bindingKey. Combinations which RabbitMQ cannot
+// route as requested fail with ErrNotSupported
+func (n *rabbitmqBroker) queue(topic string, opts broker.SubscribeOptions) (string, []string, bool, error) {
+
+	exchange := n.exchangeName()
+	if exchange == "" {
+		switch {
+		case opts.Broadcast:
+			return "", nil, false, broker.NotSupported("RABBITMQ", "Broadcast on the default exchange")
+		case opts.Queue != "":
+			return "", nil, false, broker.NotSupported("RABBITMQ", "Queue on the default exchange")
+		case hasWildcard(topic):
+			return "", nil, false, broker.NotSupported("RABBITMQ", "Wildcard topics on the default exchange")
+		}
+		return topic, nil, false, nil
+	}
+
+	switch n.exchangeType() {
+	case amqp.ExchangeFanout:
+		// fanout exchanges ignore the routing key, so every queue receives every message
+		if topic != ">" && topic != "#" {
+			return "", nil, false, broker.NotSupported("RABBITMQ", "Topics other than '>' on a fanout exchange")
+		}
+	case amqp.ExchangeDirect:
+		if hasWildcard(topic) {
+			return "", nil, false, broker.NotSupported("RABBITMQ", "Wildcard topics on a direct exchange")
+		}
+	}
+
+	// the exchange has to exist before the queue is bound to it
+	if !predeclared(exchange) {
+		if _, err := n.exchange(exchange); err != nil {
+			return "", nil, false, err
+		}
+	}
+
+	bindings := []string{bindingKey(topic)}
+
+	group := opts.QueueGroup(n.options.Name)
+	if group == "" {
+		return topic + "." + broker.NewID(), bindings, true, nil
+	}
+	return group + "." + topic, bindings, false, nil
+}
+
+// hasWildcard reports whether the topic has a NATS or AMQP wildcard
+func hasWildcard(topic string) bool {
+	for _, token := range strings.Split(topic, ".") {
+		if token == "*" || token == ">" || token == "#" {
+			return true
+		}
+	}
+	return false
+}
+
+// bindingKey maps the NATS wildcards of the topic to the AMQP wildcards. The AMQP '#' also
+// matches no words at all, so '>', which matches one or more words, becomes '*.#'. A '#'
+// of the topic keeps its AMQP meaning
+func bindingKey(topic string) string {
+	tokens := strings.Split(topic, ".")
+	for i, token := range tokens {
+		if token == ">" {
+			tokens[i] = "*.#"
+		}
+	}
+	return strings.Join(tokens, ".")
+}
+
 // New returns a new rabbitmqBroker broker
 func New(config Config) broker.Broker {
 	return &rabbitmqBroker{
-		subscriptionMap: make(map[string]rabbitmq.Consumer),
-		publisherMap:    make(map[string]rabbitmq.Publisher),
+		subscriptionMap: make(map[string]*rabbitmqSubscriber),
 		config:          config,
 	}
 }
@@ -2,12 +2,18 @@ package rabbitmq
 
 import (
 	"context"
+	"crypto/tls"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/adityak368/ego/broker"
 	proto "github.com/adityak368/ego/broker/proto/gen/broker"
+	"github.com/adityak368/ego/broker/scheduler"
+	"github.com/alicebob/miniredis/v2"
 	"github.com/pkg/errors"
+	"github.com/redis/go-redis/v9"
+	"github.com/streadway/amqp"
 	"github.com/stretchr/testify/require"
 )
 
@@ -93,3 +99,625 @@ func TestRabbitMq(t *testing.T) {
 	}
 
 }
+
+func TestRabbitMqExchange(t *testing.T) {
+
+	r := require.New(t)
+
+	newBroker := func(name string) broker.Broker {
+		bkr := New(Config{
+			Exchange:     "test.events",
+			ExchangeType: "topic",
+		})
+		bkr.Init(broker.Options{
+			Name:    name,
+			Address: "amqp://localhost:5672",
+		})
+		r.Nil(bkr.Connect())
+		return bkr
+	}
+
+	orders := newBroker("orders")
+	defer orders.Disconnect()
+	billing := newBroker("billing")
+	defer billing.Disconnect()
+
+	c := make(chan string, 4)
+	handler := func(name string) func(ctx context.Context, msg []byte) error {
+		return func(ctx context.Context, msg []byte) error {
+			m, _ := broker.FromContext(ctx)
+			c <- name + " " + m.Topic
+			return nil
+		}
+	}
+
+	// every service gets its own queue bound to the exchange
+	_, err := orders.SubscribeRaw("test.orders.*", handler("orders"))
+	r.Nil(err)
+	_, err = billing.SubscribeRaw("test.orders.>", handler("billing"))
+	r.Nil(err)
+
+	r.Nil(orders.PublishRaw("test.orders.created", []byte("Test")))
+
+	received := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case name := <-c:
+			received[name] = true
+		case <-time.After(timeout):
+			t.Fatal("Timed out waiting for message from broker")
+		}
+	}
+	r.Equal(map[string]bool{"orders test.orders.created": true, "billing test.orders.created": true}, received)
+}
+
+func TestRabbitMqUnsubscribe(t *testing.T) {
+
+	r := require.New(t)
+
+	bkr := New(Config{})
+	bkr.Init(broker.Options{
+		Name:    "RabbitMQ",
+		Address: "amqp://localhost:5672",
+	})
+	r.Nil(bkr.Connect())
+
+	_, ok := bkr.Handle().(*amqp.Connection)
+	r.True(ok, "Handle should return the connection")
+
+	c := make(chan bool, 1)
+	subscription, err := bkr.SubscribeRaw("test.testMessageUnsubscribe", func(ctx context.Context, msg []byte) error {
+		c <- true
+		return nil
+	})
+	r.Nil(err)
+
+	r.Nil(subscription.Unsubscribe())
+	r.NotNil(subscription.Unsubscribe(), "Second Unsubscribe should fail")
+
+	// the queue is kept, but the cancelled consumer does not receive its messages
+	r.Nil(bkr.PublishRaw("test.testMessageUnsubscribe", []byte("Test")))
+	select {
+	case <-c:
+		t.Fatal("Unsubscribed handler should not receive messages")
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	// Disconnect waits for the handler which is in flight
+	started := make(chan bool, 1)
+	finished := false
+	_, err = bkr.SubscribeRaw("test.testMessageUnsubscribe", func(ctx context.Context, msg []byte) error {
+		started <- true
+		time.Sleep(500 * time.Millisecond)
+		finished = true
+		return nil
+	})
+	r.Nil(err)
+
+	select {
+	case <-started:
+	case <-time.After(timeout):
+		t.Fatal("Timed out waiting for message from broker")
+	}
+
+	r.Nil(bkr.Disconnect())
+	r.True(finished, "Disconnect should wait for the handlers in flight")
+	r.Nil(bkr.Handle())
+	r.NotNil(bkr.Disconnect(), "Second Disconnect should fail")
+}
+
+func TestRabbitMqChannelPool(t *testing.T) {
+
+	r := require.New(t)
+
+	bkr := New(Config{ChannelPoolSize: 2})
+	bkr.Init(broker.Options{
+		Name:    "RabbitMQ",
+		Address: "amqp://localhost:5672",
+	})
+	r.Nil(bkr.Connect())
+	defer bkr.Disconnect()
+
+	const count = 50
+	c := make(chan bool, count)
+	_, err := bkr.SubscribeRaw("test.testMessagePool", func(ctx context.Context, msg []byte) error {
+		c <- true
+		return nil
+	})
+	r.Nil(err)
+
+	// concurrent publishers share the channels of the pool
+	var wg sync.WaitGroup
+	errs := make(chan error, count)
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- bkr.PublishRaw("test.testMessagePool", []byte("Test"))
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		r.Nil(err)
+	}
+
+	for i := 0; i < count; i++ {
+		select {
+		case <-c:
+		case <-time.After(timeout):
+			t.Fatal("Timed out waiting for message from broker")
+		}
+	}
+}
+
+func TestRabbitMqConfirm(t *testing.T) {
+
+	r := require.New(t)
+
+	bkr := New(Config{Confirm: true})
+	bkr.Init(broker.Options{
+		Name:    "RabbitMQ",
+		Address: "amqp://localhost:5672",
+	})
+	r.Nil(bkr.Connect())
+	defer bkr.Disconnect()
+
+	confirmer, ok := bkr.(Confirmer)
+	r.True(ok, "Broker should implement Confirmer")
+
+	// no queue is bound for the topic, so the message is returned by the broker
+	err := bkr.PublishRaw("test.testMessageUnroutable", []byte("Test"))
+	r.True(errors.Is(err, ErrUnroutable), "Unroutable messages should fail")
+
+	c := make(chan bool, 2)
+	_, err = bkr.SubscribeRaw("test.testMessageConfirm", func(ctx context.Context, msg []byte) error {
+		c <- true
+		return nil
+	})
+	r.Nil(err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	r.Nil(confirmer.PublishConfirm(ctx, "test.testMessageConfirm", &broker.Message{Body: []byte("Test")}))
+
+	confirm, err := confirmer.PublishAsync("test.testMessageConfirm", &broker.Message{Body: []byte("Test")})
+	r.Nil(err)
+	select {
+	case err := <-confirm:
+		r.Nil(err)
+	case <-time.After(timeout):
+		t.Fatal("Timed out waiting for confirm")
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-c:
+		case <-time.After(timeout):
+			t.Fatal("Timed out waiting for message from broker")
+		}
+	}
+}
+
+func TestConfirmsReturns(t *testing.T) {
+
+	r := require.New(t)
+
+	c := &confirms{pending: make(map[uint64]*pendingConfirm), returned: make(map[uint64]bool)}
+	var done []chan error
+	for tag := uint64(1); tag <= 2; tag++ {
+		done = append(done, make(chan error, 1))
+		c.pending[tag] = &pendingConfirm{done: done[tag-1]}
+		c.unconfirmed.Add(1)
+	}
+
+	returns := make(chan amqp.Return, 1)
+	acks := make(chan amqp.Confirmation, 2)
+	// both messages have the same id, but only the first one is returned
+	returns <- amqp.Return{MessageId: "id", Headers: amqp.Table{confirmTagHeader: int64(1)}}
+	close(returns)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		acks <- amqp.Confirmation{DeliveryTag: 1, Ack: true}
+		acks <- amqp.Confirmation{DeliveryTag: 2, Ack: true}
+		close(acks)
+	}()
+	c.listen(returns, acks)
+
+	r.True(errors.Is(<-done[0], ErrUnroutable), "The returned message should be unroutable")
+	r.Nil(<-done[1], "Messages with the id of a returned message should be confirmed")
+}
+
+func TestRabbitMqConcurrency(t *testing.T) {
+
+	r := require.New(t)
+
+	bkr := New(Config{})
+	bkr.Init(broker.Options{
+		Name:    "RabbitMQ",
+		Address: "amqp://localhost:5672",
+	})
+	r.Nil(bkr.Connect())
+	defer bkr.Disconnect()
+
+	// every handler waits until all the workers are busy, which needs a prefetch
+	// of at least the number of workers
+	const workers = 4
+	var inFlight sync.WaitGroup
+	inFlight.Add(workers)
+	busy := make(chan bool)
+	go func() {
+		inFlight.Wait()
+		close(busy)
+	}()
+
+	_, err := bkr.SubscribeRaw("test.testMessageConcurrent", func(ctx context.Context, msg []byte) error {
+		inFlight.Done()
+		<-busy
+		return nil
+	}, broker.Concurrency(workers), broker.Prefetch(workers))
+	r.Nil(err)
+
+	for i := 0; i < workers; i++ {
+		r.Nil(bkr.PublishRaw("test.testMessageConcurrent", []byte("Test")))
+	}
+
+	select {
+	case <-busy:
+	case <-time.After(timeout):
+		t.Fatal("Messages should be handled concurrently")
+	}
+}
+
+func TestRabbitMqPublishOptions(t *testing.T) {
+
+	r := require.New(t)
+
+	bkr := New(Config{})
+	bkr.Init(broker.Options{
+		Name:    "RabbitMQ",
+		Address: "amqp://localhost:5672",
+	})
+	r.Nil(bkr.Connect())
+	defer bkr.Disconnect()
+
+	c := make(chan *broker.Message, 1)
+	_, err := bkr.SubscribeRaw("test.testMessagePriority", func(ctx context.Context, msg []byte) error {
+		m, _ := broker.FromContext(ctx)
+		c <- m
+		return nil
+	}, AutoDelete(), QueueArguments(amqp.Table{"x-max-priority": int32(10)}))
+	r.Nil(err)
+
+	err = bkr.PublishRaw("test.testMessagePriority", []byte("Test"),
+		broker.Priority(5),
+		broker.TTL(time.Minute),
+		broker.WithHeader("Tenant", "ego"),
+		broker.WithCorrelationID("correlation"),
+	)
+	r.Nil(err)
+
+	select {
+	case m := <-c:
+		r.Equal("ego", m.Header["Tenant"])
+		r.Equal("correlation", m.CorrelationID)
+	case <-time.After(timeout):
+		t.Fatal("Timed out waiting for message from broker")
+	}
+}
+
+func TestRabbitMqSchedule(t *testing.T) {
+
+	r := require.New(t)
+
+	bkr := New(Config{})
+	bkr.Init(broker.Options{
+		Name:    "RabbitMQ",
+		Address: "amqp://localhost:5672",
+	})
+	r.Nil(bkr.Connect())
+	defer bkr.Disconnect()
+
+	c := make(chan string, 1)
+	_, err := bkr.SubscribeRaw("test.testMessageSchedule", func(ctx context.Context, msg []byte) error {
+		c <- string(msg)
+		return nil
+	}, AutoDelete())
+	r.Nil(err)
+
+	start := time.Now()
+	r.Nil(bkr.PublishRaw("test.testMessageSchedule", []byte("Test"), broker.PublishAfter(time.Second)))
+
+	select {
+	case msg := <-c:
+		r.Equal("Test", msg)
+		r.True(time.Since(start) >= time.Second, "Scheduled messages should be delivered when due")
+	case <-time.After(timeout):
+		t.Fatal("Timed out waiting for the scheduled message")
+	}
+
+	err = bkr.PublishRaw("test.testMessageSchedule", []byte("Test"), broker.PublishAfter(time.Second), broker.TTL(time.Minute))
+	r.True(errors.Is(err, broker.ErrNotSupported), "TTL should be rejected for scheduled messages")
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	r.True(errors.Is(broker.Cancel(ctx, bkr, "id"), broker.ErrNotSupported), "Scheduled messages cannot be cancelled")
+}
+
+func TestRabbitMqScheduleCancel(t *testing.T) {
+
+	r := require.New(t)
+
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer client.Close()
+
+	// the scheduler keeps the messages in Redis until they are due, so they can be cancelled
+	bkr := scheduler.New(New(Config{}), client, scheduler.Config{Interval: 10 * time.Millisecond})
+	bkr.Init(broker.Options{
+		Name:    "RabbitMQ",
+		Address: "amqp://localhost:5672",
+	})
+	r.Nil(bkr.Connect())
+	defer bkr.Disconnect()
+
+	c := make(chan string, 2)
+	_, err := bkr.SubscribeRaw("test.testMessageSchedule", func(ctx context.Context, msg []byte) error {
+		c <- string(msg)
+		return nil
+	}, AutoDelete())
+	r.Nil(err)
+
+	start := time.Now()
+	r.Nil(bkr.PublishRaw("test.testMessageSchedule", []byte("Cancelled"), broker.WithMessageID("reminder"), broker.PublishAfter(100*time.Millisecond)))
+	r.Nil(bkr.PublishRaw("test.testMessageSchedule", []byte("Test"), broker.PublishAfter(200*time.Millisecond), broker.TTL(time.Minute)))
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	r.Nil(broker.Cancel(ctx, bkr, "reminder"))
+
+	select {
+	case msg := <-c:
+		r.Equal("Test", msg, "Cancelled messages should not be delivered")
+		r.True(time.Since(start) >= 200*time.Millisecond, "Scheduled messages should be delivered when due")
+	case <-time.After(timeout):
+		t.Fatal("Timed out waiting for the scheduled message")
+	}
+}
+
+func TestDelayName(t *testing.T) {
+
+	r := require.New(t)
+
+	name, delay := delayName("", 1500*time.Millisecond)
+	r.Equal("ego.delay.default.2s", name)
+	r.Equal(2*time.Second, delay)
+
+	name, delay = delayName("events", time.Minute)
+	r.Equal("ego.delay.events.60s", name)
+	r.Equal(time.Minute, delay)
+}
+
+func TestRabbitMqDrain(t *testing.T) {
+
+	r := require.New(t)
+
+	bkr := New(Config{Confirm: true})
+	bkr.Init(broker.Options{
+		Name:    "RabbitMQ",
+		Address: "amqp://localhost:5672",
+	})
+	r.Nil(bkr.Connect())
+
+	const count = 5
+	var mu sync.Mutex
+	handled := 0
+	_, err := bkr.SubscribeRaw("test.testMessageDrain", func(ctx context.Context, msg []byte) error {
+		time.Sleep(50 * time.Millisecond)
+		mu.Lock()
+		defer mu.Unlock()
+		handled++
+		return nil
+	}, broker.Prefetch(count), broker.BufferSize(count))
+	r.Nil(err)
+
+	for i := 0; i < count; i++ {
+		r.Nil(bkr.PublishRaw("test.testMessageDrain", []byte("Test")))
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	r.Nil(bkr.Drain(ctx))
+	r.Nil(bkr.Handle())
+
+	mu.Lock()
+	defer mu.Unlock()
+	r.Equal(count, handled, "Drain should wait for the received messages")
+}
+
+func TestQueueOptions(t *testing.T) {
+
+	r := require.New(t)
+
+	q, err := newQueueOptions(Config{Durable: true}, broker.NewSubscribeOptions(
+		broker.AutoAck(),
+		broker.Prefetch(10),
+		Exclusive(),
+		ConsumerArguments(amqp.Table{"x-priority": int32(1)}),
+	))
+	r.Nil(err)
+	r.True(q.durable)
+	r.True(q.autoAck)
+	r.True(q.exclusive)
+	r.False(q.autoDelete)
+	r.Equal(10, q.prefetch)
+	r.Equal(amqp.Table{"x-priority": int32(1)}, q.consumerArguments)
+
+	_, err = newQueueOptions(Config{}, broker.NewSubscribeOptions(broker.StartAtSequence(1)))
+	r.True(errors.Is(err, broker.ErrNotSupported), "Start positions should be rejected")
+
+	_, err = newQueueOptions(Config{}, broker.NewSubscribeOptions(broker.NativeOption("nats.option", true)))
+	r.True(errors.Is(err, broker.ErrNotSupported), "Options of other brokers should be rejected")
+
+	// the deprecated settings of the config are the defaults of the subscriptions
+	config := Config{DeleteWhenUnused: true, Exclusive: true, AutoAck: true, Arguments: amqp.Table{"x-priority": int32(1)}}
+	q, err = newQueueOptions(config, broker.NewSubscribeOptions(broker.NativeOption(optionExclusive, false)))
+	r.Nil(err)
+	r.True(q.autoDelete)
+	r.True(q.autoAck)
+	r.False(q.exclusive, "Native options should override the config")
+	r.Equal(amqp.Table{"x-priority": int32(1)}, q.consumerArguments)
+}
+
+func TestBindingKey(t *testing.T) {
+
+	r := require.New(t)
+
+	r.Equal("orders.created", bindingKey("orders.created"))
+	r.Equal("orders.*", bindingKey("orders.*"))
+	r.Equal("orders.*.#", bindingKey("orders.>"), "'>' should not match 'orders'")
+	r.Equal("orders.#", bindingKey("orders.#"))
+	r.Equal("*.#", bindingKey(">"))
+}
+
+func TestQueue(t *testing.T) {
+
+	r := require.New(t)
+
+	// the predeclared topic exchange is used by default
+	n := &rabbitmqBroker{options: broker.Options{Name: "RabbitMQ"}}
+	r.Equal("amq.topic", n.exchangeName())
+	queue, bindings, private, err := n.queue("orders.created", broker.NewSubscribeOptions())
+	r.Nil(err)
+	r.Equal("RabbitMQ.orders.created", queue, "The default queue group should get a queue of its own")
+	r.Equal([]string{"orders.created"}, bindings)
+	r.False(private)
+
+	queue, bindings, _, err = n.queue("orders.>", broker.NewSubscribeOptions(broker.Queue("billing")))
+	r.Nil(err)
+	r.Equal("billing.orders.>", queue)
+	r.Equal([]string{"orders.*.#"}, bindings)
+
+	_, _, private, err = n.queue("orders.created", broker.NewSubscribeOptions(broker.Broadcast()))
+	r.Nil(err)
+	r.True(private, "Broadcast subscribers should get a private queue")
+
+	n.config = Config{DefaultExchange: true}
+	queue, bindings, private, err = n.queue("orders.created", broker.NewSubscribeOptions())
+	r.Nil(err)
+	r.Equal("orders.created", queue)
+	r.Nil(bindings)
+	r.False(private)
+
+	for _, opts := range []broker.SubscribeOptions{
+		broker.NewSubscribeOptions(broker.Queue("billing")),
+		broker.NewSubscribeOptions(broker.Broadcast()),
+	} {
+		_, _, _, err = n.queue("orders.created", opts)
+		r.True(errors.Is(err, broker.ErrNotSupported), "Queue groups should be rejected on the default exchange")
+	}
+	_, _, _, err = n.queue("orders.*", broker.NewSubscribeOptions())
+	r.True(errors.Is(err, broker.ErrNotSupported), "Wildcards should be rejected on the default exchange")
+
+	n.config = Config{Exchange: "events", ExchangeType: "fanout"}
+	_, _, _, err = n.queue("orders.created", broker.NewSubscribeOptions())
+	r.True(errors.Is(err, broker.ErrNotSupported), "Topics should be rejected on a fanout exchange")
+
+	n.config = Config{Exchange: "events", ExchangeType: "direct"}
+	_, _, _, err = n.queue("orders.>", broker.NewSubscribeOptions())
+	r.True(errors.Is(err, broker.ErrNotSupported), "Wildcards should be rejected on a direct exchange")
+}
+
+func TestReconnectGivesUp(t *testing.T) {
+
+	r := require.New(t)
+
+	var status broker.StatusNotifier
+	notify := status.Notify()
+
+	// nothing listens on the port, so every attempt fails
+	c := &connection{
+		url:    "amqp://localhost:1",
+		policy: broker.ReconnectPolicy{MaxAttempts: 2, Backoff: 10 * time.Millisecond},
+		setStatus: func(s broker.Status) {
+			status.Set(s, nil)
+		},
+		pool:  make(chan *channel, 1),
+		ready: make(chan struct{}),
+	}
+
+	r.Nil(c.reconnect(), "reconnect should give up after MaxAttempts")
+	r.Equal(broker.StatusReconnecting, <-notify)
+	r.Equal(broker.StatusClosed, <-notify)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	_, err := c.wait(ctx)
+	r.Equal(amqp.ErrClosed, err, "Consumers waiting for the connection should be released")
+}
+
+func TestRabbitMqSubscriptions(t *testing.T) {
+
+	r := require.New(t)
+
+	bkr := New(Config{Exchange: "test.events", ExchangeType: "topic"})
+	bkr.Init(broker.Options{
+		Name:    "RabbitMQ",
+		Address: "amqp://localhost:5672",
+	})
+	r.Nil(bkr.Connect())
+	defer bkr.Disconnect()
+
+	handler := func(ctx context.Context, msg []byte) error {
+		return nil
+	}
+
+	first, err := bkr.SubscribeRaw("test.testMessageSubscriptions", handler)
+	r.Nil(err)
+	second, err := bkr.SubscribeRaw("test.testMessageSubscriptions", handler, broker.Broadcast())
+	r.Nil(err)
+	r.NotEqual(first.ID(), second.ID(), "Subscriptions of the same topic should have unique ids")
+
+	subscriptions := bkr.Subscriptions()
+	r.Len(subscriptions, 2)
+	queues := map[string]bool{}
+	for _, s := range subscriptions {
+		queues[s.Queue] = true
+	}
+	r.Equal(map[string]bool{"RabbitMQ.test.testMessageSubscriptions": true, "": true}, queues)
+
+	r.Nil(bkr.UnsubscribeAll())
+	r.Empty(bkr.Subscriptions())
+	r.NotNil(first.Unsubscribe(), "UnsubscribeAll should unsubscribe every subscription")
+}
+
+func TestAmqpConfig(t *testing.T) {
+
+	r := require.New(t)
+
+	config, err := amqpConfig(broker.Options{Address: "amqp://localhost:5672"})
+	r.Nil(err)
+	r.Nil(config.SASL, "The credentials of the address should be used")
+	r.Equal(heartbeat, config.Heartbeat)
+
+	config, err = amqpConfig(broker.Options{Address: "amqp://localhost:5672", Username: "ego", Password: "secret"})
+	r.Nil(err)
+	r.Equal([]amqp.Authentication{&amqp.PlainAuth{Username: "ego", Password: "secret"}}, config.SASL)
+
+	clientTLS := &tls.Config{Certificates: []tls.Certificate{{}}}
+	_, err = amqpConfig(broker.Options{Address: "amqp://localhost:5672", TLSConfig: clientTLS})
+	r.NotNil(err, "TLS should require an amqps address")
+
+	config, err = amqpConfig(broker.Options{Address: "amqps://localhost:5671", TLSConfig: clientTLS})
+	r.Nil(err)
+	r.Equal(clientTLS, config.TLSClientConfig)
+	r.Len(config.SASL, 1)
+	r.Equal("EXTERNAL", config.SASL[0].Mechanism(), "The client certificate should authenticate")
+
+	for _, opts := range []broker.Options{{Token: "s3cr3t"}, {CredentialsFile: "user.creds"}, {NKeySeedFile: "user.nk"}} {
+		_, err = amqpConfig(opts)
+		r.True(errors.Is(err, broker.ErrNotSupported), "NATS credentials should be rejected")
+	}
+}
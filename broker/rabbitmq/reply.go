@@ -0,0 +1,144 @@
+package rabbitmq
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/adityak368/ego/broker"
+	"github.com/adityak368/swissknife/logger/v2"
+	"github.com/streadway/amqp"
+)
+
+// replyConsumer consumes the responses to the requests of the broker from an exclusive,
+// server named queue and hands them to the waiting requests by correlation id. The queue
+// goes away with the connection, so a new one is declared after every reconnect
+type replyConsumer struct {
+	connection *connection
+	ctx        context.Context
+	channel    *amqp.Channel
+	queue      string
+	pending    map[string]chan *broker.Message
+	mu         sync.Mutex
+}
+
+// newReplyConsumer declares the reply queue and starts consuming it on a channel of the
+// connection. The consumer stops when ctx is done
+func newReplyConsumer(connection *connection, ctx context.Context) (*replyConsumer, error) {
+	conn := connection.Connection()
+	if conn == nil {
+		return nil, errConnectionLost
+	}
+
+	r := &replyConsumer{
+		connection: connection,
+		ctx:        ctx,
+		pending:    make(map[string]chan *broker.Message),
+	}
+
+	deliveries, err := r.consume(conn)
+	if err != nil {
+		return nil, err
+	}
+	go r.run(deliveries)
+
+	return r, nil
+}
+
+// Queue returns the name of the reply queue
+func (r *replyConsumer) Queue() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.queue
+}
+
+// consume declares a new reply queue and consumes it on a new channel of the connection
+func (r *replyConsumer) consume(conn *amqp.Connection) (<-chan amqp.Delivery, error) {
+	channel, err := conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+
+	queue, err := channel.QueueDeclare("", false, true, true, false, nil)
+	if err != nil {
+		channel.Close()
+		return nil, err
+	}
+
+	deliveries, err := channel.Consume(queue.Name, "", true, true, false, false, nil)
+	if err != nil {
+		channel.Close()
+		return nil, err
+	}
+
+	r.mu.Lock()
+	r.channel = channel
+	r.queue = queue.Name
+	r.mu.Unlock()
+
+	return deliveries, nil
+}
+
+// run dispatches the responses until the consumer is closed. Requests in flight while
+// the connection is lost time out since their responses went to the lost queue
+func (r *replyConsumer) run(deliveries <-chan amqp.Delivery) {
+	for {
+		for d := range deliveries {
+			r.mu.Lock()
+			reply, ok := r.pending[d.CorrelationId]
+			delete(r.pending, d.CorrelationId)
+			r.mu.Unlock()
+
+			if ok {
+				reply <- toMessage(d.RoutingKey, d)
+			}
+		}
+
+		for attempt := 1; ; attempt++ {
+			if r.ctx.Err() != nil {
+				return
+			}
+
+			conn, err := r.connection.wait(r.ctx)
+			if err != nil {
+				return
+			}
+
+			if deliveries, err = r.consume(conn); err == nil {
+				break
+			}
+
+			logger.Warn().Err(err).Msg("[RABBITMQ]: Could not declare the reply queue. Retrying")
+			select {
+			case <-time.After(r.connection.policy.Delay(attempt)):
+			case <-r.ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// register returns the channel on which the response with the correlation id is received
+func (r *replyConsumer) register(correlationID string) <-chan *broker.Message {
+	reply := make(chan *broker.Message, 1)
+
+	r.mu.Lock()
+	r.pending[correlationID] = reply
+	r.mu.Unlock()
+
+	return reply
+}
+
+// remove stops waiting for the response with the correlation id
+func (r *replyConsumer) remove(correlationID string) {
+	r.mu.Lock()
+	delete(r.pending, correlationID)
+	r.mu.Unlock()
+}
+
+// Close closes the channel which deletes the reply queue
+func (r *replyConsumer) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.channel.Close()
+}
@@ -1,7 +1,49 @@
 package rabbitmq
 
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/adityak368/ego/broker"
+	"github.com/adityak368/swissknife/logger/v2"
+	"github.com/streadway/amqp"
+)
+
 type rabbitmqSubscriber struct {
-	topic string
+	topic    string
+	queue    string
+	bindings []string
+	private  bool
+	tag      string
+	exchange string
+	options  queueOptions
+	handler  func(d amqp.Delivery) bool
+	workers  *broker.Workers
+	stats    broker.StatsCounter
+	broker   *rabbitmqBroker
+	cancel   context.CancelFunc
+
+	// handlerType is the type of the subscribed handler
+	handlerType string
+	subscribed  time.Time
+
+	// connection is the managed connection the consumer is re-established on
+	connection *connection
+
+	// quit is closed by stop so that the consumer is not re-established
+	quit context.Context
+	stop context.CancelFunc
+	done chan struct{}
+
+	channel *amqp.Channel
+	mu      sync.Mutex
+}
+
+// ID returns the unique id of the subscription, which is its consumer tag
+func (s *rabbitmqSubscriber) ID() string {
+	return s.tag
 }
 
 // Topic returns the subscribed topic
@@ -9,7 +51,198 @@ func (s *rabbitmqSubscriber) Topic() string {
 	return s.topic
 }
 
-// Unsubscribe unsibscribes to the topic
+// info describes the subscription. The queue of a broadcast subscriber is private to it
+func (s *rabbitmqSubscriber) info() broker.SubscriptionInfo {
+	info := broker.SubscriptionInfo{
+		ID:         s.tag,
+		Topic:      s.topic,
+		Handler:    s.handlerType,
+		Subscribed: s.subscribed,
+		Stats:      s.stats.Stats(),
+	}
+	if !s.private {
+		info.Queue = s.queue
+	}
+	return info
+}
+
+// Unsubscribe unsubscribes to the topic. It cancels the consumer and waits for the handler
+// which is in flight. Unacked messages are requeued by the broker
 func (s *rabbitmqSubscriber) Unsubscribe() error {
-	return nil
+	if !s.broker.unsubscribe(s) {
+		return fmt.Errorf("[RABBITMQ]: Cannot unsubscribe from %s", s.topic)
+	}
+	return s.close()
+}
+
+// consume declares and binds the queue of the subscription on a new channel of the
+// connection and starts consuming it with the consumer tag of the subscriber
+func (s *rabbitmqSubscriber) consume(conn *amqp.Connection) (<-chan amqp.Delivery, error) {
+	channel, err := conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+
+	if s.options.prefetch > 0 {
+		if err := channel.Qos(s.options.prefetch, 0, false); err != nil {
+			channel.Close()
+			return nil, err
+		}
+	}
+
+	durable, autoDelete, exclusive := s.options.durable, s.options.autoDelete, s.options.exclusive
+	if s.private {
+		// the queue of a broadcast subscriber goes away with it
+		durable, autoDelete, exclusive = false, true, true
+	}
+
+	_, err = channel.QueueDeclare(s.queue, durable, autoDelete, exclusive, s.options.noWait, s.options.queueArguments)
+	if err != nil {
+		channel.Close()
+		return nil, err
+	}
+
+	for _, binding := range s.bindings {
+		if err := channel.QueueBind(s.queue, binding, s.exchange, s.options.noWait, nil); err != nil {
+			channel.Close()
+			return nil, err
+		}
+	}
+
+	deliveries, err := channel.Consume(s.queue, s.tag, s.options.autoAck, false, false, s.options.noWait, s.options.consumerArguments)
+	if err != nil {
+		channel.Close()
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.channel = channel
+	s.mu.Unlock()
+
+	return deliveries, nil
+}
+
+// run hands the deliveries to the workers until the consumer is cancelled. Deliveries
+// are acked when the handler returns true and requeued otherwise. When the channel is
+// lost the consumer is re-established once the connection is back
+func (s *rabbitmqSubscriber) run(deliveries <-chan amqp.Delivery) {
+	defer close(s.done)
+
+	for {
+		s.deliver(deliveries)
+
+		var ok bool
+		if deliveries, ok = s.resubscribe(); !ok {
+			return
+		}
+	}
+}
+
+// deliver hands the deliveries to the workers until the deliveries are closed
+func (s *rabbitmqSubscriber) deliver(deliveries <-chan amqp.Delivery) {
+	for d := range deliveries {
+		d := d
+		s.stats.Receive()
+		s.workers.Go(func() { s.handle(d) })
+	}
+}
+
+// handle calls the handler with the delivery and acknowledges it
+func (s *rabbitmqSubscriber) handle(d amqp.Delivery) {
+	ok := s.handler(d)
+	if s.options.autoAck {
+		return
+	}
+
+	var err error
+	if ok {
+		err = d.Ack(false)
+	} else {
+		err = d.Nack(false, true)
+	}
+	if err != nil {
+		logger.Warn().Err(err).Msgf("[RABBITMQ]: Could not acknowledge message of queue '%s'", s.queue)
+	}
+}
+
+// resubscribe waits for the connection and consumes the queue again. It returns false
+// once the subscriber is stopped
+func (s *rabbitmqSubscriber) resubscribe() (<-chan amqp.Delivery, bool) {
+	for attempt := 1; ; attempt++ {
+		if s.quit.Err() != nil {
+			return nil, false
+		}
+
+		conn, err := s.connection.wait(s.quit)
+		if err != nil {
+			return nil, false
+		}
+
+		deliveries, err := s.consume(conn)
+		if err == nil {
+			logger.Info().Msgf("[RABBITMQ]: Resubscribed to topic '%s' with queue '%s'", s.topic, s.queue)
+			return deliveries, true
+		}
+
+		delay := s.connection.policy.Delay(attempt)
+		logger.Warn().Err(err).Msgf("[RABBITMQ]: Could not resubscribe to topic '%s'. Retrying in %s", s.topic, delay)
+		select {
+		case <-time.After(delay):
+		case <-s.quit.Done():
+			return nil, false
+		}
+	}
+}
+
+// close cancels the consumer, waits for the handlers in flight and closes the channel.
+// Buffered deliveries are requeued by the broker
+func (s *rabbitmqSubscriber) close() error {
+	return s.shutdown(context.Background(), false)
+}
+
+// drain cancels the consumer, waits until the buffered deliveries are handled and closes
+// the channel. When ctx is done first the remaining deliveries are requeued by the broker
+func (s *rabbitmqSubscriber) drain(ctx context.Context) error {
+	return s.shutdown(ctx, true)
+}
+
+// shutdown cancels the consumer, stops or drains the workers and closes the channel
+func (s *rabbitmqSubscriber) shutdown(ctx context.Context, drain bool) error {
+	defer s.cancel()
+	s.stop()
+
+	s.mu.Lock()
+	channel := s.channel
+	s.mu.Unlock()
+
+	// the deliveries are closed as well when the channel is already closed
+	if err := channel.Cancel(s.tag, false); err != nil && err != amqp.ErrClosed {
+		channel.Close()
+		s.workers.Stop()
+		<-s.done
+		return err
+	}
+
+	var err error
+	if drain {
+		// the deliveries received before the cancel are handed to the workers
+		select {
+		case <-s.done:
+		case <-ctx.Done():
+		}
+		err = s.workers.Drain(ctx)
+	} else {
+		s.workers.Stop()
+	}
+	<-s.done
+
+	// a resubscribe may have replaced the channel in the meantime
+	s.mu.Lock()
+	channel = s.channel
+	s.mu.Unlock()
+
+	if closeErr := channel.Close(); closeErr != nil && closeErr != amqp.ErrClosed && err == nil {
+		err = closeErr
+	}
+	return err
 }
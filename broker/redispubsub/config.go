@@ -0,0 +1,24 @@
+package redispubsub
+
+import (
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// pingInterval is how often an idle subscription checks its connection
+	pingInterval = 30 * time.Second
+	// claimExpiry is how long the claim of a message by a member of a queue group is kept
+	claimExpiry = time.Minute
+)
+
+// Config is the config for the Redis Pub/Sub broker
+type Config struct {
+	// DB is the Redis database of the queue group claims. Pub/Sub channels are shared by
+	// every database
+	DB int
+	// Client is a go-redis v9 connection to Redis used instead of connecting to the address of the broker.
+	// It is not closed on Disconnect
+	Client redis.UniversalClient
+}
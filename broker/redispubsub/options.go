@@ -0,0 +1,23 @@
+package redispubsub
+
+import "github.com/adityak368/ego/broker"
+
+// names of the Redis Pub/Sub specific subscribe options
+const (
+	optionEmulateQueue = "redispubsub.emulateQueue"
+)
+
+// EmulateQueue emulates the queue group of the subscription, which Redis Pub/Sub does not
+// have. Every member of the group receives the message and the member which claims its id
+// first with SET NX handles it, which costs a round trip to Redis for every message. The
+// group defaults to the broker name. Without it broker.Queue is not supported and every
+// subscription receives every message of its topic
+func EmulateQueue() broker.SubscribeOption {
+	return broker.NativeOption(optionEmulateQueue, true)
+}
+
+// emulatesQueue returns whether the subscription emulates its queue group
+func emulatesQueue(opts broker.SubscribeOptions) bool {
+	emulate, _ := opts.Native[optionEmulateQueue].(bool)
+	return emulate
+}
@@ -0,0 +1,484 @@
+// Package redispubsub is the Redis Pub/Sub implementation of the broker. Every topic is a
+// channel and subscriptions with NATS wildcards are pattern subscriptions. Like core NATS
+// the messages are not persisted, subscribers which are not connected miss them. Redis has
+// no queue groups, so every subscription receives every message of its topic unless its
+// queue group is emulated, see EmulateQueue.
+package redispubsub
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/adityak368/ego/broker"
+	"github.com/adityak368/swissknife/logger/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// envelope is the payload of the published messages
+type envelope struct {
+	Headers map[string]string `json:"headers"`
+	Body    []byte            `json:"body"`
+}
+
+// globEscaper escapes the special characters of Redis globs
+var globEscaper = strings.NewReplacer(`\`, `\\`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
+
+// redisBroker is the Redis Pub/Sub implementation of the broker
+type redisBroker struct {
+	options         broker.Options
+	config          Config
+	client          redis.UniversalClient
+	subscriptionMap map[string]*redisSubscriber
+	mu              sync.Mutex
+	ctx             context.Context
+	cancel          context.CancelFunc
+	status          broker.StatusNotifier
+}
+
+// Address Returns the broker bind interface
+func (n *redisBroker) Address() string {
+	return n.options.Address
+}
+
+// Init initialises the broker
+func (n *redisBroker) Init(opts broker.Options) error {
+	n.options = opts
+	return nil
+}
+
+// Options returns the broker options
+func (n *redisBroker) Options() broker.Options {
+	return n.options
+}
+
+// String returns the description of the broker
+func (n *redisBroker) String() string {
+	return fmt.Sprintf("[REDISPUBSUB]: Connected to Redis on %s", n.Address())
+}
+
+// Connect connects to Redis
+func (n *redisBroker) Connect() error {
+	switch {
+	case n.options.Token != "":
+		return broker.NotSupported("REDISPUBSUB", "Token")
+	case n.options.CredentialsFile != "":
+		return broker.NotSupported("REDISPUBSUB", "CredentialsFile")
+	case n.options.NKeySeedFile != "":
+		return broker.NotSupported("REDISPUBSUB", "NKeySeedFile")
+	}
+
+	client := n.config.Client
+	if client == nil {
+		client = redis.NewClient(&redis.Options{
+			Addr:      n.Address(),
+			Username:  n.options.Username,
+			Password:  n.options.Password,
+			DB:        n.config.DB,
+			TLSConfig: n.options.TLSConfig,
+		})
+	}
+
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		if n.config.Client == nil {
+			client.Close()
+		}
+		return err
+	}
+
+	n.client = client
+	n.ctx, n.cancel = context.WithCancel(context.Background())
+	n.status.Set(broker.StatusConnected, n.options.OnStatus)
+	logger.Info().Msgf("[REDISPUBSUB]: Connected to %s", n.Address())
+	return nil
+}
+
+// Disconnect unsubscribes, waits for the handlers in flight and disconnects. Buffered
+// messages which were not handled yet are dropped
+func (n *redisBroker) Disconnect() error {
+
+	if n.client == nil {
+		return errors.New("[REDISPUBSUB]: Cannot Disconnect. Not connected to broker")
+	}
+
+	for _, s := range n.takeSubscribers() {
+		s.close()
+	}
+
+	return n.close()
+}
+
+// Drain unsubscribes, waits until the received messages are handled and disconnects
+func (n *redisBroker) Drain(ctx context.Context) error {
+
+	if n.client == nil {
+		return errors.New("[REDISPUBSUB]: Cannot Drain. Not connected to broker")
+	}
+
+	subscribers := n.takeSubscribers()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(subscribers))
+	for _, s := range subscribers {
+		wg.Add(1)
+		go func(s *redisSubscriber) {
+			defer wg.Done()
+			if err := s.drain(ctx); err != nil {
+				errs <- err
+			}
+		}(s)
+	}
+	wg.Wait()
+	close(errs)
+
+	err := <-errs
+	if closeErr := n.close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// close closes the client unless it was passed in the config
+func (n *redisBroker) close() error {
+	n.cancel()
+	var err error
+	if n.config.Client == nil {
+		err = n.client.Close()
+	}
+	n.status.Set(broker.StatusClosed, n.options.OnStatus)
+	logger.Info().Msgf("[REDISPUBSUB]: Disconnected from %s", n.Address())
+	return err
+}
+
+// Subscriptions returns the active subscriptions along with their stats in the order they were subscribed
+func (n *redisBroker) Subscriptions() []broker.SubscriptionInfo {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	infos := make([]broker.SubscriptionInfo, 0, len(n.subscriptionMap))
+	for _, s := range n.subscriptionMap {
+		infos = append(infos, s.info())
+	}
+	broker.SortSubscriptions(infos)
+	return infos
+}
+
+// UnsubscribeAll unsubscribes every subscription and waits for the handlers in flight
+func (n *redisBroker) UnsubscribeAll() error {
+	var err error
+	for _, s := range n.takeSubscribers() {
+		if closeErr := s.close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// takeSubscribers removes every subscriber from the broker and returns them
+func (n *redisBroker) takeSubscribers() []*redisSubscriber {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	subscribers := make([]*redisSubscriber, 0, len(n.subscriptionMap))
+	for _, s := range n.subscriptionMap {
+		subscribers = append(subscribers, s)
+	}
+	n.subscriptionMap = make(map[string]*redisSubscriber)
+	return subscribers
+}
+
+// unsubscribe removes the subscriber from the broker
+func (n *redisBroker) unsubscribe(s *redisSubscriber) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if _, ok := n.subscriptionMap[s.id]; !ok {
+		return false
+	}
+	delete(n.subscriptionMap, s.id)
+	return true
+}
+
+// Status returns the status of the connection to the broker
+func (n *redisBroker) Status() broker.Status {
+	return n.status.Status()
+}
+
+// NotifyStatus returns a channel which receives the changes of the status
+func (n *redisBroker) NotifyStatus() <-chan broker.Status {
+	return n.status.Notify()
+}
+
+// Handle returns the raw connection handle to the broker
+func (n *redisBroker) Handle() interface{} {
+	return n.client
+}
+
+// Publish publishes a message to the topic
+func (n *redisBroker) Publish(topic string, m proto.Message, opts ...broker.PublishOption) error {
+
+	if n.client == nil {
+		return errors.New("[REDISPUBSUB]: Cannot Publish. Not connected to broker")
+	}
+
+	return n.publishWith(topic, &broker.Message{Data: m}, opts)
+}
+
+// PublishRaw publishes raw data to the topic
+func (n *redisBroker) PublishRaw(topic string, m []byte, opts ...broker.PublishOption) error {
+
+	if n.client == nil {
+		return errors.New("[REDISPUBSUB]: Cannot PublishRaw. Not connected to broker")
+	}
+
+	return n.publishWith(topic, &broker.Message{Body: m}, opts)
+}
+
+// PublishMessage publishes a message envelope to the topic
+func (n *redisBroker) PublishMessage(topic string, m *broker.Message, opts ...broker.PublishOption) error {
+
+	if n.client == nil {
+		return errors.New("[REDISPUBSUB]: Cannot PublishMessage. Not connected to broker")
+	}
+
+	return n.publishWith(topic, m, opts)
+}
+
+// Request publishes the request to the topic and waits for the response on an inbox
+// channel of its own. Requests which reach no subscriber fail right away
+func (n *redisBroker) Request(ctx context.Context, topic string, req proto.Message, resp proto.Message) error {
+
+	if n.client == nil {
+		return errors.New("[REDISPUBSUB]: Cannot Request. Not connected to broker")
+	}
+
+	inbox := "_INBOX." + broker.NewID()
+	pubsub := n.client.Subscribe(ctx, inbox)
+	defer pubsub.Close()
+
+	// the response must not be published before the inbox is subscribed
+	if _, err := pubsub.Receive(ctx); err != nil {
+		return errors.Wrapf(err, "[REDISPUBSUB]: Could not subscribe to the inbox of the request on '%s'", topic)
+	}
+
+	receivers, err := n.send(topic, &broker.Message{Data: req, ReplyTo: inbox})
+	if err != nil {
+		return err
+	}
+	if receivers == 0 {
+		return fmt.Errorf("[REDISPUBSUB]: No response to request on '%s'. No subscribers", topic)
+	}
+
+	select {
+	case reply := <-pubsub.Channel():
+		return broker.DecodeResponse(toMessage(inbox, reply.Payload), resp)
+	case <-ctx.Done():
+		return errors.Wrapf(ctx.Err(), "[REDISPUBSUB]: No response to request on '%s'", topic)
+	}
+}
+
+// publishWith applies the publish options to the envelope and publishes it. Redis Pub/Sub
+// neither expires nor prioritises messages
+func (n *redisBroker) publishWith(topic string, m *broker.Message, opts []broker.PublishOption) error {
+
+	o := broker.NewPublishOptions(opts...)
+	switch {
+	case o.TTL > 0:
+		return broker.NotSupported("REDISPUBSUB", "TTL")
+	case o.Priority > 0:
+		return broker.NotSupported("REDISPUBSUB", "Priority")
+	case !o.At.IsZero():
+		return broker.NotSupported("REDISPUBSUB", "PublishAt")
+	}
+	if err := o.CheckNative("REDISPUBSUB"); err != nil {
+		return err
+	}
+
+	msg, err := o.Apply(m)
+	if err != nil {
+		return err
+	}
+	return n.publish(topic, msg)
+}
+
+// publish publishes the envelope to the channel of the topic
+func (n *redisBroker) publish(topic string, m *broker.Message) error {
+	_, err := n.send(topic, m)
+	return err
+}
+
+// send publishes the envelope to the channel of the topic and returns the number of
+// subscribers which received it
+func (n *redisBroker) send(topic string, m *broker.Message) (int64, error) {
+
+	payload, err := toPayload(m, n.options.Codec)
+	if err != nil {
+		return 0, err
+	}
+
+	return n.client.Publish(n.ctx, topic, payload).Result()
+}
+
+// Subscribe subscribes a handler to the topic
+func (n *redisBroker) Subscribe(topic string, h interface{}, opts ...broker.SubscribeOption) (broker.Subscriber, error) {
+
+	if n.client == nil {
+		return nil, errors.New("[REDISPUBSUB]: Cannot Subscribe. Not connected to broker")
+	}
+
+	handler, err := broker.NewHandlerFunc(h)
+	if err != nil {
+		return nil, errors.Wrap(err, "[REDISPUBSUB]")
+	}
+
+	return n.subscribe(topic, handler, broker.HandlerType(h), broker.NewSubscribeOptions(opts...))
+}
+
+// SubscribeRaw subscribes a raw handler to the topic
+func (n *redisBroker) SubscribeRaw(topic string, h func(c context.Context, data []byte) error, opts ...broker.SubscribeOption) (broker.Subscriber, error) {
+
+	if n.client == nil {
+		return nil, errors.New("[REDISPUBSUB]: Cannot Subscribe. Not connected to broker")
+	}
+
+	return n.subscribe(topic, broker.NewRawHandlerFunc(h), broker.HandlerType(h), broker.NewSubscribeOptions(opts...))
+}
+
+// subscribe subscribes the handler to the channel of the topic, or to the channels matching
+// the pattern of a topic with wildcards. Every subscription has a connection of its own
+func (n *redisBroker) subscribe(topic string, h broker.HandlerFunc, handlerType string, opts broker.SubscribeOptions) (broker.Subscriber, error) {
+
+	if !broker.ValidTopic(topic) {
+		return nil, fmt.Errorf("[REDISPUBSUB]: Invalid topic '%s'", topic)
+	}
+
+	if err := checkSubscribeOptions(opts); err != nil {
+		return nil, err
+	}
+
+	var pubsub *redis.PubSub
+	pattern := strings.ContainsAny(topic, "*>")
+	if pattern {
+		pubsub = n.client.PSubscribe(n.ctx, channelPattern(topic))
+	} else {
+		pubsub = n.client.Subscribe(n.ctx, topic)
+	}
+
+	// the subscription is confirmed before Subscribe returns, like with NATS
+	if _, err := pubsub.Receive(n.ctx); err != nil {
+		pubsub.Close()
+		return nil, errors.Wrapf(err, "[REDISPUBSUB]: Could not subscribe to '%s'", topic)
+	}
+
+	queue := ""
+	if emulatesQueue(opts) {
+		queue = opts.QueueGroup(n.options.Name)
+	}
+
+	ctx, cancel := context.WithCancel(n.ctx)
+	quit, stop := context.WithCancel(n.ctx)
+
+	subscriber := &redisSubscriber{
+		id:          broker.NewID(),
+		topic:       topic,
+		queue:       queue,
+		pattern:     pattern,
+		handler:     h,
+		handlerType: opts.ReportedHandlerType(handlerType),
+		subscribed:  time.Now(),
+		options:     opts,
+		pubsub:      pubsub,
+		workers:     broker.NewWorkers(opts.Concurrency, opts.BufferSize),
+		broker:      n,
+		ctx:         ctx,
+		cancel:      cancel,
+		quit:        quit,
+		stop:        stop,
+		done:        make(chan struct{}),
+	}
+
+	n.mu.Lock()
+	n.subscriptionMap[subscriber.id] = subscriber
+	n.mu.Unlock()
+
+	go subscriber.receive()
+
+	if subscriber.queue != "" {
+		logger.Info().Msgf("[REDISPUBSUB]: Subscribed to topic '%s' in queue group '%s'", topic, subscriber.queue)
+		return subscriber, nil
+	}
+	logger.Info().Msgf("[REDISPUBSUB]: Subscribed to topic '%s'", topic)
+	return subscriber, nil
+}
+
+// checkSubscribeOptions rejects the options Redis Pub/Sub has no equivalent for. Messages
+// are not persisted and are never redelivered, so every subscription acks automatically.
+// Queue groups are only supported when they are emulated
+func checkSubscribeOptions(opts broker.SubscribeOptions) error {
+	switch {
+	case opts.Queue != "" && !emulatesQueue(opts):
+		return broker.NotSupported("REDISPUBSUB", "Queue")
+	case opts.StartSequence > 0:
+		return broker.NotSupported("REDISPUBSUB", "StartAtSequence")
+	case !opts.StartTime.IsZero():
+		return broker.NotSupported("REDISPUBSUB", "StartAtTime")
+	case opts.Prefetch > 0:
+		return broker.NotSupported("REDISPUBSUB", "Prefetch")
+	}
+	return opts.CheckNative("REDISPUBSUB")
+}
+
+// channelPattern maps the NATS wildcards of the topic onto a Redis glob. A glob '*' also
+// matches dots, so the channels of the pattern are filtered with broker.MatchTopic
+func channelPattern(topic string) string {
+	tokens := strings.Split(topic, ".")
+	for i, token := range tokens {
+		switch token {
+		case "*", ">":
+			tokens[i] = "*"
+		default:
+			tokens[i] = globEscaper.Replace(token)
+		}
+	}
+	return strings.Join(tokens, ".")
+}
+
+// toPayload encodes the envelope into the payload of a Redis message. c encodes the
+// messages without content type
+func toPayload(m *broker.Message, c broker.Codec) (string, error) {
+
+	msg, err := m.Encode(c)
+	if err != nil {
+		return "", err
+	}
+
+	payload, err := json.Marshal(envelope{Headers: msg.Headers(), Body: msg.Body})
+	if err != nil {
+		return "", errors.Wrap(err, "[REDISPUBSUB]: Could not encode message")
+	}
+	return string(payload), nil
+}
+
+// toMessage extracts the envelope from the payload of a Redis message. Payloads which
+// were not published by a broker, e.g. with redis-cli, are delivered as the body
+func toMessage(channel, payload string) *broker.Message {
+	var e envelope
+	if err := json.Unmarshal([]byte(payload), &e); err != nil || e.Headers == nil {
+		return broker.MessageFromHeaders(channel, nil, []byte(payload))
+	}
+	return broker.MessageFromHeaders(channel, e.Headers, e.Body)
+}
+
+// New returns a new Redis Pub/Sub broker
+func New(config Config) broker.Broker {
+	return &redisBroker{
+		config:          config,
+		subscriptionMap: make(map[string]*redisSubscriber),
+	}
+}
@@ -0,0 +1,337 @@
+package redispubsub
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/adityak368/ego/broker"
+	proto "github.com/adityak368/ego/broker/proto/gen/broker"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/pkg/errors"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/require"
+)
+
+const timeout = 5 * time.Second
+
+func newBroker(t *testing.T, mr *miniredis.Miniredis, name string) broker.Broker {
+	bkr := New(Config{})
+	bkr.Init(broker.Options{
+		Name:    name,
+		Address: mr.Addr(),
+	})
+	require.Nil(t, bkr.Connect())
+	t.Cleanup(func() { bkr.Disconnect() })
+	return bkr
+}
+
+func TestRedisPubSub(t *testing.T) {
+
+	r := require.New(t)
+
+	mr := miniredis.RunT(t)
+	bkr := newBroker(t, mr, "RedisPubSub")
+
+	var mu sync.Mutex
+	received := map[string][]string{}
+	record := func(name, data string) {
+		mu.Lock()
+		defer mu.Unlock()
+		received[name] = append(received[name], data)
+	}
+
+	_, err := bkr.Subscribe("test.testMessageProto", func(ctx context.Context, msg *proto.TestMessage) error {
+		record("proto", msg.Data)
+		return nil
+	})
+	r.Nil(err)
+	_, err = bkr.SubscribeRaw("test.testMessageRaw", func(ctx context.Context, msg []byte) error {
+		record("raw", string(msg))
+		return nil
+	})
+	r.Nil(err)
+	_, err = bkr.SubscribeRaw("test.*", func(ctx context.Context, msg []byte) error {
+		record("wildcard", "")
+		return nil
+	}, broker.Broadcast())
+	r.Nil(err)
+	_, err = bkr.SubscribeRaw("test.>", func(ctx context.Context, msg []byte) error {
+		record("fullwildcard", "")
+		return nil
+	}, broker.Broadcast())
+	r.Nil(err)
+
+	r.Nil(bkr.Publish("test.testMessageProto", &proto.TestMessage{Data: "Test"}))
+	r.Nil(bkr.PublishRaw("test.testMessageRaw", []byte("Raw")))
+	r.Nil(bkr.PublishRaw("test.testMessageRaw.nested", []byte("Nested")))
+
+	r.Eventually(func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(received["proto"]) == 1 && len(received["raw"]) == 1 &&
+			len(received["wildcard"]) == 2 && len(received["fullwildcard"]) == 3
+	}, timeout, 10*time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	r.Equal([]string{"Test"}, received["proto"])
+	r.Equal([]string{"Raw"}, received["raw"])
+
+	_, err = bkr.SubscribeRaw("test.*a", func(ctx context.Context, msg []byte) error { return nil })
+	r.NotNil(err, "Wildcards inside tokens should be rejected")
+}
+
+func TestRedisPubSubClient(t *testing.T) {
+
+	r := require.New(t)
+
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer client.Close()
+
+	// the broker uses the client instead of connecting to its address
+	bkr := New(Config{Client: client})
+	bkr.Init(broker.Options{Name: "RedisPubSub"})
+	r.Nil(bkr.Connect())
+	r.Equal(client, bkr.Handle())
+
+	c := make(chan string, 1)
+	_, err := bkr.SubscribeRaw("test.testMessageClient", func(ctx context.Context, msg []byte) error {
+		c <- string(msg)
+		return nil
+	})
+	r.Nil(err)
+	r.Nil(bkr.PublishRaw("test.testMessageClient", []byte("Test")))
+
+	select {
+	case msg := <-c:
+		r.Equal("Test", msg)
+	case <-time.After(timeout):
+		t.Fatal("Timed out waiting for message from broker")
+	}
+
+	r.Nil(bkr.Disconnect())
+	r.Nil(client.Ping(context.Background()).Err(), "The client of the config should stay open")
+}
+
+func TestChannelPattern(t *testing.T) {
+
+	r := require.New(t)
+
+	r.Equal("test.*", channelPattern("test.*"))
+	r.Equal("test.*.created", channelPattern("test.*.created"))
+	r.Equal("test.*", channelPattern("test.>"))
+	r.Equal(`test\?.\[id\].*`, channelPattern("test?.[id].>"))
+}
+
+func TestRedisPubSubQueueGroups(t *testing.T) {
+
+	r := require.New(t)
+
+	mr := miniredis.RunT(t)
+
+	var mu sync.Mutex
+	received := map[string]int{}
+	handler := func(name string) func(ctx context.Context, msg []byte) error {
+		return func(ctx context.Context, msg []byte) error {
+			mu.Lock()
+			defer mu.Unlock()
+			received[name]++
+			return nil
+		}
+	}
+
+	// the instances of a service emulating their queue group share the messages, every
+	// other subscription receives every message
+	orders := newBroker(t, mr, "orders")
+	for i := 0; i < 2; i++ {
+		instance := newBroker(t, mr, "orders")
+		_, err := instance.SubscribeRaw("test.testMessageGroups", handler("orders"), EmulateQueue())
+		r.Nil(err)
+	}
+	billing := newBroker(t, mr, "billing")
+	_, err := billing.SubscribeRaw("test.testMessageGroups", handler("billing"))
+	r.Nil(err)
+	_, err = billing.SubscribeRaw("test.testMessageGroups", handler("broadcast"))
+	r.Nil(err)
+	r.Empty(billing.Subscriptions()[0].Queue, "Queue groups should not be emulated by default")
+
+	_, err = billing.SubscribeRaw("test.testMessageGroups", handler("billing"), broker.Queue("billing"))
+	r.True(errors.Is(err, broker.ErrNotSupported), "Queue groups should be rejected unless they are emulated")
+
+	for i := 0; i < 10; i++ {
+		r.Nil(orders.PublishRaw("test.testMessageGroups", []byte("Test")))
+	}
+
+	r.Eventually(func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return received["orders"] == 10 && received["billing"] == 10 && received["broadcast"] == 10
+	}, timeout, 10*time.Millisecond)
+
+	time.Sleep(50 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	r.Equal(10, received["orders"], "A message should be handled once per queue group")
+	r.Len(mr.Keys(), 10, "Only the emulated queue group should claim the messages")
+}
+
+func TestRedisPubSubForeignPublisher(t *testing.T) {
+
+	r := require.New(t)
+
+	mr := miniredis.RunT(t)
+	bkr := newBroker(t, mr, "RedisPubSub")
+
+	c := make(chan string, 1)
+	_, err := bkr.SubscribeRaw("cache.invalidate", func(ctx context.Context, msg []byte) error {
+		c <- string(msg)
+		return nil
+	})
+	r.Nil(err)
+
+	// messages published without a broker are delivered as they are
+	client := bkr.Handle().(*redis.Client)
+	r.Nil(client.Publish(context.Background(), "cache.invalidate", "users:42").Err())
+
+	select {
+	case msg := <-c:
+		r.Equal("users:42", msg)
+	case <-time.After(timeout):
+		t.Fatal("Timed out waiting for message from broker")
+	}
+}
+
+func TestRedisPubSubRequest(t *testing.T) {
+
+	r := require.New(t)
+
+	mr := miniredis.RunT(t)
+	bkr := newBroker(t, mr, "RedisPubSub")
+
+	for i := 0; i < 2; i++ {
+		_, err := bkr.Subscribe("test.testMessageRequest", func(ctx context.Context, req *proto.TestMessage) (*proto.TestMessage, error) {
+			return &proto.TestMessage{Data: req.Data + " Response"}, nil
+		})
+		r.Nil(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	resp := &proto.TestMessage{}
+	r.Nil(bkr.Request(ctx, "test.testMessageRequest", &proto.TestMessage{Data: "Test"}, resp))
+	r.Equal("Test Response", resp.Data)
+
+	r.NotNil(bkr.Request(ctx, "test.testMessageNoResponder", &proto.TestMessage{Data: "Test"}, resp))
+	r.Nil(ctx.Err(), "Requests without subscribers should fail right away")
+}
+
+func TestRedisPubSubSubscriptions(t *testing.T) {
+
+	r := require.New(t)
+
+	mr := miniredis.RunT(t)
+	bkr := newBroker(t, mr, "RedisPubSub")
+
+	c := make(chan string, 2)
+	subscription, err := bkr.SubscribeRaw("test.testMessageSubscriptions", func(ctx context.Context, msg []byte) error {
+		c <- "first"
+		return nil
+	})
+	r.Nil(err)
+	_, err = bkr.SubscribeRaw("test.testMessageSubscriptions", func(ctx context.Context, msg []byte) error {
+		c <- "second"
+		return nil
+	}, broker.Broadcast())
+	r.Nil(err)
+	subscriptions := bkr.Subscriptions()
+	r.Len(subscriptions, 2)
+	r.NotEqual(subscriptions[0].ID, subscriptions[1].ID)
+
+	r.Nil(subscription.Unsubscribe())
+	r.NotNil(subscription.Unsubscribe())
+	r.Len(bkr.Subscriptions(), 1)
+
+	r.Nil(bkr.PublishRaw("test.testMessageSubscriptions", []byte("Test")))
+	select {
+	case msg := <-c:
+		r.Equal("second", msg)
+	case <-time.After(timeout):
+		t.Fatal("Timed out waiting for message from broker")
+	}
+	r.Eventually(func() bool {
+		return bkr.Subscriptions()[0].Stats.Handled == 1
+	}, timeout, 10*time.Millisecond)
+
+	r.Nil(bkr.UnsubscribeAll())
+	r.Empty(bkr.Subscriptions())
+	r.Eventually(func() bool {
+		return len(mr.PubSubChannels("")) == 0
+	}, timeout, 10*time.Millisecond, "Channels should be unsubscribed")
+}
+
+func TestRedisPubSubDrain(t *testing.T) {
+
+	r := require.New(t)
+
+	mr := miniredis.RunT(t)
+	bkr := New(Config{})
+	bkr.Init(broker.Options{Name: "RedisPubSub", Address: mr.Addr()})
+	r.Nil(bkr.Connect())
+
+	const count = 5
+	var mu sync.Mutex
+	handled := 0
+	_, err := bkr.SubscribeRaw("test.testMessageDrain", func(ctx context.Context, msg []byte) error {
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		defer mu.Unlock()
+		handled++
+		return nil
+	}, broker.Broadcast(), broker.BufferSize(count))
+	r.Nil(err)
+
+	for i := 0; i < count; i++ {
+		r.Nil(bkr.PublishRaw("test.testMessageDrain", []byte("Test")))
+	}
+	r.Eventually(func() bool {
+		return bkr.Subscriptions()[0].Stats.Received > 0
+	}, timeout, time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	r.Nil(bkr.Drain(ctx))
+	r.Equal(broker.StatusClosed, bkr.Status())
+
+	mu.Lock()
+	defer mu.Unlock()
+	r.Equal(count, handled, "Drain should wait for the received messages")
+}
+
+func TestRedisPubSubOptions(t *testing.T) {
+
+	r := require.New(t)
+
+	mr := miniredis.RunT(t)
+	bkr := newBroker(t, mr, "RedisPubSub")
+
+	err := bkr.PublishRaw("test.testMessageOptions", []byte("Test"), broker.TTL(time.Second))
+	r.True(errors.Is(err, broker.ErrNotSupported), "TTL should be rejected")
+
+	for _, opt := range []broker.SubscribeOption{broker.StartAtSequence(1), broker.StartAtTime(time.Now()), broker.Prefetch(10)} {
+		_, err = bkr.SubscribeRaw("test.testMessageOptions", func(ctx context.Context, msg []byte) error {
+			return nil
+		}, opt)
+		r.True(errors.Is(err, broker.ErrNotSupported))
+	}
+
+	_, err = bkr.Subscribe("test.testMessageOptions", func(msg *proto.TestMessage) error { return nil })
+	r.NotNil(err, "Invalid handlers should be rejected")
+
+	other := New(Config{})
+	other.Init(broker.Options{Name: "RedisPubSub", Address: mr.Addr(), Token: "s3cr3t"})
+	r.True(errors.Is(other.Connect(), broker.ErrNotSupported), "Tokens should be rejected")
+}
@@ -0,0 +1,190 @@
+package redispubsub
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/adityak368/ego/broker"
+	"github.com/adityak368/swissknife/logger/v2"
+	"github.com/pkg/errors"
+	"github.com/redis/go-redis/v9"
+)
+
+type redisSubscriber struct {
+	id          string
+	topic       string
+	queue       string
+	pattern     bool
+	handler     broker.HandlerFunc
+	handlerType string
+	subscribed  time.Time
+	options     broker.SubscribeOptions
+	pubsub      *redis.PubSub
+	workers     *broker.Workers
+	stats       broker.StatsCounter
+	broker      *redisBroker
+	ctx         context.Context
+	cancel      context.CancelFunc
+
+	// quit stops the receive loop, done is closed once it returned
+	quit context.Context
+	stop context.CancelFunc
+	done chan struct{}
+}
+
+// ID returns the unique id of the subscription
+func (s *redisSubscriber) ID() string {
+	return s.id
+}
+
+// Topic returns the subscribed topic
+func (s *redisSubscriber) Topic() string {
+	return s.topic
+}
+
+// info describes the subscription
+func (s *redisSubscriber) info() broker.SubscriptionInfo {
+	return broker.SubscriptionInfo{
+		ID:         s.id,
+		Topic:      s.topic,
+		Handler:    s.handlerType,
+		Subscribed: s.subscribed,
+		Queue:      s.queue,
+		Stats:      s.stats.Stats(),
+	}
+}
+
+// Unsubscribe unsubscribes to the topic and waits for the handlers in flight.
+// Buffered messages which were not handled yet are dropped
+func (s *redisSubscriber) Unsubscribe() error {
+	if !s.broker.unsubscribe(s) {
+		return fmt.Errorf("[REDISPUBSUB]: Cannot unsubscribe from %s", s.topic)
+	}
+	return s.close()
+}
+
+// receive hands the messages to the workers until the subscriber is stopped. The client
+// re-establishes the subscription after a failed receive, which is retried with the
+// backoff of the reconnect policy of the broker
+func (s *redisSubscriber) receive() {
+	defer close(s.done)
+
+	for attempt := 1; ; {
+		msg, err := s.pubsub.ReceiveTimeout(s.quit, pingInterval)
+
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			// an idle connection is checked with a ping, whose pong is received next
+			err = s.pubsub.Ping(s.quit)
+		}
+
+		switch {
+		case s.quit.Err() != nil:
+			return
+		case err != nil:
+			delay := s.broker.options.Reconnect.Delay(attempt)
+			attempt++
+			logger.Warn().Err(err).Msgf("[REDISPUBSUB]: Could not receive topic '%s'. Retrying in %s", s.topic, delay)
+			s.broker.status.Set(broker.StatusReconnecting, s.broker.options.OnStatus)
+
+			select {
+			case <-time.After(delay):
+			case <-s.quit.Done():
+				return
+			}
+			continue
+		}
+
+		switch m := msg.(type) {
+		case *redis.Subscription:
+			// the subscription was re-established
+			attempt = 1
+			s.broker.status.Set(broker.StatusConnected, s.broker.options.OnStatus)
+		case *redis.Message:
+			attempt = 1
+			s.dispatch(m)
+		}
+	}
+}
+
+// dispatch hands the message to the workers. The glob of a pattern subscription can match
+// channels the topic does not match, their messages are skipped
+func (s *redisSubscriber) dispatch(m *redis.Message) {
+	if s.pattern && !broker.MatchTopic(s.topic, m.Channel) {
+		return
+	}
+	s.workers.Go(func() { s.handle(toMessage(m.Channel, m.Payload)) })
+}
+
+// handle delivers the message to the handler and publishes the response of requests
+func (s *redisSubscriber) handle(msg *broker.Message) {
+	s.stats.Receive()
+	if s.queue != "" && !s.claim(msg) {
+		return
+	}
+
+	err := broker.Deliver(s.ctx, s.broker, s.handler, msg, s.options)
+	s.stats.Done(err)
+	if err != nil {
+		logger.Error().Err(err).Msg("")
+	}
+
+	if msg.ReplyTo != "" && msg.Response != nil {
+		if err := s.broker.publish(msg.ReplyTo, msg.Response); err != nil {
+			logger.Error().Err(err).Msg("")
+		}
+	}
+}
+
+// claim emulates queue groups, see EmulateQueue. Every member of the group receives the
+// message and the member which claims its id first handles it. Messages without id, which
+// were not published by a broker, are handled by every member
+func (s *redisSubscriber) claim(msg *broker.Message) bool {
+	if msg.ID == "" {
+		return true
+	}
+
+	key := "ego:queue:" + s.queue + ":" + s.topic + ":" + msg.ID
+	claimed, err := s.broker.client.SetNX(s.ctx, key, s.id, claimExpiry).Result()
+	if err != nil {
+		// handling the message twice is better than losing it
+		logger.Warn().Err(err).Msgf("[REDISPUBSUB]: Could not claim message %s of '%s'. Handling it anyway", msg.ID, s.topic)
+		return true
+	}
+	return claimed
+}
+
+// close unsubscribes, cancels the handlers and waits for the handlers in flight
+func (s *redisSubscriber) close() error {
+	s.stop()
+	err := s.pubsub.Close()
+	s.cancel()
+	// the receive loop may wait for a worker
+	s.workers.Stop()
+	<-s.done
+	return err
+}
+
+// drain unsubscribes and waits until the received messages are handled
+func (s *redisSubscriber) drain(ctx context.Context) error {
+	defer s.cancel()
+
+	s.stop()
+	err := s.pubsub.Close()
+
+	select {
+	case <-s.done:
+	case <-ctx.Done():
+		// the receive loop may wait for a worker
+		s.workers.Stop()
+		<-s.done
+		return ctx.Err()
+	}
+
+	if drainErr := s.workers.Drain(ctx); drainErr != nil {
+		return drainErr
+	}
+	return err
+}
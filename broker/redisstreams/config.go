@@ -0,0 +1,63 @@
+package redisstreams
+
+import (
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	defaultAckWait = 30 * time.Second
+	defaultBlock   = time.Second
+	defaultCount   = 10
+	// replyExpiry is how long the reply stream of a request outlives the response
+	replyExpiry = time.Minute
+)
+
+// Config is the config for the Redis Streams broker
+type Config struct {
+	// DB is the Redis database
+	DB int
+	// Client is a go-redis v9 connection to Redis used instead of connecting to the address of the broker.
+	// It is not closed on Disconnect
+	Client redis.UniversalClient
+	// MaxLen trims the streams to about MaxLen entries on publish. Zero means unlimited
+	MaxLen int64
+	// MaxAge trims the entries older than MaxAge on publish. Zero means unlimited
+	MaxAge time.Duration
+	// AckWait is how long a delivered entry may stay unacked before it is claimed by
+	// another consumer of the group with XAUTOCLAIM. Entries whose handler failed are
+	// redelivered after AckWait as well. Defaults to 30 seconds
+	AckWait time.Duration
+	// ClaimInterval is how often the consumers look for entries to claim. Defaults to AckWait
+	ClaimInterval time.Duration
+	// MaxDeliver is the maximum number of delivery attempts of an entry, after which it is
+	// acked and dropped. Zero means unlimited
+	MaxDeliver int64
+	// Block is how long a read waits for new entries. Defaults to 1 second
+	Block time.Duration
+}
+
+// ackWait returns the configured AckWait or its default
+func (c Config) ackWait() time.Duration {
+	if c.AckWait > 0 {
+		return c.AckWait
+	}
+	return defaultAckWait
+}
+
+// claimInterval returns the configured ClaimInterval or its default
+func (c Config) claimInterval() time.Duration {
+	if c.ClaimInterval > 0 {
+		return c.ClaimInterval
+	}
+	return c.ackWait()
+}
+
+// block returns the configured Block or its default
+func (c Config) block() time.Duration {
+	if c.Block > 0 {
+		return c.Block
+	}
+	return defaultBlock
+}
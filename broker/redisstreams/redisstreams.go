@@ -0,0 +1,511 @@
+// Package redisstreams is the Redis Streams implementation of the broker. Every topic is
+// a stream, queue groups are consumer groups and entries are acked with XACK once their
+// handler succeeded. Entries which stay unacked, because their handler failed or their
+// consumer crashed, are claimed by the group with XAUTOCLAIM and delivered again.
+package redisstreams
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/adityak368/ego/broker"
+	"github.com/adityak368/swissknife/logger/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// bodyField is the field of the stream entries holding the body. The other fields are
+// the headers of the envelope
+const bodyField = "Ego-Body"
+
+// redisBroker is the Redis Streams implementation of the broker
+type redisBroker struct {
+	options         broker.Options
+	config          Config
+	client          redis.UniversalClient
+	subscriptionMap map[string]*redisSubscriber
+	mu              sync.Mutex
+	ctx             context.Context
+	cancel          context.CancelFunc
+	status          broker.StatusNotifier
+}
+
+// Address Returns the broker bind interface
+func (n *redisBroker) Address() string {
+	return n.options.Address
+}
+
+// Init initialises the broker
+func (n *redisBroker) Init(opts broker.Options) error {
+	n.options = opts
+	return nil
+}
+
+// Options returns the broker options
+func (n *redisBroker) Options() broker.Options {
+	return n.options
+}
+
+// String returns the description of the broker
+func (n *redisBroker) String() string {
+	return fmt.Sprintf("[REDISSTREAMS]: Connected to Redis on %s", n.Address())
+}
+
+// Connect connects to Redis
+func (n *redisBroker) Connect() error {
+	switch {
+	case n.options.Token != "":
+		return broker.NotSupported("REDISSTREAMS", "Token")
+	case n.options.CredentialsFile != "":
+		return broker.NotSupported("REDISSTREAMS", "CredentialsFile")
+	case n.options.NKeySeedFile != "":
+		return broker.NotSupported("REDISSTREAMS", "NKeySeedFile")
+	}
+
+	client := n.config.Client
+	if client == nil {
+		client = redis.NewClient(&redis.Options{
+			Addr:      n.Address(),
+			Username:  n.options.Username,
+			Password:  n.options.Password,
+			DB:        n.config.DB,
+			TLSConfig: n.options.TLSConfig,
+		})
+	}
+
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		if n.config.Client == nil {
+			client.Close()
+		}
+		return err
+	}
+
+	n.client = client
+	n.ctx, n.cancel = context.WithCancel(context.Background())
+	n.status.Set(broker.StatusConnected, n.options.OnStatus)
+	logger.Info().Msgf("[REDISSTREAMS]: Connected to %s", n.Address())
+	return nil
+}
+
+// Disconnect stops the consumers, waits for the handlers in flight and disconnects.
+// Buffered entries which were not handled are claimed by the group after AckWait
+func (n *redisBroker) Disconnect() error {
+
+	if n.client == nil {
+		return errors.New("[REDISSTREAMS]: Cannot Disconnect. Not connected to broker")
+	}
+
+	for _, s := range n.takeSubscribers() {
+		s.close()
+		s.cleanup()
+	}
+
+	return n.close()
+}
+
+// Drain stops the consumers from reading, waits until the entries they read are handled
+// and acked, and disconnects. Entries which are not handled when ctx is done are claimed
+// by the group after AckWait
+func (n *redisBroker) Drain(ctx context.Context) error {
+
+	if n.client == nil {
+		return errors.New("[REDISSTREAMS]: Cannot Drain. Not connected to broker")
+	}
+
+	subscribers := n.takeSubscribers()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(subscribers))
+	for _, s := range subscribers {
+		wg.Add(1)
+		go func(s *redisSubscriber) {
+			defer wg.Done()
+			if err := s.drain(ctx); err != nil {
+				errs <- err
+			}
+			s.cleanup()
+		}(s)
+	}
+	wg.Wait()
+	close(errs)
+
+	err := <-errs
+	if closeErr := n.close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// close closes the client unless it was passed in the config
+func (n *redisBroker) close() error {
+	n.cancel()
+	var err error
+	if n.config.Client == nil {
+		err = n.client.Close()
+	}
+	n.status.Set(broker.StatusClosed, n.options.OnStatus)
+	logger.Info().Msgf("[REDISSTREAMS]: Disconnected from %s", n.Address())
+	return err
+}
+
+// Subscriptions returns the active subscriptions along with their stats in the order they were subscribed
+func (n *redisBroker) Subscriptions() []broker.SubscriptionInfo {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	infos := make([]broker.SubscriptionInfo, 0, len(n.subscriptionMap))
+	for _, s := range n.subscriptionMap {
+		infos = append(infos, s.info())
+	}
+	broker.SortSubscriptions(infos)
+	return infos
+}
+
+// UnsubscribeAll unsubscribes every subscription and waits for the handlers in flight
+func (n *redisBroker) UnsubscribeAll() error {
+	for _, s := range n.takeSubscribers() {
+		s.close()
+		s.cleanup()
+	}
+	return nil
+}
+
+// takeSubscribers removes every subscriber from the broker and returns them
+func (n *redisBroker) takeSubscribers() []*redisSubscriber {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	subscribers := make([]*redisSubscriber, 0, len(n.subscriptionMap))
+	for _, s := range n.subscriptionMap {
+		subscribers = append(subscribers, s)
+	}
+	n.subscriptionMap = make(map[string]*redisSubscriber)
+	return subscribers
+}
+
+// unsubscribe removes the subscriber from the broker
+func (n *redisBroker) unsubscribe(s *redisSubscriber) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if _, ok := n.subscriptionMap[s.id]; !ok {
+		return false
+	}
+	delete(n.subscriptionMap, s.id)
+	return true
+}
+
+// Status returns the status of the connection to the broker
+func (n *redisBroker) Status() broker.Status {
+	return n.status.Status()
+}
+
+// NotifyStatus returns a channel which receives the changes of the status
+func (n *redisBroker) NotifyStatus() <-chan broker.Status {
+	return n.status.Notify()
+}
+
+// Handle returns the raw connection handle to the broker
+func (n *redisBroker) Handle() interface{} {
+	return n.client
+}
+
+// Publish publishes a message to the topic
+func (n *redisBroker) Publish(topic string, m proto.Message, opts ...broker.PublishOption) error {
+
+	if n.client == nil {
+		return errors.New("[REDISSTREAMS]: Cannot Publish. Not connected to broker")
+	}
+
+	return n.publishWith(topic, &broker.Message{Data: m}, opts)
+}
+
+// PublishRaw publishes raw data to the topic
+func (n *redisBroker) PublishRaw(topic string, m []byte, opts ...broker.PublishOption) error {
+
+	if n.client == nil {
+		return errors.New("[REDISSTREAMS]: Cannot PublishRaw. Not connected to broker")
+	}
+
+	return n.publishWith(topic, &broker.Message{Body: m}, opts)
+}
+
+// PublishMessage publishes a message envelope to the topic
+func (n *redisBroker) PublishMessage(topic string, m *broker.Message, opts ...broker.PublishOption) error {
+
+	if n.client == nil {
+		return errors.New("[REDISSTREAMS]: Cannot PublishMessage. Not connected to broker")
+	}
+
+	return n.publishWith(topic, m, opts)
+}
+
+// Request publishes the request to the topic and waits for the response on a reply stream
+// of its own, which is deleted afterwards
+func (n *redisBroker) Request(ctx context.Context, topic string, req proto.Message, resp proto.Message) error {
+
+	if n.client == nil {
+		return errors.New("[REDISSTREAMS]: Cannot Request. Not connected to broker")
+	}
+
+	inbox := "_INBOX." + broker.NewID()
+	defer n.client.Del(context.Background(), inbox)
+
+	err := n.publish(topic, &broker.Message{
+		CorrelationID: broker.NewID(),
+		ReplyTo:       inbox,
+		Data:          req,
+	})
+	if err != nil {
+		return err
+	}
+
+	// blocking reads do not return on cancellation, so the context is checked between reads
+	for ctx.Err() == nil {
+		streams, err := n.client.XRead(ctx, &redis.XReadArgs{
+			Streams: []string{inbox, "0"},
+			Count:   1,
+			Block:   n.config.block(),
+		}).Result()
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			return errors.Wrapf(err, "[REDISSTREAMS]: No response to request on '%s'", topic)
+		}
+		return broker.DecodeResponse(toMessage(inbox, streams[0].Messages[0].Values), resp)
+	}
+
+	return errors.Wrapf(ctx.Err(), "[REDISSTREAMS]: No response to request on '%s'", topic)
+}
+
+// publishWith applies the publish options to the envelope and publishes it. The entries
+// are trimmed by the config of the broker instead, see Config.MaxLen and Config.MaxAge
+func (n *redisBroker) publishWith(topic string, m *broker.Message, opts []broker.PublishOption) error {
+
+	o := broker.NewPublishOptions(opts...)
+	switch {
+	case o.TTL > 0:
+		return broker.NotSupported("REDISSTREAMS", "TTL")
+	case o.Priority > 0:
+		return broker.NotSupported("REDISSTREAMS", "Priority")
+	case !o.At.IsZero():
+		return broker.NotSupported("REDISSTREAMS", "PublishAt")
+	}
+	if err := o.CheckNative("REDISSTREAMS"); err != nil {
+		return err
+	}
+
+	msg, err := o.Apply(m)
+	if err != nil {
+		return err
+	}
+	return n.publish(topic, msg)
+}
+
+// publish adds the envelope to the stream of the topic and trims the stream
+func (n *redisBroker) publish(topic string, m *broker.Message) error {
+
+	msg, err := m.Encode(n.options.Codec)
+	if err != nil {
+		return err
+	}
+
+	args := &redis.XAddArgs{
+		Stream: topic,
+		Values: toValues(msg),
+		MaxLen: n.config.MaxLen,
+		Approx: true,
+	}
+
+	if n.config.MaxAge <= 0 {
+		return n.client.XAdd(n.ctx, args).Err()
+	}
+
+	minID := strconv.FormatInt(time.Now().Add(-n.config.MaxAge).UnixMilli(), 10)
+	if args.MaxLen == 0 {
+		args.MinID = minID
+		return n.client.XAdd(n.ctx, args).Err()
+	}
+
+	// XADD trims by a single strategy, so the old entries are trimmed separately
+	_, err = n.client.Pipelined(n.ctx, func(p redis.Pipeliner) error {
+		p.XAdd(n.ctx, args)
+		p.XTrimMinIDApprox(n.ctx, topic, minID, 0)
+		return nil
+	})
+	return err
+}
+
+// reply publishes the response of a responder to the reply stream of the requester. The
+// reply stream expires in case the requester gave up waiting
+func (n *redisBroker) reply(m *broker.Message) error {
+
+	msg, err := m.Response.Encode(n.options.Codec)
+	if err != nil {
+		return err
+	}
+
+	_, err = n.client.Pipelined(n.ctx, func(p redis.Pipeliner) error {
+		p.XAdd(n.ctx, &redis.XAddArgs{Stream: m.ReplyTo, Values: toValues(msg)})
+		p.Expire(n.ctx, m.ReplyTo, replyExpiry)
+		return nil
+	})
+	return err
+}
+
+// Subscribe subscribes a handler to the topic
+func (n *redisBroker) Subscribe(topic string, h interface{}, opts ...broker.SubscribeOption) (broker.Subscriber, error) {
+
+	if n.client == nil {
+		return nil, errors.New("[REDISSTREAMS]: Cannot Subscribe. Not connected to broker")
+	}
+
+	handler, err := broker.NewHandlerFunc(h)
+	if err != nil {
+		return nil, errors.Wrap(err, "[REDISSTREAMS]")
+	}
+
+	return n.subscribe(topic, handler, broker.HandlerType(h), broker.NewSubscribeOptions(opts...))
+}
+
+// SubscribeRaw subscribes a raw handler to the topic
+func (n *redisBroker) SubscribeRaw(topic string, h func(c context.Context, data []byte) error, opts ...broker.SubscribeOption) (broker.Subscriber, error) {
+
+	if n.client == nil {
+		return nil, errors.New("[REDISSTREAMS]: Cannot Subscribe. Not connected to broker")
+	}
+
+	return n.subscribe(topic, broker.NewRawHandlerFunc(h), broker.HandlerType(h), broker.NewSubscribeOptions(opts...))
+}
+
+// subscribe reads the stream of the topic in a consumer group. Subscribers in the same
+// queue group share the consumer group, broadcast subscribers get a consumer group of their
+// own. A new consumer group starts with the new entries, unless StartAtSequence(1) replays the
+// stream or StartAtTime starts it at a time. An existing group continues where it stopped
+func (n *redisBroker) subscribe(topic string, h broker.HandlerFunc, handlerType string, opts broker.SubscribeOptions) (broker.Subscriber, error) {
+
+	if strings.ContainsAny(topic, "*>") {
+		return nil, fmt.Errorf("[REDISSTREAMS]: Cannot subscribe to '%s'. Streams have no wildcards", topic)
+	}
+
+	if err := checkSubscribeOptions(opts); err != nil {
+		return nil, err
+	}
+
+	id := broker.NewID()
+	queue := opts.QueueGroup(n.options.Name)
+	group, start, private := queue, "$", false
+	if queue == "" {
+		group, private = "ego-"+id, true
+	}
+	switch {
+	case opts.StartSequence == 1:
+		start = "0"
+	case !opts.StartTime.IsZero():
+		// the group delivers the entries after its start id, the last possible id of the
+		// previous millisecond includes the entries of the start time
+		start = strconv.FormatInt(opts.StartTime.UnixMilli()-1, 10) + "-18446744073709551615"
+	}
+
+	ctx, cancel := context.WithCancel(n.ctx)
+	quit, stop := context.WithCancel(n.ctx)
+
+	subscriber := &redisSubscriber{
+		id:          id,
+		topic:       topic,
+		queue:       queue,
+		group:       group,
+		start:       start,
+		private:     private,
+		consumer:    n.options.Name + "-" + id,
+		handler:     h,
+		handlerType: opts.ReportedHandlerType(handlerType),
+		subscribed:  time.Now(),
+		options:     opts,
+		workers:     broker.NewWorkers(opts.Concurrency, opts.BufferSize),
+		broker:      n,
+		ctx:         ctx,
+		cancel:      cancel,
+		quit:        quit,
+		stop:        stop,
+		inflight:    make(map[string]struct{}),
+	}
+
+	if err := subscriber.createGroup(); err != nil {
+		subscriber.close()
+		return nil, err
+	}
+
+	n.mu.Lock()
+	n.subscriptionMap[subscriber.id] = subscriber
+	n.mu.Unlock()
+
+	subscriber.loops.Add(1)
+	go subscriber.read()
+	if !opts.AutoAck {
+		// entries read with AutoAck are never pending
+		subscriber.loops.Add(1)
+		go subscriber.claim()
+	}
+
+	if !private {
+		logger.Info().Msgf("[REDISSTREAMS]: Subscribed to topic '%s' in consumer group '%s'", topic, group)
+		return subscriber, nil
+	}
+	logger.Info().Msgf("[REDISSTREAMS]: Subscribed to topic '%s'", topic)
+	return subscriber, nil
+}
+
+// checkSubscribeOptions rejects the options Redis Streams have no equivalent for. The
+// entry ids are timestamps, so a subscription can start at a time or with the first entry
+// but not at another sequence
+func checkSubscribeOptions(opts broker.SubscribeOptions) error {
+	if opts.StartSequence > 1 {
+		return broker.NotSupported("REDISSTREAMS", "StartAtSequence other than 1")
+	}
+	return opts.CheckNative("REDISSTREAMS")
+}
+
+// toValues flattens the envelope into the fields of a stream entry
+func toValues(m *broker.Message) map[string]interface{} {
+	headers := m.Headers()
+	values := make(map[string]interface{}, len(headers)+1)
+	for k, v := range headers {
+		values[k] = v
+	}
+	values[bodyField] = m.Body
+	return values
+}
+
+// toMessage extracts the envelope from the fields of a stream entry
+func toMessage(topic string, values map[string]interface{}) *broker.Message {
+	headers := make(map[string]string, len(values))
+	var body []byte
+	for k, v := range values {
+		s, _ := v.(string)
+		if k == bodyField {
+			body = []byte(s)
+			continue
+		}
+		headers[k] = s
+	}
+	return broker.MessageFromHeaders(topic, headers, body)
+}
+
+// New returns a new Redis Streams broker
+func New(config Config) broker.Broker {
+	return &redisBroker{
+		config:          config,
+		subscriptionMap: make(map[string]*redisSubscriber),
+	}
+}
@@ -0,0 +1,429 @@
+package redisstreams
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/adityak368/ego/broker"
+	proto "github.com/adityak368/ego/broker/proto/gen/broker"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/pkg/errors"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/require"
+)
+
+const timeout = 5 * time.Second
+
+func newBroker(t *testing.T, mr *miniredis.Miniredis, name string, config Config) broker.Broker {
+	bkr := New(config)
+	bkr.Init(broker.Options{
+		Name:    name,
+		Address: mr.Addr(),
+	})
+	require.Nil(t, bkr.Connect())
+	t.Cleanup(func() { bkr.Disconnect() })
+	return bkr
+}
+
+func TestRedisStreams(t *testing.T) {
+
+	r := require.New(t)
+
+	mr := miniredis.RunT(t)
+	bkr := newBroker(t, mr, "RedisStreams", Config{})
+
+	c := make(chan string, 2)
+	_, err := bkr.Subscribe("test.testMessageProto", func(ctx context.Context, msg *proto.TestMessage, m *broker.Message) error {
+		c <- m.Topic + " " + msg.Data
+		return nil
+	})
+	r.Nil(err)
+	_, err = bkr.SubscribeRaw("test.testMessageRaw", func(ctx context.Context, msg []byte) error {
+		c <- string(msg)
+		return nil
+	})
+	r.Nil(err)
+
+	r.Nil(bkr.Publish("test.testMessageProto", &proto.TestMessage{Data: "Test"}))
+	r.Nil(bkr.PublishRaw("test.testMessageRaw", []byte("Raw")))
+
+	received := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case msg := <-c:
+			received[msg] = true
+		case <-time.After(timeout):
+			t.Fatal("Timed out waiting for message from broker")
+		}
+	}
+	r.Equal(map[string]bool{"test.testMessageProto Test": true, "Raw": true}, received)
+
+	// the handled entries are acked
+	client := bkr.Handle().(*redis.Client)
+	r.Eventually(func() bool {
+		pending, err := client.XPending(context.Background(), "test.testMessageRaw", "RedisStreams").Result()
+		return err == nil && pending.Count == 0
+	}, timeout, 10*time.Millisecond)
+
+	_, err = bkr.SubscribeRaw("test.*", func(ctx context.Context, msg []byte) error { return nil })
+	r.NotNil(err, "Wildcards should be rejected")
+}
+
+func TestRedisStreamsClient(t *testing.T) {
+
+	r := require.New(t)
+
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer client.Close()
+
+	// the broker uses the client instead of connecting to its address
+	bkr := New(Config{Client: client})
+	bkr.Init(broker.Options{Name: "RedisStreams"})
+	r.Nil(bkr.Connect())
+	r.Equal(client, bkr.Handle())
+
+	c := make(chan string, 1)
+	_, err := bkr.SubscribeRaw("test.testMessageClient", func(ctx context.Context, msg []byte) error {
+		c <- string(msg)
+		return nil
+	})
+	r.Nil(err)
+	r.Nil(bkr.PublishRaw("test.testMessageClient", []byte("Test")))
+
+	select {
+	case msg := <-c:
+		r.Equal("Test", msg)
+	case <-time.After(timeout):
+		t.Fatal("Timed out waiting for message from broker")
+	}
+
+	r.Nil(bkr.Disconnect())
+	r.Nil(client.Ping(context.Background()).Err(), "The client of the config should stay open")
+}
+
+func TestRedisStreamsQueueGroups(t *testing.T) {
+
+	r := require.New(t)
+
+	mr := miniredis.RunT(t)
+	orders := newBroker(t, mr, "orders", Config{})
+	billing := newBroker(t, mr, "billing", Config{})
+
+	var mu sync.Mutex
+	received := map[string]int{}
+	handler := func(name string) func(ctx context.Context, msg []byte) error {
+		return func(ctx context.Context, msg []byte) error {
+			mu.Lock()
+			defer mu.Unlock()
+			received[name]++
+			return nil
+		}
+	}
+
+	// the consumers of a group compete for the entries, every group receives every entry
+	for i := 0; i < 2; i++ {
+		_, err := orders.SubscribeRaw("test.testMessageGroups", handler("orders"))
+		r.Nil(err)
+	}
+	_, err := billing.SubscribeRaw("test.testMessageGroups", handler("billing"))
+	r.Nil(err)
+	_, err = billing.SubscribeRaw("test.testMessageGroups", handler("broadcast"), broker.Broadcast())
+	r.Nil(err)
+
+	for i := 0; i < 10; i++ {
+		r.Nil(orders.PublishRaw("test.testMessageGroups", []byte("Test")))
+	}
+
+	r.Eventually(func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return received["orders"] == 10 && received["billing"] == 10 && received["broadcast"] == 10
+	}, timeout, 10*time.Millisecond)
+}
+
+func TestRedisStreamsRedelivery(t *testing.T) {
+
+	r := require.New(t)
+
+	mr := miniredis.RunT(t)
+	bkr := newBroker(t, mr, "RedisStreams", Config{
+		AckWait:       50 * time.Millisecond,
+		ClaimInterval: 20 * time.Millisecond,
+		MaxDeliver:    3,
+	})
+
+	var mu sync.Mutex
+	attempts := 0
+	_, err := bkr.SubscribeRaw("test.testMessageRedelivery", func(ctx context.Context, msg []byte) error {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		return errors.New("Something went wrong")
+	})
+	r.Nil(err)
+	r.Nil(bkr.PublishRaw("test.testMessageRedelivery", []byte("Test")))
+
+	r.Eventually(func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return attempts == 3
+	}, timeout, 10*time.Millisecond)
+
+	// the entry is dropped after MaxDeliver attempts
+	client := bkr.Handle().(*redis.Client)
+	r.Eventually(func() bool {
+		pending, err := client.XPending(context.Background(), "test.testMessageRedelivery", "RedisStreams").Result()
+		return err == nil && pending.Count == 0
+	}, timeout, 10*time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	r.Equal(3, attempts, "Entry should not be delivered more than MaxDeliver times")
+}
+
+func TestRedisStreamsClaim(t *testing.T) {
+
+	r := require.New(t)
+
+	mr := miniredis.RunT(t)
+	bkr := newBroker(t, mr, "RedisStreams", Config{
+		AckWait:       50 * time.Millisecond,
+		ClaimInterval: 20 * time.Millisecond,
+	})
+	client := bkr.Handle().(*redis.Client)
+	ctx := context.Background()
+
+	// a consumer of the group reads an entry and crashes before acking it
+	r.Nil(client.XGroupCreateMkStream(ctx, "test.testMessageClaim", "RedisStreams", "$").Err())
+	r.Nil(bkr.PublishRaw("test.testMessageClaim", []byte("Test")))
+	_, err := client.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    "RedisStreams",
+		Consumer: "crashed",
+		Streams:  []string{"test.testMessageClaim", ">"},
+		Block:    -1,
+	}).Result()
+	r.Nil(err)
+
+	c := make(chan bool, 1)
+	_, err = bkr.SubscribeRaw("test.testMessageClaim", func(ctx context.Context, msg []byte) error {
+		c <- true
+		return nil
+	})
+	r.Nil(err)
+
+	select {
+	case <-c:
+	case <-time.After(timeout):
+		t.Fatal("The entry of the crashed consumer should be claimed")
+	}
+}
+
+func TestRedisStreamsSlowHandler(t *testing.T) {
+
+	r := require.New(t)
+
+	mr := miniredis.RunT(t)
+	bkr := newBroker(t, mr, "RedisStreams", Config{
+		AckWait:       20 * time.Millisecond,
+		ClaimInterval: 10 * time.Millisecond,
+	})
+
+	// the entries of a handler running longer than AckWait are not claimed by its own consumer
+	var mu sync.Mutex
+	handled := 0
+	_, err := bkr.SubscribeRaw("test.testMessageSlow", func(ctx context.Context, msg []byte) error {
+		time.Sleep(100 * time.Millisecond)
+		mu.Lock()
+		defer mu.Unlock()
+		handled++
+		return nil
+	}, broker.Concurrency(2), broker.BufferSize(2))
+	r.Nil(err)
+	r.Nil(bkr.PublishRaw("test.testMessageSlow", []byte("Test")))
+
+	r.Eventually(func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return handled == 1
+	}, timeout, 10*time.Millisecond)
+
+	time.Sleep(100 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	r.Equal(1, handled, "Entries in flight should not be delivered again")
+	r.Equal(uint64(1), bkr.Subscriptions()[0].Stats.Received)
+}
+
+func TestRedisStreamsTrim(t *testing.T) {
+
+	r := require.New(t)
+
+	mr := miniredis.RunT(t)
+	bkr := newBroker(t, mr, "RedisStreams", Config{MaxLen: 5})
+	client := bkr.Handle().(*redis.Client)
+
+	for i := 0; i < 10; i++ {
+		r.Nil(bkr.PublishRaw("test.testMessageMaxLen", []byte("Test")))
+	}
+	r.Equal(int64(5), client.XLen(context.Background(), "test.testMessageMaxLen").Val())
+
+	aged := newBroker(t, mr, "RedisStreams", Config{MaxLen: 100, MaxAge: 50 * time.Millisecond})
+	r.Nil(aged.PublishRaw("test.testMessageMaxAge", []byte("Test")))
+	time.Sleep(100 * time.Millisecond)
+	r.Nil(aged.PublishRaw("test.testMessageMaxAge", []byte("Test")))
+	r.Equal(int64(1), client.XLen(context.Background(), "test.testMessageMaxAge").Val(), "Old entries should be trimmed")
+}
+
+func TestRedisStreamsRequest(t *testing.T) {
+
+	r := require.New(t)
+
+	mr := miniredis.RunT(t)
+	bkr := newBroker(t, mr, "RedisStreams", Config{})
+
+	_, err := bkr.Subscribe("test.testMessageRequest", func(ctx context.Context, req *proto.TestMessage) (*proto.TestMessage, error) {
+		return &proto.TestMessage{Data: req.Data + " Response"}, nil
+	})
+	r.Nil(err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	resp := &proto.TestMessage{}
+	r.Nil(bkr.Request(ctx, "test.testMessageRequest", &proto.TestMessage{Data: "Test"}, resp))
+	r.Equal("Test Response", resp.Data)
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	r.NotNil(bkr.Request(ctx, "test.testMessageNoResponder", &proto.TestMessage{Data: "Test"}, resp))
+}
+
+func TestRedisStreamsSubscriptions(t *testing.T) {
+
+	r := require.New(t)
+
+	mr := miniredis.RunT(t)
+	bkr := newBroker(t, mr, "RedisStreams", Config{})
+	client := bkr.Handle().(*redis.Client)
+
+	subscription, err := bkr.SubscribeRaw("test.testMessageSubscriptions", func(ctx context.Context, msg []byte) error {
+		return nil
+	}, broker.Broadcast())
+	r.Nil(err)
+	_, err = bkr.SubscribeRaw("test.testMessageSubscriptions", func(ctx context.Context, msg []byte) error {
+		return nil
+	})
+	r.Nil(err)
+	r.Len(bkr.Subscriptions(), 2)
+
+	groups, err := client.XInfoGroups(context.Background(), "test.testMessageSubscriptions").Result()
+	r.Nil(err)
+	r.Len(groups, 2)
+
+	// the consumer group of a broadcast subscriber goes away with it
+	r.Nil(subscription.Unsubscribe())
+	groups, err = client.XInfoGroups(context.Background(), "test.testMessageSubscriptions").Result()
+	r.Nil(err)
+	r.Len(groups, 1)
+	r.Equal("RedisStreams", groups[0].Name)
+
+	r.Nil(bkr.UnsubscribeAll())
+	r.Empty(bkr.Subscriptions())
+}
+
+func TestRedisStreamsDrain(t *testing.T) {
+
+	r := require.New(t)
+
+	mr := miniredis.RunT(t)
+	bkr := New(Config{})
+	bkr.Init(broker.Options{Name: "RedisStreams", Address: mr.Addr()})
+	r.Nil(bkr.Connect())
+
+	const count = 5
+	var mu sync.Mutex
+	handled := 0
+	_, err := bkr.SubscribeRaw("test.testMessageDrain", func(ctx context.Context, msg []byte) error {
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		defer mu.Unlock()
+		handled++
+		return nil
+	}, broker.BufferSize(count))
+	r.Nil(err)
+
+	for i := 0; i < count; i++ {
+		r.Nil(bkr.PublishRaw("test.testMessageDrain", []byte("Test")))
+	}
+	r.Eventually(func() bool {
+		return bkr.Subscriptions()[0].Stats.Received == count
+	}, timeout, 10*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	r.Nil(bkr.Drain(ctx))
+	r.Equal(broker.StatusClosed, bkr.Status())
+
+	mu.Lock()
+	defer mu.Unlock()
+	r.Equal(count, handled, "Drain should wait for the entries which were read")
+}
+
+func TestRedisStreamsOptions(t *testing.T) {
+
+	r := require.New(t)
+
+	mr := miniredis.RunT(t)
+	bkr := newBroker(t, mr, "RedisStreams", Config{})
+
+	err := bkr.PublishRaw("test.testMessageOptions", []byte("Test"), broker.TTL(time.Second))
+	r.True(errors.Is(err, broker.ErrNotSupported), "TTL should be rejected")
+
+	_, err = bkr.SubscribeRaw("test.testMessageOptions", func(ctx context.Context, msg []byte) error {
+		return nil
+	}, broker.StartAtSequence(2))
+	r.True(errors.Is(err, broker.ErrNotSupported), "Start sequences other than the first entry should be rejected")
+
+	other := New(Config{})
+	other.Init(broker.Options{Name: "RedisStreams", Address: mr.Addr(), Token: "s3cr3t"})
+	r.True(errors.Is(other.Connect(), broker.ErrNotSupported), "Tokens should be rejected")
+
+	// a new queue group starts with the new entries unless it replays the stream or starts
+	// at a time
+	r.Nil(bkr.PublishRaw("test.testMessageStart", []byte("Old")))
+	time.Sleep(5 * time.Millisecond)
+	start := time.Now()
+	r.Nil(bkr.PublishRaw("test.testMessageStart", []byte("Recent")))
+
+	subscribe := func(group string, opts ...broker.SubscribeOption) chan string {
+		c := make(chan string, 3)
+		_, err := bkr.SubscribeRaw("test.testMessageStart", func(ctx context.Context, msg []byte) error {
+			c <- string(msg)
+			return nil
+		}, append(opts, broker.Queue(group))...)
+		r.Nil(err)
+		return c
+	}
+	late := subscribe("late")
+	replay := subscribe("replay", broker.StartAtSequence(1))
+	recent := subscribe("recent", broker.StartAtTime(start))
+	r.Nil(bkr.PublishRaw("test.testMessageStart", []byte("New")))
+
+	for c, expected := range map[chan string][]string{
+		late:   {"New"},
+		replay: {"Old", "Recent", "New"},
+		recent: {"Recent", "New"},
+	} {
+		for _, e := range expected {
+			select {
+			case msg := <-c:
+				r.Equal(e, msg)
+			case <-time.After(timeout):
+				t.Fatal("Timed out waiting for message from broker")
+			}
+		}
+	}
+}
@@ -0,0 +1,329 @@
+package redisstreams
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adityak368/ego/broker"
+	"github.com/adityak368/swissknife/logger/v2"
+	"github.com/pkg/errors"
+	"github.com/redis/go-redis/v9"
+)
+
+type redisSubscriber struct {
+	id          string
+	topic       string
+	queue       string
+	group       string
+	start       string
+	private     bool
+	consumer    string
+	handler     broker.HandlerFunc
+	handlerType string
+	subscribed  time.Time
+	options     broker.SubscribeOptions
+	workers     *broker.Workers
+	stats       broker.StatsCounter
+	broker      *redisBroker
+	ctx         context.Context
+	cancel      context.CancelFunc
+
+	// quit stops the read and claim loops
+	quit  context.Context
+	stop  context.CancelFunc
+	loops sync.WaitGroup
+
+	// inflight holds the ids of the entries which are buffered or being handled, so that
+	// the claim loop does not hand them to the workers again
+	inflight   map[string]struct{}
+	inflightMu sync.Mutex
+}
+
+// ID returns the unique id of the subscription
+func (s *redisSubscriber) ID() string {
+	return s.id
+}
+
+// Topic returns the subscribed topic
+func (s *redisSubscriber) Topic() string {
+	return s.topic
+}
+
+// info describes the subscription
+func (s *redisSubscriber) info() broker.SubscriptionInfo {
+	return broker.SubscriptionInfo{
+		ID:         s.id,
+		Topic:      s.topic,
+		Handler:    s.handlerType,
+		Subscribed: s.subscribed,
+		Queue:      s.queue,
+		Stats:      s.stats.Stats(),
+	}
+}
+
+// Unsubscribe unsubscribes to the topic and waits for the handlers in flight. The
+// consumer group of a broadcast subscriber is destroyed, queue groups are kept so that
+// the entries published in the meantime are delivered on the next subscribe
+func (s *redisSubscriber) Unsubscribe() error {
+	if !s.broker.unsubscribe(s) {
+		return fmt.Errorf("[REDISSTREAMS]: Cannot unsubscribe from %s", s.topic)
+	}
+	s.close()
+	return s.cleanup()
+}
+
+// createGroup creates the consumer group and the stream unless they exist
+func (s *redisSubscriber) createGroup() error {
+	err := s.broker.client.XGroupCreateMkStream(s.broker.ctx, s.topic, s.group, s.start).Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return errors.Wrapf(err, "[REDISSTREAMS]: Could not create consumer group '%s' of '%s'", s.group, s.topic)
+	}
+	return nil
+}
+
+// read hands the new entries of the group to the workers until the subscriber is stopped.
+// Failed reads are retried with the backoff of the reconnect policy of the broker
+func (s *redisSubscriber) read() {
+	defer s.loops.Done()
+
+	count := int64(s.options.Prefetch)
+	if count <= 0 {
+		count = defaultCount
+	}
+
+	for attempt := 1; s.quit.Err() == nil; {
+		streams, err := s.broker.client.XReadGroup(s.quit, &redis.XReadGroupArgs{
+			Group:    s.group,
+			Consumer: s.consumer,
+			Streams:  []string{s.topic, ">"},
+			Count:    count,
+			Block:    s.broker.config.block(),
+			NoAck:    s.options.AutoAck,
+		}).Result()
+
+		switch {
+		case err == nil || errors.Is(err, redis.Nil):
+			attempt = 1
+			s.broker.status.Set(broker.StatusConnected, s.broker.options.OnStatus)
+		case s.quit.Err() != nil:
+			return
+		case strings.HasPrefix(err.Error(), "NOGROUP"):
+			// the stream was deleted, e.g. by a restart of Redis without persistence
+			if err = s.createGroup(); err == nil {
+				continue
+			}
+			fallthrough
+		default:
+			delay := s.broker.options.Reconnect.Delay(attempt)
+			attempt++
+			logger.Warn().Err(err).Msgf("[REDISSTREAMS]: Could not read topic '%s'. Retrying in %s", s.topic, delay)
+			s.broker.status.Set(broker.StatusReconnecting, s.broker.options.OnStatus)
+
+			select {
+			case <-time.After(delay):
+			case <-s.quit.Done():
+				return
+			}
+			continue
+		}
+
+		for _, stream := range streams {
+			for _, msg := range stream.Messages {
+				s.dispatch(msg)
+			}
+		}
+	}
+}
+
+// claim periodically claims the entries of the group which stayed unacked for AckWait
+// until the subscriber is stopped
+func (s *redisSubscriber) claim() {
+	defer s.loops.Done()
+
+	ticker := time.NewTicker(s.broker.config.claimInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.quit.Done():
+			return
+		case <-ticker.C:
+		}
+		s.claimPending()
+	}
+}
+
+// claimPending claims the entries which stayed unacked for AckWait and hands them to the
+// workers. Entries which reached MaxDeliver are acked and dropped instead
+func (s *redisSubscriber) claimPending() {
+	start := "0-0"
+	for {
+		msgs, next, err := s.broker.client.XAutoClaim(s.quit, &redis.XAutoClaimArgs{
+			Stream:   s.topic,
+			Group:    s.group,
+			Consumer: s.consumer,
+			MinIdle:  s.broker.config.ackWait(),
+			Start:    start,
+			Count:    defaultCount,
+		}).Result()
+		if err != nil {
+			if s.quit.Err() == nil {
+				logger.Warn().Err(err).Msgf("[REDISSTREAMS]: Could not claim pending entries of '%s'", s.topic)
+			}
+			return
+		}
+
+		for _, msg := range msgs {
+			// the entries of slow handlers and of a full buffer are idle as well
+			if !s.isInflight(msg.ID) && !s.exhausted(msg.ID) {
+				s.dispatch(msg)
+			}
+		}
+
+		if next == "0-0" || len(msgs) == 0 {
+			return
+		}
+		start = next
+	}
+}
+
+// exhausted acks the entry and returns true once it was delivered MaxDeliver times
+func (s *redisSubscriber) exhausted(id string) bool {
+	maxDeliver := s.broker.config.MaxDeliver
+	if maxDeliver <= 0 {
+		return false
+	}
+
+	pending, err := s.broker.client.XPendingExt(s.quit, &redis.XPendingExtArgs{
+		Stream: s.topic,
+		Group:  s.group,
+		Start:  id,
+		End:    id,
+		Count:  1,
+	}).Result()
+	if err != nil || len(pending) == 0 || pending[0].RetryCount <= maxDeliver {
+		return false
+	}
+
+	logger.Warn().Msgf("[REDISSTREAMS]: Giving up on entry %s of '%s' after %d attempts", id, s.topic, maxDeliver)
+	if err := s.broker.client.XAck(context.Background(), s.topic, s.group, id).Err(); err != nil {
+		logger.Warn().Err(err).Msg("[REDISSTREAMS]: Could not ack entry")
+	}
+	return true
+}
+
+// dispatch hands the entry to the workers unless it is in flight already
+func (s *redisSubscriber) dispatch(msg redis.XMessage) {
+	s.inflightMu.Lock()
+	if _, ok := s.inflight[msg.ID]; ok {
+		s.inflightMu.Unlock()
+		return
+	}
+	s.inflight[msg.ID] = struct{}{}
+	s.inflightMu.Unlock()
+
+	s.stats.Receive()
+	if !s.workers.Go(func() { s.handle(msg) }) {
+		s.done(msg.ID)
+	}
+}
+
+// isInflight returns whether the entry is buffered or being handled
+func (s *redisSubscriber) isInflight(id string) bool {
+	s.inflightMu.Lock()
+	defer s.inflightMu.Unlock()
+	_, ok := s.inflight[id]
+	return ok
+}
+
+// done removes the entry from the entries in flight
+func (s *redisSubscriber) done(id string) {
+	s.inflightMu.Lock()
+	defer s.inflightMu.Unlock()
+	delete(s.inflight, id)
+}
+
+// handle delivers the entry to the handler and acks it once the handler succeeded. Entries
+// whose handler failed stay pending and are claimed again after AckWait
+func (s *redisSubscriber) handle(msg redis.XMessage) {
+	defer s.done(msg.ID)
+
+	m := toMessage(s.topic, msg.Values)
+	err := broker.Deliver(s.ctx, s.broker, s.handler, m, s.options)
+	s.stats.Done(err)
+
+	if m.ReplyTo != "" && m.Response != nil {
+		if err := s.broker.reply(m); err != nil {
+			logger.Error().Err(err).Msg("")
+		}
+	}
+
+	if err != nil {
+		logger.Error().Err(err).Msg("")
+		return
+	}
+	if s.options.AutoAck {
+		return
+	}
+	if err := s.broker.client.XAck(context.Background(), s.topic, s.group, msg.ID).Err(); err != nil {
+		logger.Warn().Err(err).Msg("[REDISSTREAMS]: Could not ack entry")
+	}
+}
+
+// close stops reading, cancels the handlers and waits for the handlers in flight. Buffered
+// entries are left pending and are claimed after AckWait
+func (s *redisSubscriber) close() {
+	s.stop()
+	s.cancel()
+	s.workers.Stop()
+	s.loops.Wait()
+}
+
+// drain stops reading and waits until the entries which were read are handled
+func (s *redisSubscriber) drain(ctx context.Context) error {
+	defer s.cancel()
+	s.stop()
+
+	stopped := make(chan struct{})
+	go func() {
+		s.loops.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		// the loops may wait for a worker
+		s.workers.Stop()
+		<-stopped
+		return ctx.Err()
+	}
+
+	return s.workers.Drain(ctx)
+}
+
+// cleanup destroys the consumer group of a broadcast subscriber. In a queue group the
+// consumer is deleted unless entries are pending for it, which are claimed by the group
+func (s *redisSubscriber) cleanup() error {
+	ctx := context.Background()
+
+	if s.private {
+		return s.broker.client.XGroupDestroy(ctx, s.topic, s.group).Err()
+	}
+
+	pending, err := s.broker.client.XPendingExt(ctx, &redis.XPendingExtArgs{
+		Stream:   s.topic,
+		Group:    s.group,
+		Consumer: s.consumer,
+		Start:    "-",
+		End:      "+",
+		Count:    1,
+	}).Result()
+	if err != nil || len(pending) > 0 {
+		return err
+	}
+	return s.broker.client.XGroupDelConsumer(ctx, s.topic, s.group, s.consumer).Err()
+}
@@ -0,0 +1,110 @@
+package broker
+
+import (
+	"context"
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+// Header keys added to the messages forwarded to a dead-letter topic
+const (
+	HeaderAttempts      = "Ego-Attempts"
+	HeaderOriginalID    = "Ego-Original-Id"
+	HeaderOriginalTopic = "Ego-Original-Topic"
+)
+
+// RetryPolicy configures how often a failed handler is called again before the message
+// is given up on. The delay before each retry doubles, starting from Backoff
+type RetryPolicy struct {
+	// MaxAttempts is the number of handler calls including the first one
+	MaxAttempts int
+	// Backoff is the delay before the first retry
+	Backoff time.Duration
+	// MaxBackoff caps the delay between two attempts. Zero means no cap
+	MaxBackoff time.Duration
+	// Jitter randomizes every delay by up to the fraction, e.g. 0.2 for +/- 20%
+	Jitter float64
+	// DeadLetterTopic receives the message together with the error and the number of
+	// attempts once every attempt failed. If empty the message is left to the broker
+	DeadLetterTopic string
+}
+
+// delay returns the backoff before the attempt following the given one
+func (p RetryPolicy) delay(attempt int) time.Duration {
+	d := p.Backoff
+	for i := 1; i < attempt && d < time.Duration(1<<62); i++ {
+		if p.MaxBackoff > 0 && d >= p.MaxBackoff {
+			break
+		}
+		d *= 2
+	}
+
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+
+	if p.Jitter > 0 {
+		d += time.Duration((rand.Float64()*2 - 1) * p.Jitter * float64(d))
+	}
+
+	return d
+}
+
+// deliverWithRetry calls the handler until it succeeds or the attempts of the policy are
+// exhausted, in which case the message is forwarded to the dead-letter topic. Retrying
+// stops as soon as ctx is done, e.g. when the subscriber is unsubscribed
+func deliverWithRetry(ctx context.Context, b Broker, h HandlerFunc, m *Message, opts SubscribeOptions) error {
+
+	policy := opts.Retry
+	attempt := 1
+
+	for {
+		err := deliver(ctx, h, m, opts)
+		if err == nil {
+			return nil
+		}
+
+		if attempt >= policy.MaxAttempts || ctx.Err() != nil {
+			if policy.DeadLetterTopic == "" || ctx.Err() != nil {
+				return err
+			}
+			return b.PublishMessage(policy.DeadLetterTopic, deadLetter(m, err, attempt))
+		}
+
+		timer := time.NewTimer(policy.delay(attempt))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+
+		attempt++
+	}
+}
+
+// deadLetter returns the message forwarded to the dead-letter topic. It carries the
+// original payload and headers along with the details of the failure
+func deadLetter(m *Message, err error, attempts int) *Message {
+	header := make(map[string]string, len(m.Header)+4)
+	for k, v := range m.Header {
+		header[k] = v
+	}
+	header[HeaderError] = err.Error()
+	header[HeaderAttempts] = strconv.Itoa(attempts)
+	header[HeaderOriginalID] = m.ID
+	header[HeaderOriginalTopic] = m.Topic
+
+	body := m.Body
+	if body == nil {
+		body = []byte{}
+	}
+
+	return &Message{
+		ContentType:   m.ContentType,
+		CorrelationID: m.CorrelationID,
+		Header:        header,
+		Body:          body,
+	}
+}
@@ -0,0 +1,57 @@
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryDelay(t *testing.T) {
+
+	r := require.New(t)
+
+	policy := RetryPolicy{Backoff: 100 * time.Millisecond}
+	r.Equal(100*time.Millisecond, policy.delay(1))
+	r.Equal(200*time.Millisecond, policy.delay(2))
+	r.Equal(800*time.Millisecond, policy.delay(4))
+	r.Greater(policy.delay(100), time.Duration(0), "Delays should not overflow")
+
+	policy.MaxBackoff = 300 * time.Millisecond
+	r.Equal(300*time.Millisecond, policy.delay(3))
+	r.Equal(300*time.Millisecond, policy.delay(100))
+
+	policy.Jitter = 0.2
+	for i := 0; i < 100; i++ {
+		d := policy.delay(1)
+		r.GreaterOrEqual(d, 80*time.Millisecond)
+		r.LessOrEqual(d, 120*time.Millisecond)
+	}
+}
+
+func TestDeadLetter(t *testing.T) {
+
+	r := require.New(t)
+
+	m := &Message{
+		ID:            "id",
+		Topic:         "test.retry",
+		ContentType:   ContentTypeJSON,
+		CorrelationID: "correlation",
+		Header:        map[string]string{"Key": "Value"},
+	}
+	dead := deadLetter(m, errors.New("Something went wrong"), 3)
+
+	r.Equal(ContentTypeJSON, dead.ContentType)
+	r.Equal("correlation", dead.CorrelationID)
+	r.Equal(map[string]string{
+		"Key":               "Value",
+		HeaderError:         "Something went wrong",
+		HeaderAttempts:      "3",
+		HeaderOriginalID:    "id",
+		HeaderOriginalTopic: "test.retry",
+	}, dead.Header)
+	r.Equal([]byte{}, dead.Body, "The body of the dead letter should not be nil")
+	r.Len(m.Header, 1, "The original message should not be changed")
+}
@@ -0,0 +1,29 @@
+package broker
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+)
+
+// ErrNotScheduled is returned when cancelling a message which is not scheduled, e.g. since
+// it was published already
+var ErrNotScheduled = errors.New("message is not scheduled")
+
+// Scheduler is implemented by the brokers which can cancel the messages published with
+// PublishAt or PublishAfter
+type Scheduler interface {
+	// Cancel cancels the scheduled message with the id. It fails with ErrNotScheduled when
+	// no message with the id is scheduled
+	Cancel(ctx context.Context, id string) error
+}
+
+// Cancel cancels the scheduled message with the id. The id is the message id, see
+// WithMessageID. It fails with ErrNotSupported when the broker cannot cancel scheduled messages
+func Cancel(ctx context.Context, b Broker, id string) error {
+	s, ok := b.(Scheduler)
+	if !ok {
+		return errors.Wrap(ErrNotSupported, "The broker cannot cancel scheduled messages")
+	}
+	return s.Cancel(ctx, id)
+}
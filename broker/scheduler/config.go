@@ -0,0 +1,48 @@
+package scheduler
+
+import "time"
+
+const (
+	defaultInterval = time.Second
+	defaultLease    = 30 * time.Second
+	defaultBatch    = 100
+)
+
+// Config is the config of the scheduler
+type Config struct {
+	// Key is the sorted set holding the ids of the scheduled messages by due time. The
+	// messages are stored in the hash "<Key>:messages". Defaults to "ego:schedule:<broker name>"
+	Key string
+	// Interval is how often the schedule is polled for due messages. Defaults to 1 second
+	Interval time.Duration
+	// Lease is how long a due message is claimed by an instance for publishing. Messages
+	// which are still scheduled after the lease, because their publish failed or the
+	// instance crashed, are published again. Defaults to 30 seconds
+	Lease time.Duration
+	// Batch is the maximum number of due messages claimed per poll. Defaults to 100
+	Batch int64
+}
+
+// interval returns the configured Interval or its default
+func (c Config) interval() time.Duration {
+	if c.Interval > 0 {
+		return c.Interval
+	}
+	return defaultInterval
+}
+
+// lease returns the configured Lease or its default
+func (c Config) lease() time.Duration {
+	if c.Lease > 0 {
+		return c.Lease
+	}
+	return defaultLease
+}
+
+// batch returns the configured Batch or its default
+func (c Config) batch() int64 {
+	if c.Batch > 0 {
+		return c.Batch
+	}
+	return defaultBatch
+}
@@ -0,0 +1,297 @@
+// Package scheduler adds scheduled publishing to the brokers which cannot schedule messages
+// natively. The scheduled messages are stored in Redis, their ids in a sorted set by due
+// time, and are published by the instance which claims them first once they are due.
+package scheduler
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/adityak368/ego/broker"
+	"github.com/adityak368/swissknife/logger/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// claimScript moves the due messages out of reach of the other instances until the lease
+// expires and returns their ids and payloads in turn. The claim and the read are atomic, so
+// that a claimed message is published as it was scheduled. Ids without payload are removed
+var claimScript = redis.NewScript(`
+local ids = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[3])
+local claimed = {}
+for _, id in ipairs(ids) do
+	local data = redis.call('HGET', KEYS[2], id)
+	if data then
+		redis.call('ZADD', KEYS[1], ARGV[2], id)
+		table.insert(claimed, id)
+		table.insert(claimed, data)
+	else
+		redis.call('ZREM', KEYS[1], id)
+	end
+end
+return claimed
+`)
+
+// releaseScript removes a claimed message unless it was scheduled again meanwhile
+var releaseScript = redis.NewScript(`
+local score = redis.call('ZSCORE', KEYS[1], ARGV[1])
+if score and tonumber(score) == tonumber(ARGV[2]) then
+	redis.call('ZREM', KEYS[1], ARGV[1])
+	redis.call('HDEL', KEYS[2], ARGV[1])
+	return 1
+end
+return 0
+`)
+
+// entry is a scheduled message along with the options applied on publish
+type entry struct {
+	Topic    string            `json:"topic"`
+	Headers  map[string]string `json:"headers"`
+	Body     []byte            `json:"body"`
+	TTL      time.Duration     `json:"ttl,omitempty"`
+	Priority uint8             `json:"priority,omitempty"`
+}
+
+// scheduler wraps a broker to publish the messages with PublishAt once they are due
+type scheduler struct {
+	broker.Broker
+	client redis.UniversalClient
+	config Config
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// key returns the sorted set of the scheduled ids
+func (s *scheduler) key() string {
+	if s.config.Key != "" {
+		return s.config.Key
+	}
+	return "ego:schedule:" + s.Options().Name
+}
+
+// messagesKey returns the hash of the scheduled messages
+func (s *scheduler) messagesKey() string {
+	return s.key() + ":messages"
+}
+
+// Connect connects the broker and starts polling the schedule
+func (s *scheduler) Connect() error {
+
+	if err := s.Broker.Connect(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.cancel == nil {
+		var ctx context.Context
+		ctx, s.cancel = context.WithCancel(context.Background())
+		s.done = make(chan struct{})
+		go s.run(ctx, s.done)
+	}
+	return nil
+}
+
+// Disconnect stops polling the schedule and disconnects the broker
+func (s *scheduler) Disconnect() error {
+	s.stop()
+	return s.Broker.Disconnect()
+}
+
+// Drain stops polling the schedule and drains the broker. The messages which are due
+// afterwards are published by the other instances
+func (s *scheduler) Drain(ctx context.Context) error {
+	s.stop()
+	return s.Broker.Drain(ctx)
+}
+
+// Publish publishes a message to the topic, or schedules it with PublishAt
+func (s *scheduler) Publish(topic string, m proto.Message, opts ...broker.PublishOption) error {
+	if o := broker.NewPublishOptions(opts...); !o.At.IsZero() {
+		return s.schedule(topic, &broker.Message{Data: m}, o)
+	}
+	return s.Broker.Publish(topic, m, opts...)
+}
+
+// PublishRaw publishes raw data to the topic, or schedules it with PublishAt
+func (s *scheduler) PublishRaw(topic string, m []byte, opts ...broker.PublishOption) error {
+	if o := broker.NewPublishOptions(opts...); !o.At.IsZero() {
+		return s.schedule(topic, &broker.Message{Body: m}, o)
+	}
+	return s.Broker.PublishRaw(topic, m, opts...)
+}
+
+// PublishMessage publishes a message envelope to the topic, or schedules it with PublishAt
+func (s *scheduler) PublishMessage(topic string, m *broker.Message, opts ...broker.PublishOption) error {
+	if o := broker.NewPublishOptions(opts...); !o.At.IsZero() {
+		return s.schedule(topic, m, o)
+	}
+	return s.Broker.PublishMessage(topic, m, opts...)
+}
+
+// Cancel removes the scheduled message with the id from the schedule. A message which is
+// being published already cannot be cancelled anymore
+func (s *scheduler) Cancel(ctx context.Context, id string) error {
+
+	var removed *redis.IntCmd
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		removed = pipe.ZRem(ctx, s.key(), id)
+		pipe.HDel(ctx, s.messagesKey(), id)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if removed.Val() == 0 {
+		return errors.Wrapf(broker.ErrNotScheduled, "[SCHEDULER]: Cannot cancel message %s", id)
+	}
+	return nil
+}
+
+// schedule encodes the message and stores it until it is due. A message scheduled with
+// the id of a scheduled message replaces it
+func (s *scheduler) schedule(topic string, m *broker.Message, o broker.PublishOptions) error {
+
+	// native options are not serializable
+	if len(o.Native) > 0 {
+		return broker.NotSupported("SCHEDULER", "Native options with PublishAt")
+	}
+
+	msg, err := o.Apply(m)
+	if err != nil {
+		return err
+	}
+	msg, err = msg.Encode(s.Options().Codec)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(entry{
+		Topic:    topic,
+		Headers:  msg.Headers(),
+		Body:     msg.Body,
+		TTL:      o.TTL,
+		Priority: o.Priority,
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, s.messagesKey(), msg.ID, data)
+		pipe.ZAdd(ctx, s.key(), redis.Z{Score: float64(o.At.UnixMilli()), Member: msg.ID})
+		return nil
+	})
+	return err
+}
+
+// stop stops polling the schedule and waits for the messages being published
+func (s *scheduler) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.cancel != nil {
+		s.cancel()
+		<-s.done
+		s.cancel = nil
+	}
+}
+
+// run polls the schedule until ctx is done
+func (s *scheduler) run(ctx context.Context, done chan struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(s.config.interval())
+	defer ticker.Stop()
+
+	for {
+		s.poll(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// poll claims the due messages and publishes them. Messages whose publish failed stay
+// scheduled and are claimed again after the lease
+func (s *scheduler) poll(ctx context.Context) {
+
+	now := time.Now()
+	lease := now.Add(s.config.lease()).UnixMilli()
+
+	claimed, err := claimScript.Run(ctx, s.client, []string{s.key(), s.messagesKey()}, now.UnixMilli(), lease, s.config.batch()).StringSlice()
+	if err != nil {
+		if ctx.Err() == nil {
+			logger.Warn().Err(err).Msg("[SCHEDULER]: Could not claim due messages")
+		}
+		return
+	}
+
+	for i := 0; i+1 < len(claimed); i += 2 {
+		if id := claimed[i]; s.publish(id, claimed[i+1]) {
+			s.release(id, lease)
+		}
+	}
+}
+
+// publish publishes the due message and returns whether it is done with, i.e. it was
+// published or cannot be published at all
+func (s *scheduler) publish(id, data string) bool {
+
+	var e entry
+	if err := json.Unmarshal([]byte(data), &e); err != nil {
+		logger.Error().Err(err).Msgf("[SCHEDULER]: Dropping scheduled message %s which cannot be decoded", id)
+		return true
+	}
+
+	var opts []broker.PublishOption
+	if e.TTL > 0 {
+		opts = append(opts, broker.TTL(e.TTL))
+	}
+	if e.Priority > 0 {
+		opts = append(opts, broker.Priority(e.Priority))
+	}
+
+	err := s.Broker.PublishMessage(e.Topic, broker.MessageFromHeaders(e.Topic, e.Headers, e.Body), opts...)
+	if errors.Is(err, broker.ErrNotSupported) {
+		logger.Error().Err(err).Msgf("[SCHEDULER]: Dropping scheduled message %s to '%s'", id, e.Topic)
+		return true
+	}
+	if err != nil {
+		logger.Warn().Err(err).Msgf("[SCHEDULER]: Could not publish scheduled message %s to '%s'. Retrying in %s", id, e.Topic, s.config.lease())
+		return false
+	}
+	return true
+}
+
+// release removes the published message from the schedule. It is not cancelled on stop,
+// so that the other instances do not publish the message again
+func (s *scheduler) release(id string, lease int64) {
+	err := releaseScript.Run(context.Background(), s.client, []string{s.key(), s.messagesKey()}, id, lease).Err()
+	if err != nil {
+		logger.Warn().Err(err).Msgf("[SCHEDULER]: Could not remove published message %s from the schedule", id)
+	}
+}
+
+// New wraps the broker to publish the messages with PublishAt or PublishAfter once they are
+// due, and to cancel them with broker.Cancel. The messages are scheduled in Redis, so that
+// they outlive the instance and are published once by any of the instances sharing the
+// schedule. The other publish options are passed through to the broker
+func New(b broker.Broker, client redis.UniversalClient, config Config) broker.Broker {
+	return &scheduler{
+		Broker: b,
+		client: client,
+		config: config,
+	}
+}
@@ -0,0 +1,112 @@
+package scheduler
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/adityak368/ego/broker"
+	"github.com/adityak368/ego/broker/memory"
+	proto "github.com/adityak368/ego/broker/proto/gen/broker"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/pkg/errors"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/require"
+)
+
+const timeout = 5 * time.Second
+
+func newBroker(t *testing.T, client redis.UniversalClient) broker.Broker {
+	bkr := New(memory.New(), client, Config{Interval: 10 * time.Millisecond})
+	bkr.Init(broker.Options{Name: "Memory"})
+	require.Nil(t, bkr.Connect())
+	t.Cleanup(func() { bkr.Disconnect() })
+	return bkr
+}
+
+func TestScheduler(t *testing.T) {
+
+	r := require.New(t)
+
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+
+	bkr := newBroker(t, client)
+
+	c := make(chan string, 3)
+	_, err := bkr.Subscribe("test.schedule", func(ctx context.Context, msg *proto.TestMessage, m *broker.Message) error {
+		c <- msg.Data + " " + m.Header["key"]
+		return nil
+	})
+	r.Nil(err)
+
+	start := time.Now()
+	r.Nil(bkr.Publish("test.schedule", &proto.TestMessage{Data: "cancelled"}, broker.WithMessageID("reminder"), broker.PublishAfter(100*time.Millisecond)))
+	r.Nil(bkr.Publish("test.schedule", &proto.TestMessage{Data: "delayed"}, broker.WithHeader("key", "value"), broker.PublishAt(start.Add(200*time.Millisecond))))
+	r.Nil(bkr.Publish("test.schedule", &proto.TestMessage{Data: "now"}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	r.Nil(broker.Cancel(ctx, bkr, "reminder"))
+	r.True(errors.Is(broker.Cancel(ctx, bkr, "reminder"), broker.ErrNotScheduled))
+
+	for _, expected := range []string{"now ", "delayed value"} {
+		select {
+		case msg := <-c:
+			r.Equal(expected, msg, "Cancelled messages should not be delivered")
+		case <-time.After(timeout):
+			t.Fatal("Timed out waiting for the scheduled message")
+		}
+	}
+	r.True(time.Since(start) >= 200*time.Millisecond, "Scheduled messages should be delivered when due")
+
+	time.Sleep(100 * time.Millisecond)
+	r.Len(c, 0)
+	r.False(mr.Exists("ego:schedule:Memory"), "Published messages should be removed from the schedule")
+
+	// ids without a message are dropped from the schedule when they are claimed
+	_, err = mr.ZAdd("ego:schedule:Memory", 0, "stale")
+	r.Nil(err)
+	r.Eventually(func() bool {
+		return !mr.Exists("ego:schedule:Memory")
+	}, timeout, 10*time.Millisecond)
+
+	err = bkr.PublishRaw("test.schedule", []byte("Test"), broker.PublishAfter(time.Second), broker.NativePublishOption("mqtt.qos", 1))
+	r.True(errors.Is(err, broker.ErrNotSupported), "Native options should be rejected for scheduled messages")
+}
+
+func TestSchedulerInstances(t *testing.T) {
+
+	r := require.New(t)
+
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+
+	// the instances share the schedule, every message is published by one of them
+	c := make(chan string, 20)
+	instances := []broker.Broker{newBroker(t, client), newBroker(t, client)}
+	for _, bkr := range instances {
+		_, err := bkr.SubscribeRaw("test.schedule", func(ctx context.Context, msg []byte) error {
+			c <- string(msg)
+			return nil
+		})
+		r.Nil(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		r.Nil(instances[i%2].PublishRaw("test.schedule", []byte("Test"), broker.PublishAfter(50*time.Millisecond)))
+	}
+
+	for i := 0; i < 10; i++ {
+		select {
+		case <-c:
+		case <-time.After(timeout):
+			t.Fatal("Timed out waiting for the scheduled messages")
+		}
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	r.Len(c, 0, "Scheduled messages should be published once")
+}
@@ -0,0 +1,128 @@
+package broker
+
+import (
+	"sync"
+	"time"
+)
+
+// Status is the state of the connection of a broker
+type Status int
+
+const (
+	// StatusDisconnected means the broker is not connected
+	StatusDisconnected Status = iota
+	// StatusConnected means the broker is connected
+	StatusConnected
+	// StatusReconnecting means the connection was lost and the broker is reconnecting
+	StatusReconnecting
+	// StatusClosed means the broker was disconnected or gave up reconnecting
+	StatusClosed
+)
+
+// String returns the name of the status
+func (s Status) String() string {
+	switch s {
+	case StatusConnected:
+		return "connected"
+	case StatusReconnecting:
+		return "reconnecting"
+	case StatusClosed:
+		return "closed"
+	default:
+		return "disconnected"
+	}
+}
+
+const (
+	defaultReconnectBackoff    = time.Second
+	defaultReconnectMaxBackoff = 30 * time.Second
+)
+
+// ReconnectPolicy configures how a broker re-establishes a lost connection
+type ReconnectPolicy struct {
+	// MaxAttempts is the number of reconnect attempts before the broker gives up and
+	// closes. Zero means unlimited and a negative value disables reconnecting
+	MaxAttempts int
+	// Backoff is the delay before the first attempt. It doubles with every attempt.
+	// Defaults to 1 second
+	Backoff time.Duration
+	// MaxBackoff caps the delay between attempts. Defaults to 30 seconds
+	MaxBackoff time.Duration
+}
+
+// Enabled returns whether the broker reconnects
+func (p ReconnectPolicy) Enabled() bool {
+	return p.MaxAttempts >= 0
+}
+
+// Exhausted returns whether the attempts of the policy are used up
+func (p ReconnectPolicy) Exhausted(attempt int) bool {
+	return !p.Enabled() || (p.MaxAttempts > 0 && attempt > p.MaxAttempts)
+}
+
+// Delay returns the delay before the reconnect attempt, starting at 1
+func (p ReconnectPolicy) Delay(attempt int) time.Duration {
+	delay, max := p.Backoff, p.MaxBackoff
+	if delay <= 0 {
+		delay = defaultReconnectBackoff
+	}
+	if max <= 0 {
+		max = defaultReconnectMaxBackoff
+	}
+
+	for i := 1; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
+
+// StatusNotifier keeps the status of a broker and notifies the listeners of its changes.
+// The zero value is disconnected
+type StatusNotifier struct {
+	status    Status
+	listeners []chan Status
+	mu        sync.Mutex
+}
+
+// Status returns the current status
+func (n *StatusNotifier) Status() Status {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.status
+}
+
+// Notify returns a channel which receives the status changes. Changes are dropped while
+// the channel is full
+func (n *StatusNotifier) Notify() <-chan Status {
+	ch := make(chan Status, 16)
+
+	n.mu.Lock()
+	n.listeners = append(n.listeners, ch)
+	n.mu.Unlock()
+
+	return ch
+}
+
+// Set changes the status and notifies the listeners and onStatus of the change
+func (n *StatusNotifier) Set(status Status, onStatus func(Status)) {
+	n.mu.Lock()
+	if n.status == status {
+		n.mu.Unlock()
+		return
+	}
+	n.status = status
+	for _, ch := range n.listeners {
+		select {
+		case ch <- status:
+		default:
+		}
+	}
+	n.mu.Unlock()
+
+	if onStatus != nil {
+		onStatus(status)
+	}
+}
@@ -0,0 +1,49 @@
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReconnectPolicy(t *testing.T) {
+
+	r := require.New(t)
+
+	policy := ReconnectPolicy{Backoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+	r.Equal(100*time.Millisecond, policy.Delay(1))
+	r.Equal(400*time.Millisecond, policy.Delay(3))
+	r.Equal(time.Second, policy.Delay(10))
+
+	r.Equal(defaultReconnectBackoff, ReconnectPolicy{}.Delay(1))
+	r.Equal(defaultReconnectMaxBackoff, ReconnectPolicy{}.Delay(100))
+
+	r.True(ReconnectPolicy{MaxAttempts: 3}.Exhausted(4))
+	r.False(ReconnectPolicy{MaxAttempts: 3}.Exhausted(3))
+	r.False(ReconnectPolicy{}.Exhausted(100), "Zero MaxAttempts should reconnect without limit")
+	r.False(ReconnectPolicy{MaxAttempts: -1}.Enabled())
+	r.True(ReconnectPolicy{MaxAttempts: -1}.Exhausted(1), "A negative MaxAttempts should disable reconnecting")
+}
+
+func TestStatusNotifier(t *testing.T) {
+
+	r := require.New(t)
+
+	var n StatusNotifier
+	r.Equal(StatusDisconnected, n.Status())
+
+	var statuses []Status
+	onStatus := func(s Status) { statuses = append(statuses, s) }
+	notify := n.Notify()
+
+	n.Set(StatusConnected, onStatus)
+	n.Set(StatusConnected, onStatus)
+	n.Set(StatusClosed, onStatus)
+
+	r.Equal(StatusClosed, n.Status())
+	r.Equal([]Status{StatusConnected, StatusClosed}, statuses, "Unchanged statuses should not be notified")
+	r.Equal(StatusConnected, <-notify)
+	r.Equal(StatusClosed, <-notify)
+	r.Equal("reconnecting", StatusReconnecting.String())
+}
@@ -0,0 +1,94 @@
+package broker
+
+import (
+	"reflect"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// SubscriptionInfo describes a subscription of a broker, see Broker.Subscriptions
+type SubscriptionInfo struct {
+	// ID is the unique id of the subscription, see Subscriber.ID
+	ID string
+	// Topic is the subscribed topic
+	Topic string
+	// Handler is the type of the subscribed handler
+	Handler string
+	// Queue is the queue group of the subscription, or the queue RabbitMQ consumes.
+	// It is empty for broadcast subscriptions
+	Queue string
+	// Subscribed is the time the subscription was made
+	Subscribed time.Time
+	// Stats are the deliveries of the subscription so far
+	Stats SubscriptionStats
+}
+
+// SortSubscriptions sorts the subscriptions in the order they were made, so that
+// Subscriptions lists them alike on every broker
+func SortSubscriptions(infos []SubscriptionInfo) {
+	sort.SliceStable(infos, func(i, j int) bool {
+		if !infos[i].Subscribed.Equal(infos[j].Subscribed) {
+			return infos[i].Subscribed.Before(infos[j].Subscribed)
+		}
+		return infos[i].ID < infos[j].ID
+	})
+}
+
+// SubscriptionStats counts the deliveries of a subscription. Messages which are received
+// but neither handled nor failed are buffered or being handled
+type SubscriptionStats struct {
+	// Received is the number of messages received from the broker
+	Received uint64
+	// Handled is the number of messages the handler succeeded for
+	Handled uint64
+	// Failed is the number of messages the handler failed for, after the retries
+	Failed uint64
+	// LastReceived is the time the last message was received
+	LastReceived time.Time
+}
+
+// StatsCounter counts the deliveries of a subscription. It is safe for concurrent use
+type StatsCounter struct {
+	received     atomic.Uint64
+	handled      atomic.Uint64
+	failed       atomic.Uint64
+	lastReceived atomic.Int64
+}
+
+// Receive counts a message received from the broker
+func (c *StatsCounter) Receive() {
+	c.received.Add(1)
+	c.lastReceived.Store(time.Now().UnixNano())
+}
+
+// Done counts a delivered message with the error of its handler
+func (c *StatsCounter) Done(err error) {
+	if err != nil {
+		c.failed.Add(1)
+		return
+	}
+	c.handled.Add(1)
+}
+
+// Stats returns the counted deliveries
+func (c *StatsCounter) Stats() SubscriptionStats {
+	stats := SubscriptionStats{
+		Received: c.received.Load(),
+		Handled:  c.handled.Load(),
+		Failed:   c.failed.Load(),
+	}
+	if last := c.lastReceived.Load(); last != 0 {
+		stats.LastReceived = time.Unix(0, last)
+	}
+	return stats
+}
+
+// HandlerType returns the type of a subscribe handler as reported by SubscriptionInfo
+func HandlerType(h interface{}) string {
+	typ := reflect.TypeOf(h)
+	if typ == nil {
+		return ""
+	}
+	return typ.String()
+}
@@ -0,0 +1,43 @@
+package broker
+
+import "strings"
+
+// ValidTopic checks that wildcards are only used as whole tokens and that '>' is the last token
+func ValidTopic(topic string) bool {
+	if topic == "" {
+		return false
+	}
+	tokens := strings.Split(topic, ".")
+	for i, token := range tokens {
+		switch {
+		case token == "":
+			return false
+		case token == ">" && i != len(tokens)-1:
+			return false
+		case token != "*" && token != ">" && strings.ContainsAny(token, "*>"):
+			return false
+		}
+	}
+	return true
+}
+
+// MatchTopic matches a topic against a subscription pattern using NATS wildcard semantics.
+// '*' matches a single token and '>' matches one or more trailing tokens.
+func MatchTopic(pattern, topic string) bool {
+	patternTokens := strings.Split(pattern, ".")
+	topicTokens := strings.Split(topic, ".")
+
+	for i, token := range patternTokens {
+		if token == ">" {
+			return len(topicTokens) > i
+		}
+		if i >= len(topicTokens) {
+			return false
+		}
+		if token != "*" && token != topicTokens[i] {
+			return false
+		}
+	}
+
+	return len(patternTokens) == len(topicTokens)
+}
@@ -0,0 +1,37 @@
+package broker
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidTopic(t *testing.T) {
+
+	r := require.New(t)
+
+	r.True(ValidTopic("a.b.c"))
+	r.True(ValidTopic("a.*.c"))
+	r.True(ValidTopic("a.>"))
+	r.True(ValidTopic(">"))
+	r.False(ValidTopic(""))
+	r.False(ValidTopic("a..c"))
+	r.False(ValidTopic("a.>.c"))
+	r.False(ValidTopic("a.b*.c"))
+}
+
+func TestMatchTopic(t *testing.T) {
+
+	r := require.New(t)
+
+	r.True(MatchTopic("a.b.c", "a.b.c"))
+	r.False(MatchTopic("a.b.c", "a.b"))
+	r.False(MatchTopic("a.b", "a.b.c"))
+	r.True(MatchTopic("a.*.c", "a.b.c"))
+	r.False(MatchTopic("a.*", "a.b.c"))
+	r.True(MatchTopic("a.>", "a.b.c"))
+	r.True(MatchTopic("a.>", "a.b"))
+	r.False(MatchTopic("a.>", "a"))
+	r.True(MatchTopic(">", "a"))
+	r.True(MatchTopic("*.b.>", "a.b.c.d"))
+}
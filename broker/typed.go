@@ -0,0 +1,79 @@
+package broker
+
+import (
+	"context"
+	"reflect"
+
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/proto"
+)
+
+// SubscribeTyped subscribes a handler of the message type T to the topic. Unlike Subscribe
+// the handler is checked by the compiler and is called without reflection. It works with
+// every broker since it is built on SubscribeRaw
+func SubscribeTyped[T proto.Message](b Broker, topic string, h func(ctx context.Context, msg T) error, opts ...SubscribeOption) (Subscriber, error) {
+	return b.SubscribeRaw(topic, func(ctx context.Context, data []byte) error {
+		msg, _, err := decodeTyped[T](ctx, data)
+		if err != nil {
+			return err
+		}
+		return h(ctx, msg)
+	}, append([]SubscribeOption{WithHandlerType(HandlerType(h))}, opts...)...)
+}
+
+// RespondTyped subscribes a responder which answers the requests of type Req on the topic
+// with a response of type Resp
+func RespondTyped[Req, Resp proto.Message](b Broker, topic string, h func(ctx context.Context, req Req) (Resp, error), opts ...SubscribeOption) (Subscriber, error) {
+	return b.SubscribeRaw(topic, func(ctx context.Context, data []byte) error {
+		req, m, err := decodeTyped[Req](ctx, data)
+		if err != nil {
+			return err
+		}
+
+		resp, err := h(ctx, req)
+		if m != nil {
+			var data interface{}
+			if reflect.ValueOf(resp).IsValid() && resp.ProtoReflect().IsValid() {
+				data = resp
+			}
+			m.Response = NewResponse(m, data, err)
+		}
+		return err
+	}, append([]SubscribeOption{WithHandlerType(HandlerType(h))}, opts...)...)
+}
+
+// PublishTyped publishes a message of type T to the topic
+func PublishTyped[T proto.Message](b Broker, topic string, msg T, opts ...PublishOption) error {
+	return b.Publish(topic, msg, opts...)
+}
+
+// decodeTyped decodes the data into a new message of type T with the codec of the content
+// type of the envelope carried by ctx. T has to be a concrete message type, since there is
+// no message to create for an interface type such as proto.Message
+func decodeTyped[T proto.Message](ctx context.Context, data []byte) (T, *Message, error) {
+	var zero T
+	if reflect.TypeOf(zero) == nil {
+		return zero, nil, errors.Errorf("Could not decode message into the interface type %s", reflect.TypeOf((*T)(nil)).Elem())
+	}
+	msg := zero.ProtoReflect().New().Interface().(T)
+
+	m, ok := FromContext(ctx)
+	contentType := ""
+	if ok {
+		contentType = m.ContentType
+	}
+
+	codec, err := CodecFor(contentType)
+	if err != nil {
+		return zero, nil, err
+	}
+
+	if err := codec.Unmarshal(data, msg); err != nil {
+		return zero, nil, errors.Wrap(err, "Could not decode message")
+	}
+
+	if ok {
+		m.Data = msg
+	}
+	return msg, m, nil
+}
@@ -0,0 +1,43 @@
+package broker
+
+import (
+	"context"
+	"testing"
+
+	proto "github.com/adityak368/ego/broker/proto/gen/broker"
+	"github.com/stretchr/testify/require"
+	protobuf "google.golang.org/protobuf/proto"
+)
+
+func TestDecodeTyped(t *testing.T) {
+
+	r := require.New(t)
+
+	// without an envelope the data is decoded as protobuf
+	data, err := ProtobufCodec{}.Marshal(&proto.TestMessage{Data: "Test"})
+	r.Nil(err)
+	msg, m, err := decodeTyped[*proto.TestMessage](context.Background(), data)
+	r.Nil(err)
+	r.Nil(m)
+	r.Equal("Test", msg.Data)
+
+	// the codec of the content type of the envelope decodes the data
+	data, err = ProtoJSONCodec{}.Marshal(&proto.TestMessage{Data: "JSON"})
+	r.Nil(err)
+	envelope := &Message{ContentType: ContentTypeProtoJSON, Body: data}
+	msg, m, err = decodeTyped[*proto.TestMessage](NewContext(context.Background(), envelope), data)
+	r.Nil(err)
+	r.Equal(envelope, m)
+	r.Equal("JSON", msg.Data)
+	r.Equal(msg, m.Data, "The decoded message should be set on the envelope")
+
+	envelope = &Message{ContentType: "application/x-unknown", Body: data}
+	_, _, err = decodeTyped[*proto.TestMessage](NewContext(context.Background(), envelope), data)
+	r.NotNil(err, "Unknown content types should be rejected")
+
+	_, _, err = decodeTyped[*proto.TestMessage](context.Background(), []byte("invalid"))
+	r.NotNil(err, "Invalid data should be rejected")
+
+	_, _, err = decodeTyped[protobuf.Message](context.Background(), data)
+	r.NotNil(err, "Interface types should be rejected")
+}
@@ -0,0 +1,124 @@
+package broker
+
+import (
+	"context"
+	"sync"
+)
+
+// Workers processes the deliveries of a subscription on a fixed number of goroutines.
+// Deliveries wait in a bounded buffer and Go blocks while the buffer is full, which
+// pushes back on the broker. With a single worker deliveries are processed in order
+type Workers struct {
+	queue chan func()
+	quit  chan struct{}
+	once  sync.Once
+	wg    sync.WaitGroup
+
+	// drain is closed by Drain so that the workers exit once the buffer is empty
+	drain     chan struct{}
+	drainOnce sync.Once
+}
+
+// NewWorkers starts the workers of a subscription. concurrency defaults to 1 and
+// buffer is the number of deliveries waiting for a worker
+func NewWorkers(concurrency, buffer int) *Workers {
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	if buffer < 0 {
+		buffer = 0
+	}
+
+	w := &Workers{
+		queue: make(chan func(), buffer),
+		quit:  make(chan struct{}),
+		drain: make(chan struct{}),
+	}
+
+	w.wg.Add(concurrency)
+	for i := 0; i < concurrency; i++ {
+		go w.run()
+	}
+	return w
+}
+
+// Go queues fn for a worker. It blocks while the buffer is full and returns false
+// once the workers are stopped or drained
+func (w *Workers) Go(fn func()) bool {
+	select {
+	case <-w.quit:
+		return false
+	case <-w.drain:
+		return false
+	default:
+	}
+
+	select {
+	case w.queue <- fn:
+		return true
+	case <-w.quit:
+		return false
+	}
+}
+
+// Stop stops the workers and waits for the deliveries in flight. Buffered deliveries
+// which were not picked up by a worker are discarded
+func (w *Workers) Stop() {
+	w.once.Do(func() {
+		close(w.quit)
+	})
+	w.wg.Wait()
+}
+
+// Drain processes the buffered deliveries and stops the workers. It is called once the
+// deliveries are no longer queued with Go. When ctx is done first the workers are stopped
+// and the remaining deliveries are discarded
+func (w *Workers) Drain(ctx context.Context) error {
+	w.drainOnce.Do(func() {
+		close(w.drain)
+	})
+
+	done := make(chan struct{})
+	go func() {
+		w.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		w.once.Do(func() {
+			close(w.quit)
+		})
+		return ctx.Err()
+	}
+}
+
+// run processes the queued deliveries until the workers are stopped, or until the
+// buffer is empty once the workers are drained
+func (w *Workers) run() {
+	defer w.wg.Done()
+
+	for {
+		select {
+		case <-w.quit:
+			return
+		default:
+		}
+
+		select {
+		case fn := <-w.queue:
+			fn()
+		case <-w.quit:
+			return
+		case <-w.drain:
+			select {
+			case fn := <-w.queue:
+				fn()
+			default:
+				return
+			}
+		}
+	}
+}
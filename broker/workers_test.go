@@ -0,0 +1,121 @@
+package broker
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWorkersOrder(t *testing.T) {
+
+	r := require.New(t)
+
+	// a single worker processes the deliveries in order
+	w := NewWorkers(1, 10)
+	var mu sync.Mutex
+	var order []int
+	for i := 0; i < 10; i++ {
+		i := i
+		r.True(w.Go(func() {
+			mu.Lock()
+			defer mu.Unlock()
+			order = append(order, i)
+		}))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	r.Nil(w.Drain(ctx))
+	r.Equal([]int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, order, "Drain should process the buffered deliveries")
+	r.False(w.Go(func() {}), "Drained workers should not accept deliveries")
+}
+
+func TestWorkersConcurrency(t *testing.T) {
+
+	r := require.New(t)
+
+	w := NewWorkers(3, 0)
+	defer w.Stop()
+
+	var running, peak int32
+	release := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		r.True(w.Go(func() {
+			defer wg.Done()
+			n := atomic.AddInt32(&running, 1)
+			for {
+				p := atomic.LoadInt32(&peak)
+				if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+					break
+				}
+			}
+			<-release
+			atomic.AddInt32(&running, -1)
+		}))
+	}
+
+	r.Eventually(func() bool {
+		return atomic.LoadInt32(&peak) == 3
+	}, time.Second, time.Millisecond, "Every worker should process a delivery")
+	close(release)
+	wg.Wait()
+}
+
+func TestWorkersStop(t *testing.T) {
+
+	r := require.New(t)
+
+	w := NewWorkers(1, 1)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var handled int32
+	r.True(w.Go(func() {
+		close(started)
+		<-release
+		atomic.AddInt32(&handled, 1)
+	}))
+	<-started
+	r.True(w.Go(func() { atomic.AddInt32(&handled, 1) }))
+
+	// Go blocks while the buffer is full and gives up once the workers are stopped
+	blocked := make(chan bool)
+	go func() { blocked <- w.Go(func() {}) }()
+
+	stopped := make(chan struct{})
+	go func() {
+		w.Stop()
+		close(stopped)
+	}()
+	r.False(<-blocked)
+
+	select {
+	case <-stopped:
+		t.Fatal("Stop should wait for the deliveries in flight")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+	<-stopped
+
+	r.Equal(int32(1), atomic.LoadInt32(&handled), "Buffered deliveries should be discarded")
+	r.False(w.Go(func() {}))
+}
+
+func TestWorkersDrainTimeout(t *testing.T) {
+
+	r := require.New(t)
+
+	w := NewWorkers(1, 0)
+	release := make(chan struct{})
+	defer close(release)
+	r.True(w.Go(func() { <-release }))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	r.Equal(context.DeadlineExceeded, w.Drain(ctx))
+}
@@ -6,6 +6,7 @@ replace github.com/adityak368/ego/db => ./
 
 require (
 	github.com/adityak368/swissknife/logger/v2 v2.0.1
+	github.com/alicebob/miniredis/v2 v2.33.0
 	github.com/elastic/go-elasticsearch/v7 v7.13.0
 	github.com/go-redis/redis v6.15.9+incompatible
 	github.com/pkg/errors v0.9.1
@@ -14,7 +15,9 @@ require (
 )
 
 require (
+	github.com/alicebob/gopher-json v0.0.0-20200520072559-a9ecdc9d1d3a // indirect
 	github.com/hailocab/go-hostpool v0.0.0-20160125115350-e80d13ce29ed // indirect
+	github.com/yuin/gopher-lua v1.1.1 // indirect
 	gopkg.in/inf.v0 v0.9.1 // indirect
 )
 
@@ -0,0 +1,98 @@
+package redis
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/adityak368/ego/db"
+	"github.com/go-redis/redis"
+)
+
+// dedupPrefix is the prefix of the keys of the dedup store
+const dedupPrefix = "ego:dedup:"
+
+// values of the keys of the dedup store
+const (
+	dedupProcessing = "processing"
+	dedupProcessed  = "processed"
+)
+
+// releaseScript deletes the key while it is claimed, so that a key recorded in the meantime is kept
+var releaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// DedupStore records the processed messages of the idempotent consumers of the broker in
+// Redis. It implements broker.DedupStore, so that the instances of a service share it
+type DedupStore struct {
+	database db.Database
+	ttl      time.Duration
+}
+
+// NewDedupStore returns a DedupStore which keeps the keys in the Redis db for ttl. A ttl of
+// zero keeps the keys forever. The db has to be connected before the first message arrives
+func NewDedupStore(database db.Database, ttl time.Duration) *DedupStore {
+	return &DedupStore{database: database, ttl: ttl}
+}
+
+// client returns the client of the db bound to ctx
+func (s *DedupStore) client(ctx context.Context) (*redis.Client, error) {
+	client, ok := s.database.Handle().(*redis.Client)
+	if !ok || client == nil {
+		return nil, errors.New("[DB]: Not connected to Redis")
+	}
+	return client.WithContext(ctx), nil
+}
+
+// Claim claims the key for the lease with SET NX, so that concurrent deliveries of the same
+// message claim it once. It reports false when the key was recorded or claimed already
+func (s *DedupStore) Claim(ctx context.Context, key string, lease time.Duration) (bool, error) {
+	client, err := s.client(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	return client.SetNX(dedupPrefix+key, dedupProcessing, lease).Result()
+}
+
+// Processed reports whether the key was recorded
+func (s *DedupStore) Processed(ctx context.Context, key string) (bool, error) {
+	client, err := s.client(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	value, err := client.Get(dedupPrefix+key).Result()
+	if err == redis.Nil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return value == dedupProcessed, nil
+}
+
+// Record records the key as processed for the ttl of the store
+func (s *DedupStore) Record(ctx context.Context, key string) error {
+	client, err := s.client(ctx)
+	if err != nil {
+		return err
+	}
+
+	return client.Set(dedupPrefix+key, dedupProcessed, s.ttl).Err()
+}
+
+// Release deletes the claim of the key unless it was recorded
+func (s *DedupStore) Release(ctx context.Context, key string) error {
+	client, err := s.client(ctx)
+	if err != nil {
+		return err
+	}
+
+	return releaseScript.Run(client, []string{dedupPrefix + key}, dedupProcessing).Err()
+}
@@ -0,0 +1,105 @@
+package redis
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/adityak368/ego/db"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func newDedupStore(t *testing.T, ttl time.Duration) (*DedupStore, *miniredis.Miniredis) {
+	mr := miniredis.RunT(t)
+
+	RedisDB := New()
+	RedisDB.Init(db.Options{
+		Name:     "RedisDB",
+		Address:  mr.Addr(),
+		Database: "0",
+	})
+	require.Nil(t, RedisDB.Connect())
+	t.Cleanup(func() { RedisDB.Disconnect() })
+
+	return NewDedupStore(RedisDB, ttl), mr
+}
+
+func TestDedupStore(t *testing.T) {
+
+	r := require.New(t)
+	ctx := context.Background()
+
+	store, mr := newDedupStore(t, time.Hour)
+
+	claimed, err := store.Claim(ctx, "a", time.Minute)
+	r.Nil(err)
+	r.True(claimed)
+	claimed, err = store.Claim(ctx, "a", time.Minute)
+	r.Nil(err)
+	r.False(claimed, "Claimed keys should not be claimed again")
+	processed, err := store.Processed(ctx, "a")
+	r.Nil(err)
+	r.False(processed, "Claimed keys should not be processed")
+
+	// a failed delivery releases the key for the redelivery
+	r.Nil(store.Release(ctx, "a"))
+	claimed, err = store.Claim(ctx, "a", time.Minute)
+	r.Nil(err)
+	r.True(claimed, "Released keys should be claimed again")
+
+	r.Nil(store.Record(ctx, "a"))
+	processed, err = store.Processed(ctx, "a")
+	r.Nil(err)
+	r.True(processed)
+	r.Nil(store.Release(ctx, "a"))
+	processed, err = store.Processed(ctx, "a")
+	r.Nil(err)
+	r.True(processed, "Recorded keys should not be released")
+	claimed, err = store.Claim(ctx, "a", time.Minute)
+	r.Nil(err)
+	r.False(claimed, "Recorded keys should not be claimed")
+
+	// the claims of crashed deliveries expire with their lease and the records with the ttl
+	claimed, err = store.Claim(ctx, "b", time.Minute)
+	r.Nil(err)
+	r.True(claimed)
+	mr.FastForward(time.Minute)
+	claimed, err = store.Claim(ctx, "b", time.Minute)
+	r.Nil(err)
+	r.True(claimed, "Expired claims should be claimed again")
+
+	mr.FastForward(time.Hour)
+	processed, err = store.Processed(ctx, "a")
+	r.Nil(err)
+	r.False(processed, "Expired keys should not be processed")
+}
+
+func TestDedupStoreConcurrentClaims(t *testing.T) {
+
+	r := require.New(t)
+	ctx := context.Background()
+
+	store, _ := newDedupStore(t, time.Hour)
+
+	// concurrent deliveries of the same message claim it once
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	claims := 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			claimed, err := store.Claim(ctx, "a", time.Minute)
+			r.Nil(err)
+			if claimed {
+				mu.Lock()
+				claims++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	r.Equal(1, claims)
+}